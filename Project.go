@@ -1,13 +1,13 @@
 package main
 
 import (
-	"context"
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
+	"os"
 	"strings"
 	"time"
 
@@ -15,10 +15,47 @@ import (
 )
 
 type booking struct {
-	BookingId          int    `json: "bookingid"`
-	BookingTime        string `json: "bookingtime" gorm:"type:timestamp"`
-	BookingClassroomId string `json: "bookingclassroomid"`
-	BookingBookerId    string `json: "bookingbookerid"`
+	BookingId          int
+	BookingTime        string `gorm:"type:timestamp"`
+	BookingClassroomId string
+	BookingBookerId    string
+	BookingDuration    int
+	BookingTitle       string
+	BookingStatus      string
+	BookingUpdatedAt   time.Time
+	BookingPublicId    string
+	// BookingSeats is the number of seats reserved in a shared classroom,
+	// 0 for a booking of the whole classroom.
+	BookingSeats int
+	// BookingGroupId is the booker group the booking was made for, if any.
+	BookingGroupId string
+	// BookingPriority is the booking's priority tier, see priority.go.
+	BookingPriority int
+	// ActedBy names the admin who made a change for the booker; it is
+	// passed along to notifications and not stored.
+	ActedBy string `gorm:"-"`
+	// RequestId is the id of the request that made the change, passed
+	// along like ActedBy, see requestid.go.
+	RequestId string `gorm:"-"`
+	// Tenant is the tenant of that request, whose notification templates
+	// are used, see notifytemplate.go. A create stores it as booking_tenant,
+	// which the store's reads and writes are scoped by, see repository.go,
+	// and only exports and archiving read back.
+	Tenant string `gorm:"-"`
+	// Previous is the booking as it was before a reschedule, passed along
+	// with eventBookingRescheduled for handlers of the slot it left.
+	Previous *booking `gorm:"-"`
+}
+
+const (
+	bookingStatusConfirmed = "confirmed"
+	bookingStatusPending   = "pending"
+)
+
+const bookingColumns = `booking_id, booking_time, booking_classroom_id, booking_student_id, booking_duration, booking_title, booking_status, booking_updated_at, booking_public_id, booking_seats, booking_group_id, booking_priority`
+
+func (b *booking) scanFields() []interface{} {
+	return []interface{}{&b.BookingId, &b.BookingTime, &b.BookingClassroomId, &b.BookingBookerId, &b.BookingDuration, &b.BookingTitle, &b.BookingStatus, sqlTime{&b.BookingUpdatedAt}, sqlString{&b.BookingPublicId}, &b.BookingSeats, sqlString{&b.BookingGroupId}, &b.BookingPriority}
 }
 
 var Db *sql.DB
@@ -27,12 +64,13 @@ const bookerPath = "booker"
 const bookingPath = "bookings"
 const basePath = "/api"
 
-func getBooking(bookingId int) (*booking, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (repo mysqlBookingRepository) GetBooking(bookingId int) (*booking, error) {
+	ctx, cancel := repo.queryContext(queryRead)
 	defer cancel()
-	row := Db.QueryRowContext(ctx, `SELECT booking_id, booking_time, booking_classroom_id, booking_student_id FROM booking WHERE booking_id = ?`, bookingId)
+	query, args := selectBookings(bookingColumns).where(repo.scoped(colBookingId.eq(bookingId))...).build()
+	row := repo.stmts.QueryRowContext(ctx, query, args...)
 	booking := &booking{}
-	err := row.Scan(&booking.BookingId, &booking.BookingTime, &booking.BookingClassroomId, &booking.BookingBookerId)
+	err := row.Scan(booking.scanFields()...)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
@@ -42,62 +80,83 @@ func getBooking(bookingId int) (*booking, error) {
 	return booking, nil
 }
 
-func getBooker(bookerId string) ([]booking, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (repo mysqlBookingRepository) GetBookingByPublicId(publicId string) (*booking, error) {
+	ctx, cancel := repo.queryContext(queryRead)
 	defer cancel()
-	results, err := Db.QueryContext(ctx, `SELECT booking_id, booking_time, booking_classroom_id, booking_student_id FROM booking WHERE booking_student_id = ?`, bookerId)
+	query, args := selectBookings(bookingColumns).where(repo.scoped(colBookingPublicId.eq(publicId))...).build()
+	row := repo.stmts.QueryRowContext(ctx, query, args...)
+	booking := &booking{}
+	err := row.Scan(booking.scanFields()...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return booking, nil
+}
+
+func (repo mysqlBookingRepository) GetBooker(bookerId string) ([]booking, error) {
+	ctx, cancel := repo.queryContext(queryRead)
+	defer cancel()
+	query, args := selectBookings(bookingColumns).where(repo.scoped(colBookingBookerId.eq(bookerId))...).build()
+	results, err := repo.stmts.QueryContext(ctx, query, args...)
 	if err != nil {
 		log.Println(err.Error())
 		return nil, err
 	}
 	defer results.Close()
-	booker := make([]booking, 0)
-	for results.Next() {
-		var bookers booking
-		results.Scan(&bookers.BookingId, &bookers.BookingTime, &bookers.BookingClassroomId, &bookers.BookingBookerId)
-		booker = append(booker, bookers)
+	booker, err := scanBookings(results, bookingFields, 0)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
 	}
 	return booker, nil
 }
 
-func getBookingList() ([]booking, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (repo mysqlBookingRepository) GetBookingList(filter bookingFilter, fields []bookingField) ([]booking, error) {
+	ctx, cancel := repo.queryContext(queryRead)
 	defer cancel()
-	results, err := Db.QueryContext(ctx, `SELECT booking_id, booking_time, booking_classroom_id, booking_student_id FROM booking`)
+	q := selectBookings(bookingFieldColumns(fields)).where(repo.scoped(filter.where()...)...)
+	if filter.Limit > 0 {
+		q.order(filter.order()).limitTo(filter.Limit)
+	}
+	query, args := q.build()
+	results, err := repo.stmts.QueryContext(ctx, query, args...)
 	if err != nil {
 		log.Println(err.Error())
 		return nil, err
 	}
 	defer results.Close()
-	bookings := make([]booking, 0)
-	for results.Next() {
-		var booking booking
-		results.Scan(&booking.BookingId, &booking.BookingTime, &booking.BookingClassroomId, &booking.BookingBookerId)
-		bookings = append(bookings, booking)
+	bookings, err := scanBookings(results, fields, int(bookingListSizeHint.Load()))
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
 	}
+	bookingListSizeHint.Store(int64(len(bookings)))
 	return bookings, nil
 }
 
-func insertBooking(booking booking) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (repo mysqlBookingRepository) InsertBooking(booking booking) (int, error) {
+	ctx, cancel := repo.queryContext(queryWrite)
 	defer cancel()
-	result, err := Db.ExecContext(ctx, `INSERT INTO booking (booking_time, booking_classroom_id, booking_student_id) VALUES (?, ?, ?)`, booking.BookingTime, booking.BookingClassroomId, booking.BookingBookerId)
-	if err != nil {
-		log.Println(err.Error())
-		return 0, err
+	if booking.BookingPublicId == "" {
+		booking.BookingPublicId = newPublicId()
 	}
-	insertId, err := result.LastInsertId()
-	if err != nil {
-		log.Println(err.Error())
-		return 0, err
+	if booking.Tenant == "" {
+		booking.Tenant = repo.tenant
+	}
+	if booking.BookingSeats > 0 {
+		return reserveSeats(ctx, booking)
 	}
-	return int(insertId), nil
+	return insertBookingRow(ctx, repo.stmts, booking)
 }
 
-func removeBooking(bookingId int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (repo mysqlBookingRepository) RemoveBooking(bookingId int) error {
+	ctx, cancel := repo.queryContext(queryWrite)
 	defer cancel()
-	_, err := Db.ExecContext(ctx, `DELETE FROM booking WHERE booking_id = ?`, bookingId)
+	where, args := whereClause(repo.scoped(colBookingId.eq(bookingId)))
+	_, err := repo.stmts.ExecContext(ctx, `DELETE FROM booking`+where, args...)
 	if err != nil {
 		log.Println(err.Error())
 		return err
@@ -111,24 +170,69 @@ func handlerBooking(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	bookingId, err := strconv.Atoi(urlPathSegments[len(urlPathSegments)-1])
+	urlPathSegments = strings.Split(urlPathSegments[len(urlPathSegments)-1], "/")
+	if len(urlPathSegments) == 1 && urlPathSegments[0] == validatePath {
+		handlerBookingValidate(w, r)
+		return
+	}
+	if len(urlPathSegments) == 1 && urlPathSegments[0] == autoPath {
+		handlerBookingAuto(w, r)
+		return
+	}
+	if len(urlPathSegments) == 1 && urlPathSegments[0] == importPath {
+		handlerBookingImport(w, r)
+		return
+	}
+	if len(urlPathSegments) == 1 && urlPathSegments[0] == exportPath {
+		handlerBookingExport(w, r)
+		return
+	}
+	if len(urlPathSegments) == 2 && urlPathSegments[1] == historyPath {
+		handlerBookingHistory(w, r, urlPathSegments[0])
+		return
+	}
+	if len(urlPathSegments) == 2 && urlPathSegments[1] == receiptPath {
+		handlerBookingReceipt(w, r, urlPathSegments[0])
+		return
+	}
+	store := bookingStoreFor(r)
+	booking, err := resolveBooking(store, urlPathSegments[0])
 	if err != nil {
-		log.Print(err)
+		writeServiceError(w, r, err)
+		return
+	}
+	if booking == nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	bookingId := booking.BookingId
+	if len(urlPathSegments) > 1 {
+		switch urlPathSegments[1] {
+		case qrPath:
+			handlerBookingQr(w, r, bookingId)
+		case approvePath:
+			requireApiKey(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handlerBookingApprove(w, r, *booking)
+			}), roleAdmin, roleManager).ServeHTTP(w, r)
+		case cancelPath:
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			handlerBookingCancel(w, r, store, *booking)
+		case reschedulePath:
+			handlerBookingReschedule(w, r, store, *booking)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+		return
+	}
 	switch r.Method {
 	case http.MethodGet:
-		booking, err := getBooking(bookingId)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		if checkLastModified(w, r, booking.BookingUpdatedAt) {
 			return
 		}
-		if booking == nil {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-		j, err := json.Marshal(booking)
+		j, err := json.Marshal(bookingBody(w, r, *booking))
 		if err != nil {
 			log.Print(err)
 			w.WriteHeader(http.StatusBadRequest)
@@ -139,12 +243,7 @@ func handlerBooking(w http.ResponseWriter, r *http.Request) {
 			log.Fatal(err)
 		}
 	case http.MethodDelete:
-		err := removeBooking(bookingId)
-		if err != nil {
-			log.Print(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+		handlerBookingCancel(w, r, store, *booking)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
@@ -154,14 +253,55 @@ func handlerBooker(w http.ResponseWriter, r *http.Request) {
 	urlPathSegments := strings.Split(r.URL.Path, fmt.Sprintf("%s/", bookerPath))
 	urlPathSegments = strings.Split(strings.Join(urlPathSegments, ""), "/")
 	bookerId := urlPathSegments[2]
+	if len(urlPathSegments) > 3 {
+		switch urlPathSegments[3] {
+		case templatePath:
+			handlerBookerTemplates(w, r, bookerId, urlPathSegments[4:])
+		case favoritePath:
+			handlerBookerFavorites(w, r, bookerId, urlPathSegments[4:])
+		case preferencePath:
+			handlerPreferences(w, r, scopeBooker, bookerId)
+		case standingPath:
+			handlerBookerStanding(w, r, bookerId)
+		case agendaPath:
+			handlerBookerAgenda(w, r, bookerId)
+		case exportPath:
+			handlerBookerExport(w, r, bookerId)
+		case dataPath:
+			handlerBookerData(w, r, bookerId)
+		case waitlistPath:
+			handlerBookerWaitlist(w, r, bookerId, urlPathSegments[4:])
+		case seriesPath:
+			handlerBookerSeries(w, r, bookerId, urlPathSegments[4:])
+		case usageForecastPath:
+			handlerBookerUsageForecast(w, r, bookerId)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+		return
+	}
 	switch r.Method {
 	case http.MethodGet:
-		booker, err := getBooker(bookerId)
+		limit, ok := listLimit(w, r)
+		if !ok {
+			return
+		}
+		booker, err := bookingStoreFor(r).GetBooker(bookerId)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeServiceError(w, r, err)
+			return
+		}
+		if booker, ok = limitRows(w, r, bookingFilter{Limit: limit}.limit(booker)); !ok {
+			return
+		}
+		if checkLastModified(w, r, latestUpdate(booker)) {
+			return
+		}
+		body, ok := bookingListBody(w, r, booker)
+		if !ok {
 			return
 		}
-		j, err := json.Marshal(booker)
+		j, err := json.Marshal(body)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -177,12 +317,51 @@ func handlerBooker(w http.ResponseWriter, r *http.Request) {
 func handlerBookings(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		bookingList, err := getBookingList()
+		filter, err := parseBookingFilter(r)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		var fieldNames []string
+		if v := r.URL.Query().Get("fields"); v != "" {
+			fieldNames = strings.Split(v, ",")
+		}
+		fields, err := projectBookingFields(fieldNames)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeServiceError(w, r, err)
+			return
+		}
+		var ok bool
+		if filter.Limit, ok = listLimit(w, r); !ok {
 			return
 		}
-		j, err := json.Marshal(bookingList)
+		bookingList, err := bookingStoreFor(r).GetBookingList(filter, fields)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		if bookingList, ok = limitRows(w, r, bookingList); !ok {
+			return
+		}
+		if checkLastModified(w, r, latestUpdate(bookingList)) {
+			return
+		}
+		var j []byte
+		if len(fieldNames) > 0 {
+			legacy := legacySchema(w, r)
+			redacted := redactionFor(r).bookings(bookingList)
+			projected := make([]map[string]interface{}, len(redacted))
+			for i := range redacted {
+				projected[i] = projectBooking(&redacted[i], fields, legacy)
+			}
+			j, err = json.Marshal(projected)
+		} else {
+			body, ok := bookingListBody(w, r, bookingList)
+			if !ok {
+				return
+			}
+			j, err = json.Marshal(body)
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -191,21 +370,68 @@ func handlerBookings(w http.ResponseWriter, r *http.Request) {
 			log.Fatal(err)
 		}
 	case http.MethodPost:
-		var booking booking
-		err := json.NewDecoder(r.Body).Decode(&booking)
+		var request bookingRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
 		if err != nil {
 			log.Print(err)
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, "invalid_body")
+			return
+		}
+		booking := request.booking()
+		if applyBookingTime(w, r, &booking, request.TimeZone) || writeDuplicate(w, r, booking) {
+			return
+		}
+		displaced, rejected := rejectBooking(w, r, &booking)
+		if rejected {
+			return
+		}
+		booking.BookingPublicId = newPublicId()
+		booking.Tenant = tenantOf(r)
+		var bookingId int
+		if len(displaced) > 0 {
+			bookingId, err = insertPreempting(booking, displaced)
+		} else {
+			bookingId, err = bookingStoreFor(r).InsertBooking(booking)
+		}
+		if isConflict(err) {
+			// An identical create may have won the race for the slot.
+			if !writeDuplicate(w, r, booking) {
+				writeConflict(w, r, booking, nil)
+			}
+			return
+		} else if err != nil {
+			writeServiceError(w, r, err)
 			return
 		}
-		bookingId, err := insertBooking(booking)
+		booking.BookingId = bookingId
+		booking.ActedBy = actedBy(r)
+		booking.RequestId = requestIdOf(r)
+		err = notifyPreempted(r, booking, displaced)
+		recordUsage(r, usageBooking)
+		if created := dispatchBookingEvent(eventBookingCreated, booking); err == nil {
+			err = created
+		}
 		if err != nil {
-			log.Print(err)
-			w.WriteHeader(http.StatusBadRequest)
+			writeServiceError(w, r, err)
 			return
 		}
+		var j []byte
+		if legacySchema(w, r) {
+			j, err = json.Marshal(map[string]int{"bookingid": bookingId})
+		} else {
+			j, err = json.Marshal(struct {
+				BookingId string           `json:"booking_id"`
+				Receipt   string           `json:"receipt,omitempty"`
+				Warnings  []bookingWarning `json:"warnings,omitempty"`
+			}{booking.BookingPublicId, latestReceipt(booking), quotaWarnings(r, booking)})
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
 		w.WriteHeader(http.StatusCreated)
-		w.Write([]byte(fmt.Sprintf(`{"bookingid":%d}`, bookingId)))
+		w.Write(j)
+	case http.MethodDelete:
+		requireApiKey(http.HandlerFunc(handlerBookingsDelete), roleAdmin).ServeHTTP(w, r)
 	case http.MethodOptions:
 		return
 	default:
@@ -213,41 +439,142 @@ func handlerBookings(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// addCorsHeaders sets the CORS headers shared by every API response. The
+// allowed methods come from the route table, see routeMiddleware.
+func addCorsHeaders(w http.ResponseWriter, r *http.Request) {
+	addAllowOrigin(w, r)
+	w.Header().Add("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Authorization, X-API-Key, X-Custom-Header")
+}
+
 func corsMiddleware(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Access-Control-Allow-Origin", "*")
-		w.Header().Add("Content-Type", "application/json")
-		w.Header().Add("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Add("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Authorization, X-Custom-Header")
+		addCorsHeaders(w, r)
 		handler.ServeHTTP(w, r)
 	})
 }
 
 func setupRoutes(apiBasePath string) {
-	bookingHandler := http.HandlerFunc(handlerBooking)
-	http.Handle(fmt.Sprintf("%s/%s/", apiBasePath, bookingPath), corsMiddleware(bookingHandler))
-	bookingsHandler := http.HandlerFunc(handlerBookings)
-	http.Handle(fmt.Sprintf("%s/%s", apiBasePath, bookingPath), corsMiddleware(bookingsHandler))
-	bookerHandler := http.HandlerFunc(handlerBooker)
-	http.Handle(fmt.Sprintf("%s/%s/", apiBasePath, bookerPath), corsMiddleware(bookerHandler))
+	internal := internalMux()
+	for _, m := range routeTable(apiBasePath) {
+		if m.Internal {
+			m.register(internal, true)
+		} else {
+			m.register(http.DefaultServeMux, true)
+		}
+	}
+	for _, m := range operationalRoutes() {
+		if !m.Internal {
+			m.register(http.DefaultServeMux, false)
+		}
+		if m.Internal || internal != http.DefaultServeMux {
+			m.register(internal, false)
+		}
+	}
 }
 
 func setupDb() {
 	var err error
-	Db, err = sql.Open("mysql", "root:141453@tcp(127.0.0.1:3306)/classroom")
+	// Sessions run in UTC so CURRENT_TIMESTAMP defaults match UTC_TIMESTAMP().
+	Db, err = sql.Open(instrumentedDriverName, "root:141453@tcp(127.0.0.1:3306)/classroom?time_zone=%27%2B00%3A00%27")
 	if err != nil {
 		log.Fatal(err)
 	} else {
 		fmt.Println("Connect successfully!!!")
 	}
 	//fmt.Println(Db)
-	Db.SetConnMaxLifetime(time.Minute * 3)
-	Db.SetMaxOpenConns(10)
-	Db.SetMaxIdleConns(10)
+	configurePool(Db)
 }
 
 func main() {
-	setupDb()
+	serveArgs := os.Args[1:]
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		switch os.Args[1] {
+		case "serve":
+			serveArgs = os.Args[2:]
+		case "restore":
+			runRestore(os.Args[2:])
+			return
+		case "slo-rules":
+			runSloRules(os.Args[2:])
+			return
+		case "loadtest":
+			runLoadTest(os.Args[2:])
+			return
+		case "doctor":
+			runDoctor(os.Args[2:])
+			return
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command %q, expected serve, restore, slo-rules, loadtest or doctor\n", os.Args[1])
+			os.Exit(2)
+		}
+	}
+	if err := loadConfigFile(); err != nil {
+		log.Fatal(err)
+	}
+	var err error
+	if receiptKey, err = loadReceiptKey(); err != nil {
+		log.Fatal(err)
+	}
+	serveFlags := flag.NewFlagSet("serve", flag.ExitOnError)
+	storage := serveFlags.String("storage", envString("STORAGE", storageMysql), "where data is kept: mysql, or memory for demos and CI")
+	serveFlags.BoolVar(&readOnly, "read-only", envString("READ_ONLY", "") == "true", "serve reads only, as a replica in front of a database replica")
+	serveFlags.StringVar(&primaryUrl, "primary-url", envString("PRIMARY_URL", ""), "base URL of the primary, for clients a read-only replica refuses")
+	serveFlags.Parse(serveArgs)
+	store := envString("BOOKING_STORE", "mysql")
+	switch *storage {
+	case storageMysql:
+		setupDb()
+		startPoolMetrics()
+		migrate := migrateDb
+		if readOnly {
+			migrate = checkMigrated
+		}
+		if err := migrate(); err != nil {
+			log.Fatal(err)
+		}
+		if err := checkSchema(); err != nil {
+			log.Fatal(err)
+		}
+	case storageMemory:
+		setupMemoryDb()
+		store = storageMemory
+	default:
+		log.Fatalf("unknown storage %q, expected mysql or memory", *storage)
+	}
+	if err := setupBookingStore(store); err != nil {
+		log.Fatal(err)
+	}
 	setupRoutes(basePath)
-	log.Fatal(http.ListenAndServe(":5000", nil))
+	startFlagRefresh()
+	watchReloadSignal()
+	startCheckinBuffer()
+	startExportCleanupJob()
+	if !readOnly {
+		startScheduleJob()
+		if err := backfillPublicIds(); err != nil {
+			log.Fatal(err)
+		}
+		startNotificationJobs()
+		startJob("no-shows", 15*time.Minute, detectNoShows)
+		setupCalendarSync()
+		setupAccessSync()
+		startRetentionJob()
+		startUsageJob()
+		startCleanupJob(store)
+		startJournalJob()
+	}
+	listeners, err := listen(envString("SERVER_ADDR", ":5000"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if addr := envString("ADMIN_ADDR", defaultAdminAddr); addr != "" {
+		adminListeners, err := listen(addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Fatal(serve(newServer(readOnlyMiddleware(maintenanceMiddleware(adminMux))), adminListeners))
+		}()
+	}
+	log.Fatal(serve(newServer(readOnlyMiddleware(impersonationMiddleware(usageMiddleware(maintenanceMiddleware(http.DefaultServeMux))))), listeners))
 }
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Optional door access. With ACCESS_PROVIDER set, the confirmed bookings of
+// classrooms with a door, set through /api/classrooms/{id}/door, grant the
+// booker's campus card access to that door for the booked window, widened
+// by ACCESS_MARGIN (default 10m) on both sides, and the grant is revoked
+// when the booking is cancelled, preempted or moved. Providers come from
+// accessProviders: "http" calls a campus access API at ACCESS_API_URL with
+// ACCESS_API_TOKEN, "mock" keeps grants in memory and logs them, to try the
+// integration without one. Calls are retried ACCESS_RETRIES (default 3)
+// times with backoff; what still fails, or changed behind the service's
+// back such as a classroom's door, is caught up by the reconcile job every
+// ACCESS_RECONCILE_INTERVAL (default 5m).
+
+const doorPath = "door"
+
+// accessGrant is access for one cardholder, the booker, to one door.
+type accessGrant struct {
+	DoorId       string    `json:"door_id"`
+	CardholderId string    `json:"cardholder_id"`
+	ValidFrom    time.Time `json:"valid_from"`
+	ValidUntil   time.Time `json:"valid_until"`
+	// Reference is the booking's public id, for the provider's logs.
+	Reference string `json:"reference"`
+}
+
+type accessProvider interface {
+	// Grant gives g and returns the provider's id for it.
+	Grant(g accessGrant) (string, error)
+	// Revoke withdraws a grant; one already gone is no error.
+	Revoke(grantId string) error
+}
+
+var accessProviders = map[string]func() (accessProvider, error){
+	"http": newHttpAccessProvider,
+	"mock": func() (accessProvider, error) {
+		return &mockAccessProvider{grants: make(map[string]accessGrant)}, nil
+	},
+}
+
+var accessCallsTotal = newCounter("access_calls_total", "Calls to the door access provider, by operation and outcome.", "op", "outcome")
+
+// accessMapping is the grant a booking holds, as the provider was told.
+type accessMapping struct {
+	BookingId  int
+	GrantId    string
+	DoorId     string
+	ValidFrom  time.Time
+	ValidUntil time.Time
+}
+
+type accessSync struct {
+	provider accessProvider
+	margin   time.Duration
+	locks    *bookingLocks
+}
+
+// bookingLocks serializes the grant changes of each booking. Its events are
+// handled concurrently and in no set order, so without it a create and a
+// reschedule could both find no grant and both give one, or a cancel find
+// none while the create's grant is still being given.
+type bookingLocks struct {
+	mu    sync.Mutex
+	locks map[int]*bookingLock
+}
+
+type bookingLock struct {
+	sync.Mutex
+	users int
+}
+
+// lock locks the booking numbered bookingId and returns the unlock.
+func (l *bookingLocks) lock(bookingId int) func() {
+	l.mu.Lock()
+	bl, ok := l.locks[bookingId]
+	if !ok {
+		bl = &bookingLock{}
+		l.locks[bookingId] = bl
+	}
+	bl.users++
+	l.mu.Unlock()
+	bl.Lock()
+	return func() {
+		bl.Unlock()
+		l.mu.Lock()
+		if bl.users--; bl.users == 0 {
+			delete(l.locks, bookingId)
+		}
+		l.mu.Unlock()
+	}
+}
+
+func setupAccessSync() {
+	name := envString("ACCESS_PROVIDER", "")
+	if name == "" {
+		return
+	}
+	newProvider, ok := accessProviders[name]
+	if !ok {
+		log.Fatalf("unknown ACCESS_PROVIDER %q", name)
+	}
+	provider, err := newProvider()
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := accessSync{provider, envDuration("ACCESS_MARGIN", 10*time.Minute), &bookingLocks{locks: make(map[int]*bookingLock)}}
+	bookingEventHandlers = append(bookingEventHandlers, s.handleBookingEvent)
+	startJob("access-reconcile", envDuration("ACCESS_RECONCILE_INTERVAL", 5*time.Minute), s.reconcile)
+}
+
+// withAccessRetry runs fn, retrying failures up to ACCESS_RETRIES times
+// with full jitter backoff.
+func withAccessRetry(op string, fn func() error) error {
+	attempts := envInt("ACCESS_RETRIES", 3) + 1
+	backoff := 500 * time.Millisecond
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if err = fn(); err == nil {
+			accessCallsTotal.Inc(op, "ok")
+			return nil
+		}
+		if attempt < attempts-1 {
+			accessCallsTotal.Inc(op, "retried")
+			time.Sleep(time.Duration(rand.Int63n(int64(backoff))))
+			backoff *= 2
+		}
+	}
+	accessCallsTotal.Inc(op, "failed")
+	return err
+}
+
+// wanted is the grant b should hold through door, or nil for none.
+func (s accessSync) wanted(b booking, door string) *accessGrant {
+	if door == "" || b.BookingStatus != bookingStatusConfirmed || b.BookingBookerId == "" {
+		return nil
+	}
+	start, end, err := bookingWindow(b)
+	if err != nil || !end.Add(s.margin).After(time.Now()) {
+		return nil
+	}
+	return &accessGrant{
+		DoorId:       door,
+		CardholderId: b.BookingBookerId,
+		ValidFrom:    start.Add(-s.margin).UTC().Truncate(time.Second),
+		ValidUntil:   end.Add(s.margin).UTC().Truncate(time.Second),
+		Reference:    b.publicId(),
+	}
+}
+
+// apply brings the grant of the booking numbered bookingId from current to
+// want, revoking a grant that no longer fits before giving the new one.
+func (s accessSync) apply(bookingId int, want *accessGrant, current *accessMapping) {
+	if current != nil {
+		if want != nil && current.DoorId == want.DoorId && current.ValidFrom.Equal(want.ValidFrom) && current.ValidUntil.Equal(want.ValidUntil) {
+			return
+		}
+		if err := withAccessRetry("revoke", func() error { return s.provider.Revoke(current.GrantId) }); err != nil {
+			log.Printf("access: revoke %s of booking %d: %v", current.GrantId, bookingId, err)
+			return
+		}
+		removeAccessMapping(bookingId)
+	}
+	if want == nil {
+		return
+	}
+	var grantId string
+	err := withAccessRetry("grant", func() (err error) {
+		grantId, err = s.provider.Grant(*want)
+		return err
+	})
+	if err != nil {
+		log.Printf("access: grant door %s to booking %d: %v", want.DoorId, bookingId, err)
+		return
+	}
+	saveAccessMapping(accessMapping{bookingId, grantId, want.DoorId, want.ValidFrom, want.ValidUntil})
+}
+
+// handleBookingEvent brings the grant of b in line with the booking as it
+// is now, read again under its lock: events may be handled out of order, so
+// the grant follows the booking, not the event.
+func (s accessSync) handleBookingEvent(event string, b booking) {
+	switch event {
+	case eventBookingCreated, eventBookingApproved, eventBookingRescheduled, eventBookingCancelled, eventBookingPreempted:
+	default:
+		return
+	}
+	defer s.locks.lock(b.BookingId)()
+	current, err := getAccessMapping(b.BookingId)
+	if err != nil {
+		return
+	}
+	latest, err := bookingStoreForTenant(bookingStore, b.Tenant).GetBooking(b.BookingId)
+	if err != nil {
+		return
+	}
+	if latest == nil || latest.BookingStatus != bookingStatusConfirmed {
+		if current != nil {
+			s.apply(b.BookingId, nil, current)
+		}
+		return
+	}
+	door, err := getClassroomDoor(latest.BookingClassroomId)
+	if err != nil {
+		return
+	}
+	s.apply(b.BookingId, s.wanted(*latest, door), current)
+}
+
+// reconcile grants the access that upcoming confirmed bookings lack and
+// revokes the grants no booking accounts for any more. Grants past their
+// window are forgotten, the provider having expired them.
+func (s accessSync) reconcile() {
+	doors, err := getClassroomDoors()
+	if err != nil {
+		return
+	}
+	mappings, err := getAccessMappings()
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	now := time.Now()
+	results, err := Db.QueryContext(ctx, `SELECT `+bookingColumns+` FROM booking WHERE booking_status = ? AND LEFT(TRIM(booking_time), 10) >= ?`,
+		bookingStatusConfirmed, now.In(bookingLocation).AddDate(0, 0, -1).Format(bookingDateLayout))
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	bookings := make([]booking, 0)
+	for results.Next() {
+		var b booking
+		if err := results.Scan(b.scanFields()...); err != nil {
+			results.Close()
+			log.Println(err.Error())
+			return
+		}
+		bookings = append(bookings, b)
+	}
+	results.Close()
+	if err := results.Err(); err != nil {
+		log.Println(err.Error())
+		return
+	}
+	for _, b := range bookings {
+		_, mapped := mappings[b.BookingId]
+		delete(mappings, b.BookingId)
+		if want := s.wanted(b, doors[b.BookingClassroomId]); want != nil || mapped {
+			s.reconcileBooking(b.BookingId, want)
+		}
+	}
+	for bookingId, m := range mappings {
+		if m.ValidUntil.Before(now) {
+			unlock := s.locks.lock(bookingId)
+			removeAccessMapping(bookingId)
+			unlock()
+			continue
+		}
+		s.reconcileBooking(bookingId, nil)
+	}
+}
+
+// reconcileBooking applies want to the booking numbered bookingId under its
+// lock, with the grant it holds by then: an event may have changed it since
+// the reconcile read them all.
+func (s accessSync) reconcileBooking(bookingId int, want *accessGrant) {
+	defer s.locks.lock(bookingId)()
+	current, err := getAccessMapping(bookingId)
+	if err != nil {
+		return
+	}
+	if want != nil || current != nil {
+		s.apply(bookingId, want, current)
+	}
+}
+
+func getClassroomDoor(classroomId string) (string, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	var doorId string
+	err := Db.QueryRowContext(ctx, `SELECT classroom_door_id FROM classroom WHERE classroom_id = ?`, classroomId).Scan(&doorId)
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	return doorId, nil
+}
+
+func getClassroomDoors() (map[string]string, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT classroom_id, classroom_door_id FROM classroom WHERE classroom_door_id <> ''`)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	doors := make(map[string]string)
+	for results.Next() {
+		var classroomId, doorId string
+		if err := results.Scan(&classroomId, &doorId); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		doors[classroomId] = doorId
+	}
+	return doors, results.Err()
+}
+
+func updateClassroomDoor(classroomId string, doorId string) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `UPDATE classroom SET classroom_door_id = ? WHERE classroom_id = ?`, doorId, classroomId)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+const accessMappingColumns = `access_booking_id, access_grant_id, access_door_id, access_valid_from, access_valid_until`
+
+func getAccessMapping(bookingId int) (*accessMapping, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	var m accessMapping
+	err := Db.QueryRowContext(ctx, `SELECT `+accessMappingColumns+` FROM booking_access_grant WHERE access_booking_id = ?`, bookingId).
+		Scan(&m.BookingId, &m.GrantId, &m.DoorId, sqlTime{&m.ValidFrom}, sqlTime{&m.ValidUntil})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	return &m, nil
+}
+
+func getAccessMappings() (map[int]accessMapping, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT `+accessMappingColumns+` FROM booking_access_grant`)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	mappings := make(map[int]accessMapping)
+	for results.Next() {
+		var m accessMapping
+		if err := results.Scan(&m.BookingId, &m.GrantId, &m.DoorId, sqlTime{&m.ValidFrom}, sqlTime{&m.ValidUntil}); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		mappings[m.BookingId] = m
+	}
+	return mappings, results.Err()
+}
+
+func saveAccessMapping(m accessMapping) {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `REPLACE INTO booking_access_grant (`+accessMappingColumns+`) VALUES (?, ?, ?, ?, ?)`, m.BookingId, m.GrantId, m.DoorId, m.ValidFrom, m.ValidUntil)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func removeAccessMapping(bookingId int) {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `DELETE FROM booking_access_grant WHERE access_booking_id = ?`, bookingId)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// httpAccessProvider speaks a plain REST API: POST /grants with an
+// accessGrant answering {"id": ...}, and DELETE /grants/{id}.
+type httpAccessProvider struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+func newHttpAccessProvider() (accessProvider, error) {
+	base := envString("ACCESS_API_URL", "")
+	if base == "" {
+		return nil, fmt.Errorf("ACCESS_PROVIDER http needs ACCESS_API_URL")
+	}
+	return httpAccessProvider{strings.TrimSuffix(base, "/"), envString("ACCESS_API_TOKEN", ""), &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func (p httpAccessProvider) do(method string, path string, in interface{}, out interface{}) (int, error) {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequest(method, p.base+path, &body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("access api %s %s: %s", method, path, resp.Status)
+	}
+	if out != nil {
+		return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode, nil
+}
+
+func (p httpAccessProvider) Grant(g accessGrant) (string, error) {
+	var created struct {
+		Id string `json:"id"`
+	}
+	if _, err := p.do(http.MethodPost, "/grants", g, &created); err != nil {
+		return "", err
+	}
+	if created.Id == "" {
+		return "", fmt.Errorf("access api answered a grant without an id")
+	}
+	return created.Id, nil
+}
+
+func (p httpAccessProvider) Revoke(grantId string) error {
+	status, err := p.do(http.MethodDelete, "/grants/"+url.PathEscape(grantId), nil, nil)
+	if status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+type mockAccessProvider struct {
+	mu     sync.Mutex
+	next   int
+	grants map[string]accessGrant
+}
+
+func (p *mockAccessProvider) Grant(g accessGrant) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.next++
+	grantId := fmt.Sprintf("mock-%d", p.next)
+	p.grants[grantId] = g
+	log.Printf("access mock: %s grants %s door %s from %s until %s", grantId, g.CardholderId, g.DoorId, g.ValidFrom.Format(time.RFC3339), g.ValidUntil.Format(time.RFC3339))
+	return grantId, nil
+}
+
+func (p *mockAccessProvider) Revoke(grantId string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.grants, grantId)
+	log.Printf("access mock: %s revoked", grantId)
+	return nil
+}
+
+func handlerClassroomDoor(w http.ResponseWriter, r *http.Request, classroomId string) {
+	// Whoever sets the door decides where bookers' cards open, so only
+	// admins and the classroom's managers see or change it.
+	if r.Method != http.MethodOptions && !authorizeManager(w, r, classroomId, classroomOwner, classroomManager) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		doorId, err := getClassroomDoor(classroomId)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		j, err := json.Marshal(map[string]string{"door_id": doorId})
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+	case http.MethodPut:
+		var update struct {
+			DoorId string `json:"door_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := updateClassroomDoor(classroomId, update.DoorId); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		recordAudit(r, "classroom.door", "classroom", classroomId, update)
+	case http.MethodOptions:
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
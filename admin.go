@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const adminPath = "admin"
+
+func handlerAdmin(w http.ResponseWriter, r *http.Request) {
+	urlPathSegments := strings.Split(r.URL.Path, fmt.Sprintf("%s/", adminPath))
+	urlPathSegments = strings.Split(urlPathSegments[len(urlPathSegments)-1], "/")
+	switch urlPathSegments[0] {
+	case "backup":
+		handlerAdminBackup(w, r)
+	case "maintenance":
+		handlerAdminMaintenance(w, r)
+	case flagPath:
+		handlerAdminFlags(w, r)
+	case "reload":
+		handlerAdminReload(w, r)
+	case "usage":
+		handlerAdminUsage(w, r)
+	case perfPath:
+		handlerAdminPerf(w, r)
+	case sloRulesPath:
+		handlerSloRules(w, r)
+	case schemaPath:
+		handlerAdminSchema(w, r)
+	case cachePath:
+		handlerAdminCache(w, r, urlPathSegments[1:])
+	case auditPath:
+		handlerAdminAudit(w, r, urlPathSegments[1:])
+	case exportPath:
+		handlerAdminExport(w, r, urlPathSegments[1:])
+	case notificationTemplatesPath:
+		handlerAdminNotificationTemplates(w, r, urlPathSegments[1:])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func handlerAdminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := reloadConfig(); err != nil {
+		log.Printf("reload: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "admin.reload", "service", "", nil)
+}
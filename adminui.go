@@ -0,0 +1,54 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The admin UI is a static page embedded in the binary and served at
+// /admin/ on the admin listener, next to the admin API it uses for feature
+// flags. Bookings are read and approved through the public API, at
+// ADMIN_UI_API_URL when it is on another listener (e.g.
+// https://rooms.example.edu/api, which must allow the admin origin in
+// CORS_ORIGINS). The page asks for an admin API key; serving it needs none.
+
+const adminUiPath = "/admin/"
+
+//go:embed adminui
+var adminUiFS embed.FS
+
+type adminUiConfig struct {
+	Api   string `json:"api"`
+	Admin string `json:"admin"`
+}
+
+func handlerAdminUi(apiBasePath string) http.Handler {
+	assets, err := fs.Sub(adminUiFS, "adminui")
+	if err != nil {
+		log.Fatal(err)
+	}
+	files := http.StripPrefix(adminUiPath, http.FileServer(http.FS(assets)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiUrl := envString("ADMIN_UI_API_URL", apiBasePath)
+		connect := "'self'"
+		if u, err := url.Parse(apiUrl); err == nil && u.Host != "" {
+			connect += " " + u.Scheme + "://" + u.Host
+		}
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; connect-src "+connect+"; frame-ancestors 'none'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if r.URL.Path == adminUiPath+"config.json" {
+			j, err := json.Marshal(adminUiConfig{Api: strings.TrimSuffix(apiUrl, "/"), Admin: apiBasePath + "/" + adminPath})
+			if err != nil {
+				log.Fatal(err)
+			}
+			w.Write(j)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
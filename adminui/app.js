@@ -0,0 +1,197 @@
+"use strict";
+
+// The UI talks to the JSON API with the admin key kept for the browser
+// session. config.json says where the booking API and the admin API are.
+let config = { api: "/api", admin: "/api/admin" };
+
+function apiKey() {
+  return sessionStorage.getItem("apiKey") || "";
+}
+
+function showMessage(text) {
+  document.getElementById("message").textContent = text;
+}
+
+async function call(method, url, body) {
+  const options = { method, headers: { "X-API-Key": apiKey() } };
+  if (body !== undefined) {
+    options.headers["Content-Type"] = "application/json";
+    options.body = JSON.stringify(body);
+  }
+  const response = await fetch(url, options);
+  if (!response.ok) {
+    let detail = response.statusText;
+    try {
+      const error = await response.json();
+      detail = error.message || detail;
+    } catch (e) {
+      // not a JSON error body
+    }
+    throw new Error(`${method} ${url}: ${response.status} ${detail}`);
+  }
+  return response.status === 204 ? null : response.json().catch(() => null);
+}
+
+function cell(row, text) {
+  const td = document.createElement("td");
+  td.textContent = text === undefined || text === null ? "" : String(text);
+  row.appendChild(td);
+  return td;
+}
+
+function button(row, label, action) {
+  const td = cell(row, "");
+  const b = document.createElement("button");
+  b.textContent = label;
+  b.addEventListener("click", async () => {
+    b.disabled = true;
+    try {
+      await action();
+    } catch (e) {
+      showMessage(e.message);
+    }
+    b.disabled = false;
+  });
+  td.appendChild(b);
+}
+
+function bookingCells(row, booking) {
+  cell(row, booking.booking_id);
+  cell(row, booking.booking_time);
+  cell(row, booking.booking_duration || "all day");
+  cell(row, booking.classroom_id);
+  cell(row, booking.booker_id);
+  cell(row, booking.booking_title);
+}
+
+async function loadBookings() {
+  const form = document.getElementById("booking-filter");
+  const query = new URLSearchParams();
+  for (const [name, value] of new FormData(form)) {
+    if (value) {
+      query.set(name, value);
+    }
+  }
+  const bookings = await call("GET", `${config.api}/bookings?${query}`);
+  const rows = document.getElementById("booking-rows");
+  rows.replaceChildren();
+  for (const booking of bookings) {
+    const row = document.createElement("tr");
+    bookingCells(row, booking);
+    cell(row, booking.booking_status);
+    button(row, "Cancel", async () => {
+      await call("POST", `${config.api}/bookings/${encodeURIComponent(booking.booking_id)}/cancel`, { override: true });
+      await loadBookings();
+    });
+    rows.appendChild(row);
+  }
+}
+
+async function loadPending() {
+  const bookings = await call("GET", `${config.api}/bookings?status=pending`);
+  const rows = document.getElementById("pending-rows");
+  rows.replaceChildren();
+  for (const booking of bookings) {
+    const row = document.createElement("tr");
+    bookingCells(row, booking);
+    button(row, "Approve", async () => {
+      await call("POST", `${config.api}/bookings/${encodeURIComponent(booking.booking_id)}/approve`);
+      await loadPending();
+    });
+    rows.appendChild(row);
+  }
+}
+
+async function loadFlags() {
+  const flags = await call("GET", `${config.admin}/flags`);
+  const rows = document.getElementById("flag-rows");
+  rows.replaceChildren();
+  for (const flag of flags) {
+    const row = document.createElement("tr");
+    cell(row, flag.name);
+    const enabled = document.createElement("input");
+    enabled.type = "checkbox";
+    enabled.checked = flag.enabled;
+    cell(row, "").appendChild(enabled);
+    const percentage = document.createElement("input");
+    percentage.type = "number";
+    percentage.min = 0;
+    percentage.max = 100;
+    percentage.value = flag.percentage;
+    cell(row, "").appendChild(percentage);
+    cell(row, Object.entries(flag.tenants || {}).map(([t, on]) => `${t}: ${on ? "on" : "off"}`).join(", "));
+    button(row, "Save", async () => {
+      await call("PUT", `${config.admin}/flags/${encodeURIComponent(flag.name)}`, {
+        enabled: enabled.checked,
+        percentage: Number(percentage.value),
+        tenants: flag.tenants,
+      });
+      showMessage(`Saved ${flag.name}`);
+    });
+    rows.appendChild(row);
+  }
+}
+
+const loaders = { bookings: loadBookings, pending: loadPending, flags: loadFlags };
+let current = "bookings";
+
+async function show(tab) {
+  current = tab;
+  for (const b of document.querySelectorAll("nav button")) {
+    b.classList.toggle("active", b.dataset.tab === tab);
+  }
+  for (const name of Object.keys(loaders)) {
+    document.getElementById(name).hidden = name !== tab;
+  }
+  showMessage("");
+  if (!apiKey()) {
+    showMessage("Sign in with an admin API key.");
+    return;
+  }
+  try {
+    await loaders[tab]();
+  } catch (e) {
+    showMessage(e.message);
+  }
+}
+
+function signedIn() {
+  const key = apiKey();
+  document.getElementById("api-key").hidden = key !== "";
+  document.querySelector("#login button[type=submit]").hidden = key !== "";
+  document.getElementById("logout").hidden = key === "";
+}
+
+document.getElementById("login").addEventListener("submit", (event) => {
+  event.preventDefault();
+  sessionStorage.setItem("apiKey", document.getElementById("api-key").value);
+  document.getElementById("api-key").value = "";
+  signedIn();
+  show(current);
+});
+
+document.getElementById("logout").addEventListener("click", () => {
+  sessionStorage.removeItem("apiKey");
+  signedIn();
+  show(current);
+});
+
+document.getElementById("booking-filter").addEventListener("submit", (event) => {
+  event.preventDefault();
+  show("bookings");
+});
+
+for (const b of document.querySelectorAll("nav button")) {
+  b.addEventListener("click", () => show(b.dataset.tab));
+}
+
+fetch("config.json")
+  .then((response) => response.json())
+  .then((c) => {
+    config = c;
+  })
+  .catch(() => {})
+  .finally(() => {
+    signedIn();
+    show(current);
+  });
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const agendaPath = "agenda"
+
+// getAgenda returns the booker's bookings starting on date, in the booking
+// time zone, ordered by start. Whole-day bookings come first.
+func getAgenda(store BookingRepository, bookerId string, date time.Time) ([]booking, error) {
+	bookings, err := store.GetBooker(bookerId)
+	if err != nil {
+		return nil, err
+	}
+	day := date.Format(bookingDateLayout)
+	agenda := make([]booking, 0)
+	starts := make(map[int]time.Time)
+	for _, b := range bookings {
+		start, _, err := bookingWindow(b)
+		if err != nil || start.Format(bookingDateLayout) != day {
+			continue
+		}
+		starts[b.BookingId] = start
+		agenda = append(agenda, b)
+	}
+	sort.SliceStable(agenda, func(i, j int) bool {
+		return starts[agenda[i].BookingId].Before(starts[agenda[j].BookingId])
+	})
+	return agenda, nil
+}
+
+// handlerBookerAgenda serves GET /api/booker/{id}/agenda?date=, today when
+// no date is given.
+func handlerBookerAgenda(w http.ResponseWriter, r *http.Request, bookerId string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	date := time.Now().In(bookingLocation)
+	if v := r.URL.Query().Get("date"); v != "" {
+		var err error
+		if date, err = time.ParseInLocation(bookingDateLayout, v, bookingLocation); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_booking_time")
+			return
+		}
+	}
+	limit, ok := listLimit(w, r)
+	if !ok {
+		return
+	}
+	agenda, err := getAgenda(bookingStoreFor(r), bookerId, date)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	// The agenda is in order of start already.
+	if limit > 0 && len(agenda) > limit {
+		agenda = agenda[:limit]
+	}
+	if agenda, ok = limitRows(w, r, agenda); !ok {
+		return
+	}
+	body, ok := bookingListBody(w, r, agenda)
+	if !ok {
+		return
+	}
+	j, err := json.Marshal(body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}
+
+// agendaText lists the day's bookings, one line each.
+func agendaText(agenda []booking, lang string) string {
+	lines := make([]string, len(agenda))
+	for i, b := range agenda {
+		at := translate(lang, "agenda.all_day")
+		if start, _, err := bookingWindow(b); err == nil && b.BookingDuration > 0 {
+			at = start.Format("15:04")
+		}
+		data := bookingNotificationData(eventBookingAgenda, b, "")
+		data.Time = at
+		lines[i] = renderNotification(defaultTenant, lang, templateAgendaLine, data)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// sendAgendas sends today's agenda to every booker whose agenda hour is the
+// hour of now. Bookers with nothing booked today get nothing.
+func sendAgendas(now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT `+preferenceColumns+` FROM notification_preference WHERE preference_scope = ? AND preference_agenda_hour = ?`, scopeBooker, now.Hour())
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	preferences := make([]notificationPreference, 0)
+	for results.Next() {
+		var p notificationPreference
+		if err := results.Scan(p.scanFields()...); err != nil {
+			log.Println(err.Error())
+			results.Close()
+			return
+		}
+		preferences = append(preferences, p)
+	}
+	results.Close()
+	if err := results.Err(); err != nil {
+		log.Println(err.Error())
+		return
+	}
+	for _, p := range preferences {
+		if p.Channel == channelNone {
+			continue
+		}
+		agenda, err := getAgenda(bookingStore, p.OwnerId, now)
+		if err != nil || len(agenda) == 0 {
+			continue
+		}
+		lang := preferenceLanguage(p)
+		sendNotification(p, notification{
+			Event:   eventBookingAgenda,
+			Subject: renderNotification(defaultTenant, lang, templateAgendaSubject, notificationData{Event: eventBookingAgenda, Date: now.Format(bookingDateLayout)}),
+			Text:    agendaText(agenda, lang),
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Attachments are files kept beside the database rather than in it, such
+// as classroom photos. ATTACHMENT_BACKEND picks where they go; the only
+// backend, and the default, is "file", which keeps them under
+// ATTACHMENT_DIR (default attachments). Keys are slash separated paths
+// built by the service, never taken from a request as they are.
+
+var errNoAttachment = fmt.Errorf("attachment %w", errNotFound)
+
+type attachmentStore interface {
+	Put(key string, data []byte) error
+	// Get returns errNoAttachment for a key that was never put or was
+	// deleted.
+	Get(key string) ([]byte, error)
+	// Delete removes key; a missing key is no error.
+	Delete(key string) error
+	// Keys lists the keys starting with prefix last put before before.
+	Keys(prefix string, before time.Time) ([]string, error)
+}
+
+func attachments() (attachmentStore, error) {
+	switch backend := envString("ATTACHMENT_BACKEND", "file"); backend {
+	case "file":
+		return fileAttachments(envString("ATTACHMENT_DIR", "attachments")), nil
+	default:
+		return nil, fmt.Errorf("unknown ATTACHMENT_BACKEND %q", backend)
+	}
+}
+
+type fileAttachments string
+
+func (dir fileAttachments) path(key string) (string, error) {
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", fmt.Errorf("invalid attachment key %q", key)
+		}
+	}
+	return filepath.Join(string(dir), filepath.FromSlash(key)), nil
+}
+
+// Put writes data to a temporary file renamed over key, so readers see the
+// old attachment or the new one, never part of it.
+func (dir fileAttachments) Put(key string, data []byte) error {
+	path, err := dir.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (dir fileAttachments) Get(key string) ([]byte, error) {
+	path, err := dir.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNoAttachment
+	}
+	return data, err
+}
+
+func (dir fileAttachments) Delete(key string) error {
+	path, err := dir.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Keys skips the temporary files of uploads in progress.
+func (dir fileAttachments) Keys(prefix string, before time.Time) ([]string, error) {
+	keys := make([]string, 0)
+	err := filepath.WalkDir(string(dir), func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(string(dir), path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().Before(before) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// actorOf names a caller in the audit log and usage statistics: the booker
+// for student keys, otherwise a prefix of the key hash.
+func actorOf(caller *apiKey) string {
+	if caller == nil {
+		return "anonymous"
+	}
+	if caller.ActingAdmin != nil {
+		return actorOf(caller.ActingAdmin) + " as " + caller.Role + ":" + caller.BookerId
+	}
+	if caller.BookerId != "" {
+		return caller.Role + ":" + caller.BookerId
+	}
+	return caller.Role + ":" + caller.Hash[:12]
+}
+
+// recordAudit appends an entry to the audit log, with the tenant, route
+// pattern and request id of r. Failing to write it is logged, not
+// surfaced, since the audited action already happened.
+func recordAudit(r *http.Request, action string, entity string, entityId string, detail interface{}) {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	actor := actorOf(callerOf(r))
+	route, _ := r.Context().Value(routeKey{}).(string)
+	var j []byte
+	if detail != nil {
+		var err error
+		if j, err = json.Marshal(detail); err != nil {
+			log.Print(err)
+		}
+	}
+	_, err := Db.ExecContext(ctx, `INSERT INTO audit_log (audit_at, audit_tenant, audit_route, audit_request_id, audit_actor, audit_action, audit_entity, audit_entity_id, audit_detail) VALUES (UTC_TIMESTAMP(), ?, ?, ?, ?, ?, ?, ?, ?)`,
+		tenantOf(r), route, requestIdOf(r), actor, action, entity, entityId, string(j))
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// GET /api/admin/audit/export?from=&to=&format=ndjson streams the audit
+// log for compliance reviews, one JSON entry per line in id order, filtered
+// by any of tenant, actor, entity, entity_id, action and route. from and to
+// are dates or RFC 3339 times, to exclusive, defaulting to the last 24
+// hours. A response holds up to limit (default 10000, at most 100000)
+// entries and ends with a line {"done":true,"rows":n}, with next_after when
+// there are more: the after= of the next page. A stream without the done
+// line was cut short.
+
+const auditPath = "audit"
+const formatNdjson = "ndjson"
+const maxAuditExportLimit = 100000
+
+type auditEntry struct {
+	Id        int64           `json:"id"`
+	At        time.Time       `json:"at"`
+	Tenant    string          `json:"tenant"`
+	Actor     string          `json:"actor"`
+	Action    string          `json:"action"`
+	Entity    string          `json:"entity"`
+	EntityId  string          `json:"entity_id"`
+	Route     string          `json:"route,omitempty"`
+	RequestId string          `json:"request_id,omitempty"`
+	Detail    json.RawMessage `json:"detail,omitempty"`
+}
+
+type auditExportEnd struct {
+	Done      bool  `json:"done"`
+	Rows      int   `json:"rows"`
+	NextAfter int64 `json:"next_after,omitempty"`
+}
+
+type auditFilter struct {
+	From, To time.Time
+	After    int64
+	// Columns are the audit_log columns to match exactly.
+	Columns map[string]string
+}
+
+// auditFilterColumns are the audit_log columns of the export's filters.
+var auditFilterColumns = map[string]string{
+	"tenant":    "audit_tenant",
+	"actor":     "audit_actor",
+	"entity":    "audit_entity",
+	"entity_id": "audit_entity_id",
+	"action":    "audit_action",
+	"route":     "audit_route",
+}
+
+// writeAuditExport writes up to limit entries matching f to w, then the
+// done line, calling flush every thousand entries.
+func writeAuditExport(ctx context.Context, w io.Writer, f auditFilter, limit int, flush func()) error {
+	query := `SELECT audit_id, audit_at, audit_tenant, audit_actor, audit_action, audit_entity, audit_entity_id, audit_route, audit_request_id, audit_detail
+		FROM audit_log WHERE audit_at >= ? AND audit_at < ? AND audit_id > ?`
+	args := []interface{}{f.From.UTC(), f.To.UTC(), f.After}
+	params := make([]string, 0, len(f.Columns))
+	for param := range f.Columns {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+	for _, param := range params {
+		query += ` AND ` + auditFilterColumns[param] + ` = ?`
+		args = append(args, f.Columns[param])
+	}
+	results, err := Db.QueryContext(ctx, query+` ORDER BY audit_id LIMIT ?`, append(args, limit+1)...)
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+	encoder := json.NewEncoder(w)
+	end := auditExportEnd{Done: true}
+	var last int64
+	for results.Next() {
+		if end.Rows == limit {
+			end.NextAfter = last
+			break
+		}
+		var e auditEntry
+		var detail string
+		if err := results.Scan(&e.Id, sqlTime{&e.At}, &e.Tenant, &e.Actor, &e.Action, &e.Entity, &e.EntityId, &e.Route, &e.RequestId, &detail); err != nil {
+			return err
+		}
+		if detail != "" && json.Valid([]byte(detail)) {
+			e.Detail = json.RawMessage(detail)
+		}
+		if err := encoder.Encode(e); err != nil {
+			return err
+		}
+		last = e.Id
+		if end.Rows++; end.Rows%1000 == 0 {
+			flush()
+		}
+	}
+	if err := results.Err(); err != nil {
+		return err
+	}
+	return encoder.Encode(end)
+}
+
+// parseAuditTime reads a date, as midnight in the booking zone, or an
+// RFC 3339 time.
+func parseAuditTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation(bookingDateLayout, v, bookingLocation)
+}
+
+// handlerAdminAudit serves /api/admin/audit/export.
+func handlerAdminAudit(w http.ResponseWriter, r *http.Request, segments []string) {
+	if len(segments) != 1 || segments[0] != exportPath {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	if format := query.Get("format"); format != "" && format != formatNdjson {
+		writeError(w, r, http.StatusBadRequest, "invalid_format", "format", format, "supported", formatNdjson)
+		return
+	}
+	now := time.Now()
+	f := auditFilter{From: now.Add(-24 * time.Hour), To: now, Columns: map[string]string{}}
+	var err error
+	if v := query.Get("from"); v != "" {
+		if f.From, err = parseAuditTime(v); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_audit_range")
+			return
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		if f.To, err = parseAuditTime(v); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_audit_range")
+			return
+		}
+	}
+	if !f.From.Before(f.To) {
+		writeError(w, r, http.StatusBadRequest, "invalid_audit_range")
+		return
+	}
+	if v := query.Get("after"); v != "" {
+		if f.After, err = strconv.ParseInt(v, 10, 64); err != nil || f.After < 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid_cursor")
+			return
+		}
+	}
+	limit := 10000
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxAuditExportLimit {
+			writeError(w, r, http.StatusBadRequest, "invalid_export_limit", "max", strconv.Itoa(maxAuditExportLimit))
+			return
+		}
+	}
+	for param := range auditFilterColumns {
+		if v := query.Get(param); v != "" {
+			f.Columns[param] = v
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-%s.ndjson"`, now.UTC().Format("20060102T150405")))
+	flusher, _ := w.(http.Flusher)
+	err = writeAuditExport(r.Context(), w, f, limit, func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err != nil {
+		// As with backups, the missing done line tells the client.
+		log.Printf("audit export: %v", err)
+	}
+}
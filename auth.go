@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// API keys are stored as the hex SHA-256 of the key, e.g.
+//
+//	INSERT INTO api_key (api_key_hash, api_key_role) VALUES (SHA2('<key>', 256), 'display')
+//
+// with api_key_tenant_id set for a key of a tenant other than the default.
+type apiKey struct {
+	Hash     string
+	Role     string
+	BookerId string
+	// DepartmentId is the department a manager key acts for.
+	DepartmentId string
+	// TenantId is the tenant the key belongs to, empty for the default
+	// one; see tenantOf.
+	TenantId string
+	// ActingAdmin is the admin key behind an X-Act-As request.
+	ActingAdmin *apiKey
+}
+
+const (
+	roleAdmin   = "admin"
+	roleDisplay = "display"
+	roleStudent = "student"
+	roleManager = "manager"
+)
+
+type callerKey struct{}
+
+const apiKeyCacheTTL = time.Minute
+
+type cachedApiKey struct {
+	key     *apiKey
+	expires time.Time
+}
+
+var apiKeyCache = struct {
+	sync.Mutex
+	keys map[string]cachedApiKey
+}{keys: make(map[string]cachedApiKey)}
+
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func getApiKey(hash string) (*apiKey, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	key := &apiKey{}
+	var bookerId, departmentId, tenantId sql.NullString
+	err := Db.QueryRowContext(ctx, `SELECT api_key_hash, api_key_role, api_key_booker_id, api_key_department_id, api_key_tenant_id FROM api_key WHERE api_key_hash = ?`, hash).Scan(&key.Hash, &key.Role, &bookerId, &departmentId, &tenantId)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	key.BookerId, key.DepartmentId, key.TenantId = bookerId.String, departmentId.String, tenantId.String
+	return key, nil
+}
+
+// lookupApiKey resolves a presented key, caching hits and misses briefly so
+// polling clients don't cost a query per request.
+func lookupApiKey(key string) (*apiKey, error) {
+	hash := hashApiKey(key)
+	apiKeyCache.Lock()
+	cached, ok := apiKeyCache.keys[hash]
+	apiKeyCache.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.key, nil
+	}
+	found, err := getApiKey(hash)
+	if err != nil {
+		return nil, err
+	}
+	apiKeyCache.Lock()
+	apiKeyCache.keys[hash] = cachedApiKey{found, time.Now().Add(apiKeyCacheTTL)}
+	apiKeyCache.Unlock()
+	return found, nil
+}
+
+func requestApiKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// callerOf returns the API key the request was made with, or nil for
+// anonymous requests.
+func callerOf(r *http.Request) *apiKey {
+	if key, ok := r.Context().Value(callerKey{}).(*apiKey); ok {
+		return key
+	}
+	presented := requestApiKey(r)
+	if presented == "" {
+		return nil
+	}
+	key, err := lookupApiKey(presented)
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// authorizeBooker lets admins and the booker's own student key act on a
+// booker's data, answering 401/403 for everyone else.
+func authorizeBooker(w http.ResponseWriter, r *http.Request, bookerId string) bool {
+	caller := callerOf(r)
+	if caller == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	if caller.Role == roleAdmin || caller.Role == roleStudent && caller.BookerId == bookerId {
+		return true
+	}
+	w.WriteHeader(http.StatusForbidden)
+	return false
+}
+
+// requireApiKey only lets requests through that present an API key with one
+// of the given roles.
+func requireApiKey(handler http.Handler, roles ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		key, ok := r.Context().Value(callerKey{}).(*apiKey)
+		if !ok {
+			presented := requestApiKey(r)
+			if presented == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			var err error
+			key, err = lookupApiKey(presented)
+			if err != nil {
+				writeServiceError(w, r, err)
+				return
+			}
+		}
+		if key == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		for _, role := range roles {
+			if key.Role == role {
+				handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, key)))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusForbidden)
+	})
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// POST /api/bookings/auto books a classroom the service picks: the body is
+// a booking without a classroom, plus the capacity, people the room must
+// seat, and the equipment it must have. Candidates are the classrooms
+// free at the time, in building_id or floor_id if given, whose features
+// (GET/PUT /api/classrooms/{id}/features) cover the request; shared
+// classrooms, booked by the seat, are left out. They are ranked by
+// strategy, AUTO_ASSIGN_STRATEGY by default:
+//
+//   - smallest_fit, the smallest room that fits, least used first among
+//     rooms of a size;
+//   - least_used, the room with the fewest booked minutes within
+//     AUTO_ASSIGN_USAGE_WINDOW (default 168h) either side of the booking,
+//     which spreads bookings over the rooms like a round-robin weighted by
+//     booking length.
+//
+// Rooms without a capacity set rank last, and don't fit a request with a
+// capacity. Each candidate is checked as POST /api/bookings would check
+// it, and booked by the same insert, which fails if the slot was taken
+// meanwhile; the next candidate is tried then, or when the room's policy
+// refuses the booking. Auto bookings never preempt. The answer is the
+// create's, with the classroom picked; when no room can be booked it is
+// the refusal of the best ranked one, or 409 no_classroom_available.
+
+const autoPath = "auto"
+const featuresPath = "features"
+
+const maxEquipment = 50
+const maxEquipmentName = 64
+
+const (
+	assignSmallestFit = "smallest_fit"
+	assignLeastUsed   = "least_used"
+)
+
+var assignStrategies = []string{assignSmallestFit, assignLeastUsed}
+
+type classroomFeatures struct {
+	Capacity  int      `json:"capacity"`
+	Equipment []string `json:"equipment"`
+}
+
+// covers reports whether a room with f fits a request for capacity people
+// and equipment.
+func (f classroomFeatures) covers(capacity int, equipment []string) bool {
+	if capacity > 0 && f.Capacity < capacity {
+		return false
+	}
+	has := make(map[string]bool, len(f.Equipment))
+	for _, name := range f.Equipment {
+		has[name] = true
+	}
+	for _, name := range equipment {
+		if !has[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeEquipment lowercases and sorts names, dropping duplicates, and
+// reports whether they are valid.
+func normalizeEquipment(names []string) ([]string, bool) {
+	if len(names) > maxEquipment {
+		return nil, false
+	}
+	seen := map[string]bool{}
+	normalized := []string{}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || len(name) > maxEquipmentName {
+			return nil, false
+		}
+		if !seen[name] {
+			seen[name] = true
+			normalized = append(normalized, name)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized, true
+}
+
+// getClassroomFeatures returns the features of classroomId, or of every
+// classroom if it is empty, by classroom id.
+func getClassroomFeatures(classroomId string) (map[string]classroomFeatures, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	features := map[string]classroomFeatures{}
+	query, args := `SELECT classroom_id, classroom_capacity FROM classroom`, []interface{}{}
+	if classroomId != "" {
+		query, args = query+` WHERE classroom_id = ?`, append(args, classroomId)
+	}
+	results, err := Db.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	for results.Next() {
+		var id string
+		var f classroomFeatures
+		if err := results.Scan(&id, &f.Capacity); err != nil {
+			log.Println(err.Error())
+			results.Close()
+			return nil, err
+		}
+		f.Equipment = []string{}
+		features[id] = f
+	}
+	results.Close()
+	if err := results.Err(); err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	query = `SELECT equipment_classroom_id, equipment_name FROM classroom_equipment`
+	if classroomId != "" {
+		query += ` WHERE equipment_classroom_id = ?`
+	}
+	results, err = Db.QueryContext(ctx, query+` ORDER BY equipment_classroom_id, equipment_name`, args...)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	for results.Next() {
+		var id, name string
+		if err := results.Scan(&id, &name); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		if f, ok := features[id]; ok {
+			f.Equipment = append(f.Equipment, name)
+			features[id] = f
+		}
+	}
+	return features, results.Err()
+}
+
+func saveClassroomFeatures(classroomId string, f classroomFeatures) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	tx, err := Db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `UPDATE classroom SET classroom_capacity = ? WHERE classroom_id = ?`, f.Capacity, classroomId); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM classroom_equipment WHERE equipment_classroom_id = ?`, classroomId); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	for _, name := range f.Equipment {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO classroom_equipment (equipment_classroom_id, equipment_name) VALUES (?, ?)`, classroomId, name); err != nil {
+			log.Println(err.Error())
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// handlerClassroomFeatures serves /api/classrooms/{id}/features. Anyone
+// can read them; the classroom's owners and managers change them.
+func handlerClassroomFeatures(w http.ResponseWriter, r *http.Request, classroomId string) {
+	switch r.Method {
+	case http.MethodGet:
+		features, err := getClassroomFeatures(classroomId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		f, ok := features[classroomId]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		j, err := json.Marshal(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+	case http.MethodPut:
+		if !authorizeManager(w, r, classroomId, classroomOwner, classroomManager) {
+			return
+		}
+		var update classroomFeatures
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil || update.Capacity < 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid_body")
+			return
+		}
+		equipment, ok := normalizeEquipment(update.Equipment)
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, "invalid_equipment", "max", strconv.Itoa(maxEquipment), "length", strconv.Itoa(maxEquipmentName))
+			return
+		}
+		update.Equipment = equipment
+		classroom, err := getClassroom(classroomId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		if classroom == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err := saveClassroomFeatures(classroomId, update); err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		recordAudit(r, "classroom.features", "classroom", classroomId, update)
+	case http.MethodOptions:
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+type autoBookingRequest struct {
+	bookingRequest
+	Capacity   int      `json:"capacity"`
+	Equipment  []string `json:"equipment"`
+	BuildingId int      `json:"building_id"`
+	FloorId    int      `json:"floor_id"`
+	Strategy   string   `json:"strategy"`
+}
+
+type assignCandidate struct {
+	classroomId string
+	features    classroomFeatures
+	// usage is the minutes booked in the room around the booking.
+	usage int
+}
+
+// rankCandidates orders candidates best first by strategy.
+func rankCandidates(candidates []assignCandidate, strategy string) {
+	size := func(c assignCandidate) int {
+		if c.features.Capacity == 0 {
+			return int(^uint(0) >> 1)
+		}
+		return c.features.Capacity
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if strategy == assignLeastUsed && a.usage != b.usage {
+			return a.usage < b.usage
+		}
+		if size(a) != size(b) {
+			return size(a) < size(b)
+		}
+		if a.usage != b.usage {
+			return a.usage < b.usage
+		}
+		return a.classroomId < b.classroomId
+	})
+}
+
+// assignCandidates lists the free classrooms that fit request for b,
+// ranked.
+func assignCandidates(request autoBookingRequest, b booking, strategy string) ([]assignCandidate, error) {
+	start, end, err := bookingWindow(b)
+	if err != nil {
+		return nil, err
+	}
+	available, err := getAvailableClassrooms(start, end, locationFilter{BuildingId: request.BuildingId, FloorId: request.FloorId})
+	if err != nil {
+		return nil, err
+	}
+	features, err := getClassroomFeatures("")
+	if err != nil {
+		return nil, err
+	}
+	window := envDuration("AUTO_ASSIGN_USAGE_WINDOW", 7*24*time.Hour)
+	bookings, err := getBookingsBetween(start.Add(-window), end.Add(window), "")
+	if err != nil {
+		return nil, err
+	}
+	usage := map[string]int{}
+	for classroomId, booked := range busyClassrooms(bookings, start.Add(-window), end.Add(window)) {
+		for _, other := range booked {
+			usage[classroomId] += bookingMinutes(other)
+		}
+	}
+	candidates := []assignCandidate{}
+	for _, c := range available {
+		f := features[c.ClassroomId]
+		if !f.covers(request.Capacity, request.Equipment) {
+			continue
+		}
+		candidates = append(candidates, assignCandidate{c.ClassroomId, f, usage[c.ClassroomId]})
+	}
+	rankCandidates(candidates, strategy)
+	return candidates, nil
+}
+
+// replay writes the answer bw kept to w.
+func (bw *batchWriter) replay(w http.ResponseWriter) {
+	for key, values := range bw.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(bw.status)
+	w.Write(bw.body.Bytes())
+}
+
+// handlerBookingAuto serves POST /api/bookings/auto.
+func handlerBookingAuto(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var request autoBookingRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Capacity < 0 {
+		writeError(w, r, http.StatusBadRequest, "invalid_body")
+		return
+	}
+	strategy := request.Strategy
+	if strategy == "" {
+		strategy = envString("AUTO_ASSIGN_STRATEGY", assignSmallestFit)
+	}
+	if strategy != assignSmallestFit && strategy != assignLeastUsed {
+		writeError(w, r, http.StatusBadRequest, "invalid_strategy", "strategy", strategy, "supported", strings.Join(assignStrategies, ", "))
+		return
+	}
+	equipment, ok := normalizeEquipment(request.Equipment)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, "invalid_equipment", "max", strconv.Itoa(maxEquipment), "length", strconv.Itoa(maxEquipmentName))
+		return
+	}
+	request.Equipment = equipment
+	b := request.booking()
+	if applyBookingTime(w, r, &b, request.TimeZone) {
+		return
+	}
+	if _, _, err := bookingWindow(b); err != nil || b.BookingDuration < 0 {
+		writeError(w, r, http.StatusBadRequest, "invalid_booking_time")
+		return
+	}
+	candidates, err := assignCandidates(request, b, strategy)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	store := bookingStoreFor(r)
+	var refused *batchWriter
+	for _, c := range candidates {
+		policy, err := getRoomPolicy(c.classroomId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		if policy.Capacity > 0 {
+			continue
+		}
+		candidate := b
+		candidate.BookingClassroomId = c.classroomId
+		bw := newBatchWriter()
+		displaced, rejected := rejectBooking(bw, r, &candidate)
+		if rejected {
+			// Refusals of the booker, not the room, hold for every room.
+			if bw.status == http.StatusForbidden || bw.status == http.StatusTooManyRequests || bw.status >= 500 {
+				bw.replay(w)
+				return
+			}
+			if refused == nil {
+				refused = bw
+			}
+			continue
+		}
+		if len(displaced) > 0 {
+			continue
+		}
+		candidate.BookingPublicId = newPublicId()
+		candidate.Tenant = tenantOf(r)
+		bookingId, err := store.InsertBooking(candidate)
+		if isConflict(err) {
+			continue
+		} else if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		for key, values := range bw.header {
+			w.Header()[key] = values
+		}
+		candidate.BookingId = bookingId
+		candidate.ActedBy = actedBy(r)
+		candidate.RequestId = requestIdOf(r)
+		recordUsage(r, usageBooking)
+		if err := dispatchBookingEvent(eventBookingCreated, candidate); err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		j, err := json.Marshal(struct {
+			BookingId   string           `json:"booking_id"`
+			ClassroomId string           `json:"classroom_id"`
+			Strategy    string           `json:"strategy"`
+			Receipt     string           `json:"receipt,omitempty"`
+			Warnings    []bookingWarning `json:"warnings,omitempty"`
+		}{candidate.BookingPublicId, candidate.BookingClassroomId, strategy, latestReceipt(candidate), quotaWarnings(r, candidate)})
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write(j)
+		return
+	}
+	if refused != nil {
+		refused.replay(w)
+		return
+	}
+	writeError(w, r, http.StatusConflict, "no_classroom_available")
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const availabilityPath = "availability"
+
+const maxSuggestions = 5
+const maxAvailabilityQueries = 200
+const maxSuggestionShifts = 8
+
+type suggestion struct {
+	ClassroomId     string `json:"classroom_id"`
+	BookingTime     string `json:"booking_time"`
+	BookingDuration int    `json:"booking_duration"`
+}
+
+// getBookingsBetween returns the bookings that may overlap [from, to),
+// optionally restricted to one classroom, from the booking store. Booking
+// times are stored as text so the store only narrows the candidates down by
+// date; callers check the exact overlap with bookingWindow.
+func getBookingsBetween(from, to time.Time, classroomId string) ([]booking, error) {
+	filter := bookingFilter{ClassroomId: classroomId, From: from.AddDate(0, 0, -1).Format(bookingDateLayout), To: to.Format(bookingDateLayout)}
+	return bookingStore.GetBookingList(filter, bookingFields)
+}
+
+// availabilityQuery asks whether a classroom is free for a booking time,
+// duration and seats, with the same meaning as on a booking.
+type availabilityQuery struct {
+	ClassroomId     string `json:"classroom_id"`
+	BookingTime     string `json:"booking_time"`
+	BookingDuration int    `json:"booking_duration"`
+	BookingSeats    int    `json:"booking_seats,omitempty"`
+}
+
+type availabilityAnswer struct {
+	availabilityQuery
+	Available bool     `json:"available"`
+	Conflicts []string `json:"conflicts"`
+}
+
+// getBookingsForQueries returns the bookings that may overlap any of the
+// queries, in one query: each query contributes its classroom and the dates
+// its window can touch, narrowed down exactly by the caller.
+func getBookingsForQueries(queries []availabilityQuery, windows [][2]time.Time) ([]booking, error) {
+	clauses := make([]string, len(queries))
+	args := make([]interface{}, 0, 3*len(queries))
+	for i, q := range queries {
+		clauses[i] = `(booking_classroom_id = ? AND LEFT(TRIM(booking_time), 10) BETWEEN ? AND ?)`
+		args = append(args, q.ClassroomId, windows[i][0].AddDate(0, 0, -1).Format(bookingDateLayout), windows[i][1].Format(bookingDateLayout))
+	}
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT `+bookingColumns+` FROM booking WHERE `+strings.Join(clauses, ` OR `), args...)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	bookings := make([]booking, 0)
+	for results.Next() {
+		var booking booking
+		if err := results.Scan(booking.scanFields()...); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		bookings = append(bookings, booking)
+	}
+	return bookings, results.Err()
+}
+
+// queryAvailability answers each query in order, from the schedule read
+// model once it is built.
+func queryAvailability(queries []availabilityQuery) ([]availabilityAnswer, error) {
+	answers := make([]availabilityAnswer, len(queries))
+	if len(queries) == 0 {
+		return answers, nil
+	}
+	windows := make([][2]time.Time, len(queries))
+	for i, q := range queries {
+		start, end, err := bookingWindow(booking{BookingTime: q.BookingTime, BookingDuration: q.BookingDuration})
+		if err != nil {
+			return nil, err
+		}
+		windows[i] = [2]time.Time{start, end}
+	}
+	capacities := make(map[string]int)
+	for _, q := range queries {
+		if _, ok := capacities[q.ClassroomId]; q.BookingSeats > 0 && !ok {
+			policy, err := getRoomPolicy(q.ClassroomId)
+			if err != nil {
+				return nil, err
+			}
+			capacities[q.ClassroomId] = policy.Capacity
+		}
+	}
+	overlapping := make([][]booking, len(queries))
+	if scheduleReady.Load() {
+		scheduleWindows := make([]scheduleWindow, len(queries))
+		for i, q := range queries {
+			scheduleWindows[i] = scheduleWindow{q.ClassroomId, windows[i][0], windows[i][1]}
+		}
+		conflicts, err := scheduleConflicts(scheduleWindows)
+		if err != nil {
+			return nil, err
+		}
+		for i, q := range queries {
+			overlapping[i] = conflicts[i][q.ClassroomId]
+		}
+	} else {
+		bookings, err := getBookingsForQueries(queries, windows)
+		if err != nil {
+			return nil, err
+		}
+		for i, q := range queries {
+			overlapping[i] = busyClassrooms(bookings, windows[i][0], windows[i][1])[q.ClassroomId]
+		}
+	}
+	for i, q := range queries {
+		wanted := booking{BookingClassroomId: q.ClassroomId, BookingSeats: q.BookingSeats}
+		conflicts := make([]string, 0)
+		if q.BookingSeats > 0 && q.BookingSeats > capacities[q.ClassroomId] {
+			// No classroom seats more than its capacity, however empty.
+			answers[i] = availabilityAnswer{q, false, conflicts}
+			continue
+		}
+		for _, b := range seatConflicts(wanted, overlapping[i], windows[i][0], windows[i][1], capacities[q.ClassroomId]) {
+			conflicts = append(conflicts, b.publicId())
+		}
+		answers[i] = availabilityAnswer{q, len(conflicts) == 0, conflicts}
+	}
+	return answers, nil
+}
+
+// busyClassrooms maps each classroom id to the bookings in it that overlap
+// [start, end).
+func busyClassrooms(bookings []booking, start, end time.Time) map[string][]booking {
+	busy := make(map[string][]booking)
+	for _, b := range bookings {
+		bookingStart, bookingEnd, err := bookingWindow(b)
+		if err != nil {
+			continue
+		}
+		if overlaps(start, end, bookingStart, bookingEnd) {
+			busy[b.BookingClassroomId] = append(busy[b.BookingClassroomId], b)
+		}
+	}
+	return busy
+}
+
+// findConflicts returns the existing bookings that overlap b in its classroom.
+func findConflicts(b booking) ([]booking, error) {
+	start, end, err := bookingWindow(b)
+	if err != nil {
+		return nil, err
+	}
+	bookings, err := getBookingsBetween(start, end, b.BookingClassroomId)
+	if err != nil {
+		return nil, err
+	}
+	capacity := 0
+	if b.BookingSeats > 0 {
+		policy, err := getRoomPolicy(b.BookingClassroomId)
+		if err != nil {
+			return nil, err
+		}
+		capacity = policy.Capacity
+	}
+	return seatConflicts(b, bookings, start, end, capacity), nil
+}
+
+// getBusyClassrooms lists the classrooms with bookings overlapping
+// [start, end), from the schedule read model once it is built.
+func getBusyClassrooms(start, end time.Time) (map[string]bool, error) {
+	busy := make(map[string]bool)
+	if scheduleReady.Load() {
+		conflicts, err := scheduleConflicts([]scheduleWindow{{"", start, end}})
+		if err != nil {
+			return nil, err
+		}
+		for classroomId := range conflicts[0] {
+			busy[classroomId] = true
+		}
+		return busy, nil
+	}
+	bookings, err := getBookingsBetween(start, end, "")
+	if err != nil {
+		return nil, err
+	}
+	for classroomId := range busyClassrooms(bookings, start, end) {
+		busy[classroomId] = true
+	}
+	return busy, nil
+}
+
+func getAvailableClassrooms(start, end time.Time, filter locationFilter) ([]classroom, error) {
+	classrooms, err := getClassroomList(filter)
+	if err != nil {
+		return nil, err
+	}
+	busy, err := getBusyClassrooms(start, end)
+	if err != nil {
+		return nil, err
+	}
+	available := make([]classroom, 0, len(classrooms))
+	for _, c := range classrooms {
+		if !busy[c.ClassroomId] {
+			available = append(available, c)
+		}
+	}
+	return available, nil
+}
+
+// suggestAlternatives proposes up to maxSuggestions free slots for a
+// conflicting booking: the same classroom shifted to nearby times first,
+// then other free classrooms at the requested time, nearest first.
+func suggestAlternatives(b booking) ([]suggestion, error) {
+	start, end, err := bookingWindow(b)
+	if err != nil {
+		return nil, err
+	}
+	length := end.Sub(start)
+	from, to := start.Add(-maxSuggestionShifts*length), end.Add(maxSuggestionShifts*length)
+	bookings, err := getBookingsBetween(from, to, b.BookingClassroomId)
+	if err != nil {
+		return nil, err
+	}
+	suggestions := make([]suggestion, 0, maxSuggestions)
+	now := time.Now()
+	for shift := 1; shift <= maxSuggestionShifts && len(suggestions) < maxSuggestions; shift++ {
+		for _, direction := range []int{1, -1} {
+			offset := time.Duration(direction*shift) * length
+			candidateStart, candidateEnd := start.Add(offset), end.Add(offset)
+			if candidateStart.Before(now) {
+				continue
+			}
+			if _, busy := busyClassrooms(bookings, candidateStart, candidateEnd)[b.BookingClassroomId]; busy {
+				continue
+			}
+			layout := bookingTimeLayout
+			if b.BookingDuration == 0 {
+				layout = bookingDateLayout
+			}
+			suggestions = append(suggestions, suggestion{b.BookingClassroomId, candidateStart.Format(layout), b.BookingDuration})
+			if len(suggestions) == maxSuggestions {
+				return suggestions, nil
+			}
+		}
+	}
+	origin, err := getClassroom(b.BookingClassroomId)
+	if err != nil {
+		return nil, err
+	}
+	filter := locationFilter{}
+	if origin != nil && origin.BuildingId != nil {
+		filter.BuildingId = *origin.BuildingId
+	}
+	available, err := getAvailableClassrooms(start, end, filter)
+	if err != nil {
+		return nil, err
+	}
+	if origin != nil {
+		sortByDistance(available, *origin)
+	}
+	for _, c := range available {
+		if len(suggestions) == maxSuggestions {
+			break
+		}
+		suggestions = append(suggestions, suggestion{c.ClassroomId, b.BookingTime, b.BookingDuration})
+	}
+	return suggestions, nil
+}
+
+// writeConflict answers a create that collides with existing bookings with
+// 409 and a list of alternatives the client can offer instead.
+func writeConflict(w http.ResponseWriter, r *http.Request, b booking, conflicts []booking) {
+	conflictIds := make([]string, 0, len(conflicts))
+	for _, c := range conflicts {
+		conflictIds = append(conflictIds, c.publicId())
+	}
+	suggestions := []suggestion{}
+	if flagEnabled(flagSuggestions, tenantOf(r), b.BookingBookerId) {
+		var err error
+		if suggestions, err = suggestAlternatives(b); err != nil {
+			log.Print(err)
+			suggestions = []suggestion{}
+		}
+	}
+	j, err := json.Marshal(map[string]interface{}{
+		"error":       "conflict",
+		"message":     translate(requestLanguage(r), "error.conflict", "classroom", b.BookingClassroomId, "time", strings.TrimSpace(b.BookingTime)),
+		"conflicts":   conflictIds,
+		"suggestions": suggestions,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(http.StatusConflict)
+	w.Write(j)
+}
+
+func isDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+// sortByDistance orders classrooms so that rooms in the same building as
+// origin come first, closest floor first. Rooms without a location go last.
+func sortByDistance(classrooms []classroom, origin classroom) {
+	distance := func(c classroom) int {
+		if c.BuildingId == nil || origin.BuildingId == nil {
+			return 1 << 20
+		}
+		if *c.BuildingId != *origin.BuildingId {
+			return 1 << 10
+		}
+		d := *c.FloorLevel - *origin.FloorLevel
+		if d < 0 {
+			d = -d
+		}
+		return d
+	}
+	sort.SliceStable(classrooms, func(i, j int) bool {
+		return distance(classrooms[i]) < distance(classrooms[j])
+	})
+}
+
+// handlerAvailabilityQuery serves POST /api/availability/query, answering a
+// list of classroom and time pairs in one round trip.
+func handlerAvailabilityQuery(w http.ResponseWriter, r *http.Request) {
+	urlPathSegments := strings.Split(r.URL.Path, fmt.Sprintf("%s/", availabilityPath))
+	if urlPathSegments[len(urlPathSegments)-1] != "query" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var queries []availabilityQuery
+	if err := json.NewDecoder(r.Body).Decode(&queries); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_body")
+		return
+	}
+	if len(queries) > maxAvailabilityQueries {
+		writeError(w, r, http.StatusBadRequest, "too_many_queries", "max", strconv.Itoa(maxAvailabilityQueries))
+		return
+	}
+	for _, q := range queries {
+		if q.ClassroomId == "" || q.BookingDuration < 0 || q.BookingSeats < 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid_body")
+			return
+		}
+		if _, err := parseBookingTime(q.BookingTime); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_booking_time")
+			return
+		}
+	}
+	answers, err := queryAvailability(queries)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	j, err := json.Marshal(answers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}
+
+func handlerAvailability(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		duration, _ := strconv.Atoi(query.Get("duration"))
+		probe := booking{BookingTime: query.Get("date"), BookingDuration: duration}
+		if t := query.Get("time"); t != "" {
+			probe.BookingTime += " " + t
+		}
+		start, end, err := bookingWindow(probe)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		filter, err := parseLocationFilter(r)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		classrooms, err := getAvailableClassrooms(start, end, filter)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		if near := r.URL.Query().Get("near"); near != "" {
+			origin, err := getClassroom(near)
+			if err != nil {
+				writeServiceError(w, r, err)
+				return
+			}
+			if origin == nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			sortByDistance(classrooms, *origin)
+		}
+		j, err := json.Marshal(classrooms)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = w.Write(j)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case http.MethodOptions:
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
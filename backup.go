@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// A backup is NDJSON: a header line naming the tables, one line per row and
+// a summary line after each table, which doubles as progress reporting for
+// whoever is reading the stream.
+
+const backupFormat = "classroom-backup"
+const backupVersion = 1
+
+// backupTables are dumped in foreign key order so they can be restored in
+// the same order.
+var backupTables = []string{"building", "floor", "classroom", "student", "booking"}
+
+type backupHeader struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Tables    []string  `json:"tables"`
+}
+
+type backupLine struct {
+	Table string             `json:"table"`
+	Row   map[string]*string `json:"row,omitempty"`
+	Done  bool               `json:"done,omitempty"`
+	Rows  int                `json:"rows,omitempty"`
+}
+
+// writeBackup dumps backupTables from a single read-only REPEATABLE READ
+// transaction, so all tables come from the same snapshot.
+func writeBackup(ctx context.Context, w io.Writer, progress func(table string, rows int)) error {
+	tx, err := Db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(backupHeader{backupFormat, backupVersion, time.Now().UTC(), backupTables}); err != nil {
+		return err
+	}
+	for _, table := range backupTables {
+		results, err := tx.QueryContext(ctx, `SELECT * FROM `+table)
+		if err != nil {
+			return err
+		}
+		columns, err := results.Columns()
+		if err != nil {
+			results.Close()
+			return err
+		}
+		values := make([]sql.NullString, len(columns))
+		fields := make([]interface{}, len(columns))
+		for i := range values {
+			fields[i] = &values[i]
+		}
+		rows := 0
+		for results.Next() {
+			if err := results.Scan(fields...); err != nil {
+				results.Close()
+				return err
+			}
+			row := make(map[string]*string, len(columns))
+			for i, column := range columns {
+				if values[i].Valid {
+					v := values[i].String
+					row[column] = &v
+				} else {
+					row[column] = nil
+				}
+			}
+			if err := encoder.Encode(backupLine{Table: table, Row: row}); err != nil {
+				results.Close()
+				return err
+			}
+			rows++
+		}
+		results.Close()
+		if err := results.Err(); err != nil {
+			return err
+		}
+		if err := encoder.Encode(backupLine{Table: table, Done: true, Rows: rows}); err != nil {
+			return err
+		}
+		progress(table, rows)
+	}
+	return nil
+}
+
+// restoreBackup replaces the contents of the tables in the backup with the
+// backup's rows in one transaction.
+func restoreBackup(ctx context.Context, r io.Reader, progress func(table string, rows int)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		return errors.New("restore: empty backup")
+	}
+	var header backupHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Format != backupFormat {
+		return errors.New("restore: not a classroom backup")
+	}
+	if header.Version > backupVersion {
+		return fmt.Errorf("restore: backup version %d is newer than supported %d", header.Version, backupVersion)
+	}
+	conn, err := Db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `SET FOREIGN_KEY_CHECKS = 0`); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), `SET FOREIGN_KEY_CHECKS = 1`)
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i := len(header.Tables) - 1; i >= 0; i-- {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+header.Tables[i]); err != nil {
+			return err
+		}
+	}
+	known := make(map[string]bool)
+	for _, table := range backupTables {
+		known[table] = true
+	}
+	rows := 0
+	for scanner.Scan() {
+		var line backupLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return err
+		}
+		if !known[line.Table] {
+			return fmt.Errorf("restore: unknown table %q", line.Table)
+		}
+		if line.Done {
+			if rows != line.Rows {
+				return fmt.Errorf("restore: %s has %d rows, backup says %d", line.Table, rows, line.Rows)
+			}
+			progress(line.Table, rows)
+			rows = 0
+			continue
+		}
+		columns := make([]string, 0, len(line.Row))
+		args := make([]interface{}, 0, len(line.Row))
+		for column, value := range line.Row {
+			columns = append(columns, "`"+strings.ReplaceAll(column, "`", "")+"`")
+			if value == nil {
+				args = append(args, nil)
+			} else {
+				args = append(args, *value)
+			}
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+		if _, err := tx.ExecContext(ctx, `INSERT INTO `+line.Table+` (`+strings.Join(columns, ", ")+`) VALUES (`+placeholders+`)`, args...); err != nil {
+			return err
+		}
+		rows++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func handlerAdminBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="classroom-%s.ndjson"`, time.Now().UTC().Format("20060102T150405")))
+	flusher, _ := w.(http.Flusher)
+	err := writeBackup(r.Context(), w, func(table string, rows int) {
+		log.Printf("backup: %s %d rows", table, rows)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err != nil {
+		// The status line is long gone; a truncated stream without the
+		// final table summary tells the client the backup failed.
+		log.Printf("backup: %v", err)
+		return
+	}
+	recordAudit(r, "admin.backup", "database", "", nil)
+}
+
+// runRestore implements the restore subcommand: restore <file|->.
+func runRestore(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: restore <backup.ndjson|->")
+		os.Exit(2)
+	}
+	in := os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	setupDb()
+	err := restoreBackup(context.Background(), in, func(table string, rows int) {
+		fmt.Fprintf(os.Stderr, "restored %s: %d rows\n", table, rows)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// POST /api/batch runs up to maxBatchOperations booking operations in one
+// transaction, for workflows such as moving a class: cancel one booking and
+// create another in its place. Either every operation is applied or none
+// is. Each operation is checked as its own endpoint would check it first,
+// then all are applied in order, each seeing the ones before it, so a
+// create may take the slot an earlier cancel in the batch frees. Creates
+// don't preempt other bookings here; a higher tier booking that would is a
+// conflict. Creates count against the booker's quota with the bookings the
+// operations before them add and remove. The answer has one result per
+// operation; when the batch fails, the failing operation carries its
+// error, the others 424, and the batch answers with the failing
+// operation's status.
+//
+// Batches run in a database transaction, or in the booking store when it
+// has batches of its own, as the memory one does.
+
+const batchPath = "batch"
+const maxBatchOperations = 10
+
+const (
+	batchCreate     = "create"
+	batchCancel     = "cancel"
+	batchReschedule = "reschedule"
+)
+
+type batchOperation struct {
+	Op        string `json:"op"`
+	BookingId string `json:"booking_id"`
+	// Booking is the booking a create makes, Changes what a reschedule
+	// changes, and Cancel the reason a cancel gives.
+	Booking *bookingRequest    `json:"booking"`
+	Changes *rescheduleRequest `json:"changes"`
+	Cancel  *cancelRequest     `json:"cancel"`
+}
+
+type batchResult struct {
+	Op        string          `json:"op"`
+	Status    int             `json:"status"`
+	BookingId string          `json:"booking_id,omitempty"`
+	Error     json.RawMessage `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Committed bool          `json:"committed"`
+	Results   []batchResult `json:"results"`
+}
+
+// batchStep is an operation checked and ready to apply: before is the
+// booking cancelled or rescheduled, after the booking created or moved.
+type batchStep struct {
+	op     batchOperation
+	before booking
+	after  booking
+	cancel cancelRequest
+}
+
+// batchWriter keeps the answer a check writes for one operation.
+type batchWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBatchWriter() *batchWriter {
+	return &batchWriter{header: make(http.Header)}
+}
+
+func (bw *batchWriter) Header() http.Header {
+	return bw.header
+}
+
+func (bw *batchWriter) WriteHeader(status int) {
+	if bw.status == 0 {
+		bw.status = status
+	}
+}
+
+func (bw *batchWriter) Write(p []byte) (int, error) {
+	if bw.status == 0 {
+		bw.status = http.StatusOK
+	}
+	return bw.body.Write(p)
+}
+
+func (bw *batchWriter) failed() bool {
+	return bw.status >= 300
+}
+
+// checkBatchOperation checks op as its endpoint would, after the steps
+// before it, writing the error to w if it would fail.
+func checkBatchOperation(w http.ResponseWriter, r *http.Request, store BookingRepository, op batchOperation, before []batchStep) (batchStep, bool) {
+	step := batchStep{op: op}
+	if op.Op == batchCreate {
+		if op.Booking == nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_body")
+			return step, false
+		}
+		b := op.Booking.booking()
+		if applyBookingTime(w, r, &b, op.Booking.TimeZone) {
+			return step, false
+		}
+		if owned, ok := store.(ownedBookingRepository); ok && !owned.owns(&b) {
+			w.WriteHeader(http.StatusForbidden)
+			return step, false
+		}
+		if b.BookingDuration < 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid_booking_time")
+			return step, false
+		}
+		if _, _, err := bookingWindow(b); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_booking_time")
+			return step, false
+		}
+		standing, err := getStanding(b.BookingBookerId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return step, false
+		}
+		if standing.Status == standingBlocked {
+			writeBlocked(w, r, standing)
+			return step, false
+		}
+		added, removed := batchChanges(before)
+		if applyBatchQuota(w, r, b, added, removed) {
+			return step, false
+		}
+		b.BookingStatus = standing.bookingStatus(tenantOf(r))
+		if applyGroupBooking(w, r, b) || applyRoomPolicy(w, r, &b) || applyPriority(w, r, &b) || applyPolicyWebhook(w, r, &b) {
+			return step, false
+		}
+		b.BookingPublicId = newPublicId()
+		b.Tenant = tenantOf(r)
+		step.after = b
+		return step, checkBatchHolds(w, r, b)
+	}
+	if op.Op != batchCancel && op.Op != batchReschedule {
+		writeError(w, r, http.StatusBadRequest, "invalid_batch_op", "op", op.Op)
+		return step, false
+	}
+	b, err := resolveBooking(store, op.BookingId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return step, false
+	}
+	if b == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return step, false
+	}
+	step.before = *b
+	if op.Op == batchCancel {
+		if op.Cancel != nil {
+			step.cancel = *op.Cancel
+		}
+		if step.cancel.Reason == "" {
+			step.cancel.Reason = reasonUnspecified
+		}
+		if !cancelReasons[step.cancel.Reason] || utf8.RuneCountInString(step.cancel.Note) > maxCancelNote {
+			writeError(w, r, http.StatusBadRequest, "invalid_cancel_reason")
+			return step, false
+		}
+		if step.cancel.Override && !canOverrideNotice(r) {
+			w.WriteHeader(http.StatusForbidden)
+			return step, false
+		}
+		if notice := insideCancelNotice(*b, time.Now()); notice > 0 && !step.cancel.Override {
+			writeError(w, r, http.StatusConflict, "cancel_notice", "minutes", strconv.Itoa(int(notice.Minutes())))
+			return step, false
+		}
+		return step, true
+	}
+	if op.Changes == nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_body")
+		return step, false
+	}
+	moved := op.Changes.apply(*b)
+	if op.Changes.BookingTime != "" && applyBookingTime(w, r, &moved, op.Changes.TimeZone) {
+		return step, false
+	}
+	if moved.BookingDuration < 0 {
+		writeError(w, r, http.StatusBadRequest, "invalid_booking_time")
+		return step, false
+	}
+	if _, _, err := bookingWindow(moved); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_booking_time")
+		return step, false
+	}
+	added, removed := batchChanges(before)
+	if rejectReschedule(w, r, *b, &moved, op.Changes.Override, added, removed) {
+		return step, false
+	}
+	step.after = moved
+	return step, checkBatchHolds(w, r, moved)
+}
+
+// batchChanges returns the bookings the steps before add and remove, as
+// applyBatchQuota counts them.
+func batchChanges(before []batchStep) ([]booking, []booking) {
+	var added, removed []booking
+	for _, earlier := range before {
+		if earlier.op.Op != batchCreate {
+			removed = append(removed, earlier.before)
+		}
+		if earlier.op.Op != batchCancel {
+			added = append(added, earlier.after)
+		}
+	}
+	return added, removed
+}
+
+func checkBatchHolds(w http.ResponseWriter, r *http.Request, b booking) bool {
+	holds, err := findHoldConflicts(b)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return false
+	}
+	if len(holds) > 0 {
+		writeConflict(w, r, b, nil)
+		return false
+	}
+	return true
+}
+
+// A batchTx applies the steps of a batch, all of them on commit or none.
+type batchTx interface {
+	// cancel removes b, failing with errNotFound if it is gone.
+	cancel(b booking) error
+	// move reschedules b, returning the bookings in its way with a
+	// conflict.
+	move(b booking) ([]booking, error)
+	// create inserts b and returns its id, or the bookings in its way with
+	// a conflict.
+	create(b booking) (int, []booking, error)
+	commit() error
+	// rollback undoes an uncommitted batch; after commit it does nothing.
+	rollback()
+}
+
+// batchBackend is a booking store with batches of its own.
+type batchBackend interface {
+	beginBatch() batchTx
+}
+
+// beginBatch starts a batch in the backend of store, a transaction on the
+// database unless the backend is a batchBackend.
+func beginBatch(ctx context.Context, store BookingRepository) (batchTx, error) {
+	switch s := store.(type) {
+	case dedupBookingRepository:
+		return beginBatch(ctx, s.next)
+	case resilientBookingRepository:
+		return beginBatch(ctx, s.next)
+	case ownedBookingRepository:
+		return beginBatch(ctx, s.next)
+	case batchBackend:
+		return s.beginBatch(), nil
+	}
+	tx, err := Db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	return sqlBatch{ctx, tx}, nil
+}
+
+type sqlBatch struct {
+	ctx context.Context
+	tx  *sql.Tx
+}
+
+func (s sqlBatch) cancel(b booking) error {
+	where, args := whereClause([]condition{colBookingId.eq(b.BookingId)})
+	result, err := s.tx.ExecContext(s.ctx, `DELETE FROM booking`+where, args...)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	if removed, err := result.RowsAffected(); err != nil || removed == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s sqlBatch) move(b booking) ([]booking, error) {
+	return moveBookingTx(s.ctx, s.tx, b)
+}
+
+func (s sqlBatch) create(b booking) (int, []booking, error) {
+	conflicts, err := lockedConflicts(s.ctx, s.tx, b)
+	if err == nil && len(conflicts) > 0 {
+		err = errConflict
+	}
+	if err != nil {
+		return 0, conflicts, err
+	}
+	bookingId, err := insertBookingRow(s.ctx, s.tx, b)
+	if isDuplicateKey(err) {
+		return 0, nil, errConflict
+	}
+	return bookingId, nil, err
+}
+
+func (s sqlBatch) commit() error {
+	return s.tx.Commit()
+}
+
+func (s sqlBatch) rollback() {
+	s.tx.Rollback()
+}
+
+// applyBatchStep applies step in tx, returning the booking created, moved
+// or cancelled, and if it fails, the bookings in its way.
+func applyBatchStep(tx batchTx, step batchStep) (booking, []booking, error) {
+	switch step.op.Op {
+	case batchCancel:
+		// errNotFound: cancelled since the check.
+		return step.before, nil, tx.cancel(step.before)
+	case batchReschedule:
+		conflicts, err := tx.move(step.after)
+		return step.after, conflicts, err
+	}
+	b := step.after
+	bookingId, conflicts, err := tx.create(b)
+	b.BookingId = bookingId
+	return b, conflicts, err
+}
+
+// writeBatchFailure answers a batch whose operation failed with the error
+// bw holds for it.
+func writeBatchFailure(w http.ResponseWriter, ops []batchOperation, failed int, bw *batchWriter) {
+	results := make([]batchResult, len(ops))
+	for i, op := range ops {
+		results[i] = batchResult{Op: op.Op, Status: http.StatusFailedDependency}
+	}
+	results[failed].Status = bw.status
+	if json.Valid(bw.body.Bytes()) {
+		results[failed].Error = json.RawMessage(bw.body.Bytes())
+	}
+	j, err := json.Marshal(batchResponse{false, results})
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.WriteHeader(bw.status)
+	w.Write(j)
+}
+
+func handlerBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var request struct {
+		Operations []batchOperation `json:"operations"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_body")
+		return
+	}
+	ops := request.Operations
+	if len(ops) == 0 || len(ops) > maxBatchOperations {
+		writeError(w, r, http.StatusBadRequest, "invalid_batch_size", "max", strconv.Itoa(maxBatchOperations))
+		return
+	}
+	store := bookingStoreFor(r)
+	steps := make([]batchStep, len(ops))
+	for i, op := range ops {
+		bw := newBatchWriter()
+		step, ok := checkBatchOperation(bw, r, store, op, steps[:i])
+		if !ok || bw.failed() {
+			writeBatchFailure(w, ops, i, bw)
+			return
+		}
+		steps[i] = step
+	}
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	tx, err := beginBatch(ctx, store)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	defer tx.rollback()
+	applied := make([]booking, len(steps))
+	for i, step := range steps {
+		b, conflicts, err := applyBatchStep(tx, step)
+		if err != nil {
+			tx.rollback()
+			bw := newBatchWriter()
+			if isConflict(err) {
+				writeConflict(bw, r, b, conflicts)
+			} else {
+				writeServiceError(bw, r, err)
+			}
+			writeBatchFailure(w, ops, i, bw)
+			return
+		}
+		applied[i] = b
+	}
+	if err := tx.commit(); err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	results := make([]batchResult, len(steps))
+	var historyErr error
+	for i, step := range steps {
+		b := applied[i]
+		b.ActedBy, b.RequestId = actedBy(r), requestIdOf(r)
+		b.Tenant = tenantOf(r)
+		results[i] = batchResult{Op: step.op.Op, Status: http.StatusOK, BookingId: b.publicId()}
+		event := eventBookingCreated
+		switch step.op.Op {
+		case batchCreate:
+			results[i].Status = http.StatusCreated
+			recordUsage(r, usageBooking)
+		case batchCancel:
+			event = eventBookingCancelled
+			recordUsage(r, usageCancellation)
+			recordCancellation(b)
+			recordAudit(r, "booking.cancel", "booking", b.publicId(), step.cancel)
+		case batchReschedule:
+			event = eventBookingRescheduled
+			if updated, err := store.GetBooking(b.BookingId); err == nil && updated != nil {
+				b = *updated
+				b.ActedBy, b.RequestId = actedBy(r), requestIdOf(r)
+				b.Tenant = tenantOf(r)
+			}
+			recordAudit(r, "booking.reschedule", "booking", b.publicId(), map[string]interface{}{
+				"from": newBookingResponse(step.before),
+				"to":   newBookingResponse(b),
+			})
+			b.Previous = &step.before
+		}
+		if err := dispatchBookingEvent(event, b); err != nil && historyErr == nil {
+			historyErr = err
+		}
+	}
+	if historyErr != nil {
+		writeServiceError(w, r, historyErr)
+		return
+	}
+	j, err := json.Marshal(batchResponse{true, results})
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}
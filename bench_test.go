@@ -0,0 +1,194 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The benchmarks of the booking store, the layer every query path goes
+// through, run against the memory store:
+//
+//	go test -run '^$' -bench . -benchmem
+//
+// or with BENCH_STORAGE=mysql against the BOOKING_STORE backend, which
+// needs a migrated database they may write to. They seed BENCH_BOOKINGS
+// (default 1000) bookings across BENCH_CLASSROOMS, in the synthetic slots
+// of loadtest, and remove what they inserted when done. Results compare
+// with benchstat.
+
+// benchFixture is what the benchmarks run against.
+type benchFixture struct {
+	store      BookingRepository
+	classrooms []string
+	start      time.Time
+	ids        []int
+	publicIds  []string
+	// next is the next synthetic slot free to insert into.
+	next int
+}
+
+const benchBooker = "bench"
+
+var (
+	benchOnce    sync.Once
+	benchShared  *benchFixture
+	benchFailure error
+)
+
+// fixture returns the seeded fixture every benchmark shares, setting up
+// the store on first use.
+func fixture(b *testing.B) *benchFixture {
+	benchOnce.Do(func() {
+		store := envString("BOOKING_STORE", storageMysql)
+		switch envString("BENCH_STORAGE", storageMemory) {
+		case storageMysql:
+			setupDb()
+			if benchFailure = checkMigrated(); benchFailure != nil {
+				return
+			}
+		default:
+			setupMemoryDb()
+			store = storageMemory
+		}
+		if benchFailure = setupBookingStore(store); benchFailure != nil {
+			return
+		}
+		bookings, err := strconv.Atoi(envString("BENCH_BOOKINGS", "1000"))
+		if err != nil || bookings < 1 {
+			bookings = 1000
+		}
+		benchShared = &benchFixture{store: bookingStore, classrooms: strings.Split(envString("BENCH_CLASSROOMS", "bench-1,bench-2,bench-3,bench-4"), ","), start: time.Now().AddDate(2, 0, 0)}
+		benchFailure = benchShared.seed(bookings)
+	})
+	if benchFailure != nil {
+		b.Fatal(benchFailure)
+	}
+	b.ReportAllocs()
+	return benchShared
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if benchShared != nil {
+		if failed := benchShared.cleanUp(); failed > 0 {
+			os.Stderr.WriteString(strconv.Itoa(failed) + " bookings inserted could not be removed\n")
+		}
+	}
+	os.Exit(code)
+}
+
+// insert books the next free synthetic slot.
+func (f *benchFixture) insert() (int, error) {
+	classroom, bookingTime := syntheticSlot(f.next, f.classrooms, f.start)
+	f.next++
+	return f.store.InsertBooking(booking{BookingTime: bookingTime, BookingClassroomId: classroom, BookingBookerId: benchBooker, BookingDuration: 30, BookingTitle: "bench", BookingStatus: bookingStatusConfirmed, BookingPublicId: newPublicId()})
+}
+
+func (f *benchFixture) seed(bookings int) error {
+	for len(f.ids) < bookings {
+		id, err := f.insert()
+		if err != nil {
+			return err
+		}
+		f.ids = append(f.ids, id)
+	}
+	for _, id := range f.ids {
+		b, err := f.store.GetBooking(id)
+		if err != nil {
+			return err
+		}
+		f.publicIds = append(f.publicIds, b.BookingPublicId)
+	}
+	return nil
+}
+
+// cleanUp removes every booking inserted, reporting how many it couldn't.
+func (f *benchFixture) cleanUp() int {
+	failed := 0
+	for _, id := range f.ids {
+		if err := f.store.RemoveBooking(id); err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+func BenchmarkGetBooking(b *testing.B) {
+	f := fixture(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.store.GetBooking(f.ids[i%len(f.ids)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetBookingByPublicId(b *testing.B) {
+	f := fixture(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.store.GetBookingByPublicId(f.publicIds[i%len(f.publicIds)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetBooker(b *testing.B) {
+	f := fixture(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.store.GetBooker(benchBooker); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetBookingList(b *testing.B) {
+	f := fixture(b)
+	b.Run("classroom", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := f.store.GetBookingList(bookingFilter{ClassroomId: f.classrooms[i%len(f.classrooms)]}, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("day", func(b *testing.B) {
+		b.ReportAllocs()
+		days := len(f.ids)/(10*len(f.classrooms)) + 1
+		for i := 0; i < b.N; i++ {
+			day := f.start.AddDate(0, 0, i%days).Format(bookingDateLayout)
+			if _, err := f.store.GetBookingList(bookingFilter{From: day, To: day}, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("fields", func(b *testing.B) {
+		b.ReportAllocs()
+		fields, err := projectBookingFields([]string{"booking_id", "booking_time"})
+		if err != nil {
+			b.Fatal(err)
+		}
+		for i := 0; i < b.N; i++ {
+			if _, err := f.store.GetBookingList(bookingFilter{ClassroomId: f.classrooms[i%len(f.classrooms)]}, fields); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkInsertBooking(b *testing.B) {
+	f := fixture(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		id, err := f.insert()
+		if err != nil {
+			b.Fatal(err)
+		}
+		f.ids = append(f.ids, id)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+)
+
+const bookingTimeLayout = "2006-01-02 15:04"
+const bookingDateLayout = "2006-01-02"
+
+// bookingLocation is the time zone booking times are written in. They are
+// stored as wall clock text without an offset.
+var bookingLocation = loadBookingLocation()
+
+func loadBookingLocation() *time.Location {
+	location, err := time.LoadLocation(envString("BOOKING_TIMEZONE", "Asia/Bangkok"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return location
+}
+
+// parseBookingTime accepts both the original date-only booking times and
+// the minute precision times used by bookings with a duration.
+func parseBookingTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == len(bookingDateLayout) {
+		return time.ParseInLocation(bookingDateLayout, s, bookingLocation)
+	}
+	return time.ParseInLocation(bookingTimeLayout, s, bookingLocation)
+}
+
+var (
+	errBookingTimeFormat = errors.New("booking time is in none of the accepted formats")
+	// errBookingTimeAmbiguous and errBookingTimeSkipped are local times a
+	// daylight saving change repeats or skips.
+	errBookingTimeAmbiguous = errors.New("booking time is repeated by a daylight saving change")
+	errBookingTimeSkipped   = errors.New("booking time is skipped by a daylight saving change")
+)
+
+// zonedTimeLayouts are the accepted booking times without an offset, read
+// in the zone a client names.
+var zonedTimeLayouts = []string{bookingTimeLayout, "2006-01-02T15:04", wallClockLayout, "2006-01-02T15:04:05"}
+
+const wallClockLayout = "2006-01-02 15:04:05"
+
+// normalizeBookingTime turns a booking time a client sent into the form it
+// is stored in. A date, a whole-day booking, is kept as it is. Any other
+// time is resolved to its instant in UTC first: RFC 3339 times and epoch
+// seconds name one, and times without an offset, as stored or with a T or
+// seconds, are read in zone, which defaults to the booking time zone. A
+// local time a daylight saving change repeats or skips names two instants
+// or none and is refused. Times must fall on a whole minute. Anything
+// else, such as 01/02/2006, could be read more than one way and is
+// refused. The instant is stored as wall clock time in the booking time
+// zone, the form the date filters and the slot key of the booking table
+// read.
+func normalizeBookingTime(s string, zone *time.Location) (string, error) {
+	s = strings.TrimSpace(s)
+	if zone == nil {
+		zone = bookingLocation
+	}
+	var t time.Time
+	var err error
+	if seconds, convErr := strconv.ParseInt(s, 10, 64); convErr == nil && len(s) >= 9 {
+		t = time.Unix(seconds, 0)
+	} else if len(s) == len(bookingDateLayout) {
+		if _, err := time.Parse(bookingDateLayout, s); err != nil {
+			return "", errBookingTimeFormat
+		}
+		return s, nil
+	} else if t, err = time.Parse(time.RFC3339, s); err != nil {
+		for _, layout := range zonedTimeLayouts {
+			var wall time.Time
+			if wall, err = time.Parse(layout, s); err == nil {
+				t, err = localInstant(wall, zone)
+				break
+			}
+		}
+		if err != nil && err != errBookingTimeAmbiguous && err != errBookingTimeSkipped {
+			err = errBookingTimeFormat
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if t = t.UTC(); t.Second() != 0 || t.Nanosecond() != 0 {
+		return "", errBookingTimeFormat
+	}
+	return t.In(bookingLocation).Format(bookingTimeLayout), nil
+}
+
+// localInstant is the one instant at which the clocks of zone show wall,
+// a time read without an offset.
+func localInstant(wall time.Time, zone *time.Location) (time.Time, error) {
+	var found []time.Time
+	// The offsets in effect half a day either side are the ones wall could
+	// be in, two if a daylight saving change falls between them.
+	for _, probe := range []time.Duration{-12 * time.Hour, 12 * time.Hour} {
+		_, offset := wall.Add(probe).In(zone).Zone()
+		t := wall.Add(-time.Duration(offset) * time.Second)
+		if t.In(zone).Format(wallClockLayout) == wall.Format(wallClockLayout) && (len(found) == 0 || !found[0].Equal(t)) {
+			found = append(found, t)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return time.Time{}, errBookingTimeSkipped
+	case 1:
+		return found[0], nil
+	}
+	return time.Time{}, errBookingTimeAmbiguous
+}
+
+// bookingWindow returns the interval a booking occupies. A zero duration is
+// a whole-day booking, which is what every booking was before durations.
+func bookingWindow(b booking) (time.Time, time.Time, error) {
+	start, err := parseBookingTime(b.BookingTime)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if b.BookingDuration == 0 {
+		start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, start.Location())
+		return start, start.AddDate(0, 0, 1), nil
+	}
+	return start, start.Add(time.Duration(b.BookingDuration) * time.Minute), nil
+}
+
+func overlaps(start, end, otherStart, otherEnd time.Time) bool {
+	return start.Before(otherEnd) && otherStart.Before(end)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizeBookingTime(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bangkok, err := time.LoadLocation("Asia/Bangkok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := bookingLocation
+	bookingLocation = bangkok
+	defer func() { bookingLocation = previous }()
+	for _, test := range []struct {
+		in   string
+		zone *time.Location
+		want string
+		err  error
+	}{
+		{"2026-03-02", nil, "2026-03-02", nil},
+		{"2026-03-02 10:00", nil, "2026-03-02 10:00", nil},
+		{"2026-03-02T10:00", nil, "2026-03-02 10:00", nil},
+		{"2026-03-02 10:00:00", nil, "2026-03-02 10:00", nil},
+		{"2026-03-02T03:00:00Z", nil, "2026-03-02 10:00", nil},
+		{"2026-03-02T10:00:00+07:00", newYork, "2026-03-02 10:00", nil},
+		{"1772420400", nil, "2026-03-02 10:00", nil},
+		{"2026-03-01 22:00", newYork, "2026-03-02 10:00", nil},
+		{"2026-07-01 23:00", newYork, "2026-07-02 10:00", nil},
+		{"2026-03-08 02:30", newYork, "", errBookingTimeSkipped},
+		{"2026-11-01 01:30", newYork, "", errBookingTimeAmbiguous},
+		{"2026-11-01 02:30", newYork, "2026-11-01 14:30", nil},
+		{"2026-03-02 10:00:30", nil, "", errBookingTimeFormat},
+		{"02/03/2026", nil, "", errBookingTimeFormat},
+		{"2026-13-02", nil, "", errBookingTimeFormat},
+	} {
+		got, err := normalizeBookingTime(test.in, test.zone)
+		if got != test.want || err != test.err {
+			t.Errorf("normalizeBookingTime(%q, %v) = %q, %v, want %q, %v", test.in, test.zone, got, err, test.want, test.err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A fresh deployment has no admin key to create the others with. POST
+// /api/bootstrap, authorized with "Authorization: Bearer <BOOTSTRAP_TOKEN>",
+// creates the first one, so provisioning needs no manual SQL: the body may
+// carry {"api_key": "..."} to choose it, otherwise one is generated and
+// answered once. The endpoint works only while no admin key exists and
+// only once; the bootstrap table remembers it ran, so deleting every admin
+// key later doesn't open it again. Without BOOTSTRAP_TOKEN it is not found.
+
+const bootstrapPath = "bootstrap"
+const minApiKeyLength = 32
+
+var errBootstrapped = errors.New("already bootstrapped")
+
+type bootstrapResult struct {
+	ApiKey string `json:"api_key"`
+	Role   string `json:"role"`
+}
+
+func newApiKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// bootstrapAdmin stores key as the first admin key, failing with
+// errBootstrapped if the service was bootstrapped before or has an admin.
+func bootstrapAdmin(key string) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	tx, err := Db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	defer tx.Rollback()
+	var admins int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM api_key WHERE api_key_role = ? FOR UPDATE`, roleAdmin).Scan(&admins); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	if admins > 0 {
+		return errBootstrapped
+	}
+	// The primary key lets one bootstrap through, however many race.
+	if _, err := tx.ExecContext(ctx, `INSERT INTO bootstrap (bootstrap_id, bootstrapped_at) VALUES (1, UTC_TIMESTAMP())`); isDuplicateKey(err) {
+		return errBootstrapped
+	} else if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO api_key (api_key_hash, api_key_role) VALUES (?, ?)`, hashApiKey(key), roleAdmin); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return tx.Commit()
+}
+
+func handlerBootstrap(w http.ResponseWriter, r *http.Request) {
+	token := envString("BOOTSTRAP_TOKEN", "")
+	if token == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var request struct {
+		ApiKey string `json:"api_key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		writeError(w, r, http.StatusBadRequest, "invalid_body")
+		return
+	}
+	key := request.ApiKey
+	if key == "" {
+		var err error
+		if key, err = newApiKey(); err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+	} else if len(key) < minApiKeyLength {
+		writeError(w, r, http.StatusBadRequest, "api_key_too_short", "min", strconv.Itoa(minApiKeyLength))
+		return
+	}
+	err := bootstrapAdmin(key)
+	if errors.Is(err, errBootstrapped) {
+		writeError(w, r, http.StatusGone, "bootstrapped")
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	apiKeyCache.Lock()
+	delete(apiKeyCache.keys, hashApiKey(key))
+	apiKeyCache.Unlock()
+	recordAudit(r, "service.bootstrap", "api_key", "", nil)
+	j, err := json.Marshal(bootstrapResult{key, roleAdmin})
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(j)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var errCircuitOpen = errors.New("database circuit breaker is open")
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+var (
+	breakerStateGauge = newGauge("db_circuit_breaker_state", "1 for the current state of the database circuit breaker.", "state")
+	dbRetriesTotal    = newCounter("db_retries_total", "Database calls retried after a transient error.", "op")
+	dbRejectedTotal   = newCounter("db_rejected_total", "Database calls rejected by the open circuit breaker.", "op")
+)
+
+// circuitBreaker opens after Threshold consecutive infrastructure failures
+// and then fails fast for Cooldown, after which a single trial call decides
+// whether to close again.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+var dbBreaker = newCircuitBreaker()
+
+func newCircuitBreaker() *circuitBreaker {
+	b := &circuitBreaker{state: breakerClosed}
+	b.report()
+	return b
+}
+
+func (b *circuitBreaker) report() {
+	for _, state := range []string{breakerClosed, breakerOpen, breakerHalfOpen} {
+		value := 0.0
+		if state == b.state {
+			value = 1
+		}
+		breakerStateGauge.Set(value, state)
+	}
+}
+
+func (b *circuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && time.Since(b.openedAt) >= envDuration("DB_BREAKER_COOLDOWN", 10*time.Second) {
+		return breakerHalfOpen
+	}
+	return b.state
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < envDuration("DB_BREAKER_COOLDOWN", 10*time.Second) {
+			return false
+		}
+		b.state, b.trial = breakerHalfOpen, true
+		b.report()
+		return true
+	case breakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	}
+	return true
+}
+
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if err == nil || !isInfrastructureError(err) {
+		if b.state != breakerClosed {
+			log.Println("database circuit breaker closed")
+		}
+		b.state, b.failures = breakerClosed, 0
+		b.report()
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= envInt("DB_BREAKER_THRESHOLD", 5) {
+		if b.state != breakerOpen {
+			log.Printf("database circuit breaker open: %v", err)
+		}
+		b.state, b.openedAt = breakerOpen, time.Now()
+		b.report()
+	}
+}
+
+// isTransientError reports errors worth retrying: deadlocks, lock wait
+// timeouts and dropped connections.
+func isTransientError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1213 || mysqlErr.Number == 1205
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+// isInfrastructureError tells database trouble apart from errors caused by
+// the request itself, such as a duplicate key, which must not trip the
+// breaker.
+func isInfrastructureError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return isTransientError(err)
+	}
+	return !errors.Is(err, sql.ErrNoRows) && !errors.Is(err, errNoSeats)
+}
+
+// withRetry runs fn through the breaker, retrying transient errors up to
+// DB_RETRIES times with full jitter backoff.
+func withRetry(b *circuitBreaker, op string, fn func() error) error {
+	attempts := envInt("DB_RETRIES", 2) + 1
+	backoff := 50 * time.Millisecond
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if !b.allow() {
+			dbRejectedTotal.Inc(op)
+			return errCircuitOpen
+		}
+		err = fn()
+		b.record(err)
+		if err == nil || !isTransientError(err) {
+			return err
+		}
+		if attempt < attempts-1 {
+			dbRetriesTotal.Inc(op)
+			time.Sleep(time.Duration(rand.Int63n(int64(backoff))))
+			backoff *= 2
+		}
+	}
+	return err
+}
+
+// resilientBookingRepository guards another repository with the breaker and
+// retry policy.
+type resilientBookingRepository struct {
+	next    BookingRepository
+	breaker *circuitBreaker
+}
+
+func (r resilientBookingRepository) GetBooking(bookingId int) (*booking, error) {
+	var result *booking
+	err := withRetry(r.breaker, "get_booking", func() (err error) {
+		result, err = r.next.GetBooking(bookingId)
+		return err
+	})
+	return result, err
+}
+
+func (r resilientBookingRepository) GetBookingByPublicId(publicId string) (*booking, error) {
+	var result *booking
+	err := withRetry(r.breaker, "get_booking_by_public_id", func() (err error) {
+		result, err = r.next.GetBookingByPublicId(publicId)
+		return err
+	})
+	return result, err
+}
+
+func (r resilientBookingRepository) GetBooker(bookerId string) ([]booking, error) {
+	var result []booking
+	err := withRetry(r.breaker, "get_booker", func() (err error) {
+		result, err = r.next.GetBooker(bookerId)
+		return err
+	})
+	return result, err
+}
+
+func (r resilientBookingRepository) GetBookingList(filter bookingFilter, fields []bookingField) ([]booking, error) {
+	var result []booking
+	err := withRetry(r.breaker, "get_booking_list", func() (err error) {
+		result, err = r.next.GetBookingList(filter, fields)
+		return err
+	})
+	return result, err
+}
+
+// InsertBooking is not retried: a lost connection may still have committed
+// the insert, and a retry would then book the slot twice.
+func (r resilientBookingRepository) InsertBooking(b booking) (int, error) {
+	if !r.breaker.allow() {
+		dbRejectedTotal.Inc("insert_booking")
+		return 0, errCircuitOpen
+	}
+	bookingId, err := r.next.InsertBooking(b)
+	r.breaker.record(err)
+	return bookingId, err
+}
+
+func (r resilientBookingRepository) RemoveBooking(bookingId int) error {
+	return withRetry(r.breaker, "remove_booking", func() error {
+		return r.next.RemoveBooking(bookingId)
+	})
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type building struct {
+	BuildingId   int     `json:"building_id"`
+	BuildingName string  `json:"building_name"`
+	Floors       []floor `json:"floors,omitempty"`
+}
+
+type floor struct {
+	FloorId         int    `json:"floor_id"`
+	FloorBuildingId int    `json:"floor_building_id"`
+	FloorLevel      int    `json:"floor_level"`
+	FloorName       string `json:"floor_name"`
+}
+
+const buildingPath = "buildings"
+const floorPath = "floors"
+
+func getBuilding(buildingId int) (*building, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	row := Db.QueryRowContext(ctx, `SELECT building_id, building_name FROM building WHERE building_id = ?`, buildingId)
+	building := &building{}
+	err := row.Scan(&building.BuildingId, &building.BuildingName)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	building.Floors, err = getFloorList(buildingId)
+	if err != nil {
+		return nil, err
+	}
+	return building, nil
+}
+
+func getBuildingList() ([]building, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT building_id, building_name FROM building ORDER BY building_name`)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	buildings := make([]building, 0)
+	for results.Next() {
+		var building building
+		if err := results.Scan(&building.BuildingId, &building.BuildingName); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		buildings = append(buildings, building)
+	}
+	return buildings, results.Err()
+}
+
+func insertBuilding(building building) (int, error) {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	result, err := Db.ExecContext(ctx, `INSERT INTO building (building_name) VALUES (?)`, building.BuildingName)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+	insertId, err := result.LastInsertId()
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+	return int(insertId), nil
+}
+
+func removeBuilding(buildingId int) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `DELETE FROM building WHERE building_id = ?`, buildingId)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+func getFloorList(buildingId int) ([]floor, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	query := `SELECT floor_id, floor_building_id, floor_level, floor_name FROM floor`
+	args := []interface{}{}
+	if buildingId != 0 {
+		query += ` WHERE floor_building_id = ?`
+		args = append(args, buildingId)
+	}
+	results, err := Db.QueryContext(ctx, query+` ORDER BY floor_building_id, floor_level`, args...)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	floors := make([]floor, 0)
+	for results.Next() {
+		var floor floor
+		if err := results.Scan(&floor.FloorId, &floor.FloorBuildingId, &floor.FloorLevel, &floor.FloorName); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		floors = append(floors, floor)
+	}
+	return floors, results.Err()
+}
+
+func insertFloor(floor floor) (int, error) {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	result, err := Db.ExecContext(ctx, `INSERT INTO floor (floor_building_id, floor_level, floor_name) VALUES (?, ?, ?)`, floor.FloorBuildingId, floor.FloorLevel, floor.FloorName)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+	insertId, err := result.LastInsertId()
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+	return int(insertId), nil
+}
+
+func handlerBuildings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		buildingList, err := getBuildingList()
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		j, err := json.Marshal(buildingList)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = w.Write(j)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case http.MethodPost:
+		requireApiKey(http.HandlerFunc(handlerBuildingsPost), roleAdmin).ServeHTTP(w, r)
+	case http.MethodOptions:
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func handlerBuildingsPost(w http.ResponseWriter, r *http.Request) {
+	var building building
+	err := json.NewDecoder(r.Body).Decode(&building)
+	if err != nil || building.BuildingName == "" {
+		log.Print(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	buildingId, err := insertBuilding(building)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(fmt.Sprintf(`{"building_id":%d}`, buildingId)))
+}
+
+func handlerBuilding(w http.ResponseWriter, r *http.Request) {
+	urlPathSegments := strings.Split(r.URL.Path, fmt.Sprintf("%s/", buildingPath))
+	urlPathSegments = strings.Split(urlPathSegments[len(urlPathSegments)-1], "/")
+	buildingId, err := strconv.Atoi(urlPathSegments[0])
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if len(urlPathSegments) == 2 && urlPathSegments[1] == floorPath {
+		handlerBuildingFloors(w, r, buildingId)
+		return
+	} else if len(urlPathSegments) > 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		building, err := getBuilding(buildingId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		if building == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		j, err := json.Marshal(building)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		_, err = w.Write(j)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case http.MethodDelete:
+		requireApiKey(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := removeBuilding(buildingId); err != nil {
+				writeServiceError(w, r, err)
+			}
+		}), roleAdmin).ServeHTTP(w, r)
+	case http.MethodOptions:
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func handlerBuildingFloors(w http.ResponseWriter, r *http.Request, buildingId int) {
+	switch r.Method {
+	case http.MethodGet:
+		floorList, err := getFloorList(buildingId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		j, err := json.Marshal(floorList)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = w.Write(j)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case http.MethodPost:
+		requireApiKey(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlerBuildingFloorsPost(w, r, buildingId)
+		}), roleAdmin).ServeHTTP(w, r)
+	case http.MethodOptions:
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func handlerBuildingFloorsPost(w http.ResponseWriter, r *http.Request, buildingId int) {
+	var floor floor
+	err := json.NewDecoder(r.Body).Decode(&floor)
+	if err != nil || floor.FloorName == "" {
+		log.Print(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	floor.FloorBuildingId = buildingId
+	floorId, err := insertFloor(floor)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(fmt.Sprintf(`{"floor_id":%d}`, floorId)))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+const bulkDeleteBatch = 200
+
+// bulkFilter selects the bookings of one classroom, optionally between two
+// dates inclusive, for DELETE /api/bookings.
+type bulkFilter struct {
+	ClassroomId string
+	From        string
+	To          string
+}
+
+func parseBulkFilter(r *http.Request) (bulkFilter, bool) {
+	query := r.URL.Query()
+	filter := bulkFilter{ClassroomId: query.Get("classroom"), From: query.Get("from"), To: query.Get("to")}
+	if filter.ClassroomId == "" {
+		return filter, false
+	}
+	for _, date := range []string{filter.From, filter.To} {
+		if _, err := time.Parse(bookingDateLayout, date); date != "" && err != nil {
+			return filter, false
+		}
+	}
+	return filter, true
+}
+
+func (filter bulkFilter) where() []condition {
+	return bookingFilter{ClassroomId: filter.ClassroomId, From: filter.From, To: filter.To}.where()
+}
+
+func countBookings(filter bulkFilter) (int, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	query, args := newQuery(`SELECT COUNT(*) FROM booking`).where(filter.where()...).build()
+	var count int
+	err := Db.QueryRowContext(ctx, query, args...).Scan(&count)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+	return count, nil
+}
+
+// deleteBookingBatch removes up to bulkDeleteBatch matching bookings in one
+// transaction and returns them.
+func deleteBookingBatch(filter bulkFilter) ([]booking, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tx, err := Db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	query, args := selectBookings(bookingColumns).where(filter.where()...).order("booking_id").limitTo(bulkDeleteBatch).lockForUpdate().build()
+	results, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	bookings, err := scanBookings(results, bookingFields, bulkDeleteBatch)
+	results.Close()
+	if err != nil || len(bookings) == 0 {
+		return nil, err
+	}
+	ids := make([]interface{}, len(bookings))
+	for i, b := range bookings {
+		ids[i] = b.BookingId
+	}
+	where, args := whereClause([]condition{colBookingId.in(ids...)})
+	if _, err := tx.ExecContext(ctx, `DELETE FROM booking`+where, args...); err != nil {
+		return nil, err
+	}
+	return bookings, tx.Commit()
+}
+
+// handlerBookingsDelete serves DELETE /api/bookings?classroom=&from=&to=.
+// It needs confirm=true, or dry_run=true to only count what would go. The
+// bookings are cancelled in batches, each booker being notified, but no
+// late cancellation penalty is recorded since the booker didn't cancel.
+func handlerBookingsDelete(w http.ResponseWriter, r *http.Request) {
+	filter, ok := parseBulkFilter(r)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, "invalid_bulk_filter")
+		return
+	}
+	query := r.URL.Query()
+	dryRun := query.Get("dry_run") == "true"
+	if !dryRun && query.Get("confirm") != "true" {
+		writeError(w, r, http.StatusBadRequest, "confirm_required")
+		return
+	}
+	affected := 0
+	if dryRun {
+		count, err := countBookings(filter)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		affected = count
+	} else {
+		var historyErr error
+		for {
+			bookings, err := deleteBookingBatch(filter)
+			if err != nil {
+				log.Printf("bulk delete: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if len(bookings) == 0 {
+				break
+			}
+			affected += len(bookings)
+			for _, b := range bookings {
+				b.RequestId = requestIdOf(r)
+				b.Tenant = tenantOf(r)
+				if err := dispatchBookingEvent(eventBookingCancelled, b); err != nil && historyErr == nil {
+					historyErr = err
+				}
+			}
+		}
+		recordAudit(r, "booking.bulk_delete", "classroom", filter.ClassroomId, map[string]interface{}{"from": filter.From, "to": filter.To, "deleted": affected})
+		if historyErr != nil {
+			writeServiceError(w, r, historyErr)
+			return
+		}
+	}
+	j, err := json.Marshal(map[string]interface{}{"affected": affected, "dry_run": dryRun})
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Read endpoints that answer the same to everyone can be served by a CDN or
+// Varnish in front of the service. Their mounts carry a cachePolicy: GET
+// responses are public for MaxAge and tagged with Surrogate-Key headers,
+// the policy's Key and Key/{id} for the resource under it. Everything else
+// is no-store. Writes through a cacheable mount, and booking changes, purge
+// the keys they affect at CACHE_PURGE_URL, as does POST
+// /admin/cache/purge.
+//
+// The purge is a CACHE_PURGE_METHOD (default PURGE) request carrying the
+// keys, space separated, in the CACHE_PURGE_HEADER header (default
+// Surrogate-Key), and CACHE_PURGE_TOKEN as a bearer token if set.
+
+const cachePath = "cache"
+
+// cacheVary lists the request headers responses differ by.
+const cacheVary = "Origin, Accept, Accept-Language, X-API-Schema, X-Tenant-ID"
+
+type cachePolicy struct {
+	MaxAge time.Duration
+	Key    string
+}
+
+var cachePurgeClient = &http.Client{Timeout: 5 * time.Second}
+
+func init() {
+	bookingEventHandlers = append(bookingEventHandlers, purgeBookingEvent)
+}
+
+// surrogateKeys returns the keys of a request to mountPath, a mount such as
+// /api/classrooms/ that serves the resources under it.
+func (p cachePolicy) surrogateKeys(mountPath string, path string) []string {
+	keys := []string{p.Key}
+	if strings.HasSuffix(mountPath, "/") {
+		if id := strings.Split(strings.TrimPrefix(path, mountPath), "/")[0]; id != "" {
+			keys = append(keys, p.Key+"/"+id)
+		}
+	}
+	return keys
+}
+
+// noStore keeps a response of a cacheable mount out of caches, for
+// handlers serving private data under it.
+func noStore(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Del("Surrogate-Key")
+}
+
+// cacheWriter drops the caching headers from error responses.
+type cacheWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (cw *cacheWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+		if status >= 300 && status != http.StatusNotModified {
+			noStore(cw.ResponseWriter)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *cacheWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *cacheWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(cw.ResponseWriter)
+}
+
+// cacheMiddleware sets the caching headers of m's responses and purges
+// what writes through m change. Handlers may override the headers.
+func cacheMiddleware(m mount, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", cacheVary)
+		if m.Cache.MaxAge <= 0 {
+			w.Header().Set("Cache-Control", "no-store")
+			handler.ServeHTTP(w, r)
+			return
+		}
+		keys := m.Cache.surrogateKeys(m.Path, r.URL.Path)
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(m.Cache.MaxAge.Seconds())))
+			w.Header().Set("Surrogate-Key", strings.Join(keys, " "))
+			handler.ServeHTTP(&cacheWriter{ResponseWriter: w}, r)
+		case http.MethodOptions:
+			handler.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Cache-Control", "no-store")
+			cw := &cacheWriter{ResponseWriter: w}
+			handler.ServeHTTP(cw, r)
+			if cw.status < 300 {
+				go purgeSurrogateKeys(keys)
+			}
+		}
+	})
+}
+
+// purgeSurrogateKeys asks the cache in front of the service to drop every
+// response tagged with one of keys.
+func purgeSurrogateKeys(keys []string) error {
+	target := envString("CACHE_PURGE_URL", "")
+	if target == "" || len(keys) == 0 {
+		return nil
+	}
+	req, err := http.NewRequest(envString("CACHE_PURGE_METHOD", "PURGE"), target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(envString("CACHE_PURGE_HEADER", "Surrogate-Key"), strings.Join(keys, " "))
+	if token := envString("CACHE_PURGE_TOKEN", ""); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := cachePurgeClient.Do(req)
+	if err != nil {
+		log.Printf("cache purge %v: %v", keys, err)
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		err := fmt.Errorf("cache purge %s: %s", req.URL.Host, resp.Status)
+		log.Print(err)
+		return err
+	}
+	return nil
+}
+
+// purgeBookingEvent purges the availability and the classroom of a booking
+// that changed.
+func purgeBookingEvent(event string, b booking) {
+	switch event {
+	case eventBookingCreated, eventBookingCancelled, eventBookingApproved, eventBookingRescheduled, eventBookingPreempted:
+		purgeSurrogateKeys([]string{availabilityPath, classroomPath + "/" + b.BookingClassroomId})
+	}
+}
+
+// handlerAdminCache serves POST /admin/cache/purge with {"keys": [...]}.
+func handlerAdminCache(w http.ResponseWriter, r *http.Request, rest []string) {
+	if len(rest) != 1 || rest[0] != "purge" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var request struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Keys) == 0 {
+		writeError(w, r, http.StatusBadRequest, "invalid_body")
+		return
+	}
+	if err := purgeSurrogateKeys(request.Keys); err != nil {
+		writeError(w, r, http.StatusBadGateway, "purge_failed")
+		return
+	}
+	recordAudit(r, "cache.purge", "cache", "", request)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const cancelPath = "cancel"
+
+// Reasons a booking can be cancelled for. Older clients that send none are
+// recorded as reasonUnspecified.
+const (
+	reasonUnspecified    = "unspecified"
+	reasonScheduleChange = "schedule_change"
+	reasonNotNeeded      = "not_needed"
+	reasonIllness        = "illness"
+	reasonRoomIssue      = "room_issue"
+	reasonOther          = "other"
+)
+
+var cancelReasons = map[string]bool{
+	reasonUnspecified:    true,
+	reasonScheduleChange: true,
+	reasonNotNeeded:      true,
+	reasonIllness:        true,
+	reasonRoomIssue:      true,
+	reasonOther:          true,
+}
+
+// maxCancelNote counts characters, not bytes, so a Thai note is allowed
+// as long as an English one.
+const maxCancelNote = 500
+
+type cancelRequest struct {
+	Reason   string `json:"reason"`
+	Note     string `json:"note"`
+	Override bool   `json:"override"`
+}
+
+// cancelRequestOf reads the reason from a POST body, or from the query of a
+// DELETE.
+func cancelRequestOf(r *http.Request) (cancelRequest, error) {
+	var request cancelRequest
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+			return request, err
+		}
+	} else {
+		query := r.URL.Query()
+		request = cancelRequest{Reason: query.Get("reason"), Note: query.Get("note"), Override: query.Get("override") == "true"}
+	}
+	if request.Reason == "" {
+		request.Reason = reasonUnspecified
+	}
+	request.Note = strings.TrimSpace(request.Note)
+	return request, nil
+}
+
+// canOverrideNotice reports whether the caller may cancel inside the notice
+// window: admins, also when acting for a booker.
+func canOverrideNotice(r *http.Request) bool {
+	caller := callerOf(r)
+	return caller != nil && (caller.Role == roleAdmin || caller.ActingAdmin != nil)
+}
+
+// insideCancelNotice returns CANCEL_MIN_NOTICE if b is within it of its
+// start and hasn't ended, and 0 if it can be cancelled.
+func insideCancelNotice(b booking, now time.Time) time.Duration {
+	notice := envDuration("CANCEL_MIN_NOTICE", 15*time.Minute)
+	if start, end, err := bookingWindow(b); err == nil && notice > 0 && now.After(start.Add(-notice)) && now.Before(end) {
+		return notice
+	}
+	return 0
+}
+
+// handlerBookingCancel serves DELETE /api/bookings/{id} and POST
+// /api/bookings/{id}/cancel. Bookings can't be cancelled from
+// CANCEL_MIN_NOTICE before they start until they end unless an admin
+// overrides it; bookings that ended can still be deleted.
+func handlerBookingCancel(w http.ResponseWriter, r *http.Request, store BookingRepository, b booking) {
+	request, err := cancelRequestOf(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_body")
+		return
+	}
+	if !cancelReasons[request.Reason] || utf8.RuneCountInString(request.Note) > maxCancelNote {
+		writeError(w, r, http.StatusBadRequest, "invalid_cancel_reason")
+		return
+	}
+	if request.Override && !canOverrideNotice(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if notice := insideCancelNotice(b, time.Now()); notice > 0 && !request.Override {
+		writeError(w, r, http.StatusConflict, "cancel_notice", "minutes", strconv.Itoa(int(notice.Minutes())))
+		return
+	}
+	if err := store.RemoveBooking(b.BookingId); err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	recordUsage(r, usageCancellation)
+	recordCancellation(b)
+	recordAudit(r, "booking.cancel", "booking", b.publicId(), request)
+	b.ActedBy = actedBy(r)
+	b.RequestId = requestIdOf(r)
+	b.Tenant = tenantOf(r)
+	if err := dispatchBookingEvent(eventBookingCancelled, b); err != nil {
+		writeServiceError(w, r, err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const changesPath = "changes"
+
+// Clients that can't hold a stream open, e.g. behind proxies that buffer
+// or cut streaming responses, follow booking changes by long polling GET
+// /api/bookings/changes?since=<cursor>. The cursor is the sequence number
+// of the last event seen, see events.go, so it stays valid across
+// instances and restarts. A poll answers at once when there are newer
+// events and otherwise waits for the next one, up to LONGPOLL_TIMEOUT or
+// ?wait= seconds if shorter. Events of other instances are picked up by
+// re-reading every LONGPOLL_INTERVAL while waiting.
+
+type bookingChanges struct {
+	Events []sequencedEvent `json:"events"`
+	Cursor int64            `json:"cursor"`
+}
+
+// changeBus wakes the polls waiting on this instance: each history event
+// closes the current channel and replaces it.
+var changeBus = struct {
+	sync.Mutex
+	ch chan struct{}
+}{ch: make(chan struct{})}
+
+func publishChange(event string, b booking) {
+	if !historyEvents[event] {
+		return
+	}
+	changeBus.Lock()
+	close(changeBus.ch)
+	changeBus.ch = make(chan struct{})
+	changeBus.Unlock()
+}
+
+func nextChange() <-chan struct{} {
+	changeBus.Lock()
+	defer changeBus.Unlock()
+	return changeBus.ch
+}
+
+func init() {
+	bookingEventHandlers = append(bookingEventHandlers, publishChange)
+}
+
+// writeChanges answers a poll with changes, pointing to the next poll.
+func writeChanges(w http.ResponseWriter, r *http.Request, changes bookingChanges) {
+	paginate(w, r, pagination{Cursor: "since", Next: strconv.FormatInt(changes.Cursor, 10)})
+	j, err := json.Marshal(changes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}
+
+// handlerBookingChanges serves GET /api/bookings/changes. Without since it
+// answers the current cursor to start from. Students only see the events
+// of their own bookings, as in booking lists.
+func handlerBookingChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	bookerId, all := "", true
+	if owned, ok := bookingStoreFor(r).(ownedBookingRepository); ok {
+		bookerId, all = owned.bookerId, false
+	}
+	if query.Get("since") == "" {
+		seq, err := latestSeq()
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		writeChanges(w, r, bookingChanges{Events: []sequencedEvent{}, Cursor: seq})
+		return
+	}
+	since, err := strconv.ParseInt(query.Get("since"), 10, 64)
+	if err != nil || since < 0 {
+		writeError(w, r, http.StatusBadRequest, "invalid_cursor")
+		return
+	}
+	timeout := envDuration("LONGPOLL_TIMEOUT", 25*time.Second)
+	if v := query.Get("wait"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid_wait")
+			return
+		}
+		if wait := time.Duration(seconds) * time.Second; wait < timeout {
+			timeout = wait
+		}
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(envDuration("LONGPOLL_INTERVAL", 2*time.Second))
+	defer ticker.Stop()
+	limit := envInt("LONGPOLL_LIMIT", 100)
+	for {
+		// Taken before reading so an event appended meanwhile still wakes us.
+		wake := nextChange()
+		changes, err := getSequencedEvents(since, bookerId, all, limit)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		if len(changes) > 0 {
+			redactionFor(r).events(changes)
+			writeChanges(w, r, bookingChanges{Events: changes, Cursor: changes[len(changes)-1].Seq})
+			return
+		}
+		select {
+		case <-wake:
+		case <-ticker.C:
+		case <-deadline.C:
+			writeChanges(w, r, bookingChanges{Events: changes, Cursor: since})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,133 @@
+//go:build chaos
+
+package main
+
+import (
+	"database/sql/driver"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Building with -tags chaos injects failures to test retries, the circuit
+// breaker and clients against. Release builds leave the tag off, so none of
+// this is in them. Percentages are of API requests, or of booking store
+// calls for dropped connections, and are re-read on reload:
+//
+//	CHAOS_LATENCY_PERCENT  delay requests by CHAOS_LATENCY (default 1s)
+//	CHAOS_ERROR_PERCENT    answer with CHAOS_ERROR_STATUS (default 503)
+//	CHAOS_DB_DROP_PERCENT  fail booking store calls with driver.ErrBadConn
+//
+// Internal mounts are left alone so operators can still reach the admin
+// endpoints.
+
+var chaosInjected = newCounter("chaos_injected_total", "Failures injected by chaos mode, by kind.", "kind")
+
+var chaosRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+func init() {
+	log.Println("chaos mode: failures are injected per CHAOS_* settings")
+	apiMiddleware = append(apiMiddleware, chaosMiddleware)
+	backendLayers = append(backendLayers, func(next BookingRepository) BookingRepository {
+		return chaosBookingRepository{next}
+	})
+}
+
+// chaosHit rolls whether to inject the failure set by the percentage key.
+func chaosHit(key string) bool {
+	percent := envFloat(key, 0)
+	if percent <= 0 {
+		return false
+	}
+	chaosRand.Lock()
+	roll := chaosRand.Float64() * 100
+	chaosRand.Unlock()
+	return roll < percent
+}
+
+func chaosMiddleware(m mount, handler http.Handler) http.Handler {
+	if m.Internal {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if chaosHit("CHAOS_LATENCY_PERCENT") {
+			chaosInjected.Inc("latency")
+			select {
+			case <-time.After(envDuration("CHAOS_LATENCY", time.Second)):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if chaosHit("CHAOS_ERROR_PERCENT") {
+			chaosInjected.Inc("error")
+			w.WriteHeader(envInt("CHAOS_ERROR_STATUS", http.StatusServiceUnavailable))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// chaosBookingRepository fails calls as a dropped connection would, beneath
+// the retries that should absorb it.
+type chaosBookingRepository struct {
+	next BookingRepository
+}
+
+func (c chaosBookingRepository) drop() error {
+	if chaosHit("CHAOS_DB_DROP_PERCENT") {
+		chaosInjected.Inc("db_drop")
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+func (c chaosBookingRepository) forTenant(tenant string) BookingRepository {
+	return chaosBookingRepository{bookingStoreForTenant(c.next, tenant)}
+}
+
+func (c chaosBookingRepository) GetBooking(bookingId int) (*booking, error) {
+	if err := c.drop(); err != nil {
+		return nil, err
+	}
+	return c.next.GetBooking(bookingId)
+}
+
+func (c chaosBookingRepository) GetBookingByPublicId(publicId string) (*booking, error) {
+	if err := c.drop(); err != nil {
+		return nil, err
+	}
+	return c.next.GetBookingByPublicId(publicId)
+}
+
+func (c chaosBookingRepository) GetBooker(bookerId string) ([]booking, error) {
+	if err := c.drop(); err != nil {
+		return nil, err
+	}
+	return c.next.GetBooker(bookerId)
+}
+
+func (c chaosBookingRepository) GetBookingList(filter bookingFilter, fields []bookingField) ([]booking, error) {
+	if err := c.drop(); err != nil {
+		return nil, err
+	}
+	return c.next.GetBookingList(filter, fields)
+}
+
+func (c chaosBookingRepository) InsertBooking(b booking) (int, error) {
+	if err := c.drop(); err != nil {
+		return 0, err
+	}
+	return c.next.InsertBooking(b)
+}
+
+func (c chaosBookingRepository) RemoveBooking(bookingId int) error {
+	if err := c.drop(); err != nil {
+		return err
+	}
+	return c.next.RemoveBooking(bookingId)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Check-ins are written through a buffer: attendance kiosks check a whole
+// class in within seconds, and one transaction per scan would queue them
+// up on the booking table. A flusher takes the pending check-ins up to
+// CHECKIN_FLUSH_SIZE (default 100) at a time, or whatever is pending
+// after CHECKIN_FLUSH_INTERVAL (default 50ms), and writes them in one
+// transaction; each caller waits for the flush of its own. At most
+// CHECKIN_BUFFER (default 1000) check-ins wait at once, and beyond that
+// callers are answered 503 to retry, rather than the buffer growing
+// without bound. POST /api/checkins/batch checks in up to 500 tokens
+// in one request, answering per check-in as POST /api/checkin would.
+
+const checkinsPath = "checkins"
+const maxCheckinBatch = 500
+
+var errCheckinsBacklogged = errors.New("check-in buffer is full")
+
+var (
+	checkinBufferDepth   = newGauge("checkin_buffer_depth", "Check-ins waiting to be written.")
+	checkinFlushesTotal  = newCounter("checkin_flushes_total", "Transactions writing buffered check-ins.")
+	checkinFlushSize     = newHistogram("checkin_flush_size", "Check-ins written per transaction.", []float64{1, 5, 10, 25, 50, 100, 250, 500})
+	checkinsRefusedTotal = newCounter("checkins_refused_total", "Check-ins refused because the buffer was full.")
+)
+
+type pendingCheckin struct {
+	bookingId int
+	done      chan checkinResult
+}
+
+type checkinResult struct {
+	checkedIn bool
+	err       error
+}
+
+var checkinQueue chan pendingCheckin
+var checkinDepth int64
+
+// startCheckinBuffer starts the flusher; until then check-ins are refused
+// as backlogged.
+func startCheckinBuffer() {
+	checkinQueue = make(chan pendingCheckin, envInt("CHECKIN_BUFFER", 1000))
+	size := envInt("CHECKIN_FLUSH_SIZE", 100)
+	interval := envDuration("CHECKIN_FLUSH_INTERVAL", 50*time.Millisecond)
+	go func() {
+		for first := range checkinQueue {
+			batch := []pendingCheckin{first}
+			timer := time.NewTimer(interval)
+		collect:
+			for len(batch) < size {
+				select {
+				case p := <-checkinQueue:
+					batch = append(batch, p)
+				case <-timer.C:
+					break collect
+				}
+			}
+			timer.Stop()
+			checkinBufferDepth.Set(float64(atomic.AddInt64(&checkinDepth, -int64(len(batch)))))
+			flushCheckins(batch)
+		}
+	}()
+}
+
+// enqueueCheckins queues check-ins of bookingIds, or none if they don't all
+// fit.
+func enqueueCheckins(bookingIds []int) ([]chan checkinResult, error) {
+	if depth := atomic.AddInt64(&checkinDepth, int64(len(bookingIds))); depth > int64(cap(checkinQueue)) {
+		atomic.AddInt64(&checkinDepth, -int64(len(bookingIds)))
+		checkinsRefusedTotal.Add(float64(len(bookingIds)))
+		return nil, errCheckinsBacklogged
+	}
+	checkinBufferDepth.Set(float64(atomic.LoadInt64(&checkinDepth)))
+	done := make([]chan checkinResult, len(bookingIds))
+	for i, bookingId := range bookingIds {
+		done[i] = make(chan checkinResult, 1)
+		checkinQueue <- pendingCheckin{bookingId, done[i]}
+	}
+	return done, nil
+}
+
+// flushCheckins records the check-in time of the bookings of batch not
+// checked in yet, in one transaction. A booking in batch twice is checked
+// in by the first.
+func flushCheckins(batch []pendingCheckin) {
+	checkinFlushesTotal.Inc()
+	checkinFlushSize.Observe(float64(len(batch)))
+	open, err := writeCheckins(batch)
+	for _, p := range batch {
+		p.done <- checkinResult{open[p.bookingId], err}
+		open[p.bookingId] = false
+	}
+}
+
+func writeCheckins(batch []pendingCheckin) (map[int]bool, error) {
+	open := make(map[int]bool)
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	ids := make([]interface{}, len(batch))
+	for i, p := range batch {
+		ids[i] = p.bookingId
+	}
+	in := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	tx, err := Db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err.Error())
+		return open, err
+	}
+	defer tx.Rollback()
+	results, err := tx.QueryContext(ctx, `SELECT booking_id FROM booking WHERE booking_id IN (`+in+`) AND booking_checked_in_at IS NULL FOR UPDATE`, ids...)
+	if err != nil {
+		log.Println(err.Error())
+		return open, err
+	}
+	opened := make([]interface{}, 0, len(ids))
+	for results.Next() {
+		var bookingId int
+		if err := results.Scan(&bookingId); err != nil {
+			results.Close()
+			log.Println(err.Error())
+			return open, err
+		}
+		opened = append(opened, bookingId)
+	}
+	results.Close()
+	if err := results.Err(); err != nil {
+		log.Println(err.Error())
+		return open, err
+	}
+	if len(opened) > 0 {
+		in := strings.TrimSuffix(strings.Repeat("?, ", len(opened)), ", ")
+		if _, err := tx.ExecContext(ctx, `UPDATE booking SET booking_checked_in_at = UTC_TIMESTAMP() WHERE booking_id IN (`+in+`)`, opened...); err != nil {
+			log.Println(err.Error())
+			return open, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err.Error())
+		return open, err
+	}
+	for _, bookingId := range opened {
+		open[bookingId.(int)] = true
+	}
+	return open, nil
+}
+
+type checkinRequest struct {
+	Token       string `json:"token"`
+	ClassroomId string `json:"classroom_id"`
+}
+
+type checkinBatchResult struct {
+	Status    int             `json:"status"`
+	BookingId string          `json:"booking_id,omitempty"`
+	Error     json.RawMessage `json:"error,omitempty"`
+}
+
+// handlerCheckinBatch serves POST /api/checkins/batch.
+func handlerCheckinBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var request struct {
+		Checkins []checkinRequest `json:"checkins"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_body")
+		return
+	}
+	if len(request.Checkins) == 0 || len(request.Checkins) > maxCheckinBatch {
+		writeError(w, r, http.StatusBadRequest, "invalid_batch_size", "max", strconv.Itoa(maxCheckinBatch))
+		return
+	}
+	results := make([]checkinBatchResult, len(request.Checkins))
+	bookings := make([]booking, 0, len(request.Checkins))
+	indexes := make([]int, 0, len(request.Checkins))
+	for i, c := range request.Checkins {
+		bw := newBatchWriter()
+		if b, ok := verifyCheckin(bw, r, c); ok {
+			bookings = append(bookings, *b)
+			indexes = append(indexes, i)
+			continue
+		}
+		results[i].Status = bw.status
+		if json.Valid(bw.body.Bytes()) {
+			results[i].Error = json.RawMessage(bw.body.Bytes())
+		}
+	}
+	ids := make([]int, len(bookings))
+	for i, b := range bookings {
+		ids[i] = b.BookingId
+	}
+	done, err := enqueueCheckins(ids)
+	if err != nil {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, http.StatusServiceUnavailable, "overloaded")
+		return
+	}
+	for i, b := range bookings {
+		result := <-done[i]
+		switch {
+		case result.err != nil:
+			results[indexes[i]].Status = http.StatusInternalServerError
+		case !result.checkedIn:
+			results[indexes[i]].Status = http.StatusConflict
+		default:
+			results[indexes[i]] = checkinBatchResult{Status: http.StatusOK, BookingId: b.publicId()}
+			b.RequestId = requestIdOf(r)
+			b.Tenant = tenantOf(r)
+			if err := dispatchBookingEvent(eventBookingCheckedIn, b); err != nil {
+				results[indexes[i]].Status = http.StatusInternalServerError
+			}
+		}
+	}
+	j, err := json.Marshal(map[string][]checkinBatchResult{"results": results})
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type classroom struct {
+	ClassroomId   string `json:"classroom_id"`
+	ClassroomName string `json:"classroom_name"`
+	FloorId       *int   `json:"floor_id,omitempty"`
+	FloorLevel    *int   `json:"floor_level,omitempty"`
+	BuildingId    *int   `json:"building_id,omitempty"`
+	BuildingName  string `json:"building_name,omitempty"`
+
+	MapUrl             string     `json:"map_url,omitempty"`
+	AccessInstructions string     `json:"access_instructions,omitempty"`
+	PhotoUpdatedAt     *time.Time `json:"photo_updated_at,omitempty"`
+}
+
+type locationFilter struct {
+	BuildingId int
+	FloorId    int
+}
+
+const classroomPath = "classrooms"
+
+const classroomSelect = `SELECT c.classroom_id, c.classroom_name, c.classroom_floor_id, f.floor_level, f.floor_building_id, COALESCE(bd.building_name, ''),
+		c.classroom_map_url, COALESCE(c.classroom_access_instructions, ''), c.classroom_photo_updated_at
+	FROM classroom c
+	LEFT JOIN floor f ON f.floor_id = c.classroom_floor_id
+	LEFT JOIN building bd ON bd.building_id = f.floor_building_id`
+
+func parseLocationFilter(r *http.Request) (locationFilter, error) {
+	var filter locationFilter
+	var err error
+	query := r.URL.Query()
+	if v := query.Get("building"); v != "" {
+		if filter.BuildingId, err = strconv.Atoi(v); err != nil {
+			return filter, validationError{Fields: []string{"building"}}
+		}
+	}
+	if v := query.Get("floor"); v != "" {
+		if filter.FloorId, err = strconv.Atoi(v); err != nil {
+			return filter, validationError{Fields: []string{"floor"}}
+		}
+	}
+	return filter, nil
+}
+
+// where returns the SQL conditions restricting a classroom id column to the
+// filtered building or floor.
+func (filter locationFilter) where(classroomColumn sqlColumn) []condition {
+	conditions := []condition{}
+	if filter.FloorId != 0 {
+		conditions = append(conditions, classroomColumn.inSubquery(`SELECT classroom_id FROM classroom WHERE classroom_floor_id = ?`, filter.FloorId))
+	}
+	if filter.BuildingId != 0 {
+		conditions = append(conditions, classroomColumn.inSubquery(`SELECT c.classroom_id FROM classroom c JOIN floor f ON f.floor_id = c.classroom_floor_id WHERE f.floor_building_id = ?`, filter.BuildingId))
+	}
+	return conditions
+}
+
+func scanClassroom(scanner interface{ Scan(...interface{}) error }) (classroom, error) {
+	var classroom classroom
+	var floorId, floorLevel, buildingId sql.NullInt64
+	var photoUpdatedAt time.Time
+	err := scanner.Scan(&classroom.ClassroomId, &classroom.ClassroomName, &floorId, &floorLevel, &buildingId, &classroom.BuildingName,
+		&classroom.MapUrl, &classroom.AccessInstructions, sqlTime{&photoUpdatedAt})
+	if err != nil {
+		return classroom, err
+	}
+	if !photoUpdatedAt.IsZero() {
+		classroom.PhotoUpdatedAt = &photoUpdatedAt
+	}
+	if floorId.Valid {
+		id, level, building := int(floorId.Int64), int(floorLevel.Int64), int(buildingId.Int64)
+		classroom.FloorId, classroom.FloorLevel, classroom.BuildingId = &id, &level, &building
+	}
+	return classroom, nil
+}
+
+func getClassroom(classroomId string) (*classroom, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	row := Db.QueryRowContext(ctx, classroomSelect+` WHERE c.classroom_id = ?`, classroomId)
+	classroom, err := scanClassroom(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return &classroom, nil
+}
+
+func getClassroomList(filter locationFilter) ([]classroom, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	query, args := newQuery(classroomSelect).where(filter.where("c.classroom_id")...).order("c.classroom_id").build()
+	results, err := Db.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	classrooms := make([]classroom, 0)
+	for results.Next() {
+		classroom, err := scanClassroom(results)
+		if err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		classrooms = append(classrooms, classroom)
+	}
+	return classrooms, results.Err()
+}
+
+func updateClassroomFloor(classroomId string, floorId *int) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `UPDATE classroom SET classroom_floor_id = ? WHERE classroom_id = ?`, floorId, classroomId)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+func handlerClassrooms(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		filter, err := parseLocationFilter(r)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		classroomList, err := getClassroomList(filter)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		j, err := json.Marshal(classroomList)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = w.Write(j)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case http.MethodOptions:
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func handlerClassroom(w http.ResponseWriter, r *http.Request) {
+	urlPathSegments := strings.Split(r.URL.Path, fmt.Sprintf("%s/", classroomPath))
+	urlPathSegments = strings.Split(urlPathSegments[len(urlPathSegments)-1], "/")
+	classroomId := urlPathSegments[0]
+	if len(urlPathSegments) == 2 {
+		switch urlPathSegments[1] {
+		case preferencePath:
+			noStore(w)
+			handlerPreferences(w, r, scopeClassroom, classroomId)
+			return
+		case calendarPath:
+			noStore(w)
+			handlerClassroomCalendar(w, r, classroomId)
+			return
+		case doorPath:
+			noStore(w)
+			handlerClassroomDoor(w, r, classroomId)
+			return
+		case policyPath:
+			handlerRoomPolicy(w, r, classroomId)
+			return
+		case occupancyPath:
+			handlerOccupancy(w, r, classroomId)
+			return
+		case featuresPath:
+			handlerClassroomFeatures(w, r, classroomId)
+			return
+		case scheduleViewPath:
+			noStore(w)
+			handlerClassroomSchedule(w, r, classroomId)
+			return
+		case schedulePdfPath:
+			handlerSchedulePdf(w, r, classroomId)
+			return
+		}
+	}
+	if len(urlPathSegments) == 2 && (urlPathSegments[1] == photoPath || urlPathSegments[1] == metadataPath) {
+		classroom, err := getClassroom(classroomId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		if classroom == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if urlPathSegments[1] == photoPath {
+			handlerClassroomPhoto(w, r, *classroom)
+		} else {
+			handlerClassroomMetadata(w, r, *classroom)
+		}
+		return
+	}
+	if len(urlPathSegments) > 1 && urlPathSegments[1] == subscriptionPath {
+		noStore(w)
+		handlerClassroomSubscriptions(w, r, classroomId, urlPathSegments[2:])
+		return
+	}
+	if len(urlPathSegments) > 1 && urlPathSegments[1] == managerPath {
+		noStore(w)
+		handlerClassroomManagers(w, r, classroomId, urlPathSegments[2:])
+		return
+	}
+	if classroomId == "" || len(urlPathSegments) > 1 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		classroom, err := getClassroom(classroomId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		if classroom == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		j, err := json.Marshal(classroom)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		_, err = w.Write(j)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case http.MethodPut:
+		requireApiKey(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var update struct {
+				FloorId *int `json:"floor_id"`
+			}
+			err := json.NewDecoder(r.Body).Decode(&update)
+			if err != nil {
+				log.Print(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			err = updateClassroomFloor(classroomId, update.FloorId)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}), roleAdmin).ServeHTTP(w, r)
+	case http.MethodOptions:
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The cleanup job removes what nothing refers to any more, every
+// CLEANUP_INTERVAL (default 1m): holds past their expiry, which no read
+// sees but which stay in booking_hold; classroom photos and thumbnails
+// left in the attachment store after their classroom was deleted or its
+// photo removed; and cached API key lookups past their TTL, whose misses
+// for deleted or mistyped keys would otherwise pile up for the life of
+// the process. Each pass counts what it deleted in
+// cleanup_deleted_total and logs it. The service keeps no idempotency keys
+// or sessions, so there are none to clear: duplicate creates are matched
+// against the bookings themselves and callers authenticate with API keys
+// on every request.
+
+const (
+	cleanupHolds       = "holds"
+	cleanupAttachments = "attachments"
+	cleanupApiKeys     = "api_key_cache"
+)
+
+var cleanupDeletedTotal = newCounter("cleanup_deleted_total", "Rows, files and cache entries the cleanup job deleted, by kind.", "kind")
+
+// startCleanupJob starts the cleanup job. The attachment store is left
+// alone when storage is in memory, where no classroom has a photo and
+// every one would look orphaned.
+func startCleanupJob(storage string) {
+	startJob("cleanup", envDuration("CLEANUP_INTERVAL", time.Minute), func() {
+		counts := map[string]int{}
+		var err error
+		if counts[cleanupHolds], err = expireHolds(); err != nil {
+			log.Printf("cleanup: holds: %v", err)
+		}
+		if storage != storageMemory {
+			if counts[cleanupAttachments], err = removeOrphanedPhotos(); err != nil {
+				log.Printf("cleanup: attachments: %v", err)
+			}
+		}
+		counts[cleanupApiKeys] = pruneApiKeyCache(time.Now())
+		for _, kind := range []string{cleanupHolds, cleanupAttachments, cleanupApiKeys} {
+			if counts[kind] > 0 {
+				cleanupDeletedTotal.Add(float64(counts[kind]), kind)
+				log.Printf("cleanup: deleted %d %s", counts[kind], kind)
+			}
+		}
+	})
+}
+
+// photoClassroomIds returns the classrooms that have a photo.
+func photoClassroomIds() (map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT classroom_id FROM classroom WHERE classroom_photo_updated_at IS NOT NULL`)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	ids := make(map[string]bool)
+	for results.Next() {
+		var id string
+		if err := results.Scan(&id); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, results.Err()
+}
+
+// removeOrphanedPhotos deletes the photos and thumbnails, stored over an
+// hour ago, of classrooms without a photo. Other attachments are left as
+// they are.
+func removeOrphanedPhotos() (int, error) {
+	store, err := attachments()
+	if err != nil {
+		return 0, err
+	}
+	// An upload stores the photo before it marks the classroom as having
+	// one; recent keys may be such uploads.
+	keys, err := store.Keys(classroomPath+"/", time.Now().Add(-time.Hour))
+	if err != nil {
+		return 0, err
+	}
+	ids, err := photoClassroomIds()
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, key := range keys {
+		segments := strings.Split(key, "/")
+		if len(segments) != 3 || segments[2] != photoPath && !strings.HasPrefix(segments[2], photoPath+"-") {
+			continue
+		}
+		classroomId, err := url.PathUnescape(segments[1])
+		if err != nil || ids[classroomId] {
+			continue
+		}
+		if err := store.Delete(key); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// pruneApiKeyCache drops the cached lookups expired at now.
+func pruneApiKeyCache(now time.Time) int {
+	apiKeyCache.Lock()
+	defer apiKeyCache.Unlock()
+	pruned := 0
+	for hash, cached := range apiKeyCache.keys {
+		if !now.Before(cached.expires) {
+			delete(apiKeyCache.keys, hash)
+			pruned++
+		}
+	}
+	return pruned
+}
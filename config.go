@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Settings are read from the environment each time they are used, with
+// values from the JSON object in CONFIG_FILE taking precedence. The file is
+// re-read on SIGHUP and POST /api/admin/reload, so anything looked up per use
+// (CORS origins, penalty thresholds, cache TTLs, ...) changes without a
+// restart. Settings read once at startup, such as the database and listen
+// address, still need one.
+var configOverrides = struct {
+	sync.RWMutex
+	values map[string]string
+}{values: make(map[string]string)}
+
+func lookupConfig(key string) (string, bool) {
+	configOverrides.RLock()
+	v, ok := configOverrides.values[key]
+	configOverrides.RUnlock()
+	if ok {
+		return v, true
+	}
+	return os.LookupEnv(key)
+}
+
+func envString(key string, fallback string) string {
+	if v, ok := lookupConfig(key); ok {
+		return v
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	v, _ := lookupConfig(key)
+	if i, err := strconv.Atoi(v); err == nil {
+		return i
+	}
+	return fallback
+}
+
+func envFloat(key string, fallback float64) float64 {
+	v, _ := lookupConfig(key)
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		return f
+	}
+	return fallback
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	v, _ := lookupConfig(key)
+	if d, err := time.ParseDuration(v); err == nil {
+		return d
+	}
+	return fallback
+}
+
+func loadConfigFile() error {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	overrides := make(map[string]string, len(values))
+	for key, value := range values {
+		overrides[key] = fmt.Sprint(value)
+	}
+	configOverrides.Lock()
+	configOverrides.values = overrides
+	configOverrides.Unlock()
+	return nil
+}
+
+// reloadConfig re-reads the config file and the feature flags and resizes
+// the connection pool. A broken file leaves the previous settings in place.
+func reloadConfig() error {
+	if err := loadConfigFile(); err != nil {
+		return err
+	}
+	if Db != nil {
+		configurePool(Db)
+	}
+	if err := reloadNotificationTemplates(); err != nil {
+		return err
+	}
+	return reloadFlags()
+}
+
+func watchReloadSignal() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := reloadConfig(); err != nil {
+				log.Printf("reload: %v", err)
+				continue
+			}
+			log.Println("configuration reloaded")
+		}
+	}()
+}
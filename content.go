@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const jsonContentType = "application/json; charset=utf-8"
+
+// jsonWriter labels successful responses as JSON unless the handler chose
+// another type, such as a PDF or a PNG. Errors without a body go out
+// without a type; error bodies set it themselves, see writeError.
+type jsonWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (jw *jsonWriter) WriteHeader(status int) {
+	if !jw.wroteHeader {
+		jw.wroteHeader = true
+		h := jw.Header()
+		if status >= 200 && status < 300 && status != http.StatusNoContent && h.Get("Content-Type") == "" {
+			h.Set("Content-Type", jsonContentType)
+		}
+	}
+	jw.ResponseWriter.WriteHeader(status)
+}
+
+func (jw *jsonWriter) Write(p []byte) (int, error) {
+	if !jw.wroteHeader {
+		jw.WriteHeader(http.StatusOK)
+	}
+	return jw.ResponseWriter.Write(p)
+}
+
+// Flush keeps streaming responses, such as backups, streaming.
+func (jw *jsonWriter) Flush() {
+	if flusher, ok := jw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (jw *jsonWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(jw.ResponseWriter)
+}
+
+// hasJsonBody reports whether r's body, if it has one, is UTF-8 JSON.
+func hasJsonBody(r *http.Request) bool {
+	if r.ContentLength == 0 {
+		return true
+	}
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return false
+	}
+	charset, ok := params["charset"]
+	return !ok || strings.EqualFold(charset, "utf-8")
+}
+
+// contentTypeMiddleware rejects request bodies that aren't JSON with 415,
+// but for photo uploads and calendar imports, and labels the responses,
+// enveloped if asked for.
+func contentTypeMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+			if !hasJsonBody(r) && !isPhotoUpload(r) && !isCalendarImport(r) {
+				writeError(w, r, http.StatusUnsupportedMediaType, "unsupported_media_type")
+				return
+			}
+		}
+		serveProfile(&jsonWriter{ResponseWriter: w}, r, handler)
+	})
+}
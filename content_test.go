@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestContentTypeMiddlewareRequests(t *testing.T) {
+	for _, test := range []struct {
+		method, path, contentType, body string
+		status                          int
+	}{
+		{http.MethodPost, "/api/bookings", "application/json", `{}`, http.StatusOK},
+		{http.MethodPost, "/api/bookings", "application/json; charset=utf-8", `{}`, http.StatusOK},
+		{http.MethodPost, "/api/bookings", "application/json; charset=UTF-8", `{}`, http.StatusOK},
+		{http.MethodPut, "/api/classrooms/c1", "application/json", `{}`, http.StatusOK},
+		{http.MethodPost, "/api/bookings", "", ``, http.StatusOK},
+		{http.MethodGet, "/api/bookings", "text/plain", ``, http.StatusOK},
+		{http.MethodPost, "/api/bookings", "", `{}`, http.StatusUnsupportedMediaType},
+		{http.MethodPost, "/api/bookings", "text/plain", `{}`, http.StatusUnsupportedMediaType},
+		{http.MethodPost, "/api/bookings", "application/json; charset=iso-8859-1", `{}`, http.StatusUnsupportedMediaType},
+		{http.MethodPost, "/api/bookings", "application/x-www-form-urlencoded", `a=b`, http.StatusUnsupportedMediaType},
+		{http.MethodPatch, "/api/bookings/b1", "text/plain", `{}`, http.StatusUnsupportedMediaType},
+		{http.MethodPut, "/api/classrooms/c1/" + photoPath, "image/png", `png`, http.StatusOK},
+		{http.MethodPost, "/api/classrooms/c1/" + photoPath, "image/png", `png`, http.StatusUnsupportedMediaType},
+		{http.MethodPost, "/api/bookings/" + importPath, "text/calendar", `BEGIN:VCALENDAR`, http.StatusOK},
+	} {
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		w := httptest.NewRecorder()
+		contentTypeMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{}`))
+		})).ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s %s with %q answered %d, want %d", test.method, test.path, test.contentType, w.Code, test.status)
+		}
+		if test.status == http.StatusUnsupportedMediaType && !strings.Contains(w.Body.String(), `"unsupported_media_type"`) {
+			t.Errorf("%s %s with %q answered %s", test.method, test.path, test.contentType, w.Body)
+		}
+	}
+}
+
+func TestContentTypeMiddlewareResponses(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		handler     http.HandlerFunc
+		contentType string
+	}{
+		{"body", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{}`)) }, jsonContentType},
+		{"created", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusCreated) }, jsonContentType},
+		{"no content", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }, ""},
+		{"not found", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNotFound) }, ""},
+		{"server error", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) }, ""},
+		{"error body", func(w http.ResponseWriter, r *http.Request) { writeError(w, r, http.StatusBadRequest, "invalid_body") }, jsonContentType},
+		{"own type", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("png"))
+		}, "image/png"},
+	} {
+		w := httptest.NewRecorder()
+		contentTypeMiddleware(test.handler).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/bookings", nil))
+		if got := w.Header().Get("Content-Type"); got != test.contentType {
+			t.Errorf("%s: Content-Type %q, want %q", test.name, got, test.contentType)
+		}
+	}
+}
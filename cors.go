@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// addAllowOrigin allows the origins listed in CORS_ORIGINS (comma separated,
+// "*" for any, the default).
+func addAllowOrigin(w http.ResponseWriter, r *http.Request) {
+	allowed := envString("CORS_ORIGINS", "*")
+	if allowed == "*" {
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		return
+	}
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	for _, o := range strings.Split(allowed, ",") {
+		if origin != "" && strings.TrimSpace(o) == origin {
+			w.Header().Add("Access-Control-Allow-Origin", origin)
+			return
+		}
+	}
+}
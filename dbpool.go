@@ -0,0 +1,60 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// The connection pool is sized by DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS,
+// DB_CONN_MAX_LIFETIME and DB_CONN_MAX_IDLE_TIME, applied again on a
+// config reload since database/sql resizes a live pool. Db.Stats() is
+// sampled every DB_POOL_SAMPLE_INTERVAL into the db_pool_* metrics; a
+// sample where callers waited longer than DB_POOL_WAIT_LOG on average for
+// a connection is also logged, as a sign the pool is too small for the
+// load.
+
+var (
+	dbPoolConnections  = newGauge("db_pool_connections", "Database connections by state.", "state")
+	dbPoolMaxOpen      = newGauge("db_pool_max_open_connections", "The configured maximum of open database connections.")
+	dbPoolWaitTotal    = newCounter("db_pool_wait_total", "Times a caller waited for a database connection.")
+	dbPoolWaitDuration = newHistogram("db_pool_wait_duration_seconds", "Time callers waited for a database connection, averaged per sample.", latencyBuckets)
+	dbPoolClosedTotal  = newCounter("db_pool_closed_total", "Database connections closed by the pool.", "reason")
+)
+
+// configurePool applies the pool settings to db.
+func configurePool(db *sql.DB) {
+	db.SetMaxOpenConns(envInt("DB_MAX_OPEN_CONNS", 10))
+	db.SetMaxIdleConns(envInt("DB_MAX_IDLE_CONNS", 10))
+	db.SetConnMaxLifetime(envDuration("DB_CONN_MAX_LIFETIME", 3*time.Minute))
+	db.SetConnMaxIdleTime(envDuration("DB_CONN_MAX_IDLE_TIME", 0))
+}
+
+// samplePool turns the change in Db.Stats() since last into metrics.
+func samplePool(last sql.DBStats) sql.DBStats {
+	stats := Db.Stats()
+	dbPoolConnections.Set(float64(stats.InUse), "in_use")
+	dbPoolConnections.Set(float64(stats.Idle), "idle")
+	dbPoolMaxOpen.Set(float64(stats.MaxOpenConnections))
+	dbPoolClosedTotal.Add(float64(stats.MaxIdleClosed-last.MaxIdleClosed), "max_idle")
+	dbPoolClosedTotal.Add(float64(stats.MaxIdleTimeClosed-last.MaxIdleTimeClosed), "max_idle_time")
+	dbPoolClosedTotal.Add(float64(stats.MaxLifetimeClosed-last.MaxLifetimeClosed), "max_lifetime")
+	waits := stats.WaitCount - last.WaitCount
+	if waits <= 0 {
+		return stats
+	}
+	average := (stats.WaitDuration - last.WaitDuration) / time.Duration(waits)
+	dbPoolWaitTotal.Add(float64(waits))
+	dbPoolWaitDuration.ObserveN(average.Seconds(), float64(waits))
+	if average > envDuration("DB_POOL_WAIT_LOG", 50*time.Millisecond) {
+		log.Printf("db pool: %d callers waited %s on average for a connection, %d of %d in use", waits, average, stats.InUse, stats.MaxOpenConnections)
+	}
+	return stats
+}
+
+func startPoolMetrics() {
+	var last sql.DBStats
+	startJob("db-pool", envDuration("DB_POOL_SAMPLE_INTERVAL", 5*time.Second), func() {
+		last = samplePool(last)
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"golang.org/x/sync/singleflight"
+)
+
+var readGroup singleflight.Group
+
+var readsSharedTotal = newCounter("db_reads_shared_total", "Reads that shared their result with an identical read in flight.", "read")
+
+// sharedRead runs fn once for all identical concurrent reads, identical
+// meaning the same name and key. Callers get the same value, so they must
+// not modify it.
+func sharedRead(name string, key string, fn func() (interface{}, error)) (interface{}, error) {
+	v, err, shared := readGroup.Do(name+"/"+key, fn)
+	if shared {
+		readsSharedTotal.Inc(name)
+	}
+	return v, err
+}
+
+// dedupBookingRepository collapses identical concurrent booking reads, such
+// as many door displays polling one classroom, into one query. Each caller
+// gets its own copy of the result. Reads are only shared within tenant,
+// whose store below sees its own bookings.
+type dedupBookingRepository struct {
+	next   BookingRepository
+	tenant string
+}
+
+// key is key of a read shared within the repository's tenant.
+func (d dedupBookingRepository) key(key string) string {
+	return d.tenant + "/" + key
+}
+
+func copyBooking(v interface{}) *booking {
+	b := v.(*booking)
+	if b == nil {
+		return nil
+	}
+	c := *b
+	return &c
+}
+
+func copyBookings(v interface{}) []booking {
+	return append([]booking(nil), v.([]booking)...)
+}
+
+func (d dedupBookingRepository) GetBooking(bookingId int) (*booking, error) {
+	v, err := sharedRead("booking", d.key(strconv.Itoa(bookingId)), func() (interface{}, error) {
+		return d.next.GetBooking(bookingId)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyBooking(v), nil
+}
+
+func (d dedupBookingRepository) GetBookingByPublicId(publicId string) (*booking, error) {
+	v, err := sharedRead("booking", d.key(publicId), func() (interface{}, error) {
+		return d.next.GetBookingByPublicId(publicId)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyBooking(v), nil
+}
+
+func (d dedupBookingRepository) GetBooker(bookerId string) ([]booking, error) {
+	v, err := sharedRead("booker", d.key(bookerId), func() (interface{}, error) {
+		return d.next.GetBooker(bookerId)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyBookings(v), nil
+}
+
+func (d dedupBookingRepository) GetBookingList(filter bookingFilter, fields []bookingField) ([]booking, error) {
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = f.column
+	}
+	v, err := sharedRead("booking_list", d.key(fmt.Sprintf("%+v %v", filter, names)), func() (interface{}, error) {
+		return d.next.GetBookingList(filter, fields)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyBookings(v), nil
+}
+
+func (d dedupBookingRepository) InsertBooking(b booking) (int, error) {
+	return d.next.InsertBooking(b)
+}
+
+func (d dedupBookingRepository) RemoveBooking(bookingId int) error {
+	return d.next.RemoveBooking(bookingId)
+}
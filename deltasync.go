@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Clients sync incrementally by passing the Last-Modified of their previous
+// list as ?updated_since=, in RFC 3339, or by sending If-Modified-Since to
+// get a 304 when nothing changed. Deleted bookings are not reported.
+
+func parseBookingFilter(r *http.Request) (bookingFilter, error) {
+	location, err := parseLocationFilter(r)
+	if err != nil {
+		return bookingFilter{}, err
+	}
+	query := r.URL.Query()
+	filter := bookingFilter{locationFilter: location, ClassroomId: query.Get("classroom"), GroupId: query.Get("group"), Status: query.Get("status"), From: query.Get("from"), To: query.Get("to")}
+	for _, name := range []string{"from", "to"} {
+		if date := query.Get(name); date != "" {
+			if _, err := time.Parse(bookingDateLayout, date); err != nil {
+				return filter, validationError{Fields: []string{name}}
+			}
+		}
+	}
+	if v := query.Get("updated_since"); v != "" {
+		if filter.UpdatedSince, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return filter, validationError{Fields: []string{"updated_since"}}
+		}
+	}
+	return filter, nil
+}
+
+func latestUpdate(bookings []booking) time.Time {
+	var latest time.Time
+	for _, b := range bookings {
+		if b.BookingUpdatedAt.After(latest) {
+			latest = b.BookingUpdatedAt
+		}
+	}
+	return latest
+}
+
+// checkLastModified sets Last-Modified and answers 304 when the request's
+// If-Modified-Since is not older than modified, reporting whether it did.
+// HTTP dates have whole seconds, so modified is truncated to compare.
+func checkLastModified(w http.ResponseWriter, r *http.Request, modified time.Time) bool {
+	if modified.IsZero() {
+		return false
+	}
+	modified = modified.UTC().Truncate(time.Second)
+	w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const displayPath = "display"
+const displayHorizonDays = 7
+
+type displaySlot struct {
+	BookingId string    `json:"booking_id"`
+	Title     string    `json:"title,omitempty"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+}
+
+type displayNow struct {
+	ClassroomId   string       `json:"classroom_id"`
+	ClassroomName string       `json:"classroom_name"`
+	Current       *displaySlot `json:"current"`
+	Next          *displaySlot `json:"next"`
+	FreeUntil     *time.Time   `json:"free_until"`
+	BusyUntil     *time.Time   `json:"busy_until,omitempty"`
+}
+
+type cachedDisplay struct {
+	body    []byte
+	expires time.Time
+}
+
+var displayCache = struct {
+	sync.Mutex
+	entries map[string]cachedDisplay
+}{entries: make(map[string]cachedDisplay)}
+
+// getDisplayNow works out what a door display should show right now. Booker
+// identities are left out since the display hangs in a public corridor.
+func getDisplayNow(c classroom, now time.Time) (displayNow, error) {
+	display := displayNow{ClassroomId: c.ClassroomId, ClassroomName: c.ClassroomName}
+	bookings, err := getBookingsBetween(now, now.AddDate(0, 0, displayHorizonDays), c.ClassroomId)
+	if err != nil {
+		return display, err
+	}
+	slots := make([]displaySlot, 0, len(bookings))
+	for _, b := range bookings {
+		start, end, err := bookingWindow(b)
+		if err != nil || !end.After(now) {
+			continue
+		}
+		slots = append(slots, displaySlot{b.publicId(), b.BookingTitle, start, end})
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].Start.Before(slots[j].Start) })
+	for i := range slots {
+		slot := slots[i]
+		if !slot.Start.After(now) {
+			display.Current = &slot
+			continue
+		}
+		display.Next = &slot
+		break
+	}
+	if display.Current == nil {
+		if display.Next != nil {
+			display.FreeUntil = &display.Next.Start
+		}
+		return display, nil
+	}
+	busyUntil := display.Current.End
+	for _, slot := range slots {
+		if !slot.Start.After(busyUntil) && slot.End.After(busyUntil) {
+			busyUntil = slot.End
+		}
+	}
+	display.BusyUntil = &busyUntil
+	return display, nil
+}
+
+// handlerDisplay serves /api/display/classrooms/{id}/now. Responses are
+// cached for DISPLAY_CACHE_TTL since every display polls it.
+func handlerDisplay(w http.ResponseWriter, r *http.Request) {
+	urlPathSegments := strings.Split(r.URL.Path, fmt.Sprintf("%s/", displayPath))
+	urlPathSegments = strings.Split(urlPathSegments[len(urlPathSegments)-1], "/")
+	if len(urlPathSegments) != 3 || urlPathSegments[0] != classroomPath || urlPathSegments[2] != "now" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	classroomId := urlPathSegments[1]
+	ttl := envDuration("DISPLAY_CACHE_TTL", 15*time.Second)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(ttl.Seconds())))
+	displayCache.Lock()
+	cached, ok := displayCache.entries[classroomId]
+	displayCache.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		w.Write(cached.body)
+		return
+	}
+	// Displays of one classroom tend to poll in step, so concurrent misses
+	// share one read.
+	v, err := sharedRead("display", classroomId, func() (interface{}, error) {
+		classroom, err := getClassroom(classroomId)
+		if err != nil || classroom == nil {
+			return []byte(nil), err
+		}
+		display, err := getDisplayNow(*classroom, time.Now())
+		if err != nil {
+			return []byte(nil), err
+		}
+		j, err := json.Marshal(display)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return j, nil
+	})
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	j := v.([]byte)
+	if j == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	displayCache.Lock()
+	displayCache.entries[classroomId] = cachedDisplay{j, time.Now().Add(ttl)}
+	displayCache.Unlock()
+	w.Write(j)
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// doctor checks what the server needs to start and run, one check at a
+// time, and prints what is wrong with a hint on how to fix it:
+//
+//	doctor [-storage memory]
+//
+// It reads the configuration the way serve does, checks the settings it
+// can (numbers and durations that don't parse make serve silently fall back
+// to defaults), that the listen addresses are free, the database connects,
+// is migrated and has the advised indexes, that its clock agrees with
+// this host's, and that the configured services answer. It exits 1 when a
+// check fails; warnings are worth a look but don't stop serve.
+
+const (
+	doctorOk   = "ok"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+	doctorSkip = "skip"
+)
+
+// Clocks further apart than this put holds, check-in windows and
+// Last-Modified out of step.
+const maxClockSkew = 2 * time.Second
+
+type doctorResult struct {
+	Status  string
+	Message string
+	Hint    string
+}
+
+// doctorRun is what the checks run so far found.
+type doctorRun struct {
+	storage string
+	// database is whether the database answered; the checks of its schema
+	// and clock skip otherwise.
+	database bool
+}
+
+type doctorCheck struct {
+	name string
+	run  func(ctx context.Context, run *doctorRun) doctorResult
+}
+
+var doctorChecks = []doctorCheck{
+	{"config", doctorConfig},
+	{"settings", doctorSettings},
+	{"listen", doctorListen},
+	{"database", doctorDatabase},
+	{"migrations", doctorMigrations},
+	{"indexes", doctorIndexes},
+	{"clock", doctorClock},
+	{"dependencies", doctorDependencies},
+}
+
+// intSettings and durationSettings are the numeric settings read with
+// envInt and envDuration.
+var intSettings = []string{
+	"ACCESS_RETRIES", "BOOKER_WEEKLY_BOOKINGS", "BOOKER_WEEKLY_MINUTES", "CHAOS_ERROR_STATUS", "CHECKIN_BUFFER",
+	"CHECKIN_FLUSH_SIZE", "DB_BREAKER_THRESHOLD", "DB_MAX_IDLE_CONNS", "DB_MAX_OPEN_CONNS", "DB_RETRIES",
+	"GCAL_SYNC_DAYS", "ICS_MAX_SIZE", "JOURNAL_KEEP", "JOURNAL_MAX_BODY", "JOURNAL_MAX_SIZE", "LONGPOLL_LIMIT",
+	"MAINTENANCE_RETRY_AFTER", "MAX_IN_FLIGHT", "PENALTY_APPROVAL_THRESHOLD", "PENALTY_BLOCK_THRESHOLD",
+	"PHOTO_MAX_SIZE", "QUOTA_WARN_PERCENT", "RETENTION_DAYS", "SERVER_MAX_HEADER_BYTES", "SHED_QUEUE",
+}
+
+var durationSettings = []string{
+	"ACCESS_MARGIN", "ACCESS_RECONCILE_INTERVAL", "AUTO_ASSIGN_USAGE_WINDOW", "CANCEL_MIN_NOTICE", "CHAOS_LATENCY", "CHECKIN_EARLY",
+	"CHECKIN_FLUSH_INTERVAL", "CLEANUP_INTERVAL", "DB_BREAKER_COOLDOWN", "DB_CONN_MAX_IDLE_TIME",
+	"DB_CONN_MAX_LIFETIME", "DB_POOL_SAMPLE_INTERVAL", "DB_POOL_WAIT_LOG", "DB_SLOW_QUERY", "DIGEST_INTERVAL",
+	"DISPLAY_CACHE_TTL", "DUPLICATE_WINDOW", "EXPORT_CLEANUP_INTERVAL", "EXPORT_SNAPSHOT_REUSE", "EXPORT_SNAPSHOT_TTL", "FEATURE_FLAGS_REFRESH", "GCAL_SYNC_INTERVAL", "HOLD_TTL",
+	"JOURNAL_RETENTION", "LATE_CANCEL_WINDOW", "LONGPOLL_INTERVAL", "LONGPOLL_TIMEOUT", "NO_SHOW_GRACE",
+	"PENALTY_BLOCK_FOR", "PENALTY_WINDOW", "PERF_WINDOW", "POLICY_WEBHOOK_TIMEOUT", "RETENTION_INTERVAL",
+	"SCHEDULE_REBUILD_INTERVAL", "SERVER_IDLE_TIMEOUT", "SERVER_READ_HEADER_TIMEOUT", "SERVER_READ_TIMEOUT",
+	"SERVER_WRITE_TIMEOUT", "SHED_QUEUE_TIMEOUT", "SLO_LATENCY", "USAGE_FLUSH_INTERVAL",
+}
+
+func doctorConfig(ctx context.Context, run *doctorRun) doctorResult {
+	if err := loadConfigFile(); err != nil {
+		return doctorResult{doctorFail, err.Error(), "fix CONFIG_FILE, a JSON object of settings, or unset it"}
+	}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		return doctorResult{Status: doctorOk, Message: "loaded " + path}
+	}
+	return doctorResult{Status: doctorOk, Message: "settings from the environment only"}
+}
+
+func doctorSettings(ctx context.Context, run *doctorRun) doctorResult {
+	problems := []string{}
+	for _, key := range intSettings {
+		if v, ok := lookupConfig(key); ok && v != "" {
+			if _, err := strconv.Atoi(v); err != nil {
+				problems = append(problems, fmt.Sprintf("%s=%q is not a whole number", key, v))
+			}
+		}
+	}
+	for _, key := range durationSettings {
+		if v, ok := lookupConfig(key); ok && v != "" {
+			if _, err := time.ParseDuration(v); err != nil {
+				problems = append(problems, fmt.Sprintf("%s=%q is not a duration", key, v))
+			}
+		}
+	}
+	for _, key := range []string{"SLO_AVAILABILITY", "SLO_LATENCY_TARGET"} {
+		if v, ok := lookupConfig(key); ok && v != "" {
+			if f, err := strconv.ParseFloat(v, 64); err != nil || f <= 0 || f >= 1 {
+				problems = append(problems, fmt.Sprintf("%s=%q is not a share between 0 and 1", key, v))
+			}
+		}
+	}
+	if run.storage == storageMysql {
+		if store := envString("BOOKING_STORE", "mysql"); bookingBackends[store] == nil {
+			problems = append(problems, fmt.Sprintf("BOOKING_STORE=%q is unknown or needs its build tag", store))
+		}
+	}
+	if name := envString("ACCESS_PROVIDER", ""); name != "" {
+		if newProvider, ok := accessProviders[name]; !ok {
+			problems = append(problems, fmt.Sprintf("ACCESS_PROVIDER=%q is unknown", name))
+		} else if _, err := newProvider(); err != nil {
+			problems = append(problems, "ACCESS_PROVIDER: "+err.Error())
+		}
+	}
+	if err := checkArchiveMode(envString("RETENTION_ARCHIVE", archiveTable)); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := loadReceiptKey(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if path := envString("GCAL_CREDENTIALS_FILE", ""); path != "" {
+		if _, err := newCalendarClient(path); err != nil {
+			problems = append(problems, "GCAL_CREDENTIALS_FILE: "+err.Error())
+		}
+	}
+	if path := envString("FEATURE_FLAGS_FILE", ""); path != "" {
+		if _, err := loadFlagFile(path); err != nil {
+			problems = append(problems, "FEATURE_FLAGS_FILE: "+err.Error())
+		}
+	}
+	if dir := envString("NOTIFICATION_TEMPLATES_DIR", ""); dir != "" {
+		if _, err := loadNotificationTemplates(dir); err != nil {
+			problems = append(problems, "NOTIFICATION_TEMPLATES_DIR: "+err.Error())
+		}
+	}
+	if mode := envString("QUERY_COST_MODE", queryCostReject); mode != queryCostReject && mode != queryCostTruncate {
+		problems = append(problems, fmt.Sprintf("QUERY_COST_MODE=%q is neither reject nor truncate", mode))
+	}
+	for _, role := range queryBudgetRoles {
+		key := "QUERY_BUDGET_" + strings.ToUpper(role)
+		if _, err := parseQueryBudget(envString(key, ""), defaultQueryBudgets[role]); err != nil {
+			problems = append(problems, key+": "+err.Error())
+		}
+	}
+	if format := envString("API_RESPONSE_FORMAT", bareProfile); format != bareProfile && format != envelopeProfile {
+		problems = append(problems, fmt.Sprintf("API_RESPONSE_FORMAT=%q is neither bare nor envelope", format))
+	}
+	if envString("READ_ONLY", "") == "true" && envString("PRIMARY_URL", "") == "" {
+		problems = append(problems, "READ_ONLY is set without PRIMARY_URL, so refused writes can't point clients to the primary")
+	}
+	if len(problems) > 0 {
+		return doctorResult{doctorFail, strings.Join(problems, "; "), "fix or unset these settings; serve falls back to defaults or exits on them"}
+	}
+	return doctorResult{Status: doctorOk, Message: "settings parse"}
+}
+
+// doctorListen checks the TCP addresses to listen on are free; sockets
+// and socket activation are left to serve.
+func doctorListen(ctx context.Context, run *doctorRun) doctorResult {
+	addrs := []string{}
+	for _, setting := range [][2]string{{"SERVER_ADDR", ":5000"}, {"ADMIN_ADDR", defaultAdminAddr}} {
+		for _, addr := range strings.Split(envString(setting[0], setting[1]), ",") {
+			if addr = strings.TrimSpace(addr); addr == "" || addr == "systemd" || strings.HasPrefix(addr, "unix:") {
+				continue
+			}
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				return doctorResult{doctorFail, fmt.Sprintf("%s %s: %v", setting[0], addr, err), "stop what listens there, often another instance, or change " + setting[0]}
+			}
+			l.Close()
+			addrs = append(addrs, addr)
+		}
+	}
+	return doctorResult{Status: doctorOk, Message: "free: " + strings.Join(addrs, ", ")}
+}
+
+func doctorDatabase(ctx context.Context, run *doctorRun) doctorResult {
+	if run.storage == storageMemory {
+		return doctorResult{Status: doctorSkip, Message: "storage is in memory"}
+	}
+	if err := Db.PingContext(ctx); err != nil {
+		return doctorResult{doctorFail, err.Error(), "start MySQL on 127.0.0.1:3306 with a classroom database the server's user can reach"}
+	}
+	var version string
+	if err := Db.QueryRowContext(ctx, `SELECT VERSION()`).Scan(&version); err != nil {
+		return doctorResult{doctorFail, err.Error(), "check the server's user may query the classroom database"}
+	}
+	run.database = true
+	return doctorResult{Status: doctorOk, Message: "connected to MySQL " + version}
+}
+
+func doctorMigrations(ctx context.Context, run *doctorRun) doctorResult {
+	if !run.database {
+		return doctorResult{Status: doctorSkip, Message: "no database to check"}
+	}
+	latest := migrations[len(migrations)-1].Version
+	var current int
+	if err := Db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return doctorResult{doctorWarn, "no migrations applied: " + err.Error(), "serve applies them on start, given a user allowed to change the schema"}
+	}
+	switch {
+	case current < latest:
+		hint := "serve applies them on start"
+		if envString("READ_ONLY", "") == "true" {
+			hint = "migrate the primary; a read-only replica refuses to start until then"
+		}
+		return doctorResult{doctorWarn, fmt.Sprintf("at migration %d of %d", current, latest), hint}
+	case current > latest:
+		return doctorResult{doctorFail, fmt.Sprintf("at migration %d, newer than this build's %d", current, latest), "run the release that migrated the database, or restore a backup from before it"}
+	}
+	return doctorResult{Status: doctorOk, Message: fmt.Sprintf("at migration %d", current)}
+}
+
+func doctorIndexes(ctx context.Context, run *doctorRun) doctorResult {
+	if !run.database {
+		return doctorResult{Status: doctorSkip, Message: "no database to check"}
+	}
+	advice, err := adviseSchema(ctx)
+	if err != nil {
+		return doctorResult{doctorWarn, err.Error(), "check the server's user may read information_schema"}
+	}
+	missing, statements := []string{}, []string{}
+	for _, a := range advice {
+		if !a.Present {
+			missing = append(missing, a.Table+"."+a.Index)
+			statements = append(statements, a.Statement)
+		}
+	}
+	if len(missing) > 0 {
+		return doctorResult{doctorWarn, "missing " + strings.Join(missing, ", "), "run " + strings.Join(statements, "; ") + ", or start with SCHEMA_CREATE_INDEXES=true"}
+	}
+	return doctorResult{Status: doctorOk, Message: fmt.Sprintf("%d advised indexes present", len(advice))}
+}
+
+// doctorClock compares the database's clock with this host's, taking the
+// host's at the middle of the round trip.
+func doctorClock(ctx context.Context, run *doctorRun) doctorResult {
+	if !run.database {
+		return doctorResult{Status: doctorSkip, Message: "no database to check"}
+	}
+	before := time.Now()
+	var raw string
+	if err := Db.QueryRowContext(ctx, `SELECT UTC_TIMESTAMP(6)`).Scan(&raw); err != nil {
+		return doctorResult{doctorWarn, err.Error(), "check the server's user may query the classroom database"}
+	}
+	roundTrip := time.Since(before)
+	dbNow, err := time.Parse("2006-01-02 15:04:05.999999", raw)
+	if err != nil {
+		return doctorResult{doctorWarn, err.Error(), ""}
+	}
+	skew := dbNow.Sub(before.Add(roundTrip / 2))
+	if skew < 0 {
+		skew = -skew
+	}
+	message := fmt.Sprintf("database and host clocks %s apart", skew.Round(time.Millisecond))
+	if skew > maxClockSkew {
+		return doctorResult{doctorWarn, message, "sync both clocks with NTP; holds, check-ins and Last-Modified compare them"}
+	}
+	return doctorResult{Status: doctorOk, Message: message}
+}
+
+func doctorDependencies(ctx context.Context, run *doctorRun) doctorResult {
+	statuses := checkDependencies(ctx)
+	if len(statuses) == 0 {
+		return doctorResult{Status: doctorOk, Message: "none configured"}
+	}
+	names := make([]string, 0, len(statuses))
+	for name := range statuses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := doctorResult{Status: doctorOk}
+	ok, down := []string{}, []string{}
+	for _, name := range names {
+		status := statuses[name]
+		if status.Status == dependencyOk {
+			ok = append(ok, name)
+			continue
+		}
+		down = append(down, name+": "+status.Error)
+		if status.Critical {
+			result.Status = doctorFail
+		} else if result.Status == doctorOk {
+			result.Status = doctorWarn
+		}
+	}
+	if len(down) == 0 {
+		result.Message = "reachable: " + strings.Join(ok, ", ")
+		return result
+	}
+	result.Message = "unreachable: " + strings.Join(down, "; ")
+	result.Hint = "check the addresses and the firewall; READYZ_CRITICAL ones keep the instance unready"
+	return result
+}
+
+func runDoctor(args []string) {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	storage := flags.String("storage", envString("STORAGE", storageMysql), "where data is kept: mysql, or memory")
+	timeout := flags.Duration("timeout", 10*time.Second, "time each check may take")
+	flags.Parse(args)
+	if flags.NArg() != 0 || *storage != storageMysql && *storage != storageMemory {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *storage == storageMysql {
+		setupDb()
+	}
+	run := &doctorRun{storage: *storage}
+	failed := false
+	for _, check := range doctorChecks {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		result := check.run(ctx, run)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && result.Status != doctorOk {
+			result.Hint = strings.TrimSpace(result.Hint + fmt.Sprintf(" (timed out after %s)", *timeout))
+		}
+		cancel()
+		fmt.Printf("[%-4s] %-12s %s\n", result.Status, check.name, result.Message)
+		if result.Hint != "" {
+			fmt.Printf("%19s %s\n", "->", result.Hint)
+		}
+		failed = failed || result.Status == doctorFail
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
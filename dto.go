@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The booking model's struct tags used to be malformed, so bookings were
+// served with Go field names (BookingId, ...). Responses now use the
+// snake_case DTOs below. Clients that still expect the old names can ask for
+// the legacy schema with an "X-API-Schema: legacy" header or ?schema=legacy,
+// and API_LEGACY_SCHEMA=true serves it to everyone until they have moved.
+// Legacy responses carry a Deprecation header, and a Sunset header when
+// API_LEGACY_SUNSET is set.
+
+// bookingResponse is the documented JSON shape of a booking. booking_id is
+// the public id, see publicid.go.
+type bookingResponse struct {
+	BookingId       string    `json:"booking_id"`
+	BookingTime     string    `json:"booking_time"`
+	ClassroomId     string    `json:"classroom_id"`
+	BookerId        string    `json:"booker_id"`
+	BookingDuration int       `json:"booking_duration"`
+	BookingTitle    string    `json:"booking_title"`
+	BookingStatus   string    `json:"booking_status"`
+	UpdatedAt       time.Time `json:"updated_at"`
+	Seats           int       `json:"seats,omitempty"`
+	GroupId         string    `json:"group_id,omitempty"`
+	Priority        priority  `json:"priority,omitempty"`
+	// Group is expanded from GroupId in API responses, see expandGroups.
+	Group   *groupSummary `json:"group,omitempty"`
+	ActedBy string        `json:"acted_by,omitempty"`
+}
+
+func newBookingResponse(b booking) bookingResponse {
+	return bookingResponse{
+		BookingId:       b.publicId(),
+		BookingTime:     b.BookingTime,
+		ClassroomId:     b.BookingClassroomId,
+		BookerId:        b.BookingBookerId,
+		BookingDuration: b.BookingDuration,
+		BookingTitle:    b.BookingTitle,
+		BookingStatus:   b.BookingStatus,
+		UpdatedAt:       b.BookingUpdatedAt,
+		Seats:           b.BookingSeats,
+		GroupId:         b.BookingGroupId,
+		Priority:        b.priority(),
+		ActedBy:         b.ActedBy,
+	}
+}
+
+func newBookingResponses(bookings []booking) []bookingResponse {
+	responses := make([]bookingResponse, len(bookings))
+	for i, b := range bookings {
+		responses[i] = newBookingResponse(b)
+	}
+	return responses
+}
+
+// legacyBookingResponse is a booking as it was served before the schema
+// fix, keyed by Go field names.
+type legacyBookingResponse struct {
+	BookingId          int
+	BookingTime        string
+	BookingClassroomId string
+	BookingBookerId    string
+	BookingDuration    int
+	BookingTitle       string
+	BookingStatus      string
+	BookingUpdatedAt   time.Time
+	BookingPublicId    string
+	BookingSeats       int
+	BookingGroupId     string
+	BookingPriority    int
+	ActedBy            string   `json:"-"`
+	RequestId          string   `json:"-"`
+	Tenant             string   `json:"-"`
+	Previous           *booking `json:"-"`
+}
+
+// bookingRequest is the body of a booking create. The legacy keys are still
+// accepted; when both are sent the snake_case one wins.
+type bookingRequest struct {
+	BookingTime     string `json:"booking_time"`
+	ClassroomId     string `json:"classroom_id"`
+	BookerId        string `json:"booker_id"`
+	BookingDuration int    `json:"booking_duration"`
+	BookingTitle    string `json:"booking_title"`
+	Seats           int    `json:"seats"`
+	GroupId         string `json:"group_id"`
+	// Priority defaults to the classroom's default tier, see applyPriority.
+	Priority priority `json:"priority"`
+	// TimeZone is the IANA zone of a booking time without an offset,
+	// the booking time zone by default; see normalizeBookingTime.
+	TimeZone string `json:"time_zone"`
+
+	LegacyBookingTime        string `json:"BookingTime"`
+	LegacyBookingClassroomId string `json:"BookingClassroomId"`
+	LegacyBookingBookerId    string `json:"BookingBookerId"`
+	LegacyBookingDuration    int    `json:"BookingDuration"`
+	LegacyBookingTitle       string `json:"BookingTitle"`
+}
+
+func (req bookingRequest) booking() booking {
+	b := booking{
+		BookingTime:        req.BookingTime,
+		BookingClassroomId: req.ClassroomId,
+		BookingBookerId:    req.BookerId,
+		BookingDuration:    req.BookingDuration,
+		BookingTitle:       req.BookingTitle,
+		BookingSeats:       req.Seats,
+		BookingGroupId:     req.GroupId,
+		BookingPriority:    int(req.Priority),
+	}
+	if b.BookingTime == "" {
+		b.BookingTime = req.LegacyBookingTime
+	}
+	if b.BookingClassroomId == "" {
+		b.BookingClassroomId = req.LegacyBookingClassroomId
+	}
+	if b.BookingBookerId == "" {
+		b.BookingBookerId = req.LegacyBookingBookerId
+	}
+	if b.BookingDuration == 0 {
+		b.BookingDuration = req.LegacyBookingDuration
+	}
+	if b.BookingTitle == "" {
+		b.BookingTitle = req.LegacyBookingTitle
+	}
+	return b
+}
+
+// legacySchema reports whether r gets the pre-fix response schema, and marks
+// the response as deprecated if so.
+func legacySchema(w http.ResponseWriter, r *http.Request) bool {
+	schema := r.Header.Get("X-API-Schema")
+	if schema == "" {
+		schema = r.URL.Query().Get("schema")
+	}
+	legacy := strings.EqualFold(schema, "legacy") || schema == "" && envString("API_LEGACY_SCHEMA", "") == "true"
+	if legacy {
+		w.Header().Set("Deprecation", "true")
+		if sunset := envString("API_LEGACY_SUNSET", ""); sunset != "" {
+			w.Header().Set("Sunset", sunset)
+		}
+	}
+	return legacy
+}
+
+// bookingBody returns the response body for b in the schema r asked for.
+func bookingBody(w http.ResponseWriter, r *http.Request, b booking) interface{} {
+	b = redactionFor(r).booking(b)
+	if legacySchema(w, r) {
+		return legacyBookingResponse(b)
+	}
+	responses := []bookingResponse{newBookingResponse(b)}
+	expandGroups(responses)
+	return responses[0]
+}
+
+// bookingListBody returns the response body for bookings in the schema r
+// asked for, expanding as many groups as the caller's query budget allows;
+// see querycost.go. It reports false when it answered r instead.
+func bookingListBody(w http.ResponseWriter, r *http.Request, bookings []booking) (interface{}, bool) {
+	bookings = redactionFor(r).bookings(bookings)
+	if legacySchema(w, r) {
+		legacy := make([]legacyBookingResponse, len(bookings))
+		for i, b := range bookings {
+			legacy[i] = legacyBookingResponse(b)
+		}
+		return legacy, true
+	}
+	responses := newBookingResponses(bookings)
+	groupIds := responseGroupIds(responses)
+	n, ok := limitQueryCost(w, r, costExpansions, len(groupIds))
+	if !ok {
+		return nil, false
+	}
+	expandGroupIds(responses, groupIds[:n])
+	return responses, true
+}
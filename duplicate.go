@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Clients that retry a booking create after a timeout, or users who click
+// twice, send the same booking again. A create identical to a booking the
+// booker created in the last DUPLICATE_WINDOW (default 10s, 0 turns this
+// off), same classroom, time, duration, title, seats and group, answers 200
+// with that booking's id instead of a conflict, and creates nothing. A
+// booking's creation time is that of its ULID, so one merely updated since,
+// say checked in, isn't taken for a fresh create.
+
+var bookingDuplicatesTotal = newCounter("booking_duplicates_total", "Booking creates answered with an identical recent booking.")
+
+func sameBooking(a, b booking) bool {
+	return a.BookingBookerId == b.BookingBookerId &&
+		a.BookingClassroomId == b.BookingClassroomId &&
+		strings.TrimSpace(a.BookingTime) == strings.TrimSpace(b.BookingTime) &&
+		a.BookingDuration == b.BookingDuration &&
+		a.BookingTitle == b.BookingTitle &&
+		a.BookingSeats == b.BookingSeats &&
+		a.BookingGroupId == b.BookingGroupId
+}
+
+// findDuplicateBooking returns the booking b repeats, if the caller created
+// it within the window.
+func findDuplicateBooking(r *http.Request, b booking) (*booking, error) {
+	window := envDuration("DUPLICATE_WINDOW", 10*time.Second)
+	if window <= 0 || b.BookingBookerId == "" {
+		return nil, nil
+	}
+	date := strings.TrimSpace(b.BookingTime)
+	if len(date) > len(bookingDateLayout) {
+		date = date[:len(bookingDateLayout)]
+	}
+	candidates, err := bookingStoreFor(r).GetBookingList(bookingFilter{BookerId: b.BookingBookerId, ClassroomId: b.BookingClassroomId, From: date, To: date}, bookingFields)
+	if err != nil {
+		return nil, err
+	}
+	since := time.Now().Add(-window)
+	for i := range candidates {
+		if created, ok := publicIdTime(candidates[i].BookingPublicId); ok && created.After(since) && sameBooking(candidates[i], b) {
+			return &candidates[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// writeDuplicate answers a create with the booking it duplicates, reporting
+// whether there was one. Lookup failures leave the create to go on.
+func writeDuplicate(w http.ResponseWriter, r *http.Request, b booking) bool {
+	duplicate, err := findDuplicateBooking(r, b)
+	if err != nil || duplicate == nil {
+		return false
+	}
+	bookingDuplicatesTotal.Inc()
+	var j []byte
+	if legacySchema(w, r) {
+		j, err = json.Marshal(map[string]int{"bookingid": duplicate.BookingId})
+	} else {
+		j, err = json.Marshal(map[string]string{"booking_id": duplicate.publicId()})
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+	return true
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Responses are bare by default: a list is a JSON array, a resource its
+// object. API_RESPONSE_FORMAT=envelope wraps every successful JSON
+// response instead, and a client can ask for either per request with the
+// profile of its Accept header, application/json; profile="envelope" or
+// profile="bare":
+//
+//	{"data": [...], "meta": {"count": 100, "next_cursor": "101", "limit": 100}, "links": {"self": "/api/events", "next": "/api/events?from_seq=101"}}
+//
+// meta carries the count of a list and the page of a paginated one, links
+// the request and the next page. The envelope is applied once, here, to the
+// bodies handlers write, so every endpoint gets it; errors, streams and
+// other types than JSON go out as written. Paginated handlers describe
+// their page with paginate, which also sets a Link header in either
+// format.
+
+const envelopeProfile = "envelope"
+const bareProfile = "bare"
+
+// pagination is where the next page of a response is: the same request
+// with the query parameter Cursor set to Next.
+type pagination struct {
+	Cursor string
+	Next   string
+	Limit  int
+}
+
+// link is the URI of the next page of r.
+func (p pagination) link(r *http.Request) string {
+	query := r.URL.Query()
+	query.Set(p.Cursor, p.Next)
+	next := *r.URL
+	next.RawQuery = query.Encode()
+	return next.RequestURI()
+}
+
+type responseMetaKey struct{}
+
+// responseMeta is what handlers tell the envelope about their response.
+type responseMeta struct {
+	page *pagination
+}
+
+type envelope struct {
+	Data  json.RawMessage        `json:"data"`
+	Meta  map[string]interface{} `json:"meta"`
+	Links map[string]string      `json:"links"`
+}
+
+// responseProfile returns the response format r asked for, or the
+// configured one.
+func responseProfile(r *http.Request) string {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(accepted)
+		if err != nil || mediaType != "application/json" && mediaType != "*/*" {
+			continue
+		}
+		if profile := params["profile"]; profile == envelopeProfile || profile == bareProfile {
+			return profile
+		}
+	}
+	if envString("API_RESPONSE_FORMAT", bareProfile) == envelopeProfile {
+		return envelopeProfile
+	}
+	return bareProfile
+}
+
+// paginate tells the client where the next page of the response is.
+func paginate(w http.ResponseWriter, r *http.Request, page pagination) {
+	w.Header().Set("Link", "<"+page.link(r)+`>; rel="next"`)
+	if meta, ok := r.Context().Value(responseMetaKey{}).(*responseMeta); ok {
+		meta.page = &page
+	}
+}
+
+// envelopeWriter holds back successful JSON bodies to write them
+// enveloped, and passes everything else through.
+type envelopeWriter struct {
+	http.ResponseWriter
+	r         *http.Request
+	meta      *responseMeta
+	status    int
+	buffering bool
+	body      bytes.Buffer
+}
+
+func (ew *envelopeWriter) WriteHeader(status int) {
+	if ew.status != 0 {
+		return
+	}
+	ew.status = status
+	contentType := ew.Header().Get("Content-Type")
+	if status >= 200 && status < 300 && status != http.StatusNoContent && (contentType == "" || strings.HasPrefix(contentType, "application/json")) {
+		ew.buffering = true
+		return
+	}
+	ew.ResponseWriter.WriteHeader(status)
+}
+
+func (ew *envelopeWriter) Write(p []byte) (int, error) {
+	if ew.status == 0 {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.buffering {
+		return ew.body.Write(p)
+	}
+	return ew.ResponseWriter.Write(p)
+}
+
+func (ew *envelopeWriter) Flush() {
+	if flusher, ok := ew.ResponseWriter.(http.Flusher); ok && !ew.buffering {
+		flusher.Flush()
+	}
+}
+
+func (ew *envelopeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(ew.ResponseWriter)
+}
+
+// finish writes the body held back, enveloped if it is JSON.
+func (ew *envelopeWriter) finish() {
+	if !ew.buffering {
+		return
+	}
+	data := bytes.TrimSpace(ew.body.Bytes())
+	if !json.Valid(data) {
+		ew.ResponseWriter.WriteHeader(ew.status)
+		ew.ResponseWriter.Write(ew.body.Bytes())
+		return
+	}
+	meta := map[string]interface{}{}
+	if data[0] == '[' {
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err == nil {
+			meta["count"] = len(items)
+		}
+	}
+	links := map[string]string{"self": ew.r.URL.RequestURI()}
+	if page := ew.meta.page; page != nil {
+		meta["next_cursor"] = page.Next
+		if page.Limit > 0 {
+			meta["limit"] = page.Limit
+		}
+		links["next"] = page.link(ew.r)
+	}
+	// Unescaped, so links keep their & as written.
+	var j bytes.Buffer
+	encoder := json.NewEncoder(&j)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(envelope{data, meta, links}); err != nil {
+		ew.ResponseWriter.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ew.Header().Set("Content-Type", jsonContentType+`; profile="`+envelopeProfile+`"`)
+	ew.Header().Set("Content-Length", strconv.Itoa(j.Len()))
+	ew.ResponseWriter.WriteHeader(ew.status)
+	ew.ResponseWriter.Write(j.Bytes())
+}
+
+// serveProfile serves r through handler in the response format it asked
+// for.
+func serveProfile(w http.ResponseWriter, r *http.Request, handler http.Handler) {
+	if responseProfile(r) != envelopeProfile {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	meta := &responseMeta{}
+	r = r.WithContext(context.WithValue(r.Context(), responseMetaKey{}, meta))
+	ew := &envelopeWriter{ResponseWriter: w, r: r, meta: meta}
+	handler.ServeHTTP(ew, r)
+	ew.finish()
+}
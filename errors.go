@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Stores and service functions say what kind of failure they hit by
+// wrapping one of the errors below, and handlers answer with
+// writeServiceError, which maps the kind to a status in one place rather
+// than each handler guessing one from a bare error. Errors of no kind are
+// the service's own failures and answer 500. A handler that has more to
+// say for a kind, such as the suggestions of a booking conflict, checks
+// for it with errors.Is first.
+var (
+	errNotFound  = errors.New("not found")
+	errConflict  = errors.New("conflict")
+	errForbidden = errors.New("forbidden")
+	// errQuotaExceeded is for limits on how much a caller may do, as
+	// opposed to what the slot allows.
+	errQuotaExceeded = errors.New("quota exceeded")
+)
+
+// validationError names the request fields a store or service function
+// refused.
+type validationError struct {
+	Fields []string
+}
+
+func (e validationError) Error() string {
+	return "invalid " + strings.Join(e.Fields, ", ")
+}
+
+// foreignKeyColumn finds the column of a MySQL foreign key violation.
+var foreignKeyColumn = regexp.MustCompile("FOREIGN KEY \\(`(\\w+)`\\)")
+
+// requestFields are the request fields booking columns are set from.
+var requestFields = map[string]string{
+	"booking_classroom_id": "classroom_id",
+	"booking_student_id":   "booker_id",
+	"booking_group_id":     "group_id",
+}
+
+// translateWriteError gives a failed write a kind: a duplicate key is a
+// conflict and a missing referenced row, such as an unknown classroom,
+// invalid. The duplicate key stays visible to isDuplicateKey.
+func translateWriteError(err error) error {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) || mysqlErr.Number != 1452 {
+		return err
+	}
+	field := "booking"
+	if m := foreignKeyColumn.FindStringSubmatch(mysqlErr.Message); m != nil {
+		field = m[1]
+		if f, ok := requestFields[field]; ok {
+			field = f
+		}
+	}
+	return validationError{Fields: []string{field}}
+}
+
+// isConflict reports whether err is a conflict, a duplicate key included.
+func isConflict(err error) bool {
+	return errors.Is(err, errConflict) || isDuplicateKey(err)
+}
+
+// serviceStatus is the status answering err.
+func serviceStatus(err error) int {
+	var invalid validationError
+	switch {
+	case errors.As(err, &invalid):
+		return http.StatusBadRequest
+	case errors.Is(err, errNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errForbidden):
+		return http.StatusForbidden
+	case isConflict(err):
+		return http.StatusConflict
+	case errors.Is(err, errQuotaExceeded):
+		return http.StatusTooManyRequests
+	case errors.Is(err, errCircuitOpen):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// writeServiceError answers with the status of err, with an error body
+// where the client can act on it, and logs errors of no kind.
+func writeServiceError(w http.ResponseWriter, r *http.Request, err error) {
+	var invalid validationError
+	switch status := serviceStatus(err); {
+	case errors.As(err, &invalid):
+		writeError(w, r, status, "invalid_fields", "fields", strings.Join(invalid.Fields, ", "))
+	case status == http.StatusTooManyRequests:
+		writeError(w, r, status, "quota_exceeded")
+	case status == http.StatusServiceUnavailable:
+		writeError(w, r, status, "overloaded")
+	case status == http.StatusInternalServerError:
+		log.Print(err)
+		w.WriteHeader(status)
+	default:
+		w.WriteHeader(status)
+	}
+}
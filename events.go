@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var bookingEventHandlers = []func(event string, b booking){notifyBookingEvent}
+
+// dispatchBookingEvent appends a booking event to the booking's history,
+// applies it to the schedule read model and hands it to every registered
+// handler in the background, so handlers never block the request that
+// triggered it. b is stamped as updated now, as its row just was, since
+// stores don't read a booking back after changing it.
+//
+// The booking has changed by then, so the rest runs even if the history
+// can't be appended, but the error is returned: the event takes no number
+// of the sequence and consumers would never learn of it, so the caller
+// must report it rather than answer as if all went well.
+func dispatchBookingEvent(event string, b booking) error {
+	b.BookingUpdatedAt = time.Now().UTC()
+	err := appendBookingEvent(event, b)
+	issueReceipt(event, b)
+	applyToSchedule(event, b)
+	for _, handler := range bookingEventHandlers {
+		go handler(event, b)
+	}
+	return err
+}
+
+const eventsPath = "events"
+
+// Booking events are numbered by a global sequence without gaps, see
+// appendBookingEvent, so a consumer that has seen event n and is handed
+// n+2 knows it missed one. GET /api/events?from_seq=n replays the events
+// from n on, in order, for consumers catching up or retrying deliveries.
+
+type sequencedEvent struct {
+	Seq int64 `json:"seq"`
+	bookingEvent
+}
+
+type eventPage struct {
+	Events []sequencedEvent `json:"events"`
+	// NextSeq is the from_seq of the next page.
+	NextSeq   int64 `json:"next_seq"`
+	LatestSeq int64 `json:"latest_seq"`
+}
+
+// getSequencedEvents returns up to limit events numbered after after, of
+// one booker's bookings unless all is set.
+func getSequencedEvents(after int64, bookerId string, all bool, limit int) ([]sequencedEvent, error) {
+	query := `SELECT event_seq, event_type, event_created_at, event_acted_by, event_request_id, event_booking FROM booking_event WHERE event_seq > ?`
+	args := []interface{}{after}
+	if !all {
+		query += ` AND event_booker_id = ?`
+		args = append(args, bookerId)
+	}
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, query+` ORDER BY event_seq LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	events := make([]sequencedEvent, 0)
+	for results.Next() {
+		var e sequencedEvent
+		var snapshot []byte
+		if err := results.Scan(&e.Seq, &e.Event, sqlTime{&e.At}, &e.ActedBy, &e.RequestId, &snapshot); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		if err := json.Unmarshal(snapshot, &e.Booking); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, results.Err()
+}
+
+// latestSeq is the number of the last event appended.
+func latestSeq() (int64, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	var seq int64
+	err := Db.QueryRowContext(ctx, `SELECT sequence_value FROM event_sequence WHERE sequence_name = 'booking_event'`).Scan(&seq)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return seq, err
+}
+
+// handlerEvents serves GET /api/events?from_seq=&limit= for admins.
+// from_seq defaults to 1, limit to 100 and is at most 1000.
+func handlerEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	from, limit := int64(1), 100
+	if v := query.Get("from_seq"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			writeError(w, r, http.StatusBadRequest, "invalid_cursor")
+			return
+		}
+		from = n
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			writeError(w, r, http.StatusBadRequest, "invalid_limit")
+			return
+		}
+		limit = n
+	}
+	latest, err := latestSeq()
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	events, err := getSequencedEvents(from-1, "", true, limit)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	page := eventPage{Events: events, NextSeq: from, LatestSeq: latest}
+	if len(events) > 0 {
+		page.NextSeq = events[len(events)-1].Seq + 1
+	}
+	if len(events) == limit {
+		paginate(w, r, pagination{"from_seq", strconv.FormatInt(page.NextSeq, 10), limit})
+	}
+	redactionFor(r).events(page.Events)
+	j, err := json.Marshal(page)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Feature flags come from, in increasing precedence, the defaults below,
+// the JSON file named by FEATURE_FLAGS_FILE and the feature_flag table. The
+// table is what the admin API writes and is re-read every
+// FEATURE_FLAGS_REFRESH so all instances pick up a flip.
+
+const flagPath = "flags"
+
+const (
+	flagApprovalWorkflow = "approval_workflow"
+	flagSuggestions      = "suggestions"
+)
+
+type featureFlag struct {
+	Name       string          `json:"name"`
+	Enabled    bool            `json:"enabled"`
+	Percentage int             `json:"percentage"`
+	Tenants    map[string]bool `json:"tenants,omitempty"`
+}
+
+var defaultFlags = []featureFlag{
+	{Name: flagApprovalWorkflow, Enabled: true, Percentage: 100},
+	{Name: flagSuggestions, Enabled: true, Percentage: 100},
+}
+
+var flags = struct {
+	sync.RWMutex
+	byName map[string]featureFlag
+}{byName: make(map[string]featureFlag)}
+
+// flagEnabled decides a flag for a tenant and a subject such as a booker id.
+// A tenant override wins; otherwise an enabled flag is on for Percentage
+// percent of subjects, chosen by a stable hash so a subject doesn't flip
+// between requests.
+func flagEnabled(name string, tenant string, subject string) bool {
+	flags.RLock()
+	flag, ok := flags.byName[name]
+	flags.RUnlock()
+	if !ok {
+		return false
+	}
+	if on, ok := flag.Tenants[tenant]; ok {
+		return on
+	}
+	if !flag.Enabled {
+		return false
+	}
+	if flag.Percentage >= 100 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name + "/" + subject))
+	return int(h.Sum32()%100) < flag.Percentage
+}
+
+func flagList() []featureFlag {
+	flags.RLock()
+	defer flags.RUnlock()
+	list := make([]featureFlag, 0, len(flags.byName))
+	for _, flag := range flags.byName {
+		list = append(list, flag)
+	}
+	return list
+}
+
+func loadFlagFile(path string) ([]featureFlag, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fileFlags []featureFlag
+	if err := json.Unmarshal(raw, &fileFlags); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return fileFlags, nil
+}
+
+func getFlagRows() ([]featureFlag, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT flag_name, flag_enabled, flag_percentage, flag_tenants FROM feature_flag`)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	rows := make([]featureFlag, 0)
+	for results.Next() {
+		var flag featureFlag
+		var tenants string
+		if err := results.Scan(&flag.Name, &flag.Enabled, &flag.Percentage, &tenants); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		if tenants != "" {
+			if err := json.Unmarshal([]byte(tenants), &flag.Tenants); err != nil {
+				log.Printf("flag %s: %v", flag.Name, err)
+			}
+		}
+		rows = append(rows, flag)
+	}
+	return rows, results.Err()
+}
+
+func saveFlag(flag featureFlag) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	tenants := ""
+	if len(flag.Tenants) > 0 {
+		j, err := json.Marshal(flag.Tenants)
+		if err != nil {
+			return err
+		}
+		tenants = string(j)
+	}
+	_, err := Db.ExecContext(ctx, `INSERT INTO feature_flag (flag_name, flag_enabled, flag_percentage, flag_tenants) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE flag_enabled = VALUES(flag_enabled), flag_percentage = VALUES(flag_percentage), flag_tenants = VALUES(flag_tenants)`,
+		flag.Name, flag.Enabled, flag.Percentage, tenants)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+// reloadFlags rebuilds the flag set from all sources. On a source error the
+// previous flags stay in place.
+func reloadFlags() error {
+	byName := make(map[string]featureFlag)
+	for _, flag := range defaultFlags {
+		byName[flag.Name] = flag
+	}
+	if path := envString("FEATURE_FLAGS_FILE", ""); path != "" {
+		fileFlags, err := loadFlagFile(path)
+		if err != nil {
+			return err
+		}
+		for _, flag := range fileFlags {
+			byName[flag.Name] = flag
+		}
+	}
+	rows, err := getFlagRows()
+	if err != nil {
+		return err
+	}
+	for _, flag := range rows {
+		byName[flag.Name] = flag
+	}
+	flags.Lock()
+	flags.byName = byName
+	flags.Unlock()
+	return nil
+}
+
+func startFlagRefresh() {
+	if err := reloadFlags(); err != nil {
+		log.Printf("flags: %v", err)
+	}
+	startJob("flags", envDuration("FEATURE_FLAGS_REFRESH", 30*time.Second), func() {
+		if err := reloadFlags(); err != nil {
+			log.Printf("flags: %v", err)
+		}
+	})
+}
+
+// handlerAdminFlags serves /api/admin/flags and /api/admin/flags/{name}.
+func handlerAdminFlags(w http.ResponseWriter, r *http.Request) {
+	urlPathSegments := strings.Split(r.URL.Path, fmt.Sprintf("%s/", flagPath))
+	name := ""
+	if len(urlPathSegments) > 1 {
+		name = urlPathSegments[len(urlPathSegments)-1]
+	}
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		j, err := json.Marshal(flagList())
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+	case r.Method == http.MethodPut && name != "":
+		flag := featureFlag{Percentage: 100}
+		err := json.NewDecoder(r.Body).Decode(&flag)
+		if err != nil || flag.Percentage < 0 || flag.Percentage > 100 {
+			log.Print(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		flag.Name = name
+		if err := saveFlag(flag); err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		if err := reloadFlags(); err != nil {
+			log.Printf("flags: %v", err)
+		}
+		recordAudit(r, "admin.flag", "flag", name, flag)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
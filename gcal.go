@@ -0,0 +1,569 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Optional Google Calendar mirroring. Enabled by pointing
+// GCAL_CREDENTIALS_FILE at a service-account key with access to the
+// calendars set on classrooms through /api/classrooms/{id}/calendar.
+
+const calendarPath = "calendar"
+const calendarApi = "https://www.googleapis.com/calendar/v3"
+const calendarWallLayout = "2006-01-02T15:04:05"
+
+type serviceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenUri    string `json:"token_uri"`
+}
+
+type calendarClient struct {
+	account     serviceAccount
+	key         *rsa.PrivateKey
+	importAs    string
+	http        *http.Client
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+type calendarTime struct {
+	Date     string `json:"date,omitempty"`
+	DateTime string `json:"dateTime,omitempty"`
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+type calendarEvent struct {
+	Id                 string       `json:"id,omitempty"`
+	Status             string       `json:"status,omitempty"`
+	Summary            string       `json:"summary,omitempty"`
+	Start              calendarTime `json:"start"`
+	End                calendarTime `json:"end"`
+	ExtendedProperties *struct {
+		Private map[string]string `json:"private"`
+	} `json:"extendedProperties,omitempty"`
+}
+
+type calendarMapping struct {
+	BookingId  int
+	CalendarId string
+	EventId    string
+	Imported   bool
+}
+
+func setupCalendarSync() {
+	path := envString("GCAL_CREDENTIALS_FILE", "")
+	if path == "" {
+		return
+	}
+	client, err := newCalendarClient(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bookingEventHandlers = append(bookingEventHandlers, client.handleBookingEvent)
+	startJob("calendar-reconcile", envDuration("GCAL_SYNC_INTERVAL", 10*time.Minute), client.reconcile)
+}
+
+func newCalendarClient(path string) (*calendarClient, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var account serviceAccount
+	if err := json.Unmarshal(raw, &account); err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, errors.New("gcal: no private key in credentials file")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("gcal: private key is not RSA")
+	}
+	if account.TokenUri == "" {
+		account.TokenUri = "https://oauth2.googleapis.com/token"
+	}
+	return &calendarClient{
+		account:  account,
+		key:      key,
+		importAs: envString("GCAL_IMPORT_BOOKER_ID", ""),
+		http:     &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// accessToken exchanges a self-signed JWT for an OAuth access token, reusing
+// it until shortly before it expires.
+func (c *calendarClient) accessToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Before(c.tokenExpiry) {
+		return c.token, nil
+	}
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   c.account.ClientEmail,
+		"scope": "https://www.googleapis.com/auth/calendar",
+		"aud":   c.account.TokenUri,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	}
+	resp, err := c.http.PostForm(c.account.TokenUri, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("gcal token: %s", resp.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	c.token = token.AccessToken
+	c.tokenExpiry = now.Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return c.token, nil
+}
+
+func (c *calendarClient) do(method string, path string, in interface{}, out interface{}) error {
+	token, err := c.accessToken()
+	if err != nil {
+		return err
+	}
+	var body io.Reader
+	if in != nil {
+		j, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(j)
+	}
+	req, err := http.NewRequest(method, calendarApi+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone || resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("gcal %s %s: %s", method, path, resp.Status)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+func (c *calendarClient) eventFor(b booking) (calendarEvent, error) {
+	start, end, err := bookingWindow(b)
+	if err != nil {
+		return calendarEvent{}, err
+	}
+	event := calendarEvent{Summary: b.BookingTitle}
+	if event.Summary == "" {
+		event.Summary = fmt.Sprintf("Booked by %s", b.BookingBookerId)
+	}
+	if b.BookingDuration == 0 {
+		event.Start.Date, event.End.Date = start.Format(bookingDateLayout), end.Format(bookingDateLayout)
+	} else {
+		tz := bookingLocation.String()
+		event.Start = calendarTime{DateTime: start.Format(calendarWallLayout), TimeZone: tz}
+		event.End = calendarTime{DateTime: end.Format(calendarWallLayout), TimeZone: tz}
+	}
+	event.ExtendedProperties = &struct {
+		Private map[string]string `json:"private"`
+	}{map[string]string{"bookingId": strconv.Itoa(b.BookingId)}}
+	return event, nil
+}
+
+// bookingTimeFor converts an event back to a booking time and duration in
+// the booking time zone.
+func (c *calendarClient) bookingTimeFor(event calendarEvent) (string, int, error) {
+	if event.Start.Date != "" {
+		return event.Start.Date, 0, nil
+	}
+	start, err := time.Parse(time.RFC3339, event.Start.DateTime)
+	if err != nil {
+		return "", 0, err
+	}
+	end, err := time.Parse(time.RFC3339, event.End.DateTime)
+	if err != nil {
+		return "", 0, err
+	}
+	return start.In(bookingLocation).Format(bookingTimeLayout), int(end.Sub(start).Minutes()), nil
+}
+
+func (c *calendarClient) mirror(calendarId string, b booking) {
+	event, err := c.eventFor(b)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	var created calendarEvent
+	if err := c.do(http.MethodPost, "/calendars/"+url.PathEscape(calendarId)+"/events", event, &created); err != nil {
+		log.Print(err)
+		return
+	}
+	saveCalendarMapping(calendarMapping{b.BookingId, calendarId, created.Id, false})
+}
+
+func (c *calendarClient) handleBookingEvent(event string, b booking) {
+	switch event {
+	case eventBookingCreated, eventBookingApproved:
+		if b.BookingStatus != bookingStatusConfirmed {
+			return
+		}
+		calendarId, err := getClassroomCalendar(b.BookingClassroomId)
+		if err != nil || calendarId == "" {
+			return
+		}
+		c.mirror(calendarId, b)
+	case eventBookingCancelled, eventBookingPreempted:
+		c.unmirror(b.BookingId)
+	case eventBookingRescheduled:
+		// The booking may have moved to a classroom with another calendar,
+		// or none, so its event is replaced rather than patched.
+		if !c.unmirror(b.BookingId) || b.BookingStatus != bookingStatusConfirmed {
+			return
+		}
+		calendarId, err := getClassroomCalendar(b.BookingClassroomId)
+		if err != nil || calendarId == "" {
+			return
+		}
+		c.mirror(calendarId, b)
+	}
+}
+
+// unmirror deletes the mirrored event of a booking, reporting false if it
+// couldn't be deleted or looked up, so that a reschedule doesn't mirror
+// the booking twice. Bookings that aren't mirrored have nothing to delete.
+func (c *calendarClient) unmirror(bookingId int) bool {
+	m, err := getCalendarMapping(bookingId)
+	if err != nil {
+		return false
+	}
+	if m == nil {
+		return true
+	}
+	if err := c.do(http.MethodDelete, "/calendars/"+url.PathEscape(m.CalendarId)+"/events/"+url.PathEscape(m.EventId), nil, nil); err != nil {
+		log.Print(err)
+		return false
+	}
+	removeCalendarMapping(bookingId)
+	return true
+}
+
+// reconcile brings every mirrored calendar in line with the booking table.
+// Bookings are the source of truth for mirrored events: external edits are
+// reverted and external deletions re-created. Events created directly in the
+// calendar become blocking bookings when GCAL_IMPORT_BOOKER_ID is set, and
+// follow later edits and deletions of those events.
+func (c *calendarClient) reconcile() {
+	calendars, err := getClassroomCalendars()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	timeMin := now.AddDate(0, 0, -1).Format(time.RFC3339)
+	timeMax := now.AddDate(0, 0, envInt("GCAL_SYNC_DAYS", 30)).Format(time.RFC3339)
+	for classroomId, calendarId := range calendars {
+		var list struct {
+			Items []calendarEvent `json:"items"`
+		}
+		query := url.Values{"timeMin": {timeMin}, "timeMax": {timeMax}, "singleEvents": {"true"}, "showDeleted": {"true"}, "maxResults": {"2500"}}
+		if err := c.do(http.MethodGet, "/calendars/"+url.PathEscape(calendarId)+"/events?"+query.Encode(), nil, &list); err != nil {
+			log.Print(err)
+			continue
+		}
+		mappings, err := getCalendarMappings(calendarId)
+		if err != nil {
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, event := range list.Items {
+			seen[event.Id] = true
+			m, mapped := mappings[event.Id]
+			if mapped && !m.Imported {
+				c.reconcileMirrored(calendarId, m, event)
+			} else {
+				c.reconcileImported(classroomId, calendarId, m, mapped, event)
+			}
+		}
+		for eventId, m := range mappings {
+			if !seen[eventId] && !m.Imported {
+				b, err := bookingStore.GetBooking(m.BookingId)
+				if err == nil && b == nil {
+					removeCalendarMapping(m.BookingId)
+				}
+			}
+		}
+	}
+}
+
+func (c *calendarClient) reconcileMirrored(calendarId string, m calendarMapping, event calendarEvent) {
+	b, err := bookingStore.GetBooking(m.BookingId)
+	if err != nil {
+		return
+	}
+	eventPath := "/calendars/" + url.PathEscape(calendarId) + "/events/" + url.PathEscape(event.Id)
+	if b == nil {
+		if event.Status != "cancelled" {
+			c.do(http.MethodDelete, eventPath, nil, nil)
+		}
+		removeCalendarMapping(m.BookingId)
+		return
+	}
+	if event.Status == "cancelled" {
+		removeCalendarMapping(m.BookingId)
+		c.mirror(calendarId, *b)
+		return
+	}
+	bookingTime, duration, err := c.bookingTimeFor(event)
+	if err != nil || bookingTime != strings.TrimSpace(b.BookingTime) || duration != b.BookingDuration {
+		want, err := c.eventFor(*b)
+		if err == nil {
+			c.do(http.MethodPatch, eventPath, want, nil)
+		}
+	}
+}
+
+func (c *calendarClient) reconcileImported(classroomId string, calendarId string, m calendarMapping, mapped bool, event calendarEvent) {
+	if event.ExtendedProperties != nil && event.ExtendedProperties.Private["bookingId"] != "" {
+		return
+	}
+	if event.Status == "cancelled" {
+		if mapped {
+			bookingStore.RemoveBooking(m.BookingId)
+			applyToSchedule(eventBookingCancelled, booking{BookingId: m.BookingId})
+			removeCalendarMapping(m.BookingId)
+		}
+		return
+	}
+	bookingTime, duration, err := c.bookingTimeFor(event)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if mapped {
+		if updateBookingTime(m.BookingId, bookingTime, duration) == nil {
+			if b, err := bookingStore.GetBooking(m.BookingId); err == nil && b != nil {
+				applyToSchedule(eventBookingRescheduled, *b)
+			}
+		}
+		return
+	}
+	if c.importAs == "" {
+		return
+	}
+	b := booking{BookingTime: bookingTime, BookingClassroomId: classroomId, BookingBookerId: c.importAs, BookingDuration: duration, BookingTitle: event.Summary, BookingStatus: bookingStatusConfirmed}
+	if conflicts, err := findConflicts(b); err != nil || len(conflicts) > 0 {
+		log.Printf("gcal: not importing event %s into classroom %s: slot taken", event.Id, classroomId)
+		return
+	}
+	b.BookingPublicId = newPublicId()
+	bookingId, err := bookingStore.InsertBooking(b)
+	if err != nil {
+		return
+	}
+	b.BookingId = bookingId
+	applyToSchedule(eventBookingCreated, b)
+	saveCalendarMapping(calendarMapping{bookingId, calendarId, event.Id, true})
+}
+
+func getClassroomCalendar(classroomId string) (string, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	var calendarId string
+	err := Db.QueryRowContext(ctx, `SELECT classroom_calendar_id FROM classroom WHERE classroom_id = ?`, classroomId).Scan(&calendarId)
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	return calendarId, nil
+}
+
+func getClassroomCalendars() (map[string]string, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT classroom_id, classroom_calendar_id FROM classroom WHERE classroom_calendar_id <> ''`)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	calendars := make(map[string]string)
+	for results.Next() {
+		var classroomId, calendarId string
+		if err := results.Scan(&classroomId, &calendarId); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		calendars[classroomId] = calendarId
+	}
+	return calendars, results.Err()
+}
+
+func updateClassroomCalendar(classroomId string, calendarId string) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `UPDATE classroom SET classroom_calendar_id = ? WHERE classroom_id = ?`, calendarId, classroomId)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+func updateBookingTime(bookingId int, bookingTime string, duration int) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `UPDATE booking SET booking_time = ?, booking_duration = ? WHERE booking_id = ?`, bookingTime, duration, bookingId)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+func getCalendarMapping(bookingId int) (*calendarMapping, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	m := &calendarMapping{}
+	err := Db.QueryRowContext(ctx, `SELECT booking_id, calendar_id, calendar_event_id, calendar_event_imported FROM booking_calendar_event WHERE booking_id = ?`, bookingId).Scan(&m.BookingId, &m.CalendarId, &m.EventId, &m.Imported)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	return m, nil
+}
+
+func getCalendarMappings(calendarId string) (map[string]calendarMapping, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT booking_id, calendar_id, calendar_event_id, calendar_event_imported FROM booking_calendar_event WHERE calendar_id = ?`, calendarId)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	mappings := make(map[string]calendarMapping)
+	for results.Next() {
+		var m calendarMapping
+		if err := results.Scan(&m.BookingId, &m.CalendarId, &m.EventId, &m.Imported); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		mappings[m.EventId] = m
+	}
+	return mappings, results.Err()
+}
+
+func saveCalendarMapping(m calendarMapping) {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `REPLACE INTO booking_calendar_event (booking_id, calendar_id, calendar_event_id, calendar_event_imported) VALUES (?, ?, ?, ?)`, m.BookingId, m.CalendarId, m.EventId, m.Imported)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func removeCalendarMapping(bookingId int) {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `DELETE FROM booking_calendar_event WHERE booking_id = ?`, bookingId)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// handlerClassroomCalendar serves /api/classrooms/{id}/calendar. The
+// calendar is sent the classroom's bookings and its events block the
+// classroom, so only admins and the classroom's managers see or change it.
+func handlerClassroomCalendar(w http.ResponseWriter, r *http.Request, classroomId string) {
+	if r.Method != http.MethodOptions && !authorizeManager(w, r, classroomId, classroomOwner, classroomManager) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		calendarId, err := getClassroomCalendar(classroomId)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		j, err := json.Marshal(map[string]string{"calendar_id": calendarId})
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+	case http.MethodPut:
+		var update struct {
+			CalendarId string `json:"calendar_id"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&update)
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := updateClassroomCalendar(classroomId, update.CalendarId); err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+	case http.MethodOptions:
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+const exportPath = "export"
+const dataPath = "data"
+
+// anonymousBookerId owns the bookings of erased bookers so utilization
+// statistics keep counting them.
+const anonymousBookerId = "anonymous"
+
+type penalty struct {
+	PenaltyId int    `json:"penalty_id"`
+	BookingId int    `json:"booking_id"`
+	Kind      string `json:"kind"`
+	CreatedAt string `json:"created_at"`
+}
+
+type bookerExport struct {
+	ExportedAt  time.Time              `json:"exported_at"`
+	BookerId    string                 `json:"booker_id"`
+	BookerName  string                 `json:"booker_name"`
+	Bookings    []bookingResponse      `json:"bookings"`
+	Templates   []bookingTemplate      `json:"templates"`
+	Favorites   []classroom            `json:"favorites"`
+	Preferences notificationPreference `json:"preferences"`
+	Penalties   []penalty              `json:"penalties"`
+	Standing    bookerStanding         `json:"standing"`
+}
+
+func getStudentName(studentId string) (*string, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	var name string
+	err := Db.QueryRowContext(ctx, `SELECT student_name FROM student WHERE student_id = ?`, studentId).Scan(&name)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return &name, nil
+}
+
+func getPenaltyList(bookerId string) ([]penalty, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT penalty_id, penalty_booking_id, penalty_kind, penalty_created_at FROM booker_penalty WHERE penalty_booker_id = ? ORDER BY penalty_id`, bookerId)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	penalties := make([]penalty, 0)
+	for results.Next() {
+		var p penalty
+		if err := results.Scan(&p.PenaltyId, &p.BookingId, &p.Kind, &p.CreatedAt); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		penalties = append(penalties, p)
+	}
+	return penalties, results.Err()
+}
+
+func exportBooker(bookerId string) (*bookerExport, error) {
+	name, err := getStudentName(bookerId)
+	if err != nil || name == nil {
+		return nil, err
+	}
+	export := &bookerExport{ExportedAt: time.Now().UTC(), BookerId: bookerId, BookerName: *name}
+	bookings, err := bookingStore.GetBooker(bookerId)
+	if err != nil {
+		return nil, err
+	}
+	export.Bookings = newBookingResponses(bookings)
+	if export.Templates, err = getTemplateList(bookerId); err != nil {
+		return nil, err
+	}
+	if export.Favorites, err = getFavoriteList(bookerId); err != nil {
+		return nil, err
+	}
+	if export.Preferences, err = getPreference(scopeBooker, bookerId); err != nil {
+		return nil, err
+	}
+	if export.Penalties, err = getPenaltyList(bookerId); err != nil {
+		return nil, err
+	}
+	if export.Standing, err = getStanding(bookerId); err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+// eraseBooker hands the booker's bookings to the anonymous booker, stripped
+// of their titles, and deletes everything else that identifies them. It
+// returns the number of bookings anonymized.
+func eraseBooker(bookerId string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tx, err := Db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx, `UPDATE booking SET booking_student_id = ?, booking_title = '' WHERE booking_student_id = ?`, anonymousBookerId, bookerId)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+	anonymized, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE booking_event SET event_booker_id = ?, event_booking = JSON_SET(event_booking, '$.booker_id', ?, '$.booking_title', '')
+		WHERE event_booker_id = ?`, anonymousBookerId, anonymousBookerId, bookerId)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+	for _, stmt := range []string{
+		`DELETE FROM booking_template WHERE template_booker_id = ?`,
+		`DELETE o FROM booking_occurrence o JOIN booking_series s ON s.series_id = o.occurrence_series_id WHERE s.series_booker_id = ?`,
+		`DELETE FROM booking_series WHERE series_booker_id = ?`,
+		`DELETE FROM favorite_classroom WHERE favorite_booker_id = ?`,
+		`DELETE FROM notification_preference WHERE preference_scope = 'booker' AND preference_owner_id = ?`,
+		`DELETE FROM notification_digest WHERE digest_scope = 'booker' AND digest_owner_id = ?`,
+		`DELETE FROM booker_penalty WHERE penalty_booker_id = ?`,
+		`DELETE FROM booker_group_member WHERE member_booker_id = ?`,
+		`DELETE FROM booking_waitlist WHERE waitlist_booker_id = ?`,
+		`DELETE FROM booking_receipt WHERE receipt_booker_id = ?`,
+		`DELETE FROM api_key WHERE api_key_booker_id = ?`,
+		`DELETE FROM student WHERE student_id = ?`,
+	} {
+		if _, err := tx.ExecContext(ctx, stmt, bookerId); err != nil {
+			log.Println(err.Error())
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	apiKeyCache.Lock()
+	apiKeyCache.keys = make(map[string]cachedApiKey)
+	apiKeyCache.Unlock()
+	return anonymized, nil
+}
+
+func handlerBookerExport(w http.ResponseWriter, r *http.Request, bookerId string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeBooker(w, r, bookerId) {
+		return
+	}
+	export, err := exportBooker(bookerId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	if export == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	j, err := json.Marshal(export)
+	if err != nil {
+		log.Fatal(err)
+	}
+	recordAudit(r, "booker.export", "booker", bookerId, map[string]int{"bookings": len(export.Bookings)})
+	w.Header().Set("Content-Disposition", `attachment; filename="booker-`+bookerId+`.json"`)
+	w.Write(j)
+}
+
+func handlerBookerData(w http.ResponseWriter, r *http.Request, bookerId string) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeBooker(w, r, bookerId) {
+		return
+	}
+	if bookerId == anonymousBookerId {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	name, err := getStudentName(bookerId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	if name == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	anonymized, err := eraseBooker(bookerId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	recordAudit(r, "booker.erase", "booker", bookerId, map[string]int64{"bookings_anonymized": anonymized})
+	w.WriteHeader(http.StatusNoContent)
+}
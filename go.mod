@@ -2,4 +2,17 @@ module github.com/Supamongkol-kid/Practise-GO
 
 go 1.19
 
-require github.com/go-sql-driver/mysql v1.6.0 // indirect
+require (
+	github.com/go-sql-driver/mysql v1.6.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	golang.org/x/net v0.17.0
+	golang.org/x/sync v0.4.0
+	gorm.io/driver/mysql v1.3.6
+	gorm.io/gorm v1.23.10
+)
+
+require (
+	github.com/jinzhu/inflection v1.0.0 // indirect
+	github.com/jinzhu/now v1.1.5 // indirect
+	golang.org/x/text v0.13.0 // indirect
+)
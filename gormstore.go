@@ -0,0 +1,220 @@
+//go:build gorm
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Building with -tags gorm adds a GORM backed booking store, picked with
+// BOOKING_STORE=gorm. It shares the connection pool with the rest of the
+// service and leaves the schema to the migrations.
+func init() {
+	bookingBackends["gorm"] = func(db *sql.DB) (BookingRepository, error) {
+		orm, err := gorm.Open(mysql.New(mysql.Config{Conn: db}), &gorm.Config{
+			Logger:                 logger.Default.LogMode(logger.Warn),
+			SkipDefaultTransaction: true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return gormBookingRepository{db: orm}, nil
+	}
+}
+
+// gormBooking is the booking row as GORM maps it. booking_updated_at is
+// maintained by the database.
+type gormBooking struct {
+	BookingId          int            `gorm:"column:booking_id;primaryKey"`
+	BookingTime        string         `gorm:"column:booking_time"`
+	BookingClassroomId string         `gorm:"column:booking_classroom_id"`
+	BookingBookerId    string         `gorm:"column:booking_student_id"`
+	BookingDuration    int            `gorm:"column:booking_duration"`
+	BookingTitle       string         `gorm:"column:booking_title"`
+	BookingStatus      string         `gorm:"column:booking_status"`
+	BookingUpdatedAt   gormTime       `gorm:"column:booking_updated_at;<-:false"`
+	BookingPublicId    sql.NullString `gorm:"column:booking_public_id"`
+	BookingSeats       int            `gorm:"column:booking_seats"`
+	BookingGroupId     sql.NullString `gorm:"column:booking_group_id"`
+	BookingPriority    int            `gorm:"column:booking_priority"`
+	BookingTenant      string         `gorm:"column:booking_tenant"`
+}
+
+func (gormBooking) TableName() string {
+	return "booking"
+}
+
+// gormTime scans the text datetimes the connection returns without
+// parseTime.
+type gormTime struct {
+	time.Time
+}
+
+func (t *gormTime) Scan(value interface{}) error {
+	return sqlTime{&t.Time}.Scan(value)
+}
+
+func (row gormBooking) booking() booking {
+	return booking{
+		BookingId:          row.BookingId,
+		BookingTime:        row.BookingTime,
+		BookingClassroomId: row.BookingClassroomId,
+		BookingBookerId:    row.BookingBookerId,
+		BookingDuration:    row.BookingDuration,
+		BookingTitle:       row.BookingTitle,
+		BookingStatus:      row.BookingStatus,
+		BookingUpdatedAt:   row.BookingUpdatedAt.Time,
+		BookingPublicId:    row.BookingPublicId.String,
+		BookingSeats:       row.BookingSeats,
+		BookingGroupId:     row.BookingGroupId.String,
+		BookingPriority:    row.BookingPriority,
+	}
+}
+
+// gormBookingRepository limits its queries to the bookings of tenant, as
+// the SQL store does; without one it sees every tenant's.
+type gormBookingRepository struct {
+	db     *gorm.DB
+	tenant string
+}
+
+func (repo gormBookingRepository) forTenant(tenant string) BookingRepository {
+	repo.tenant = tenant
+	return repo
+}
+
+func (repo gormBookingRepository) query(conditions ...condition) *gorm.DB {
+	q := repo.db.Model(&gormBooking{})
+	if repo.tenant != "" {
+		conditions = append(conditions, colBookingTenant.eq(repo.tenant))
+	}
+	for _, c := range conditions {
+		q = q.Where(c.sql, c.args...)
+	}
+	return q
+}
+
+func (repo gormBookingRepository) first(conditions ...condition) (*booking, error) {
+	var rows []gormBooking
+	if err := repo.query(conditions...).Limit(1).Find(&rows).Error; err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	b := rows[0].booking()
+	return &b, nil
+}
+
+func (repo gormBookingRepository) GetBooking(bookingId int) (*booking, error) {
+	return repo.first(colBookingId.eq(bookingId))
+}
+
+func (repo gormBookingRepository) GetBookingByPublicId(publicId string) (*booking, error) {
+	return repo.first(colBookingPublicId.eq(publicId))
+}
+
+func (repo gormBookingRepository) GetBooker(bookerId string) ([]booking, error) {
+	var rows []gormBooking
+	if err := repo.query(colBookingBookerId.eq(bookerId)).Find(&rows).Error; err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	bookings := make([]booking, len(rows))
+	for i, row := range rows {
+		bookings[i] = row.booking()
+	}
+	return bookings, nil
+}
+
+// GetBookingList selects only the requested columns, so it scans them the
+// way the SQL store does.
+func (repo gormBookingRepository) GetBookingList(filter bookingFilter, fields []bookingField) ([]booking, error) {
+	q := repo.query(filter.where()...).Select(bookingFieldColumns(fields))
+	if filter.Limit > 0 {
+		q = q.Order(filter.order()).Limit(filter.Limit)
+	}
+	results, err := q.Rows()
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	bookings, err := scanBookings(results, fields, int(bookingListSizeHint.Load()))
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	bookingListSizeHint.Store(int64(len(bookings)))
+	return bookings, nil
+}
+
+func (repo gormBookingRepository) InsertBooking(b booking) (int, error) {
+	if b.BookingPublicId == "" {
+		b.BookingPublicId = newPublicId()
+	}
+	if b.Tenant == "" {
+		b.Tenant = repo.tenant
+	}
+	row := gormBooking{
+		BookingTime:        b.BookingTime,
+		BookingClassroomId: b.BookingClassroomId,
+		BookingBookerId:    b.BookingBookerId,
+		BookingDuration:    b.BookingDuration,
+		BookingTitle:       b.BookingTitle,
+		BookingStatus:      b.BookingStatus,
+		BookingPublicId:    sql.NullString{String: b.BookingPublicId, Valid: true},
+		BookingSeats:       b.BookingSeats,
+		BookingGroupId:     sql.NullString{String: b.BookingGroupId, Valid: b.BookingGroupId != ""},
+		BookingPriority:    int(b.priority()),
+		BookingTenant:      b.tenant(),
+	}
+	if b.BookingSeats > 0 {
+		if err := repo.reserveSeats(b, &row); err != nil {
+			return 0, translateWriteError(err)
+		}
+		return row.BookingId, nil
+	}
+	if err := repo.db.Create(&row).Error; err != nil {
+		log.Println(err.Error())
+		return 0, translateWriteError(err)
+	}
+	return row.BookingId, nil
+}
+
+// reserveSeats counts the seats taken and inserts the reservation in one
+// transaction, as the SQL store does.
+func (repo gormBookingRepository) reserveSeats(b booking, row *gormBooking) error {
+	err := repo.db.Transaction(func(tx *gorm.DB) error {
+		ctx, cancel := queryContext(queryWrite)
+		defer cancel()
+		conflicts, err := lockedConflicts(ctx, tx.Statement.ConnPool, b)
+		if err != nil {
+			return err
+		}
+		if len(conflicts) > 0 {
+			return errNoSeats
+		}
+		return tx.Create(row).Error
+	})
+	if err != nil && !errors.Is(err, errNoSeats) {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+func (repo gormBookingRepository) RemoveBooking(bookingId int) error {
+	if err := repo.query(colBookingId.eq(bookingId)).Delete(&gormBooking{}).Error; err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const groupPath = "groups"
+const memberPath = "members"
+
+// A booker group, such as a course section, books classrooms together:
+// any member can make a booking on behalf of the group, and the group's
+// managers can reschedule or cancel every booking made for it. Admins and
+// manager keys create groups and act as managers of all of them.
+const (
+	groupMember  = "member"
+	groupManager = "manager"
+)
+
+type groupMembership struct {
+	BookerId string `json:"booker_id"`
+	Role     string `json:"role"`
+}
+
+type bookerGroup struct {
+	GroupId string            `json:"group_id"`
+	Name    string            `json:"name"`
+	Members []groupMembership `json:"members,omitempty"`
+}
+
+// groupSummary is a group as expanded in booking responses.
+type groupSummary struct {
+	GroupId string `json:"group_id"`
+	Name    string `json:"name"`
+}
+
+func getGroup(groupId string) (*bookerGroup, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	g := &bookerGroup{}
+	err := Db.QueryRowContext(ctx, `SELECT group_id, group_name FROM booker_group WHERE group_id = ?`, groupId).Scan(&g.GroupId, &g.Name)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	results, err := Db.QueryContext(ctx, `SELECT member_booker_id, member_role FROM booker_group_member WHERE member_group_id = ? ORDER BY member_role DESC, member_booker_id`, groupId)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	g.Members = make([]groupMembership, 0)
+	for results.Next() {
+		var m groupMembership
+		if err := results.Scan(&m.BookerId, &m.Role); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		g.Members = append(g.Members, m)
+	}
+	return g, results.Err()
+}
+
+// getGroupList lists every group, or only those bookerId belongs to when it
+// isn't empty.
+func getGroupList(bookerId string) ([]bookerGroup, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	query, args := `SELECT group_id, group_name FROM booker_group ORDER BY group_name`, []interface{}{}
+	if bookerId != "" {
+		query = `SELECT g.group_id, g.group_name FROM booker_group g JOIN booker_group_member m ON m.member_group_id = g.group_id
+			WHERE m.member_booker_id = ? ORDER BY g.group_name`
+		args = append(args, bookerId)
+	}
+	results, err := Db.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	groups := make([]bookerGroup, 0)
+	for results.Next() {
+		var g bookerGroup
+		if err := results.Scan(&g.GroupId, &g.Name); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, results.Err()
+}
+
+// getGroupNames returns the names of the groups in groupIds by id.
+func getGroupNames(groupIds []string) (map[string]string, error) {
+	names := map[string]string{}
+	if len(groupIds) == 0 {
+		return names, nil
+	}
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	args := make([]interface{}, len(groupIds))
+	for i, groupId := range groupIds {
+		args[i] = groupId
+	}
+	results, err := Db.QueryContext(ctx, `SELECT group_id, group_name FROM booker_group WHERE group_id IN (?`+strings.Repeat(", ?", len(groupIds)-1)+`)`, args...)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	for results.Next() {
+		var groupId, name string
+		if err := results.Scan(&groupId, &name); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		names[groupId] = name
+	}
+	return names, results.Err()
+}
+
+// insertGroup creates g with its members in one transaction.
+func insertGroup(g bookerGroup) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	tx, err := Db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `INSERT INTO booker_group (group_id, group_name) VALUES (?, ?)`, g.GroupId, g.Name); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	for _, m := range g.Members {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO booker_group_member (member_group_id, member_booker_id, member_role) VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE member_role = VALUES(member_role)`, g.GroupId, m.BookerId, m.Role); err != nil {
+			log.Println(err.Error())
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// removeGroup deletes a group. Its bookings stay, made by their bookers
+// alone.
+func removeGroup(groupId string) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	tx, err := Db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		`UPDATE booking SET booking_group_id = NULL WHERE booking_group_id = ?`,
+		`DELETE FROM booker_group_member WHERE member_group_id = ?`,
+		`DELETE FROM booker_group WHERE group_id = ?`,
+	} {
+		if _, err := tx.ExecContext(ctx, stmt, groupId); err != nil {
+			log.Println(err.Error())
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func saveGroupMember(groupId string, m groupMembership) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `INSERT INTO booker_group_member (member_group_id, member_booker_id, member_role) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE member_role = VALUES(member_role)`, groupId, m.BookerId, m.Role)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+func removeGroupMember(groupId string, bookerId string) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `DELETE FROM booker_group_member WHERE member_group_id = ? AND member_booker_id = ?`, groupId, bookerId)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+// groupRole is the role bookerId holds in a group, or "" if none.
+func groupRole(groupId string, bookerId string) (string, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	var role string
+	err := Db.QueryRowContext(ctx, `SELECT member_role FROM booker_group_member WHERE member_group_id = ? AND member_booker_id = ?`, groupId, bookerId).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		log.Println(err.Error())
+		return "", err
+	}
+	return role, nil
+}
+
+// callerGroupRole is the role the caller holds in a group. Admins and
+// manager keys manage every group.
+func callerGroupRole(caller *apiKey, groupId string) (string, error) {
+	switch {
+	case caller == nil:
+		return "", nil
+	case caller.Role == roleAdmin || caller.Role == roleManager:
+		return groupManager, nil
+	case caller.BookerId == "":
+		return "", nil
+	}
+	return groupRole(groupId, caller.BookerId)
+}
+
+// managesGroupBooking reports whether bookerId manages the group b was
+// booked for.
+func managesGroupBooking(b *booking, bookerId string) bool {
+	if b.BookingGroupId == "" || bookerId == "" {
+		return false
+	}
+	role, err := groupRole(b.BookingGroupId, bookerId)
+	if err != nil {
+		return false
+	}
+	return role == groupManager
+}
+
+// applyGroupBooking checks that the caller may book for the group b names,
+// and writes the error and returns true if not.
+func applyGroupBooking(w http.ResponseWriter, r *http.Request, b booking) bool {
+	if b.BookingGroupId == "" {
+		return false
+	}
+	g, err := getGroup(b.BookingGroupId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return true
+	}
+	if g == nil {
+		writeError(w, r, http.StatusBadRequest, "unknown_group", "group", b.BookingGroupId)
+		return true
+	}
+	caller := callerOf(r)
+	if caller == nil || caller.Role == roleStudent {
+		// Bookers book for groups they belong to.
+		for _, m := range g.Members {
+			if m.BookerId == b.BookingBookerId {
+				return false
+			}
+		}
+		writeError(w, r, http.StatusForbidden, "not_group_member", "group", g.GroupId)
+		return true
+	}
+	return false
+}
+
+// responseGroupIds returns the distinct groups of booking responses, in
+// the order they first appear.
+func responseGroupIds(responses []bookingResponse) []string {
+	groupIds := []string{}
+	seen := map[string]bool{}
+	for _, response := range responses {
+		if response.GroupId != "" && !seen[response.GroupId] {
+			seen[response.GroupId] = true
+			groupIds = append(groupIds, response.GroupId)
+		}
+	}
+	return groupIds
+}
+
+// expandGroups fills in the groups of booking responses.
+func expandGroups(responses []bookingResponse) {
+	expandGroupIds(responses, responseGroupIds(responses))
+}
+
+// expandGroupIds fills in the groups of booking responses that are among
+// groupIds.
+func expandGroupIds(responses []bookingResponse, groupIds []string) {
+	if len(groupIds) == 0 {
+		return
+	}
+	names, err := getGroupNames(groupIds)
+	if err != nil {
+		return
+	}
+	for i := range responses {
+		if name, ok := names[responses[i].GroupId]; ok {
+			responses[i].Group = &groupSummary{responses[i].GroupId, name}
+		}
+	}
+}
+
+func validGroupRole(role string) bool {
+	return role == groupMember || role == groupManager
+}
+
+// handlerGroups serves GET /api/groups, every group for admins and manager
+// keys and the caller's own for bookers, and POST to create one.
+func handlerGroups(w http.ResponseWriter, r *http.Request) {
+	caller := callerOf(r)
+	if caller == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	staff := caller.Role == roleAdmin || caller.Role == roleManager
+	switch r.Method {
+	case http.MethodGet:
+		bookerId := ""
+		if !staff {
+			if caller.BookerId == "" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			bookerId = caller.BookerId
+		}
+		groups, err := getGroupList(bookerId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		j, err := json.Marshal(groups)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+	case http.MethodPost:
+		if !staff {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var g bookerGroup
+		if err := json.NewDecoder(r.Body).Decode(&g); err != nil || g.GroupId == "" || strings.Contains(g.GroupId, "/") || g.Name == "" {
+			writeError(w, r, http.StatusBadRequest, "invalid_body")
+			return
+		}
+		for i, m := range g.Members {
+			if m.Role == "" {
+				g.Members[i].Role = groupMember
+			} else if !validGroupRole(m.Role) || m.BookerId == "" {
+				writeError(w, r, http.StatusBadRequest, "invalid_body")
+				return
+			}
+		}
+		err := insertGroup(g)
+		if isDuplicateKey(err) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		recordAudit(r, "group.create", "group", g.GroupId, g)
+		w.WriteHeader(http.StatusCreated)
+		j, err := json.Marshal(g)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handlerGroup serves /api/groups/{id} and its members. Members can see the
+// group; its managers change it.
+func handlerGroup(w http.ResponseWriter, r *http.Request) {
+	urlPathSegments := strings.Split(r.URL.Path, groupPath+"/")
+	urlPathSegments = strings.Split(urlPathSegments[len(urlPathSegments)-1], "/")
+	groupId := urlPathSegments[0]
+	if groupId == "" || len(urlPathSegments) > 3 || len(urlPathSegments) > 1 && urlPathSegments[1] != memberPath {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	caller := callerOf(r)
+	if caller == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	role, err := callerGroupRole(caller, groupId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	g, err := getGroup(groupId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	if g == nil || role == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if len(urlPathSegments) == 1 || len(urlPathSegments) == 2 {
+		switch r.Method {
+		case http.MethodGet:
+			body := interface{}(g)
+			if len(urlPathSegments) == 2 {
+				body = g.Members
+			}
+			j, err := json.Marshal(body)
+			if err != nil {
+				log.Fatal(err)
+			}
+			w.Write(j)
+		case http.MethodDelete:
+			if len(urlPathSegments) == 2 {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			if role != groupManager {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if err := removeGroup(groupId); err != nil {
+				writeServiceError(w, r, err)
+				return
+			}
+			recordAudit(r, "group.remove", "group", groupId, nil)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	bookerId := urlPathSegments[2]
+	if bookerId == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		if role != groupManager {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		m := groupMembership{BookerId: bookerId, Role: groupMember}
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil && !errors.Is(err, io.EOF) || !validGroupRole(m.Role) {
+			writeError(w, r, http.StatusBadRequest, "invalid_body")
+			return
+		}
+		m.BookerId = bookerId
+		if err := saveGroupMember(groupId, m); err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		recordAudit(r, "group.member", "group", groupId, m)
+	case http.MethodDelete:
+		// Members may leave; managers remove anyone.
+		if role != groupManager && caller.BookerId != bookerId {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err := removeGroupMember(groupId, bookerId); err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		recordAudit(r, "group.member_remove", "group", groupId, bookerId)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Besides the database, /readyz checks the optional services the instance
+// is configured to use. READYZ_CRITICAL lists, comma separated, those the
+// instance is not ready without; the others are best-effort and only mark
+// it degraded, since bookings still work without them.
+
+const (
+	dependencyOk       = "ok"
+	dependencyDown     = "down"
+	readinessReady     = "ready"
+	readinessDegraded  = "degraded"
+	readinessUnhealthy = "unavailable"
+)
+
+var dependencyUp = newGauge("dependency_up", "Whether an optional dependency answered the last readiness check.", "dependency")
+
+// A dependency is an optional service checked by /readyz. address returns
+// the host:port to reach, or "" when the service isn't configured.
+type dependency struct {
+	name    string
+	address func() string
+}
+
+type dependencyStatus struct {
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+}
+
+// urlAddress returns the host:port of the URL in setting key.
+func urlAddress(key string) func() string {
+	return func() string {
+		u, err := url.Parse(envString(key, ""))
+		if err != nil || u.Host == "" {
+			return ""
+		}
+		if u.Port() != "" {
+			return u.Host
+		}
+		if u.Scheme == "http" {
+			return net.JoinHostPort(u.Hostname(), "80")
+		}
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+}
+
+var dependencies = []dependency{
+	{"smtp", func() string { return envString("SMTP_ADDR", "") }},
+	{"policy_webhook", urlAddress("POLICY_WEBHOOK_URL")},
+	{"cache_purge", urlAddress("CACHE_PURGE_URL")},
+	{"google_calendar", func() string {
+		if envString("GCAL_CREDENTIALS_FILE", "") == "" {
+			return ""
+		}
+		return "www.googleapis.com:443"
+	}},
+	{"access_provider", func() string {
+		if envString("ACCESS_PROVIDER", "") != "http" {
+			return ""
+		}
+		return urlAddress("ACCESS_API_URL")()
+	}},
+}
+
+func criticalDependencies() map[string]bool {
+	critical := map[string]bool{}
+	for _, name := range strings.Split(envString("READYZ_CRITICAL", ""), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			critical[name] = true
+		}
+	}
+	return critical
+}
+
+// checkDependencies dials every configured dependency concurrently.
+func checkDependencies(ctx context.Context) map[string]dependencyStatus {
+	critical := criticalDependencies()
+	statuses := map[string]dependencyStatus{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, d := range dependencies {
+		address := d.address()
+		if address == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(d dependency) {
+			defer wg.Done()
+			status := dependencyStatus{Status: dependencyOk, Critical: critical[d.name]}
+			var dialer net.Dialer
+			conn, err := dialer.DialContext(ctx, "tcp", address)
+			if err != nil {
+				status.Status, status.Error = dependencyDown, err.Error()
+				dependencyUp.Set(0, d.name)
+			} else {
+				conn.Close()
+				dependencyUp.Set(1, d.name)
+			}
+			mu.Lock()
+			statuses[d.name] = status
+			mu.Unlock()
+		}(d)
+	}
+	wg.Wait()
+	return statuses
+}
+
+func handlerHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// handlerReadyz reports ready while the database answers, the breaker isn't
+// open and no critical dependency is down, so load balancers stop routing
+// to an instance that would only fail fast. A best-effort dependency being
+// down reports the instance degraded, still with 200.
+func handlerReadyz(w http.ResponseWriter, r *http.Request) {
+	status := map[string]interface{}{"database": "ok", "breaker": dbBreaker.State()}
+	ready := dbBreaker.State() != breakerOpen
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+	if err := Db.PingContext(ctx); err != nil {
+		status["database"] = err.Error()
+		ready = false
+	}
+	readiness := readinessReady
+	dependencies := checkDependencies(ctx)
+	for _, d := range dependencies {
+		if d.Status == dependencyOk {
+			continue
+		}
+		if d.Critical {
+			ready = false
+		} else {
+			readiness = readinessDegraded
+		}
+	}
+	if !ready {
+		readiness = readinessUnhealthy
+	}
+	status["status"] = readiness
+	status["dependencies"] = dependencies
+	j, err := json.Marshal(status)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(j)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const historyPath = "history"
+
+// bookingCancelled is the state a cancelled booking is left in by its
+// history. Cancelled bookings are deleted, so no stored booking has it.
+const bookingCancelled = "cancelled"
+
+// historyEvents are the booking events appended to booking_event. Each
+// carries the booking as it was right after the event.
+var historyEvents = map[string]bool{
+	eventBookingCreated:     true,
+	eventBookingRescheduled: true,
+	eventBookingApproved:    true,
+	eventBookingCheckedIn:   true,
+	eventBookingCancelled:   true,
+	eventBookingPreempted:   true,
+}
+
+type bookingEvent struct {
+	Event     string          `json:"event"`
+	At        time.Time       `json:"at"`
+	ActedBy   string          `json:"acted_by,omitempty"`
+	RequestId string          `json:"request_id,omitempty"`
+	Booking   bookingResponse `json:"booking"`
+}
+
+type bookingHistory struct {
+	BookingId string          `json:"booking_id"`
+	State     bookingResponse `json:"state"`
+	CheckedIn bool            `json:"checked_in"`
+	Events    []bookingEvent  `json:"events"`
+}
+
+// appendBookingEvent adds event to the booking's history. It runs before the
+// event handlers so the history keeps the order events happened in.
+//
+// Every event takes the next number of a global sequence, in the same
+// transaction, so the sequence has no gaps (an insert that fails gives its
+// number back) and events commit in sequence order, see events.go.
+// Memory mode keeps no history.
+func appendBookingEvent(event string, b booking) error {
+	if !historyEvents[event] || memoryStorage() {
+		return nil
+	}
+	snapshot, err := json.Marshal(newBookingResponse(b))
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	tx, err := Db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx, `UPDATE event_sequence SET sequence_value = LAST_INSERT_ID(sequence_value + 1) WHERE sequence_name = 'booking_event'`)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	seq, err := result.LastInsertId()
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO booking_event (event_seq, event_booking_id, event_booking_public_id, event_booker_id, event_type, event_acted_by, event_request_id, event_booking, event_created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, UTC_TIMESTAMP(3))`, seq, b.BookingId, b.publicId(), b.BookingBookerId, event, b.ActedBy, b.RequestId, snapshot)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+// getBookingEvents returns a booking's events oldest first, by public id or,
+// while integer ids are still accepted, by integer id.
+func getBookingEvents(segment string) ([]bookingEvent, error) {
+	column, key := "event_booking_public_id", interface{}(segment)
+	if !isPublicId(segment) {
+		bookingId, err := strconv.Atoi(segment)
+		if err != nil || envString("BOOKING_INTEGER_IDS", "true") != "true" {
+			return []bookingEvent{}, nil
+		}
+		column, key = "event_booking_id", bookingId
+	}
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT event_type, event_created_at, event_acted_by, event_request_id, event_booking FROM booking_event
+		WHERE `+column+` = ? ORDER BY event_id`, key)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	events := make([]bookingEvent, 0)
+	for results.Next() {
+		var e bookingEvent
+		var snapshot []byte
+		if err := results.Scan(&e.Event, sqlTime{&e.At}, &e.ActedBy, &e.RequestId, &snapshot); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		if err := json.Unmarshal(snapshot, &e.Booking); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, results.Err()
+}
+
+// replayBookingEvents folds a booking's events into its current state.
+func replayBookingEvents(events []bookingEvent) bookingHistory {
+	history := bookingHistory{Events: events}
+	for _, e := range events {
+		switch e.Event {
+		case eventBookingCreated, eventBookingRescheduled, eventBookingApproved:
+			history.State = e.Booking
+		case eventBookingCheckedIn:
+			history.CheckedIn = true
+		case eventBookingCancelled, eventBookingPreempted:
+			history.State = e.Booking
+			history.State.BookingStatus = bookingCancelled
+		}
+	}
+	history.BookingId = history.State.BookingId
+	return history
+}
+
+// handlerBookingHistory serves GET /api/bookings/{id}/history. It works for
+// cancelled bookings too, which only their history remembers; students only
+// see the history of their own bookings.
+func handlerBookingHistory(w http.ResponseWriter, r *http.Request, segment string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	events, err := getBookingEvents(segment)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	if len(events) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	history := replayBookingEvents(events)
+	if owned, ok := bookingStoreFor(r).(ownedBookingRepository); ok && (owned.bookerId == "" || history.State.BookerId != owned.bookerId) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	red := redactionFor(r)
+	red.response(&history.State)
+	for i := range history.Events {
+		red.event(&history.Events[i])
+	}
+	j, err := json.Marshal(history)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const holdPath = "holds"
+
+// A hold keeps a slot free for its booker for HOLD_TTL while a booking UI
+// collects the remaining details, and is then confirmed into a booking or
+// left to expire. Hold ids are random, so knowing one is what entitles a
+// client to confirm or release it.
+type hold struct {
+	HoldId          string    `json:"hold_id"`
+	ClassroomId     string    `json:"classroom_id"`
+	BookerId        string    `json:"booker_id"`
+	BookingTime     string    `json:"booking_time"`
+	BookingDuration int       `json:"booking_duration"`
+	BookingTitle    string    `json:"booking_title"`
+	ExpiresAt       time.Time `json:"expires_at"`
+}
+
+func (h hold) booking() booking {
+	return booking{BookingTime: h.BookingTime, BookingClassroomId: h.ClassroomId, BookingBookerId: h.BookerId, BookingDuration: h.BookingDuration, BookingTitle: h.BookingTitle}
+}
+
+const holdColumns = `hold_id, hold_classroom_id, hold_booker_id, hold_booking_time, hold_duration, hold_title, hold_expires_at`
+
+func (h *hold) scanFields() []interface{} {
+	return []interface{}{&h.HoldId, &h.ClassroomId, &h.BookerId, &h.BookingTime, &h.BookingDuration, &h.BookingTitle, sqlTime{&h.ExpiresAt}}
+}
+
+func newHoldId() (string, error) {
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func getHold(holdId string) (*hold, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	h := &hold{}
+	err := Db.QueryRowContext(ctx, `SELECT `+holdColumns+` FROM booking_hold WHERE hold_id = ? AND hold_expires_at > UTC_TIMESTAMP()`, holdId).Scan(h.scanFields()...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return h, nil
+}
+
+// insertHold inserts h unless a booking or another booker's hold took its
+// slot, returning errConflict if one did. The check and the insert are one
+// transaction holding the classroom's row, so that of two holds asking for
+// the same free slot at once only one gets it.
+func insertHold(h hold) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	tx, err := Db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	defer tx.Rollback()
+	var classroomId string
+	if err := tx.QueryRowContext(ctx, `SELECT classroom_id FROM classroom WHERE classroom_id = ? FOR UPDATE`, h.ClassroomId).Scan(&classroomId); err != nil && err != sql.ErrNoRows {
+		log.Println(err.Error())
+		return err
+	}
+	conflicts, err := lockedConflicts(ctx, tx, h.booking())
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return errConflict
+	}
+	holds, err := findHoldConflictsIn(ctx, tx, h.booking())
+	if err != nil {
+		return err
+	}
+	if len(holds) > 0 {
+		return errConflict
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO booking_hold (`+holdColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		h.HoldId, h.ClassroomId, h.BookerId, h.BookingTime, h.BookingDuration, h.BookingTitle, h.ExpiresAt.UTC())
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+func removeHold(holdId string) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `DELETE FROM booking_hold WHERE hold_id = ?`, holdId)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+// findHoldConflicts returns the live holds of other bookers that overlap b
+// in its classroom.
+func findHoldConflicts(b booking) ([]hold, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	return findHoldConflictsIn(ctx, Db, b)
+}
+
+// findHoldConflictsIn is findHoldConflicts reading through q.
+func findHoldConflictsIn(ctx context.Context, q sqlQueryer, b booking) ([]hold, error) {
+	if b.BookingSeats > 0 {
+		return nil, nil
+	}
+	start, end, err := bookingWindow(b)
+	if err != nil {
+		return nil, err
+	}
+	results, err := q.QueryContext(ctx, `SELECT `+holdColumns+` FROM booking_hold
+		WHERE hold_classroom_id = ? AND hold_booker_id <> ? AND hold_expires_at > UTC_TIMESTAMP()`, b.BookingClassroomId, b.BookingBookerId)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	conflicts := make([]hold, 0)
+	for results.Next() {
+		var h hold
+		if err := results.Scan(h.scanFields()...); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		holdStart, holdEnd, err := bookingWindow(h.booking())
+		if err == nil && overlaps(start, end, holdStart, holdEnd) {
+			conflicts = append(conflicts, h)
+		}
+	}
+	return conflicts, results.Err()
+}
+
+// slotTaken reports whether b collides with a booking or another booker's
+// hold, answering 409 if so.
+func slotTaken(w http.ResponseWriter, r *http.Request, b booking) bool {
+	_, taken := slotConflicts(w, r, b, nil)
+	return taken
+}
+
+// slotConflicts is slotTaken letting b through the bookings displaces
+// accepts, which it returns.
+func slotConflicts(w http.ResponseWriter, r *http.Request, b booking, displaces func(booking) bool) ([]booking, bool) {
+	conflicts, err := findConflicts(b)
+	if err != nil {
+		log.Print(err)
+		writeError(w, r, http.StatusBadRequest, "invalid_booking_time")
+		return nil, true
+	}
+	var blocking, displaced []booking
+	for _, c := range conflicts {
+		if displaces != nil && displaces(c) {
+			displaced = append(displaced, c)
+		} else {
+			blocking = append(blocking, c)
+		}
+	}
+	if len(blocking) > 0 {
+		writeConflict(w, r, b, blocking)
+		return nil, true
+	}
+	holds, err := findHoldConflicts(b)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return nil, true
+	}
+	if len(holds) > 0 {
+		writeConflict(w, r, b, nil)
+		return nil, true
+	}
+	return displaced, false
+}
+
+// expireHolds deletes the holds past their expiry, for the cleanup job.
+func expireHolds() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := Db.ExecContext(ctx, `DELETE FROM booking_hold WHERE hold_expires_at <= UTC_TIMESTAMP()`)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
+
+// handlerHolds serves POST /api/holds.
+func handlerHolds(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var request bookingRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			log.Print(err)
+			writeError(w, r, http.StatusBadRequest, "invalid_body")
+			return
+		}
+		b := request.booking()
+		if applyBookingTime(w, r, &b, request.TimeZone) {
+			return
+		}
+		// Holds block the slot as bookings do, so callers only hold in
+		// the names they may book in.
+		if owned, ok := bookingStoreFor(r).(ownedBookingRepository); ok && !owned.owns(&b) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		standing, err := getStanding(b.BookingBookerId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		if standing.Status == standingBlocked {
+			writeBlocked(w, r, standing)
+			return
+		}
+		if applyQuota(w, r, b) || applyRoomPolicy(w, r, &b) || slotTaken(w, r, b) {
+			return
+		}
+		holdId, err := newHoldId()
+		if err != nil {
+			log.Fatal(err)
+		}
+		h := hold{HoldId: holdId, ClassroomId: b.BookingClassroomId, BookerId: b.BookingBookerId, BookingTime: b.BookingTime,
+			BookingDuration: b.BookingDuration, BookingTitle: b.BookingTitle, ExpiresAt: time.Now().UTC().Add(envDuration("HOLD_TTL", 5*time.Minute))}
+		if err := insertHold(h); isConflict(err) {
+			writeConflict(w, r, b, nil)
+			return
+		} else if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		j, err := json.Marshal(h)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write(j)
+	case http.MethodOptions:
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handlerHold serves DELETE /api/holds/{id} and POST /api/holds/{id}/confirm.
+func handlerHold(w http.ResponseWriter, r *http.Request) {
+	urlPathSegments := strings.Split(r.URL.Path, fmt.Sprintf("%s/", holdPath))
+	urlPathSegments = strings.Split(urlPathSegments[len(urlPathSegments)-1], "/")
+	h, err := getHold(urlPathSegments[0])
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	if h == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// Other bookers' holds don't exist for the caller, as their bookings
+	// don't.
+	held := h.booking()
+	if owned, ok := bookingStoreFor(r).(ownedBookingRepository); ok && !owned.owns(&held) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if len(urlPathSegments) > 1 {
+		if urlPathSegments[1] != "confirm" || len(urlPathSegments) > 2 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		confirmHold(w, r, *h)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		j, err := json.Marshal(h)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+	case http.MethodDelete:
+		if err := removeHold(h.HoldId); err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+	case http.MethodOptions:
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// confirmHold books the held slot. The body may set the title collected
+// while the slot was held.
+func confirmHold(w http.ResponseWriter, r *http.Request, h hold) {
+	var request struct {
+		BookingTitle *string `json:"booking_title"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		writeError(w, r, http.StatusBadRequest, "invalid_body")
+		return
+	}
+	b := h.booking()
+	if request.BookingTitle != nil {
+		b.BookingTitle = *request.BookingTitle
+	}
+	standing, err := getStanding(b.BookingBookerId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	if standing.Status == standingBlocked {
+		writeBlocked(w, r, standing)
+		return
+	}
+	b.BookingStatus = standing.bookingStatus(tenantOf(r))
+	if applyQuota(w, r, b) || applyRoomPolicy(w, r, &b) || slotTaken(w, r, b) || applyPolicyWebhook(w, r, &b) {
+		return
+	}
+	b.BookingPublicId = newPublicId()
+	b.Tenant = tenantOf(r)
+	bookingId, err := bookingStoreFor(r).InsertBooking(b)
+	if isConflict(err) {
+		writeConflict(w, r, b, nil)
+		return
+	} else if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	if err := removeHold(h.HoldId); err != nil {
+		// The booking is made; the hold, the booker's own, only lingers
+		// until it expires.
+		log.Printf("hold %s outlives booking %d: %v", h.HoldId, bookingId, err)
+	}
+	b.BookingId = bookingId
+	b.ActedBy = actedBy(r)
+	b.RequestId = requestIdOf(r)
+	recordUsage(r, usageBooking)
+	if err := dispatchBookingEvent(eventBookingCreated, b); err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	j, err := json.Marshal(bookingBody(w, r, b))
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(j)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Message catalogs live in locales/<language>.json. A key missing from a
+// catalog falls back to English, and an unknown key to the key itself.
+
+//go:embed locales/*.json
+var localeFS embed.FS
+
+const fallbackLanguage = "en"
+
+var catalogs = loadCatalogs()
+
+func loadCatalogs() map[string]map[string]string {
+	files, err := localeFS.ReadDir("locales")
+	if err != nil {
+		log.Fatal(err)
+	}
+	catalogs := make(map[string]map[string]string, len(files))
+	for _, file := range files {
+		data, err := localeFS.ReadFile(path.Join("locales", file.Name()))
+		if err != nil {
+			log.Fatal(err)
+		}
+		messages := make(map[string]string)
+		if err := json.Unmarshal(data, &messages); err != nil {
+			log.Fatalf("locales/%s: %v", file.Name(), err)
+		}
+		catalogs[strings.TrimSuffix(file.Name(), ".json")] = messages
+	}
+	return catalogs
+}
+
+// translate looks up key in lang and fills in {name} placeholders from the
+// name, value pairs in args.
+func translate(lang string, key string, args ...string) string {
+	message, ok := catalogs[lang][key]
+	if !ok {
+		if message, ok = catalogs[fallbackLanguage][key]; !ok {
+			message = key
+		}
+	}
+	for i := 0; i+1 < len(args); i += 2 {
+		message = strings.ReplaceAll(message, "{"+args[i]+"}", args[i+1])
+	}
+	return message
+}
+
+// supportedLanguage returns lang if there is a catalog for it or for its
+// base language, e.g. th for th-TH.
+func supportedLanguage(lang string) (string, bool) {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if _, ok := catalogs[lang]; ok {
+		return lang, true
+	}
+	if i := strings.IndexByte(lang, '-'); i > 0 {
+		if _, ok := catalogs[lang[:i]]; ok {
+			return lang[:i], true
+		}
+	}
+	return "", false
+}
+
+// defaultLanguage is used for requests without a usable Accept-Language and
+// for notifications to owners without a language preference.
+func defaultLanguage() string {
+	if lang, ok := supportedLanguage(envString("DEFAULT_LANGUAGE", fallbackLanguage)); ok {
+		return lang
+	}
+	return fallbackLanguage
+}
+
+// requestLanguage picks the supported language the client weights highest
+// in Accept-Language.
+func requestLanguage(r *http.Request) string {
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	var accepted []weighted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(part, ";")
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if lang, ok := supportedLanguage(fields[0]); ok && q > 0 {
+			accepted = append(accepted, weighted{lang, q})
+		}
+	}
+	if len(accepted) == 0 {
+		return defaultLanguage()
+	}
+	sort.SliceStable(accepted, func(i, j int) bool { return accepted[i].q > accepted[j].q })
+	return accepted[0].lang
+}
+
+// writeError answers with status and a JSON body carrying a stable error
+// code and its message in the client's language.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, args ...string) {
+	j, err := json.Marshal(map[string]string{"error": code, "message": translate(requestLanguage(r), "error."+code, args...)})
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(status)
+	w.Write(j)
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bookings go out and come back in iCalendar. GET
+// /api/bookings/export?format=ics answers the bookings a booking list
+// would, same filters, as a VCALENDAR; POST
+// /api/bookings/import?format=ics takes one, such as a departmental
+// timetable, and books each VEVENT: SUMMARY is the title, DTSTART and
+// DTEND or DURATION the time, in the event's TZID or UTC (floating times
+// and dates are in the booking time zone), and ?classroom= or else
+// LOCATION the classroom. The booker is ?booker=, else the exported
+// X-BOOKER-ID, else the caller's own. Each event is checked as a booking
+// create would check it, and the import answers per event whether it was
+// created, refused and why, skipped (cancelled events) or already there:
+// exported events keep their booking's UID, so importing an export again
+// creates nothing twice. Recurring events are refused; ?dry_run=true only
+// checks, each event against the store and the events before it, so that
+// two events of one file taking the same slot are refused as an import
+// would refuse them. Files larger than ICS_MAX_SIZE are refused with 413.
+
+const importPath = "import"
+const formatIcs = "ics"
+const icsContentType = "text/calendar; charset=utf-8"
+const maxImportEvents = 500
+
+const (
+	importCreated  = "created"
+	importValid    = "valid"
+	importExists   = "exists"
+	importSkipped  = "skipped"
+	importRejected = "rejected"
+)
+
+var errNoCalendar = errors.New("not an iCalendar file")
+
+type icsProperty struct {
+	params map[string]string
+	value  string
+}
+
+// icsEvent is a VEVENT's properties by name; repeated ones keep the first.
+type icsEvent map[string]icsProperty
+
+type importResult struct {
+	Uid       string          `json:"uid,omitempty"`
+	Summary   string          `json:"summary,omitempty"`
+	Result    string          `json:"result"`
+	Status    int             `json:"status"`
+	BookingId string          `json:"booking_id,omitempty"`
+	Error     json.RawMessage `json:"error,omitempty"`
+}
+
+type importSummary struct {
+	DryRun   bool           `json:"dry_run"`
+	Created  int            `json:"created"`
+	Rejected int            `json:"rejected"`
+	Events   []importResult `json:"events"`
+}
+
+// isCalendarImport reports whether r uploads an iCalendar file, whose body
+// isn't JSON.
+func isCalendarImport(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/"+importPath) && err == nil && mediaType == "text/calendar"
+}
+
+func icsUidDomain() string {
+	return envString("ICS_UID_DOMAIN", "classroom-booking")
+}
+
+// parseIcsProperty splits a content line into its name, parameters and
+// value; colons and semicolons inside quoted parameter values don't count.
+func parseIcsProperty(line string) (string, icsProperty, bool) {
+	quoted, colon := false, -1
+	for i := 0; i < len(line) && colon < 0; i++ {
+		switch line[i] {
+		case '"':
+			quoted = !quoted
+		case ':':
+			if !quoted {
+				colon = i
+			}
+		}
+	}
+	if colon < 0 {
+		return "", icsProperty{}, false
+	}
+	prop := icsProperty{params: make(map[string]string), value: line[colon+1:]}
+	parts := strings.Split(line[:colon], ";")
+	for _, param := range parts[1:] {
+		if k, v, ok := strings.Cut(param, "="); ok {
+			prop.params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+		}
+	}
+	return strings.ToUpper(parts[0]), prop, true
+}
+
+// parseIcs returns the VEVENTs of an iCalendar file, unfolding its lines.
+func parseIcs(body io.Reader) ([]icsEvent, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 || !strings.EqualFold(strings.TrimSpace(lines[0]), "BEGIN:VCALENDAR") {
+		return nil, errNoCalendar
+	}
+	events := make([]icsEvent, 0)
+	var current icsEvent
+	depth := 0
+	for _, line := range lines {
+		name, prop, ok := parseIcsProperty(line)
+		if !ok {
+			continue
+		}
+		switch {
+		case name == "BEGIN" && strings.EqualFold(prop.value, "VEVENT") && current == nil:
+			current = make(icsEvent)
+		case name == "BEGIN" && current != nil:
+			// Alarms and the like nest inside events; their properties
+			// aren't the event's.
+			depth++
+		case name == "END" && current != nil && depth > 0:
+			depth--
+		case name == "END" && strings.EqualFold(prop.value, "VEVENT") && current != nil:
+			events = append(events, current)
+			current = nil
+		case current != nil && depth == 0:
+			if _, seen := current[name]; !seen {
+				current[name] = prop
+			}
+		}
+	}
+	return events, nil
+}
+
+func unescapeIcsText(s string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(s)
+}
+
+func escapeIcsText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`, "\r", "").Replace(s)
+}
+
+// icsTime reads a DATE or DATE-TIME value, reporting whether it is a date.
+func icsTime(prop icsProperty) (time.Time, bool, error) {
+	value := strings.TrimSpace(prop.value)
+	if prop.params["VALUE"] == "DATE" || len(value) == len("20060102") {
+		t, err := time.ParseInLocation("20060102", value, bookingLocation)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+	location := bookingLocation
+	if tzid := prop.params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			location = l
+		}
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, location)
+	return t, false, err
+}
+
+// icsDuration reads a DURATION value such as PT1H30M or P1D.
+func icsDuration(value string) (time.Duration, error) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "+")
+	if !strings.HasPrefix(value, "P") {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	units := map[byte]time.Duration{'W': 7 * 24 * time.Hour, 'D': 24 * time.Hour, 'H': time.Hour, 'M': time.Minute, 'S': time.Second}
+	var d time.Duration
+	n := ""
+	for i := 1; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == 'T':
+		case c >= '0' && c <= '9':
+			n += string(c)
+		default:
+			unit, ok := units[c]
+			count, err := strconv.Atoi(n)
+			if !ok || err != nil {
+				return 0, fmt.Errorf("invalid duration %q", value)
+			}
+			d += time.Duration(count) * unit
+			n = ""
+		}
+	}
+	if n != "" {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return d, nil
+}
+
+// icsBooking maps e to a booking, writing the error to w if it can't be.
+func icsBooking(w http.ResponseWriter, r *http.Request, e icsEvent) (booking, bool) {
+	uid := e["UID"].value
+	if _, ok := e["RRULE"]; ok {
+		writeError(w, r, http.StatusBadRequest, "unsupported_recurrence", "uid", uid)
+		return booking{}, false
+	}
+	startProp, ok := e["DTSTART"]
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, "invalid_event", "uid", uid)
+		return booking{}, false
+	}
+	start, date, err := icsTime(startProp)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_event", "uid", uid)
+		return booking{}, false
+	}
+	var end time.Time
+	if endProp, ok := e["DTEND"]; ok {
+		end, _, err = icsTime(endProp)
+	} else if durationProp, ok := e["DURATION"]; ok {
+		var d time.Duration
+		d, err = icsDuration(durationProp.value)
+		end = start.Add(d)
+	} else if date {
+		end = start.AddDate(0, 0, 1)
+	} else {
+		end = start
+	}
+	start, end = start.In(bookingLocation), end.In(bookingLocation)
+	b := booking{BookingTitle: unescapeIcsText(e["SUMMARY"].value)}
+	switch {
+	case err != nil:
+		writeError(w, r, http.StatusBadRequest, "invalid_event", "uid", uid)
+		return b, false
+	case date:
+		// A date is a whole-day booking, which covers one day.
+		if !end.Equal(start.AddDate(0, 0, 1)) {
+			writeError(w, r, http.StatusBadRequest, "invalid_event", "uid", uid)
+			return b, false
+		}
+		b.BookingTime = start.Format(bookingDateLayout)
+	default:
+		minutes := end.Sub(start) / time.Minute
+		if minutes <= 0 || end.Sub(start)%time.Minute != 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid_event", "uid", uid)
+			return b, false
+		}
+		b.BookingTime = start.Format(bookingTimeLayout)
+		b.BookingDuration = int(minutes)
+	}
+	query := r.URL.Query()
+	b.BookingClassroomId = query.Get("classroom")
+	if b.BookingClassroomId == "" {
+		b.BookingClassroomId = strings.TrimSpace(unescapeIcsText(e["LOCATION"].value))
+	}
+	b.BookingBookerId = query.Get("booker")
+	if b.BookingBookerId == "" {
+		b.BookingBookerId = e["X-BOOKER-ID"].value
+	}
+	if caller := callerOf(r); caller != nil && caller.Role == roleStudent && query.Get("booker") == "" {
+		b.BookingBookerId = caller.BookerId
+	}
+	if b.BookingClassroomId == "" || b.BookingBookerId == "" {
+		writeError(w, r, http.StatusBadRequest, "invalid_event", "uid", uid)
+		return b, false
+	}
+	return b, true
+}
+
+// importIcsEvent books e unless dryRun, writing the error to w if it is
+// refused. accepted is the bookings of the events imported before it.
+func importIcsEvent(w http.ResponseWriter, r *http.Request, store BookingRepository, e icsEvent, accepted []booking, dryRun bool) (booking, string, string) {
+	uid := e["UID"].value
+	if strings.EqualFold(e["STATUS"].value, "CANCELLED") {
+		return booking{}, importSkipped, ""
+	}
+	if publicId := strings.TrimSuffix(uid, "@"+icsUidDomain()); publicId != uid {
+		existing, err := resolveBooking(store, publicId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return booking{}, importRejected, ""
+		}
+		if existing != nil {
+			return booking{}, importExists, existing.publicId()
+		}
+	}
+	b, ok := icsBooking(w, r, e)
+	if !ok {
+		return b, importRejected, ""
+	}
+	displaced, rejected := rejectBooking(w, r, &b)
+	if rejected {
+		return b, importRejected, ""
+	}
+	// Imports don't preempt; a slot they would is taken.
+	if len(displaced) > 0 {
+		writeConflict(w, r, b, displaced)
+		return b, importRejected, ""
+	}
+	// A dry run books nothing, so the store doesn't hold the events
+	// before this one.
+	start, end, _ := bookingWindow(b)
+	if len(busyClassrooms(accepted, start, end)[b.BookingClassroomId]) > 0 {
+		writeConflict(w, r, b, nil)
+		return b, importRejected, ""
+	}
+	if dryRun {
+		return b, importValid, ""
+	}
+	b.BookingPublicId = newPublicId()
+	b.Tenant = tenantOf(r)
+	bookingId, err := store.InsertBooking(b)
+	if isConflict(err) {
+		writeConflict(w, r, b, nil)
+		return b, importRejected, ""
+	} else if err != nil {
+		writeServiceError(w, r, err)
+		return b, importRejected, ""
+	}
+	b.BookingId = bookingId
+	b.ActedBy, b.RequestId = actedBy(r), requestIdOf(r)
+	recordUsage(r, usageBooking)
+	if err := dispatchBookingEvent(eventBookingCreated, b); err != nil {
+		// Created all the same, see handlerBookingImport.
+		writeServiceError(w, r, err)
+	}
+	return b, importCreated, b.BookingPublicId
+}
+
+// handlerBookingImport serves POST /api/bookings/import?format=ics.
+func handlerBookingImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	if format := query.Get("format"); format != "" && format != formatIcs {
+		writeError(w, r, http.StatusBadRequest, "invalid_format", "format", format, "supported", formatIcs)
+		return
+	}
+	maxSize := int64(envInt("ICS_MAX_SIZE", 1<<20))
+	events, err := parseIcs(http.MaxBytesReader(w, r.Body, maxSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, "calendar_too_large", "max", strconv.FormatInt(maxSize, 10))
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_ics")
+		return
+	}
+	if len(events) > maxImportEvents {
+		writeError(w, r, http.StatusRequestEntityTooLarge, "too_many_events", "max", strconv.Itoa(maxImportEvents))
+		return
+	}
+	summary := importSummary{DryRun: query.Get("dry_run") == "true", Events: make([]importResult, len(events))}
+	store := bookingStoreFor(r)
+	var accepted []booking
+	for i, e := range events {
+		bw := newBatchWriter()
+		b, result, bookingId := importIcsEvent(bw, r, store, e, accepted, summary.DryRun)
+		if result == importCreated || result == importValid {
+			accepted = append(accepted, b)
+		}
+		summary.Events[i] = importResult{Uid: e["UID"].value, Summary: unescapeIcsText(e["SUMMARY"].value), Result: result, Status: bw.status, BookingId: bookingId}
+		switch {
+		case result == importRejected:
+			summary.Rejected++
+			if json.Valid(bw.body.Bytes()) {
+				summary.Events[i].Error = json.RawMessage(bw.body.Bytes())
+			}
+		case result == importCreated:
+			summary.Created++
+			if !bw.failed() {
+				summary.Events[i].Status = http.StatusCreated
+			} else if json.Valid(bw.body.Bytes()) {
+				// The booking was made but its event couldn't be appended.
+				summary.Events[i].Error = json.RawMessage(bw.body.Bytes())
+			}
+		default:
+			summary.Events[i].Status = http.StatusOK
+		}
+	}
+	if !summary.DryRun {
+		recordAudit(r, "booking.import", "booking", "", map[string]int{"events": len(events), "created": summary.Created, "rejected": summary.Rejected})
+	}
+	j, err := json.Marshal(summary)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}
+
+// writeIcsLine writes a content line folded at 75 octets, not splitting
+// UTF-8 sequences.
+func writeIcsLine(sb *strings.Builder, line string) {
+	for len(line) > 75 {
+		cut := 75
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		sb.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+	}
+	sb.WriteString(line + "\r\n")
+}
+
+// icsCalendar renders bookings as a VCALENDAR, times in UTC.
+func icsCalendar(bookings []booking, now time.Time) string {
+	var sb strings.Builder
+	writeIcsHeader(&sb, "")
+	for _, b := range bookings {
+		writeIcsEvent(&sb, b, now, icsStatus(b))
+	}
+	writeIcsLine(&sb, "END:VCALENDAR")
+	return sb.String()
+}
+
+// writeIcsHeader opens a VCALENDAR, with an iTIP method if not empty.
+func writeIcsHeader(sb *strings.Builder, method string) {
+	writeIcsLine(sb, "BEGIN:VCALENDAR")
+	writeIcsLine(sb, "VERSION:2.0")
+	writeIcsLine(sb, "PRODID:-//Practise-GO//Classroom Booking//EN")
+	writeIcsLine(sb, "CALSCALE:GREGORIAN")
+	if method != "" {
+		writeIcsLine(sb, "METHOD:"+method)
+	}
+}
+
+func icsStatus(b booking) string {
+	if b.BookingStatus == bookingStatusPending {
+		return "TENTATIVE"
+	}
+	return "CONFIRMED"
+}
+
+// writeIcsEvent writes b as a VEVENT, with extra properties before its end.
+// Bookings without a valid time are left out.
+func writeIcsEvent(sb *strings.Builder, b booking, now time.Time, status string, extra ...string) {
+	start, end, err := bookingWindow(b)
+	if err != nil {
+		return
+	}
+	stamp := b.BookingUpdatedAt
+	if stamp.IsZero() {
+		stamp = now
+	}
+	writeIcsLine(sb, "BEGIN:VEVENT")
+	writeIcsLine(sb, "UID:"+b.publicId()+"@"+icsUidDomain())
+	writeIcsLine(sb, "DTSTAMP:"+stamp.UTC().Format("20060102T150405Z"))
+	if b.BookingDuration == 0 {
+		writeIcsLine(sb, "DTSTART;VALUE=DATE:"+start.Format("20060102"))
+		writeIcsLine(sb, "DTEND;VALUE=DATE:"+end.Format("20060102"))
+	} else {
+		writeIcsLine(sb, "DTSTART:"+start.UTC().Format("20060102T150405Z"))
+		writeIcsLine(sb, "DTEND:"+end.UTC().Format("20060102T150405Z"))
+	}
+	writeIcsLine(sb, "SUMMARY:"+escapeIcsText(b.BookingTitle))
+	writeIcsLine(sb, "LOCATION:"+escapeIcsText(b.BookingClassroomId))
+	writeIcsLine(sb, "STATUS:"+status)
+	if b.BookingBookerId != "" {
+		writeIcsLine(sb, "X-BOOKER-ID:"+escapeIcsText(b.BookingBookerId))
+	}
+	for _, line := range extra {
+		writeIcsLine(sb, line)
+	}
+	writeIcsLine(sb, "END:VEVENT")
+}
+
+// handlerBookingExport serves GET /api/bookings/export?format=ics.
+func handlerBookingExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if format := r.URL.Query().Get("format"); format != "" && format != formatIcs {
+		writeError(w, r, http.StatusBadRequest, "invalid_format", "format", format, "supported", formatIcs)
+		return
+	}
+	filter, err := parseBookingFilter(r)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	bookings, err := bookingStoreFor(r).GetBookingList(filter, bookingFields)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	if checkLastModified(w, r, latestUpdate(bookings)) {
+		return
+	}
+	w.Header().Set("Content-Type", icsContentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="bookings.ics"`)
+	w.Write([]byte(icsCalendar(redactionFor(r).bookings(bookings), time.Now())))
+}
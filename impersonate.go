@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// Admins can act for a booker by sending X-Act-As with the booker id. The
+// request then runs with that booker's student rights, and the audit log and
+// notifications name both the admin and the booker.
+
+const actAsHeader = "X-Act-As"
+
+func impersonationMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bookerId := r.Header.Get(actAsHeader)
+		if bookerId == "" || r.Method == http.MethodOptions {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		admin := callerOf(r)
+		if admin == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if admin.Role != roleAdmin {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		name, err := getStudentName(bookerId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		if name == nil {
+			writeError(w, r, http.StatusBadRequest, "unknown_booker", "booker", bookerId)
+			return
+		}
+		acting := &apiKey{Hash: admin.Hash, Role: roleStudent, BookerId: bookerId, ActingAdmin: admin}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, acting)))
+	})
+}
+
+// actedBy names the admin acting for the booker in r, or is empty.
+func actedBy(r *http.Request) string {
+	if caller := callerOf(r); caller != nil && caller.ActingAdmin != nil {
+		return actorOf(caller.ActingAdmin)
+	}
+	return ""
+}
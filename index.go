@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const openApiPath = "openapi.json"
+
+// version is the build's version, set with
+//
+//	go build -ldflags "-X main.version=1.4.0"
+var version = "dev"
+
+type apiResource struct {
+	Name    string   `json:"name"`
+	Path    string   `json:"path"`
+	Methods []string `json:"methods"`
+	Roles   []string `json:"roles,omitempty"`
+}
+
+type apiIndex struct {
+	Version   string            `json:"version"`
+	Links     map[string]string `json:"links"`
+	Resources []apiResource     `json:"resources"`
+}
+
+// publicRoutes lists the routes served on the public listener, in route
+// table order.
+func publicRoutes(apiBasePath string) []routeInfo {
+	routes := []routeInfo{}
+	for _, m := range append(routeTable(apiBasePath), operationalRoutes()...) {
+		if !m.Internal {
+			routes = append(routes, m.routes(apiBasePath)...)
+		}
+	}
+	return routes
+}
+
+// handlerIndex serves GET /api, describing every public resource from the
+// route table so clients can discover the service.
+func handlerIndex(apiBasePath string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		index := apiIndex{
+			Version:   version,
+			Links:     map[string]string{"self": apiBasePath, "openapi": apiBasePath + "/" + openApiPath},
+			Resources: []apiResource{},
+		}
+		for _, rt := range publicRoutes(apiBasePath) {
+			index.Resources = append(index.Resources, apiResource{rt.Name, rt.Pattern, strings.Split(rt.allow(), ", "), rt.Roles})
+		}
+		j, err := json.Marshal(index)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+	})
+}
+
+// scopedRoutes lists the routes callers of scope can use, with only their
+// methods in scope. The admin scope includes the internal listener's.
+func scopedRoutes(apiBasePath string, scope apiScope) []routeInfo {
+	routes := []routeInfo{}
+	for _, m := range append(routeTable(apiBasePath), operationalRoutes()...) {
+		if m.Internal && scope != scopeAdmin {
+			continue
+		}
+		for _, rt := range m.routes(apiBasePath) {
+			scoped := routeInfo{route{Pattern: rt.Pattern}, rt.Name, rt.Roles}
+			for _, method := range rt.Methods {
+				if s := rt.scope(method); scope.includes(s) {
+					scoped.Methods = append(scoped.Methods, method)
+					scoped.Scopes = append(scoped.Scopes, s)
+				}
+			}
+			if len(scoped.Methods) > 0 {
+				routes = append(routes, scoped)
+			}
+		}
+	}
+	return routes
+}
+
+// callerScope is the widest scope the caller's key can use.
+func callerScope(caller *apiKey) apiScope {
+	switch {
+	case caller == nil:
+		return scopePublic
+	case caller.Role == roleStudent:
+		return scopeStudent
+	default:
+		return scopeAdmin
+	}
+}
+
+// handlerOpenApi serves a minimal OpenAPI 3 document of the routes of
+// ?scope= (public by default, student or admin): their paths, path
+// parameters and methods. Scopes beyond public need a key that can use
+// them, so partners get the document of what they can call and no more.
+func handlerOpenApi(apiBasePath string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope := scopePublic
+		if v := r.URL.Query().Get("scope"); v != "" {
+			scope = apiScope(v)
+			known := false
+			for _, s := range apiScopes {
+				known = known || s == scope
+			}
+			if !known {
+				writeError(w, r, http.StatusBadRequest, "invalid_scope")
+				return
+			}
+		}
+		if scope != scopePublic {
+			noStore(w)
+			caller := callerOf(r)
+			if caller == nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if !callerScope(caller).includes(scope) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		paths := map[string]interface{}{}
+		for _, rt := range scopedRoutes(apiBasePath, scope) {
+			parameters := []interface{}{}
+			for _, segment := range strings.Split(rt.Pattern, "/") {
+				if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+					parameters = append(parameters, map[string]interface{}{
+						"name": strings.Trim(segment, "{}"), "in": "path", "required": true, "schema": map[string]string{"type": "string"},
+					})
+				}
+			}
+			operations := map[string]interface{}{}
+			if len(parameters) > 0 {
+				operations["parameters"] = parameters
+			}
+			for _, method := range rt.Methods {
+				operation := map[string]interface{}{
+					"operationId": rt.operationId(method),
+					"x-scope":     rt.scope(method),
+					"responses":   map[string]interface{}{"default": map[string]string{"description": "The resource, or an error with a code and message."}},
+				}
+				if len(rt.Roles) > 0 {
+					operation["x-roles"] = rt.Roles
+				}
+				operations[strings.ToLower(method)] = operation
+			}
+			paths[rt.Pattern] = operations
+		}
+		j, err := json.Marshal(map[string]interface{}{
+			"openapi": "3.0.3",
+			"info":    map[string]string{"title": "Classroom booking API (" + string(scope) + ")", "version": version},
+			"paths":   paths,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Booking emails to the booker carry an iCalendar invite (iMIP), so the
+// booking lands in their calendar without an import: a created, approved
+// or rescheduled booking is sent as METHOD:REQUEST, a cancelled or
+// preempted one as METHOD:CANCEL, all under the UID the ics export uses.
+// Calendars apply the one with the highest SEQUENCE, which is the time of
+// the change the email is about, so a later change always wins however
+// late or out of order its emails go out. The classroom owner's
+// emails stay plain, as their calendars aren't booked. EMAIL_INVITES=false
+// turns invites off.
+
+var inviteMethods = map[string]string{
+	eventBookingCreated:     "REQUEST",
+	eventBookingApproved:    "REQUEST",
+	eventBookingRescheduled: "REQUEST",
+	eventBookingCancelled:   "CANCEL",
+	eventBookingPreempted:   "CANCEL",
+}
+
+// inviteMethod is the iTIP method of the invite the email n to p carries,
+// empty for none.
+func inviteMethod(p notificationPreference, n notification) string {
+	if n.booking == nil || p.Scope != scopeBooker || envString("EMAIL_INVITES", "true") != "true" {
+		return ""
+	}
+	return inviteMethods[n.Event]
+}
+
+// icsInvite is the VCALENDAR of an invite to attendee for b.
+func icsInvite(method string, b booking, organizer string, attendee string, now time.Time) string {
+	status := icsStatus(b)
+	if method == "CANCEL" {
+		status = "CANCELLED"
+	}
+	sequence := b.BookingUpdatedAt
+	if sequence.IsZero() {
+		sequence = now
+	}
+	var sb strings.Builder
+	writeIcsHeader(&sb, method)
+	writeIcsEvent(&sb, b, now, status,
+		"SEQUENCE:"+strconv.FormatInt(sequence.Unix(), 10),
+		"ORGANIZER:mailto:"+organizer,
+		"ATTENDEE;ROLE=REQ-PARTICIPANT;PARTSTAT=ACCEPTED;RSVP=FALSE:mailto:"+attendee)
+	writeIcsLine(&sb, "END:VCALENDAR")
+	return sb.String()
+}
+
+// inviteEmailBody is the MIME headers and body of an email with the text
+// of n and its invite, both as the calendar part clients act on and as an
+// invite.ics attachment for the ones that don't.
+func inviteEmailBody(method string, n notification, from string, to string, now time.Time) string {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	text, _ := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	fmt.Fprintf(text, "%s\r\n", n.Text)
+	calendar, _ := parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"text/calendar; charset=utf-8; method=" + method + `; name="invite.ics"`},
+		"Content-Disposition": {`attachment; filename="invite.ics"`},
+	})
+	calendar.Write([]byte(icsInvite(method, *n.booking, from, to, now)))
+	parts.Close()
+	return fmt.Sprintf("MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=%s\r\n\r\n%s", parts.Boundary(), body.String())
+}
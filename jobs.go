@@ -0,0 +1,25 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// startJob runs fn every interval in the background. A panicking run is
+// logged and does not stop later runs.
+func startJob(name string, interval time.Duration, fn func()) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						log.Printf("job %s panicked: %v", name, r)
+					}
+				}()
+				fn()
+			}()
+		}
+	}()
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The request journal records every mutating request before it runs and
+// its outcome after, so operators can tell what the service was asked to
+// do when the database and the logs disagree, e.g. after a crash. A start
+// without a finish is a request that never completed. JOURNAL=file appends
+// JSON lines to JOURNAL_FILE, rotated past JOURNAL_MAX_SIZE bytes keeping
+// JOURNAL_KEEP old files; JOURNAL=table writes to request_journal, pruned
+// of entries older than JOURNAL_RETENTION. The journal is off by default.
+//
+// Bodies are journaled up to JOURNAL_MAX_BODY bytes, and only JSON ones,
+// with the values of secret looking keys, and those in JOURNAL_REDACT,
+// replaced; so are those of query parameters, such as api_key.
+
+const (
+	journalFile  = "file"
+	journalTable = "table"
+
+	journalStart  = "start"
+	journalFinish = "finish"
+)
+
+type journalEntry struct {
+	Id         string          `json:"id"`
+	Phase      string          `json:"phase"`
+	At         time.Time       `json:"at"`
+	Method     string          `json:"method,omitempty"`
+	Path       string          `json:"path,omitempty"`
+	Actor      string          `json:"actor,omitempty"`
+	Body       json.RawMessage `json:"body,omitempty"`
+	Truncated  bool            `json:"body_truncated,omitempty"`
+	Status     int             `json:"status,omitempty"`
+	DurationMs int64           `json:"duration_ms,omitempty"`
+}
+
+var redactedKeys = []string{"password", "secret", "token", "key", "credential", "authorization"}
+
+// redactedKey reports whether the value of a body key is kept out of the
+// journal.
+func redactedKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, k := range redactedKeys {
+		if strings.Contains(key, k) {
+			return true
+		}
+	}
+	for _, k := range strings.Split(envString("JOURNAL_REDACT", ""), ",") {
+		if k = strings.TrimSpace(k); k != "" && strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if redactedKey(key) {
+				v[key] = "[redacted]"
+			} else {
+				v[key] = redact(value)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redact(v[i])
+		}
+	}
+	return v
+}
+
+// sanitizeBody returns body with secrets redacted, or nil if it isn't JSON.
+func sanitizeBody(body []byte) json.RawMessage {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil
+	}
+	sanitized, err := json.Marshal(redact(v))
+	if err != nil {
+		return nil
+	}
+	return sanitized
+}
+
+// sanitizePath returns the path and query of u with the values of secret
+// looking parameters redacted.
+func sanitizePath(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	query, _ := url.ParseQuery(u.RawQuery)
+	for key, values := range query {
+		if redactedKey(key) {
+			for i := range values {
+				values[i] = "[redacted]"
+			}
+		}
+	}
+	return u.Path + "?" + query.Encode()
+}
+
+var journalLog = struct {
+	sync.Mutex
+	f    *os.File
+	size int64
+}{}
+
+// rotateJournal moves JOURNAL_FILE to .1, .1 to .2 and so on, dropping the
+// oldest of JOURNAL_KEEP.
+func rotateJournal(path string) error {
+	if journalLog.f != nil {
+		journalLog.f.Close()
+		journalLog.f = nil
+	}
+	keep := envInt("JOURNAL_KEEP", 5)
+	for i := keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+	}
+	if keep > 0 {
+		return os.Rename(path, path+".1")
+	}
+	return os.Remove(path)
+}
+
+// appendJournalFile writes e as a line of JOURNAL_FILE and syncs it, so a
+// start entry is on disk before its request runs.
+func appendJournalFile(e journalEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	path := envString("JOURNAL_FILE", "journal.log")
+	journalLog.Lock()
+	defer journalLog.Unlock()
+	if journalLog.f != nil && journalLog.f.Name() != path {
+		journalLog.f.Close()
+		journalLog.f = nil
+	}
+	if journalLog.f != nil && journalLog.size+int64(len(line)) > int64(envInt("JOURNAL_MAX_SIZE", 64<<20)) {
+		if err := rotateJournal(path); err != nil {
+			return err
+		}
+	}
+	if journalLog.f == nil {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		journalLog.f, journalLog.size = f, info.Size()
+	}
+	n, err := journalLog.f.Write(line)
+	journalLog.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return journalLog.f.Sync()
+}
+
+func appendJournalTable(e journalEntry) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	var body interface{}
+	if e.Body != nil {
+		body = string(e.Body)
+	}
+	_, err := Db.ExecContext(ctx, `INSERT INTO request_journal (journal_request_id, journal_phase, journal_at, journal_method, journal_path, journal_actor, journal_body, journal_body_truncated, journal_status, journal_duration_ms)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, e.Id, e.Phase, e.At, e.Method, e.Path, e.Actor, body, e.Truncated, e.Status, e.DurationMs)
+	return err
+}
+
+func appendJournal(sink string, e journalEntry) {
+	var err error
+	switch sink {
+	case journalFile:
+		err = appendJournalFile(e)
+	case journalTable:
+		err = appendJournalTable(e)
+	default:
+		err = fmt.Errorf("unknown JOURNAL %q", sink)
+	}
+	if err != nil {
+		log.Printf("journal %s %s: %v", e.Id, e.Phase, err)
+	}
+}
+
+// journalMiddleware journals the POST, PUT, PATCH and DELETE requests of a
+// mount.
+func journalMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sink := envString("JOURNAL", "")
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			sink = ""
+		}
+		if sink == journalTable && readOnly {
+			// A replica's database takes no writes; its primary journals.
+			sink = ""
+		}
+		if sink == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		id := requestIdOf(r)
+		if id == "" {
+			id = newPublicId()
+		}
+		e := journalEntry{Id: id, Phase: journalStart, At: start.UTC(), Method: r.Method, Path: sanitizePath(r.URL), Actor: actorOf(callerOf(r))}
+		if r.Body != nil && r.Body != http.NoBody {
+			limit := envInt("JOURNAL_MAX_BODY", 4096)
+			head, err := io.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+			if err == nil && len(head) <= limit {
+				e.Body = sanitizeBody(head)
+			} else {
+				e.Truncated = true
+			}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+		}
+		appendJournal(sink, e)
+		sw := &statusWriter{ResponseWriter: w}
+		handler.ServeHTTP(sw, r)
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		appendJournal(sink, journalEntry{Id: e.Id, Phase: journalFinish, At: time.Now().UTC(), Status: status, DurationMs: time.Since(start).Milliseconds()})
+	})
+}
+
+// startJournalJob prunes request_journal daily when the journal is kept in
+// the database.
+func startJournalJob() {
+	if envString("JOURNAL", "") != journalTable {
+		return
+	}
+	startJob("journal", 24*time.Hour, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		cutoff := time.Now().UTC().Add(-envDuration("JOURNAL_RETENTION", 30*24*time.Hour))
+		if _, err := Db.ExecContext(ctx, `DELETE FROM request_journal WHERE journal_at < ?`, cutoff); err != nil {
+			log.Println(err.Error())
+		}
+	})
+}
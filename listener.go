@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// systemdListenFdsStart is the first file descriptor systemd passes to a
+// socket-activated service.
+const systemdListenFdsStart = 3
+
+// listen opens the listeners named in addrs, a comma separated list of
+// host:port, unix:/path/to.sock or systemd for the sockets inherited through
+// socket activation.
+func listen(addrs string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		var opened []net.Listener
+		var err error
+		switch {
+		case addr == "systemd":
+			opened, err = systemdListeners()
+		case strings.HasPrefix(addr, "unix:"):
+			var l net.Listener
+			l, err = listenUnix(strings.TrimPrefix(addr, "unix:"))
+			opened = []net.Listener{l}
+		default:
+			var l net.Listener
+			l, err = net.Listen("tcp", addr)
+			opened = []net.Listener{l}
+		}
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("listen on %s: %w", addr, err)
+		}
+		listeners = append(listeners, opened...)
+	}
+	return listeners, nil
+}
+
+// listenUnix removes a socket left behind by an earlier run before binding,
+// and opens the socket to the group so a reverse proxy can connect.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := strconv.ParseUint(envString("SERVER_SOCKET_MODE", "0660"), 8, 32)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// systemdListeners returns the sockets passed by systemd, following the
+// sd_listen_fds protocol.
+func systemdListeners() ([]net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	listeners := make([]net.Listener, 0, count)
+	for fd := systemdListenFdsStart; fd < systemdListenFdsStart+count; fd++ {
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
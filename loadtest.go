@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// loadtest replays synthetic traffic against a running instance and reports
+// the latency of each kind of request in the histogram buckets of the perf
+// report, so a run can be compared with /api/admin/perf and with earlier
+// runs:
+//
+//	loadtest -target http://127.0.0.1:5000 -rps 100 -duration 1m -writes 0.2
+//
+// Requests start at -rps whatever the latency, as clients would send them,
+// at most -concurrency at a time; requests that would start beyond it are
+// counted as dropped, a sign the target can't keep up. A share -writes of
+// them create bookings, in slots from -start on across -classrooms, and the
+// rest list bookings of a day or get one created earlier. The bookings
+// created are cancelled once the run is over, unless -keep. Point it at a
+// staging instance: with -api-key (or LOADTEST_API_KEY) the bookings are
+// made for -booker like any other.
+
+const (
+	loadList   = "list"
+	loadGet    = "get"
+	loadCreate = "create"
+)
+
+var loadOps = []string{loadList, loadGet, loadCreate}
+
+type loadTest struct {
+	target     string
+	apiKey     string
+	booker     string
+	classrooms []string
+	start      time.Time
+	writes     float64
+	client     *http.Client
+
+	slot    int64
+	dropped int64
+	mu      sync.Mutex
+	stats   map[string]*perfSlot
+	failed  map[string]int
+	created []string
+}
+
+// syntheticSlot is the classroom and booking time of the nth synthetic
+// booking: 30 minutes each, ten a day from 08:00, days from start on.
+func syntheticSlot(n int, classrooms []string, start time.Time) (string, string) {
+	classroom := classrooms[n%len(classrooms)]
+	n /= len(classrooms)
+	day := start.AddDate(0, 0, n/10)
+	return classroom, fmt.Sprintf("%s %02d:00", day.Format(bookingDateLayout), 8+n%10)
+}
+
+func (lt *loadTest) do(method string, path string, body interface{}) (int, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		j, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, err
+		}
+		reader = bytes.NewReader(j)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(lt.target, "/")+basePath+path, reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", jsonContentType)
+	if lt.apiKey != "" {
+		req.Header.Set("X-API-Key", lt.apiKey)
+	}
+	resp, err := lt.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, respBody, err
+}
+
+// pick chooses the next request; gets need a booking created before.
+func (lt *loadTest) pick() string {
+	if rand.Float64() < lt.writes {
+		return loadCreate
+	}
+	lt.mu.Lock()
+	created := len(lt.created)
+	lt.mu.Unlock()
+	if created > 0 && rand.Intn(2) == 0 {
+		return loadGet
+	}
+	return loadList
+}
+
+// send makes one request of kind op and counts it.
+func (lt *loadTest) send(op string) {
+	begin := time.Now()
+	var status int
+	var body []byte
+	var err error
+	switch op {
+	case loadList:
+		classroom, bookingTime := syntheticSlot(rand.Intn(int(atomic.LoadInt64(&lt.slot))+1), lt.classrooms, lt.start)
+		day := bookingTime[:len(bookingDateLayout)]
+		status, _, err = lt.do(http.MethodGet, fmt.Sprintf("/%s?classroom=%s&from=%s&to=%s", bookingPath, classroom, day, day), nil)
+	case loadGet:
+		lt.mu.Lock()
+		id := lt.created[rand.Intn(len(lt.created))]
+		lt.mu.Unlock()
+		status, _, err = lt.do(http.MethodGet, "/"+bookingPath+"/"+id, nil)
+	case loadCreate:
+		classroom, bookingTime := syntheticSlot(int(atomic.AddInt64(&lt.slot, 1)-1), lt.classrooms, lt.start)
+		status, body, err = lt.do(http.MethodPost, "/"+bookingPath, bookingRequest{BookingTime: bookingTime, ClassroomId: classroom, BookerId: lt.booker, BookingDuration: 30, BookingTitle: "loadtest"})
+	}
+	elapsed := time.Since(begin)
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if err != nil {
+		lt.failed[op]++
+		return
+	}
+	lt.stats[op].observe(status, elapsed)
+	if op == loadCreate && status == http.StatusCreated {
+		var created struct {
+			BookingId string `json:"booking_id"`
+		}
+		if json.Unmarshal(body, &created) == nil && created.BookingId != "" {
+			lt.created = append(lt.created, created.BookingId)
+		}
+	}
+}
+
+// run sends rps requests a second for duration, at most concurrency at a
+// time.
+func (lt *loadTest) run(rps float64, duration time.Duration, concurrency int) {
+	inFlight := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rps))
+	defer ticker.Stop()
+	deadline := time.After(duration)
+	for {
+		select {
+		case <-deadline:
+			wg.Wait()
+			return
+		case <-ticker.C:
+			select {
+			case inFlight <- struct{}{}:
+			default:
+				atomic.AddInt64(&lt.dropped, 1)
+				continue
+			}
+			wg.Add(1)
+			go func(op string) {
+				defer wg.Done()
+				lt.send(op)
+				<-inFlight
+			}(lt.pick())
+		}
+	}
+}
+
+// cancelCreated cancels the bookings the run created, reporting how many
+// it couldn't.
+func (lt *loadTest) cancelCreated() int {
+	failed := 0
+	for _, id := range lt.created {
+		status, _, err := lt.do(http.MethodDelete, "/"+bookingPath+"/"+id, nil)
+		if err != nil || status >= 300 {
+			failed++
+		}
+	}
+	return failed
+}
+
+type loadBucket struct {
+	// UpperMs is the bucket's bound in milliseconds, 0 for requests slower
+	// than every bound.
+	UpperMs float64 `json:"le_ms"`
+	Count   int     `json:"count"`
+}
+
+type loadOpReport struct {
+	perfRoute
+	Failed    int          `json:"failed"`
+	Histogram []loadBucket `json:"histogram"`
+}
+
+type loadReport struct {
+	Target     string         `json:"target"`
+	Duration   string         `json:"duration"`
+	Rps        float64        `json:"rps"`
+	Writes     float64        `json:"writes"`
+	Dropped    int64          `json:"dropped"`
+	Ops        []loadOpReport `json:"ops"`
+	Total      loadOpReport   `json:"total"`
+	NotCleaned int            `json:"not_cleaned,omitempty"`
+}
+
+func newLoadOpReport(op string, slot perfSlot, failed int, duration time.Duration) loadOpReport {
+	report := loadOpReport{perfRoute: perfRoute{Route: op}, Failed: failed, Histogram: []loadBucket{}}
+	report.add(slot)
+	report.finish(duration)
+	for i, n := range report.counts {
+		if n == 0 {
+			continue
+		}
+		bucket := loadBucket{Count: int(n)}
+		if i < len(perfBounds) {
+			bucket.UpperMs = math.Round(perfBounds[i]*10) / 10
+		}
+		report.Histogram = append(report.Histogram, bucket)
+	}
+	return report
+}
+
+func (lt *loadTest) report(rps float64, duration time.Duration) loadReport {
+	report := loadReport{Target: lt.target, Duration: duration.String(), Rps: rps, Writes: lt.writes, Dropped: lt.dropped, Ops: []loadOpReport{}}
+	total := perfSlot{counts: make([]uint32, len(perfBounds)+1)}
+	failed := 0
+	for _, op := range loadOps {
+		slot := *lt.stats[op]
+		if slot.requests == 0 && lt.failed[op] == 0 {
+			continue
+		}
+		report.Ops = append(report.Ops, newLoadOpReport(op, slot, lt.failed[op], duration))
+		total.requests += slot.requests
+		total.errors += slot.errors
+		total.clientErrors += slot.clientErrors
+		for i, n := range slot.counts {
+			total.counts[i] += n
+		}
+		failed += lt.failed[op]
+	}
+	report.Total = newLoadOpReport("total", total, failed, duration)
+	return report
+}
+
+func printLoadReport(out io.Writer, report loadReport) {
+	fmt.Fprintf(out, "%s for %s at %.0f rps, %.0f%% writes, %d dropped\n\n", report.Target, report.Duration, report.Rps, report.Writes*100, report.Dropped)
+	fmt.Fprintf(out, "%-8s %9s %9s %8s %8s %8s %9s %9s %9s\n", "op", "requests", "rps", "4xx", "5xx", "failed", "p50 ms", "p95 ms", "p99 ms")
+	for _, op := range append(report.Ops, report.Total) {
+		fmt.Fprintf(out, "%-8s %9d %9.1f %7.2f%% %7.2f%% %8d %9.1f %9.1f %9.1f\n", op.Route, op.Requests, op.RequestsPerSecond, op.ClientErrorRate*100, op.ErrorRate*100, op.Failed, op.P50, op.P95, op.P99)
+	}
+	for _, op := range report.Ops {
+		fmt.Fprintf(out, "\n%s\n", op.Route)
+		for _, bucket := range op.Histogram {
+			bound := "slower"
+			if bucket.UpperMs > 0 {
+				bound = fmt.Sprintf("<= %.1fms", bucket.UpperMs)
+			}
+			bar := strings.Repeat("#", (bucket.Count*50+op.Requests-1)/op.Requests)
+			fmt.Fprintf(out, "  %12s %7d %s\n", bound, bucket.Count, bar)
+		}
+	}
+	if report.NotCleaned > 0 {
+		fmt.Fprintf(out, "\n%d bookings created could not be cancelled\n", report.NotCleaned)
+	}
+}
+
+func runLoadTest(args []string) {
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	target := flags.String("target", "http://127.0.0.1:5000", "base URL of the instance to load")
+	rps := flags.Float64("rps", 50, "requests started a second")
+	duration := flags.Duration("duration", 30*time.Second, "how long to send requests for")
+	concurrency := flags.Int("concurrency", 64, "requests in flight at most")
+	writes := flags.Float64("writes", 0.1, "share of requests that create bookings, 0 to 1")
+	classrooms := flags.String("classrooms", "loadtest", "comma-separated classrooms to book")
+	booker := flags.String("booker", "loadtest", "booker the bookings are made for")
+	start := flags.String("start", time.Now().AddDate(1, 0, 0).Format(bookingDateLayout), "first day to book, "+bookingDateLayout)
+	keep := flags.Bool("keep", false, "keep the bookings created instead of cancelling them")
+	jsonOut := flags.Bool("json", false, "report in JSON")
+	apiKey := flags.String("api-key", envString("LOADTEST_API_KEY", ""), "API key the requests are made with")
+	flags.Parse(args)
+	begin, err := time.ParseInLocation(bookingDateLayout, *start, bookingLocation)
+	if err != nil || *rps <= 0 || *concurrency < 1 || *writes < 0 || *writes > 1 || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	lt := &loadTest{
+		target:     *target,
+		apiKey:     *apiKey,
+		booker:     *booker,
+		classrooms: strings.Split(*classrooms, ","),
+		start:      begin,
+		writes:     *writes,
+		client:     &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency}},
+		stats:      map[string]*perfSlot{},
+		failed:     map[string]int{},
+	}
+	for _, op := range loadOps {
+		lt.stats[op] = &perfSlot{counts: make([]uint32, len(perfBounds)+1)}
+	}
+	lt.run(*rps, *duration, *concurrency)
+	report := lt.report(*rps, *duration)
+	if !*keep {
+		report.NotCleaned = lt.cancelCreated()
+	}
+	if *jsonOut {
+		j, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(string(j))
+		return
+	}
+	printLoadReport(os.Stdout, report)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type maintenanceState struct {
+	Enabled    bool   `json:"enabled"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retry_after"`
+}
+
+var maintenance = struct {
+	sync.RWMutex
+	state maintenanceState
+}{state: maintenanceState{
+	Enabled:    envString("MAINTENANCE_MODE", "") == "true",
+	Message:    envString("MAINTENANCE_MESSAGE", "The booking service is under maintenance."),
+	RetryAfter: envInt("MAINTENANCE_RETRY_AFTER", 300),
+}}
+
+func currentMaintenance() maintenanceState {
+	maintenance.RLock()
+	defer maintenance.RUnlock()
+	return maintenance.state
+}
+
+func isReadMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// maintenanceMiddleware keeps serving reads during maintenance but refuses
+// writes, except to the admin API so maintenance can be switched off again.
+// Every response carries the banner while maintenance is on.
+func maintenanceMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := currentMaintenance()
+		if !state.Enabled {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("X-Maintenance-Message", state.Message)
+		if isReadMethod(r.Method) || strings.HasPrefix(r.URL.Path, basePath+"/"+adminPath+"/") {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(state.RetryAfter))
+		w.Header().Set("Content-Type", jsonContentType)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		j, err := json.Marshal(map[string]string{"error": "maintenance", "message": state.Message})
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+	})
+}
+
+func handlerAdminMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		j, err := json.Marshal(currentMaintenance())
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+	case http.MethodPut:
+		state := currentMaintenance()
+		err := json.NewDecoder(r.Body).Decode(&state)
+		if err != nil || state.RetryAfter < 0 {
+			log.Print(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		maintenance.Lock()
+		maintenance.state = state
+		maintenance.Unlock()
+		recordAudit(r, "admin.maintenance", "service", "", state)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const managerPath = "managers"
+const policyPath = "policy"
+
+// A department owns or manages classrooms through classroom_manager rows.
+// Manager keys carry their department, e.g.
+//
+//	INSERT INTO api_key (api_key_hash, api_key_role, api_key_department_id) VALUES (SHA2('<key>', 256), 'manager', 'physics')
+//
+// Managers approve bookings, set room policies and see reports for their
+// classrooms. Owners can also hand classrooms to other departments.
+const (
+	classroomOwner   = "owner"
+	classroomManager = "manager"
+)
+
+var errNotManager = fmt.Errorf("%w: classroom is not managed by the caller", errForbidden)
+
+type classroomManagerEntry struct {
+	ClassroomId  string `json:"classroom_id"`
+	DepartmentId string `json:"department_id"`
+	Role         string `json:"role"`
+}
+
+// roomPolicy is what a classroom's managers decide about bookings of it. A
+// zero MaxDuration allows any duration.
+type roomPolicy struct {
+	ClassroomId      string `json:"classroom_id"`
+	RequiresApproval bool   `json:"requires_approval"`
+	MaxDuration      int    `json:"max_duration"`
+	// Capacity makes the classroom shared between seat reservations, see
+	// seats.go.
+	Capacity int `json:"capacity"`
+	// DefaultPriority is the tier of bookings that don't ask for one, and
+	// Preemptible lets bookings of a higher tier displace lower, tentative
+	// ones up to PreemptNotice minutes before they start, see priority.go.
+	DefaultPriority priority `json:"default_priority,omitempty"`
+	Preemptible     bool     `json:"preemptible"`
+	PreemptNotice   int      `json:"preempt_notice"`
+	// MinDuration and Granularity, in minutes, bound timed bookings from
+	// below and make their start and length whole steps; MaxLeadDays and
+	// MinNotice (minutes) bound how far ahead any booking starts, whole-day
+	// ones at midnight. Zero is no limit.
+	MinDuration int `json:"min_duration"`
+	Granularity int `json:"granularity"`
+	MaxLeadDays int `json:"max_lead_days"`
+	MinNotice   int `json:"min_notice"`
+}
+
+func getClassroomManagers(classroomId string) ([]classroomManagerEntry, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT manager_classroom_id, manager_department_id, manager_role FROM classroom_manager
+		WHERE manager_classroom_id = ? ORDER BY manager_role DESC, manager_department_id`, classroomId)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	managers := make([]classroomManagerEntry, 0)
+	for results.Next() {
+		var m classroomManagerEntry
+		if err := results.Scan(&m.ClassroomId, &m.DepartmentId, &m.Role); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		managers = append(managers, m)
+	}
+	return managers, results.Err()
+}
+
+func saveClassroomManager(m classroomManagerEntry) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `INSERT INTO classroom_manager (manager_classroom_id, manager_department_id, manager_role) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE manager_role = VALUES(manager_role)`, m.ClassroomId, m.DepartmentId, m.Role)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+func removeClassroomManager(classroomId, departmentId string) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `DELETE FROM classroom_manager WHERE manager_classroom_id = ? AND manager_department_id = ?`, classroomId, departmentId)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+// classroomRole is the role the caller's department holds on a classroom,
+// or "" if it holds none. Admins are treated as owners of every classroom.
+func classroomRole(caller *apiKey, classroomId string) (string, error) {
+	if caller == nil {
+		return "", nil
+	}
+	if caller.Role == roleAdmin {
+		return classroomOwner, nil
+	}
+	if caller.Role != roleManager || caller.DepartmentId == "" {
+		return "", nil
+	}
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	var role string
+	err := Db.QueryRowContext(ctx, `SELECT manager_role FROM classroom_manager WHERE manager_classroom_id = ? AND manager_department_id = ?`,
+		classroomId, caller.DepartmentId).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		log.Println(err.Error())
+		return "", err
+	}
+	return role, nil
+}
+
+// managedClassrooms lists the classrooms the caller manages. all is true
+// for admins, who manage every classroom.
+func managedClassrooms(caller *apiKey) (classroomIds []string, all bool, err error) {
+	if caller != nil && caller.Role == roleAdmin {
+		return nil, true, nil
+	}
+	classroomIds = []string{}
+	if caller == nil || caller.Role != roleManager || caller.DepartmentId == "" {
+		return classroomIds, false, nil
+	}
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT manager_classroom_id FROM classroom_manager WHERE manager_department_id = ? ORDER BY manager_classroom_id`, caller.DepartmentId)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, false, err
+	}
+	defer results.Close()
+	for results.Next() {
+		var classroomId string
+		if err := results.Scan(&classroomId); err != nil {
+			log.Println(err.Error())
+			return nil, false, err
+		}
+		classroomIds = append(classroomIds, classroomId)
+	}
+	return classroomIds, false, results.Err()
+}
+
+// authorizeManager checks that the caller holds one of the roles on a
+// classroom, answering 401/403 (or 500) otherwise.
+func authorizeManager(w http.ResponseWriter, r *http.Request, classroomId string, roles ...string) bool {
+	caller := callerOf(r)
+	if caller == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	held, err := classroomRole(caller, classroomId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return false
+	}
+	for _, role := range roles {
+		if held == role {
+			return true
+		}
+	}
+	w.WriteHeader(http.StatusForbidden)
+	return false
+}
+
+// approveBookingAs approves a pending booking if the caller manages its
+// classroom.
+func approveBookingAs(caller *apiKey, b booking) (bool, error) {
+	role, err := classroomRole(caller, b.BookingClassroomId)
+	if err != nil {
+		return false, err
+	}
+	if role == "" {
+		return false, errNotManager
+	}
+	return approveBooking(b.BookingId)
+}
+
+func getRoomPolicy(classroomId string) (roomPolicy, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	policy := roomPolicy{ClassroomId: classroomId}
+	results, err := Db.QueryContext(ctx, `SELECT policy_requires_approval, policy_max_duration, policy_capacity, policy_default_priority, policy_preemptible, policy_preempt_notice,
+		policy_min_duration, policy_granularity, policy_max_lead_days, policy_min_notice FROM classroom_policy WHERE policy_classroom_id = ?`, classroomId)
+	if err != nil {
+		log.Println(err.Error())
+		return policy, err
+	}
+	defer results.Close()
+	if results.Next() {
+		if err := results.Scan(&policy.RequiresApproval, &policy.MaxDuration, &policy.Capacity, &policy.DefaultPriority, &policy.Preemptible, &policy.PreemptNotice,
+			&policy.MinDuration, &policy.Granularity, &policy.MaxLeadDays, &policy.MinNotice); err != nil {
+			log.Println(err.Error())
+			return policy, err
+		}
+	}
+	return policy, results.Err()
+}
+
+// saveRoomPolicy stores a classroom's policy if the caller manages it.
+func saveRoomPolicy(caller *apiKey, policy roomPolicy) error {
+	role, err := classroomRole(caller, policy.ClassroomId)
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		return errNotManager
+	}
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err = Db.ExecContext(ctx, `INSERT INTO classroom_policy (policy_classroom_id, policy_requires_approval, policy_max_duration, policy_capacity, policy_default_priority, policy_preemptible, policy_preempt_notice,
+		policy_min_duration, policy_granularity, policy_max_lead_days, policy_min_notice) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE policy_requires_approval = VALUES(policy_requires_approval), policy_max_duration = VALUES(policy_max_duration), policy_capacity = VALUES(policy_capacity),
+		policy_default_priority = VALUES(policy_default_priority), policy_preemptible = VALUES(policy_preemptible), policy_preempt_notice = VALUES(policy_preempt_notice),
+		policy_min_duration = VALUES(policy_min_duration), policy_granularity = VALUES(policy_granularity), policy_max_lead_days = VALUES(policy_max_lead_days), policy_min_notice = VALUES(policy_min_notice)`,
+		policy.ClassroomId, policy.RequiresApproval, policy.MaxDuration, policy.Capacity, policy.DefaultPriority, policy.Preemptible, policy.PreemptNotice,
+		policy.MinDuration, policy.Granularity, policy.MaxLeadDays, policy.MinNotice)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+// allows reports whether the policy lets a booking of this duration through.
+// Whole-day bookings exceed any maximum.
+func (p roomPolicy) allows(b booking) bool {
+	return p.MaxDuration == 0 || b.BookingDuration > 0 && b.BookingDuration <= p.MaxDuration
+}
+
+// violation returns the error code and arguments of the first duration,
+// granularity or lead time rule b breaks, or "" if it keeps them. Whole-day
+// bookings have no start time or length to step, and are long enough; the
+// lead time rules take them to start at midnight.
+func (p roomPolicy) violation(b booking, now time.Time) (string, []string) {
+	start, _, err := bookingWindow(b)
+	if err != nil {
+		return "", nil
+	}
+	if b.BookingDuration > 0 {
+		if p.MinDuration > 0 && b.BookingDuration < p.MinDuration {
+			return "below_room_minimum", []string{"classroom", b.BookingClassroomId, "min", strconv.Itoa(p.MinDuration)}
+		}
+		if p.Granularity > 0 && (b.BookingDuration%p.Granularity != 0 || (start.Hour()*60+start.Minute())%p.Granularity != 0) {
+			return "off_room_granularity", []string{"classroom", b.BookingClassroomId, "granularity", strconv.Itoa(p.Granularity)}
+		}
+	}
+	if p.MaxLeadDays > 0 && start.After(now.AddDate(0, 0, p.MaxLeadDays)) {
+		return "too_far_ahead", []string{"classroom", b.BookingClassroomId, "days", strconv.Itoa(p.MaxLeadDays)}
+	}
+	if p.MinNotice > 0 && start.Before(now.Add(time.Duration(p.MinNotice)*time.Minute)) {
+		return "too_short_notice", []string{"classroom", b.BookingClassroomId, "minutes", strconv.Itoa(p.MinNotice)}
+	}
+	return "", nil
+}
+
+// applyRoomPolicy holds b for approval if its classroom requires it, makes
+// it a one seat reservation in a shared classroom unless it asks for more,
+// and writes the error and returns true if the policy rejects it.
+func applyRoomPolicy(w http.ResponseWriter, r *http.Request, b *booking) bool {
+	policy, err := getRoomPolicy(b.BookingClassroomId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return true
+	}
+	if policy.Capacity > 0 && b.BookingSeats == 0 {
+		b.BookingSeats = 1
+	}
+	if b.BookingSeats < 0 || b.BookingSeats > policy.Capacity {
+		writeError(w, r, http.StatusBadRequest, "invalid_seats", "classroom", b.BookingClassroomId, "capacity", strconv.Itoa(policy.Capacity))
+		return true
+	}
+	if !policy.allows(*b) {
+		writeError(w, r, http.StatusBadRequest, "exceeds_room_policy", "classroom", b.BookingClassroomId, "max", strconv.Itoa(policy.MaxDuration))
+		return true
+	}
+	if code, args := policy.violation(*b, time.Now()); code != "" {
+		writeError(w, r, http.StatusBadRequest, code, args...)
+		return true
+	}
+	if policy.RequiresApproval {
+		b.BookingStatus = bookingStatusPending
+	}
+	return false
+}
+
+func handlerRoomPolicy(w http.ResponseWriter, r *http.Request, classroomId string) {
+	switch r.Method {
+	case http.MethodGet:
+		policy, err := getRoomPolicy(classroomId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		j, err := json.Marshal(policy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+	case http.MethodPut:
+		var policy roomPolicy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil || policy.MaxDuration < 0 || policy.Capacity < 0 || policy.PreemptNotice < 0 ||
+			policy.MinDuration < 0 || policy.Granularity < 0 || policy.MaxLeadDays < 0 || policy.MinNotice < 0 ||
+			policy.MaxDuration > 0 && policy.MinDuration > policy.MaxDuration {
+			writeError(w, r, http.StatusBadRequest, "invalid_body")
+			return
+		}
+		policy.ClassroomId = classroomId
+		caller := callerOf(r)
+		if caller == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := saveRoomPolicy(caller, policy); err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		recordAudit(r, "classroom.policy", "classroom", classroomId, policy)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handlerClassroomManagers serves /api/classrooms/{id}/managers. Any
+// manager of the classroom can list them; only owners change them.
+func handlerClassroomManagers(w http.ResponseWriter, r *http.Request, classroomId string, rest []string) {
+	if len(rest) == 0 {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorizeManager(w, r, classroomId, classroomOwner, classroomManager) {
+			return
+		}
+		managers, err := getClassroomManagers(classroomId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		j, err := json.Marshal(managers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+		return
+	}
+	if len(rest) > 1 || rest[0] == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	departmentId := rest[0]
+	switch r.Method {
+	case http.MethodPut:
+		var update struct {
+			Role string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil || update.Role != classroomOwner && update.Role != classroomManager {
+			writeError(w, r, http.StatusBadRequest, "invalid_body")
+			return
+		}
+		if !authorizeManager(w, r, classroomId, classroomOwner) {
+			return
+		}
+		m := classroomManagerEntry{ClassroomId: classroomId, DepartmentId: departmentId, Role: update.Role}
+		if err := saveClassroomManager(m); err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		recordAudit(r, "classroom.manager", "classroom", classroomId, m)
+	case http.MethodDelete:
+		if !authorizeManager(w, r, classroomId, classroomOwner) {
+			return
+		}
+		if err := removeClassroomManager(classroomId, departmentId); err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		recordAudit(r, "classroom.manager_remove", "classroom", classroomId, departmentId)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
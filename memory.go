@@ -0,0 +1,473 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Running with --storage=memory (or STORAGE=memory) needs no MySQL, for
+// demos, front-end development and CI. Bookings live in the memory booking
+// store, saved after every change to MEMORY_SNAPSHOT as JSON and loaded
+// from it on start when it is set. Everything kept outside the booking
+// store reads from an empty database instead: there are no classrooms,
+// policies, penalties or keys, writes to those tables fail with
+// errNoSql, as do booking changes made in SQL rather than through the
+// store, such as approvals, and migrations don't run.
+
+const (
+	storageMysql  = "mysql"
+	storageMemory = "memory"
+
+	emptyDriverName = "empty"
+)
+
+func init() {
+	bookingBackends[storageMemory] = func(db *sql.DB) (BookingRepository, error) {
+		return openMemoryBookings(envString("MEMORY_SNAPSHOT", ""))
+	}
+	sql.Register(emptyDriverName, emptyDriver{})
+}
+
+type memorySnapshot struct {
+	NextId   int       `json:"next_id"`
+	Bookings []booking `json:"bookings"`
+}
+
+// memoryBookingRepository keeps bookings in a map by id, mirroring the
+// booking table's auto increment and unique keys. tenant limits it to the
+// tenant's bookings as in the SQL store.
+type memoryBookingRepository struct {
+	*memoryBookings
+	tenant string
+}
+
+func (repo memoryBookingRepository) forTenant(tenant string) BookingRepository {
+	repo.tenant = tenant
+	return repo
+}
+
+// visible reports whether b is a booking of the repository's tenant.
+func (repo memoryBookingRepository) visible(b booking) bool {
+	return repo.tenant == "" || b.tenant() == repo.tenant
+}
+
+type memoryBookings struct {
+	mu       sync.Mutex
+	bookings map[int]booking
+	nextId   int
+	snapshot string
+}
+
+func openMemoryBookings(snapshot string) (memoryBookingRepository, error) {
+	m := &memoryBookings{bookings: make(map[int]booking), nextId: 1, snapshot: snapshot}
+	if snapshot == "" {
+		return memoryBookingRepository{memoryBookings: m}, nil
+	}
+	data, err := os.ReadFile(snapshot)
+	if errors.Is(err, os.ErrNotExist) {
+		return memoryBookingRepository{memoryBookings: m}, nil
+	} else if err != nil {
+		return memoryBookingRepository{}, err
+	}
+	var s memorySnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return memoryBookingRepository{}, fmt.Errorf("MEMORY_SNAPSHOT %s: %w", snapshot, err)
+	}
+	for _, b := range s.Bookings {
+		m.bookings[b.BookingId] = b
+		if b.BookingId >= m.nextId {
+			m.nextId = b.BookingId + 1
+		}
+	}
+	if s.NextId > m.nextId {
+		m.nextId = s.NextId
+	}
+	log.Printf("loaded %d bookings from %s", len(m.bookings), snapshot)
+	return memoryBookingRepository{memoryBookings: m}, nil
+}
+
+// sorted returns the bookings matching keep in id order, as the booking
+// table's primary key returns them.
+func (m *memoryBookings) sorted(keep func(b booking) bool) []booking {
+	bookings := make([]booking, 0)
+	for _, b := range m.bookings {
+		if keep(b) {
+			bookings = append(bookings, b)
+		}
+	}
+	sort.Slice(bookings, func(i, j int) bool { return bookings[i].BookingId < bookings[j].BookingId })
+	return bookings
+}
+
+// save writes the snapshot through a temporary file, so a crash leaves the
+// previous one. Callers hold mu.
+func (m *memoryBookings) save() error {
+	if m.snapshot == "" {
+		return nil
+	}
+	j, err := json.Marshal(memorySnapshot{m.nextId, m.sorted(func(booking) bool { return true })})
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(m.snapshot), ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(j); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), m.snapshot)
+}
+
+func (repo memoryBookingRepository) GetBooking(bookingId int) (*booking, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	b, ok := repo.bookings[bookingId]
+	if !ok || !repo.visible(b) {
+		return nil, nil
+	}
+	return &b, nil
+}
+
+func (repo memoryBookingRepository) GetBookingByPublicId(publicId string) (*booking, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	for _, b := range repo.bookings {
+		if b.BookingPublicId == publicId && repo.visible(b) {
+			return &b, nil
+		}
+	}
+	return nil, nil
+}
+
+func (repo memoryBookingRepository) GetBooker(bookerId string) ([]booking, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	return repo.sorted(func(b booking) bool { return b.BookingBookerId == bookerId && repo.visible(b) }), nil
+}
+
+// GetBookingList applies the filter as filter.where does in SQL. No
+// classroom has a location in memory mode, so location filters match
+// nothing. Every field is returned whatever fields asks for.
+func (repo memoryBookingRepository) GetBookingList(filter bookingFilter, fields []bookingField) ([]booking, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	bookings := repo.sorted(func(b booking) bool {
+		date := strings.TrimSpace(b.BookingTime)
+		if len(date) > len(bookingDateLayout) {
+			date = date[:len(bookingDateLayout)]
+		}
+		return repo.visible(b) && filter.BuildingId == 0 && filter.FloorId == 0 &&
+			(filter.ClassroomId == "" || b.BookingClassroomId == filter.ClassroomId) &&
+			(filter.BookerId == "" || b.BookingBookerId == filter.BookerId) &&
+			(filter.GroupId == "" || b.BookingGroupId == filter.GroupId) &&
+			(filter.Status == "" || b.BookingStatus == filter.Status) &&
+			(filter.From == "" || date >= filter.From) &&
+			(filter.To == "" || date <= filter.To) &&
+			(filter.UpdatedSince.IsZero() || b.BookingUpdatedAt.After(filter.UpdatedSince))
+	})
+	return filter.limit(bookings), nil
+}
+
+// InsertBooking enforces what the booking table's keys do: unique public
+// ids, and one whole classroom booking per classroom and time, failing
+// like MySQL so callers treat the duplicate the same way.
+func (repo memoryBookingRepository) InsertBooking(b booking) (int, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if b.BookingPublicId == "" {
+		b.BookingPublicId = newPublicId()
+	}
+	if b.Tenant == "" {
+		b.Tenant = repo.tenant
+	}
+	for _, other := range repo.bookings {
+		if other.BookingPublicId == b.BookingPublicId ||
+			b.BookingSeats == 0 && other.BookingSeats == 0 && other.BookingClassroomId == b.BookingClassroomId && strings.TrimSpace(other.BookingTime) == strings.TrimSpace(b.BookingTime) {
+			return 0, &mysql.MySQLError{Number: 1062, Message: "Duplicate entry for key 'booking.booking_UNIQUE'"}
+		}
+	}
+	// No policy gives a classroom seats in memory mode.
+	if b.BookingSeats > 0 {
+		return 0, errNoSeats
+	}
+	b.BookingId = repo.nextId
+	b.BookingPriority = int(b.priority())
+	b.BookingUpdatedAt = time.Now().UTC()
+	b.ActedBy, b.RequestId = "", ""
+	repo.bookings[b.BookingId] = b
+	repo.nextId++
+	if err := repo.save(); err != nil {
+		log.Printf("MEMORY_SNAPSHOT: %v", err)
+	}
+	return b.BookingId, nil
+}
+
+func (repo memoryBookingRepository) RemoveBooking(bookingId int) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if b, ok := repo.bookings[bookingId]; !ok || !repo.visible(b) {
+		return nil
+	}
+	delete(repo.bookings, bookingId)
+	if err := repo.save(); err != nil {
+		log.Printf("MEMORY_SNAPSHOT: %v", err)
+	}
+	return nil
+}
+
+// memoryBatch applies a batch to a copy of the bookings, swapped in on
+// commit. It holds the repository's lock throughout, so no change slips in
+// between.
+type memoryBatch struct {
+	repo     memoryBookingRepository
+	bookings map[int]booking
+	nextId   int
+	done     bool
+}
+
+func (repo memoryBookingRepository) beginBatch() batchTx {
+	repo.mu.Lock()
+	bookings := make(map[int]booking, len(repo.bookings))
+	for id, b := range repo.bookings {
+		bookings[id] = b
+	}
+	return &memoryBatch{repo: repo, bookings: bookings, nextId: repo.nextId}
+}
+
+// conflicts returns the bookings of the batch in the way of b.
+func (batch *memoryBatch) conflicts(b booking) ([]booking, error) {
+	// No policy gives a classroom seats in memory mode.
+	if b.BookingSeats > 0 {
+		return nil, errNoSeats
+	}
+	start, end, err := bookingWindow(b)
+	if err != nil {
+		return nil, err
+	}
+	others := make([]booking, 0)
+	for _, other := range batch.bookings {
+		if other.BookingId != b.BookingId && other.BookingClassroomId == b.BookingClassroomId {
+			others = append(others, other)
+		}
+	}
+	if conflicts := seatConflicts(b, others, start, end, 0); len(conflicts) > 0 {
+		return conflicts, errConflict
+	}
+	return nil, nil
+}
+
+func (batch *memoryBatch) cancel(b booking) error {
+	if _, ok := batch.bookings[b.BookingId]; !ok {
+		return errNotFound
+	}
+	delete(batch.bookings, b.BookingId)
+	return nil
+}
+
+func (batch *memoryBatch) move(b booking) ([]booking, error) {
+	current, ok := batch.bookings[b.BookingId]
+	if !ok {
+		return nil, errNotFound
+	}
+	if conflicts, err := batch.conflicts(b); err != nil {
+		return conflicts, err
+	}
+	current.BookingTime, current.BookingDuration, current.BookingClassroomId = b.BookingTime, b.BookingDuration, b.BookingClassroomId
+	current.BookingStatus, current.BookingSeats, current.BookingUpdatedAt = b.BookingStatus, b.BookingSeats, time.Now().UTC()
+	batch.bookings[b.BookingId] = current
+	return nil, nil
+}
+
+func (batch *memoryBatch) create(b booking) (int, []booking, error) {
+	if conflicts, err := batch.conflicts(b); err != nil {
+		return 0, conflicts, err
+	}
+	for _, other := range batch.bookings {
+		if other.BookingPublicId == b.BookingPublicId {
+			return 0, nil, errConflict
+		}
+	}
+	b.BookingId = batch.nextId
+	b.BookingPriority = int(b.priority())
+	b.BookingUpdatedAt = time.Now().UTC()
+	b.ActedBy, b.RequestId = "", ""
+	batch.bookings[b.BookingId] = b
+	batch.nextId++
+	return b.BookingId, nil, nil
+}
+
+func (batch *memoryBatch) commit() error {
+	if batch.done {
+		return nil
+	}
+	batch.repo.bookings, batch.repo.nextId = batch.bookings, batch.nextId
+	if err := batch.repo.save(); err != nil {
+		log.Printf("MEMORY_SNAPSHOT: %v", err)
+	}
+	batch.done = true
+	batch.repo.mu.Unlock()
+	return nil
+}
+
+func (batch *memoryBatch) rollback() {
+	if !batch.done {
+		batch.done = true
+		batch.repo.mu.Unlock()
+	}
+}
+
+// setupMemoryDb opens the empty database in place of MySQL.
+func setupMemoryDb() {
+	var err error
+	Db, err = sql.Open(emptyDriverName, "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("storage is in memory; only bookings are kept")
+}
+
+// emptyDriver is a database without rows: queries return none, but for
+// aggregates, and statements fail, so that a write is never taken for done.
+type emptyDriver struct{}
+
+var errNoSql = errors.New("memory mode: no SQL")
+
+type emptyConn struct{}
+
+type emptyStmt struct {
+	query string
+}
+
+type emptyRows struct {
+	row  []driver.Value
+	done bool
+}
+
+func (emptyDriver) Open(name string) (driver.Conn, error) {
+	return emptyConn{}, nil
+}
+
+func (emptyConn) Prepare(query string) (driver.Stmt, error) {
+	return emptyStmt{query}, nil
+}
+
+func (emptyConn) Close() error {
+	return nil
+}
+
+func (emptyConn) Begin() (driver.Tx, error) {
+	return emptyConn{}, nil
+}
+
+func (emptyConn) Commit() error {
+	return nil
+}
+
+func (emptyConn) Rollback() error {
+	return nil
+}
+
+func (emptyStmt) Close() error {
+	return nil
+}
+
+func (emptyStmt) NumInput() int {
+	return -1
+}
+
+func (emptyStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errNoSql
+}
+
+func (s emptyStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &emptyRows{row: aggregateRow(s.query)}, nil
+}
+
+func (rows *emptyRows) Columns() []string {
+	return make([]string, len(rows.row))
+}
+
+func (rows *emptyRows) Close() error {
+	return nil
+}
+
+func (rows *emptyRows) Next(dest []driver.Value) error {
+	if rows.row == nil || rows.done {
+		return io.EOF
+	}
+	rows.done = true
+	copy(dest, rows.row)
+	return nil
+}
+
+// aggregateRow is the one row an aggregate query without GROUP BY answers
+// over no rows, as SQL has it: COUNT is 0, other aggregates NULL, unless
+// COALESCE gives a literal fallback. Other queries answer no rows.
+func aggregateRow(query string) []driver.Value {
+	q := strings.TrimSpace(query)
+	upper := strings.ToUpper(q)
+	from := strings.Index(upper, " FROM ")
+	if !strings.HasPrefix(upper, "SELECT ") || strings.Contains(upper, " GROUP BY ") {
+		return nil
+	}
+	if from < 0 {
+		from = len(q)
+	}
+	var columns []string
+	depth, start := 0, len("SELECT ")
+	for i := start; i < from; i++ {
+		switch q[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				columns = append(columns, q[start:i])
+				start = i + 1
+			}
+		}
+	}
+	columns = append(columns, q[start:from])
+	row := make([]driver.Value, len(columns))
+	for i, column := range columns {
+		column = strings.TrimSpace(column)
+		upper := strings.ToUpper(column)
+		switch {
+		case strings.HasPrefix(upper, "COUNT("):
+			row[i] = int64(0)
+		case strings.HasPrefix(upper, "COALESCE("):
+			inner := strings.TrimSuffix(column[len("COALESCE("):], ")")
+			fallback := strings.TrimSpace(inner[strings.LastIndex(inner, ",")+1:])
+			if n, err := strconv.ParseInt(fallback, 10, 64); err == nil {
+				row[i] = n
+			} else {
+				row[i] = strings.Trim(fallback, "'")
+			}
+		case strings.HasPrefix(upper, "SUM("), strings.HasPrefix(upper, "MAX("), strings.HasPrefix(upper, "MIN("), strings.HasPrefix(upper, "AVG("):
+		default:
+			return nil
+		}
+	}
+	return row
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A minimal Prometheus text exposition registry, enough for counters,
+// gauges and histograms with fixed label names.
+
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+	// Histograms count observations per upper bound in buckets, keeping
+	// their sums in values.
+	buckets []float64
+	counts  map[string][]float64
+}
+
+var metricRegistry = struct {
+	sync.Mutex
+	metrics []*metricVec
+}{}
+
+func newMetric(kind string, name string, help string, labels ...string) *metricVec {
+	m := &metricVec{name: name, help: help, kind: kind, labels: labels, values: make(map[string]float64)}
+	metricRegistry.Lock()
+	metricRegistry.metrics = append(metricRegistry.metrics, m)
+	metricRegistry.Unlock()
+	return m
+}
+
+func newCounter(name string, help string, labels ...string) *metricVec {
+	return newMetric("counter", name, help, labels...)
+}
+
+func newGauge(name string, help string, labels ...string) *metricVec {
+	return newMetric("gauge", name, help, labels...)
+}
+
+// newHistogram counts observations into buckets, which must be sorted.
+func newHistogram(name string, help string, buckets []float64, labels ...string) *metricVec {
+	m := newMetric("histogram", name, help, labels...)
+	m.buckets, m.counts = buckets, make(map[string][]float64)
+	return m
+}
+
+func (m *metricVec) key(labelValues []string) string {
+	pairs := make([]string, len(m.labels))
+	for i, label := range m.labels {
+		value := ""
+		if i < len(labelValues) {
+			value = labelValues[i]
+		}
+		pairs[i] = fmt.Sprintf("%s=%q", label, value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *metricVec) Add(delta float64, labelValues ...string) {
+	k := m.key(labelValues)
+	m.mu.Lock()
+	m.values[k] += delta
+	m.mu.Unlock()
+}
+
+func (m *metricVec) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+func (m *metricVec) Set(value float64, labelValues ...string) {
+	k := m.key(labelValues)
+	m.mu.Lock()
+	m.values[k] = value
+	m.mu.Unlock()
+}
+
+// Observe adds value to a histogram. The last count of a series is its
+// +Inf bucket.
+func (m *metricVec) Observe(value float64, labelValues ...string) {
+	m.ObserveN(value, 1, labelValues...)
+}
+
+// ObserveN adds n observations of value to a histogram.
+func (m *metricVec) ObserveN(value float64, n float64, labelValues ...string) {
+	k := m.key(labelValues)
+	m.mu.Lock()
+	counts, ok := m.counts[k]
+	if !ok {
+		counts = make([]float64, len(m.buckets)+1)
+		m.counts[k] = counts
+	}
+	for i, bound := range m.buckets {
+		if value <= bound {
+			counts[i] += n
+		}
+	}
+	counts[len(m.buckets)] += n
+	m.values[k] += value * n
+	m.mu.Unlock()
+}
+
+// series writes one sample, joining the series labels and extra ones.
+func series(sb *strings.Builder, name string, labels string, extra string, value float64) {
+	if labels != "" && extra != "" {
+		labels += ","
+	}
+	labels += extra
+	if labels == "" {
+		fmt.Fprintf(sb, "%s %g\n", name, value)
+	} else {
+		fmt.Fprintf(sb, "%s{%s} %g\n", name, labels, value)
+	}
+}
+
+func (m *metricVec) write(sb *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if m.kind == "histogram" {
+		for _, k := range keys {
+			counts := m.counts[k]
+			for i, bound := range m.buckets {
+				series(sb, m.name+"_bucket", k, fmt.Sprintf("le=%q", fmt.Sprint(bound)), counts[i])
+			}
+			series(sb, m.name+"_bucket", k, `le="+Inf"`, counts[len(m.buckets)])
+			series(sb, m.name+"_sum", k, "", m.values[k])
+			series(sb, m.name+"_count", k, "", counts[len(m.buckets)])
+		}
+		return
+	}
+	for _, k := range keys {
+		if k == "" {
+			fmt.Fprintf(sb, "%s %g\n", m.name, m.values[k])
+		} else {
+			fmt.Fprintf(sb, "%s{%s} %g\n", m.name, k, m.values[k])
+		}
+	}
+}
+
+func handlerMetrics(w http.ResponseWriter, r *http.Request) {
+	var sb strings.Builder
+	metricRegistry.Lock()
+	for _, m := range metricRegistry.metrics {
+		m.write(&sb)
+	}
+	metricRegistry.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(sb.String()))
+}
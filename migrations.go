@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+type migration struct {
+	Version    int
+	Statements []string
+}
+
+var migrations = []migration{
+	{1, []string{
+		`CREATE TABLE IF NOT EXISTS building (
+			building_id int NOT NULL AUTO_INCREMENT,
+			building_name varchar(45) NOT NULL,
+			PRIMARY KEY (building_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+		`CREATE TABLE IF NOT EXISTS floor (
+			floor_id int NOT NULL AUTO_INCREMENT,
+			floor_building_id int NOT NULL,
+			floor_level int NOT NULL,
+			floor_name varchar(45) NOT NULL,
+			PRIMARY KEY (floor_id),
+			UNIQUE KEY floor_UNIQUE (floor_building_id, floor_level),
+			CONSTRAINT fk_floor_building_id FOREIGN KEY (floor_building_id) REFERENCES building (building_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+		`ALTER TABLE classroom ADD COLUMN classroom_floor_id int NULL,
+			ADD KEY fk_classroom_floor_id_idx (classroom_floor_id),
+			ADD CONSTRAINT fk_classroom_floor_id FOREIGN KEY (classroom_floor_id) REFERENCES floor (floor_id)`,
+	}},
+	{2, []string{
+		`ALTER TABLE booking ADD COLUMN booking_duration int NOT NULL DEFAULT 0,
+			ADD COLUMN booking_title varchar(100) NOT NULL DEFAULT ''`,
+		`CREATE TABLE IF NOT EXISTS booking_template (
+			template_id int NOT NULL AUTO_INCREMENT,
+			template_booker_id varchar(20) NOT NULL,
+			template_classroom_id varchar(20) NOT NULL,
+			template_duration int NOT NULL,
+			template_recurrence varchar(10) NOT NULL DEFAULT '',
+			template_title varchar(100) NOT NULL DEFAULT '',
+			PRIMARY KEY (template_id),
+			KEY fk_template_booker_id_idx (template_booker_id),
+			CONSTRAINT fk_template_booker_id FOREIGN KEY (template_booker_id) REFERENCES student (student_id),
+			CONSTRAINT fk_template_classroom_id FOREIGN KEY (template_classroom_id) REFERENCES classroom (classroom_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+		`CREATE TABLE IF NOT EXISTS favorite_classroom (
+			favorite_booker_id varchar(20) NOT NULL,
+			favorite_classroom_id varchar(20) NOT NULL,
+			PRIMARY KEY (favorite_booker_id, favorite_classroom_id),
+			CONSTRAINT fk_favorite_booker_id FOREIGN KEY (favorite_booker_id) REFERENCES student (student_id),
+			CONSTRAINT fk_favorite_classroom_id FOREIGN KEY (favorite_classroom_id) REFERENCES classroom (classroom_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+	}},
+	{3, []string{
+		`CREATE TABLE IF NOT EXISTS notification_preference (
+			preference_booker_id varchar(20) NOT NULL,
+			preference_channel varchar(20) NOT NULL DEFAULT 'none',
+			preference_email varchar(100) NOT NULL DEFAULT '',
+			preference_webhook_url varchar(255) NOT NULL DEFAULT '',
+			preference_reminder_lead int NOT NULL DEFAULT 0,
+			preference_mode varchar(10) NOT NULL DEFAULT 'immediate',
+			PRIMARY KEY (preference_booker_id),
+			CONSTRAINT fk_preference_booker_id FOREIGN KEY (preference_booker_id) REFERENCES student (student_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+		`CREATE TABLE IF NOT EXISTS notification_digest (
+			digest_id int NOT NULL AUTO_INCREMENT,
+			digest_booker_id varchar(20) NOT NULL,
+			digest_text varchar(500) NOT NULL,
+			digest_created_at datetime NOT NULL,
+			PRIMARY KEY (digest_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+	}},
+	{4, []string{
+		`ALTER TABLE notification_preference DROP FOREIGN KEY fk_preference_booker_id`,
+		`ALTER TABLE notification_preference RENAME COLUMN preference_booker_id TO preference_owner_id,
+			ADD COLUMN preference_scope varchar(10) NOT NULL DEFAULT 'booker' FIRST,
+			ADD COLUMN preference_slack_webhook_url varchar(255) NOT NULL DEFAULT '' AFTER preference_webhook_url,
+			ADD COLUMN preference_line_token varchar(100) NOT NULL DEFAULT '' AFTER preference_slack_webhook_url,
+			ADD COLUMN preference_telegram_chat_id varchar(50) NOT NULL DEFAULT '' AFTER preference_line_token,
+			DROP PRIMARY KEY, ADD PRIMARY KEY (preference_scope, preference_owner_id)`,
+		`ALTER TABLE notification_digest RENAME COLUMN digest_booker_id TO digest_owner_id,
+			ADD COLUMN digest_scope varchar(10) NOT NULL DEFAULT 'booker' AFTER digest_id`,
+	}},
+	{5, []string{
+		`ALTER TABLE classroom ADD COLUMN classroom_calendar_id varchar(255) NOT NULL DEFAULT ''`,
+		`CREATE TABLE IF NOT EXISTS booking_calendar_event (
+			booking_id int NOT NULL,
+			calendar_id varchar(255) NOT NULL,
+			calendar_event_id varchar(255) NOT NULL,
+			calendar_event_imported tinyint(1) NOT NULL DEFAULT 0,
+			PRIMARY KEY (booking_id),
+			KEY calendar_event_idx (calendar_id, calendar_event_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+	}},
+	{6, []string{
+		`ALTER TABLE booking ADD COLUMN booking_checked_in_at datetime NULL`,
+	}},
+	{7, []string{
+		`CREATE TABLE IF NOT EXISTS api_key (
+			api_key_hash char(64) NOT NULL,
+			api_key_role varchar(20) NOT NULL,
+			api_key_booker_id varchar(20) NULL,
+			PRIMARY KEY (api_key_hash),
+			CONSTRAINT fk_api_key_booker_id FOREIGN KEY (api_key_booker_id) REFERENCES student (student_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+	}},
+	{8, []string{
+		`ALTER TABLE booking ADD COLUMN booking_status varchar(20) NOT NULL DEFAULT 'confirmed'`,
+		`CREATE TABLE IF NOT EXISTS booker_penalty (
+			penalty_id int NOT NULL AUTO_INCREMENT,
+			penalty_booker_id varchar(20) NOT NULL,
+			penalty_booking_id int NOT NULL,
+			penalty_kind varchar(20) NOT NULL,
+			penalty_created_at datetime NOT NULL,
+			PRIMARY KEY (penalty_id),
+			UNIQUE KEY penalty_UNIQUE (penalty_booking_id, penalty_kind),
+			KEY penalty_booker_idx (penalty_booker_id, penalty_created_at)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+	}},
+	{9, []string{
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			audit_id bigint NOT NULL AUTO_INCREMENT,
+			audit_at datetime NOT NULL,
+			audit_actor varchar(50) NOT NULL,
+			audit_action varchar(50) NOT NULL,
+			audit_entity varchar(20) NOT NULL,
+			audit_entity_id varchar(50) NOT NULL,
+			audit_detail text NOT NULL,
+			PRIMARY KEY (audit_id),
+			KEY audit_entity_idx (audit_entity, audit_entity_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+		`INSERT IGNORE INTO student (student_id, student_name) VALUES ('anonymous', 'ANONYMOUS')`,
+	}},
+	{10, []string{
+		`CREATE TABLE IF NOT EXISTS booking_archive (
+			booking_id int NOT NULL,
+			booking_time varchar(20) NOT NULL,
+			booking_classroom_id varchar(20) NOT NULL,
+			booking_student_id varchar(20) NOT NULL,
+			booking_duration int NOT NULL,
+			booking_title varchar(100) NOT NULL,
+			booking_status varchar(20) NOT NULL,
+			booking_checked_in_at datetime NULL,
+			archived_at datetime NOT NULL,
+			PRIMARY KEY (booking_id),
+			KEY booking_archive_time_idx (booking_time)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+	}},
+	{11, []string{
+		`CREATE TABLE IF NOT EXISTS feature_flag (
+			flag_name varchar(50) NOT NULL,
+			flag_enabled tinyint(1) NOT NULL,
+			flag_percentage int NOT NULL DEFAULT 100,
+			flag_tenants text NOT NULL,
+			PRIMARY KEY (flag_name)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+	}},
+	{12, []string{
+		`CREATE TABLE IF NOT EXISTS api_usage (
+			usage_hour datetime NOT NULL,
+			usage_actor varchar(100) NOT NULL,
+			usage_requests int NOT NULL DEFAULT 0,
+			usage_bookings int NOT NULL DEFAULT 0,
+			usage_cancellations int NOT NULL DEFAULT 0,
+			PRIMARY KEY (usage_hour, usage_actor)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+	}},
+	{13, []string{
+		`ALTER TABLE notification_preference ADD COLUMN preference_language varchar(10) NOT NULL DEFAULT ''`,
+	}},
+	{14, []string{
+		`ALTER TABLE booking ADD COLUMN booking_updated_at datetime(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3) ON UPDATE CURRENT_TIMESTAMP(3),
+			ADD INDEX booking_updated_at (booking_updated_at)`,
+		`ALTER TABLE booking_archive ADD COLUMN booking_updated_at datetime(3) NULL`,
+	}},
+	{15, []string{
+		`CREATE TABLE IF NOT EXISTS booking_hold (
+			hold_id char(32) NOT NULL,
+			hold_classroom_id varchar(20) NOT NULL,
+			hold_booker_id varchar(20) NOT NULL,
+			hold_booking_time varchar(20) NOT NULL,
+			hold_duration int NOT NULL DEFAULT 0,
+			hold_title varchar(100) NOT NULL DEFAULT '',
+			hold_expires_at datetime NOT NULL,
+			PRIMARY KEY (hold_id),
+			KEY hold_classroom_id (hold_classroom_id, hold_expires_at)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+	}},
+	{16, []string{
+		`ALTER TABLE booking ADD COLUMN booking_public_id char(26) NULL, ADD UNIQUE KEY booking_public_id (booking_public_id)`,
+		`ALTER TABLE booking_archive ADD COLUMN booking_public_id char(26) NULL`,
+	}},
+	{17, []string{
+		`ALTER TABLE api_key ADD COLUMN api_key_department_id varchar(20) NULL`,
+		`CREATE TABLE IF NOT EXISTS classroom_manager (
+			manager_classroom_id varchar(20) NOT NULL,
+			manager_department_id varchar(20) NOT NULL,
+			manager_role varchar(10) NOT NULL,
+			PRIMARY KEY (manager_classroom_id, manager_department_id),
+			KEY manager_department_id (manager_department_id),
+			CONSTRAINT fk_manager_classroom_id FOREIGN KEY (manager_classroom_id) REFERENCES classroom (classroom_id) ON DELETE CASCADE
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+		`CREATE TABLE IF NOT EXISTS classroom_policy (
+			policy_classroom_id varchar(20) NOT NULL,
+			policy_requires_approval tinyint(1) NOT NULL DEFAULT 0,
+			policy_max_duration int NOT NULL DEFAULT 0,
+			PRIMARY KEY (policy_classroom_id),
+			CONSTRAINT fk_policy_classroom_id FOREIGN KEY (policy_classroom_id) REFERENCES classroom (classroom_id) ON DELETE CASCADE
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+	}},
+	{18, []string{
+		`CREATE TABLE IF NOT EXISTS booking_event (
+			event_id bigint NOT NULL AUTO_INCREMENT,
+			event_booking_id int NOT NULL,
+			event_booking_public_id char(26) NOT NULL,
+			event_booker_id varchar(20) NOT NULL,
+			event_type varchar(30) NOT NULL,
+			event_acted_by varchar(100) NOT NULL DEFAULT '',
+			event_booking json NOT NULL,
+			event_created_at datetime(3) NOT NULL,
+			PRIMARY KEY (event_id),
+			KEY event_booking_public_id (event_booking_public_id),
+			KEY event_booking_id (event_booking_id),
+			KEY event_booker_id (event_booker_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+	}},
+	{19, []string{
+		`CREATE TABLE IF NOT EXISTS schedule_slot (
+			slot_classroom_id varchar(20) NOT NULL,
+			slot_start datetime NOT NULL,
+			slot_booking_id int NOT NULL,
+			slot_booking_public_id char(26) NOT NULL,
+			slot_booking_start datetime NOT NULL,
+			slot_booking_end datetime NOT NULL,
+			PRIMARY KEY (slot_classroom_id, slot_start, slot_booking_id),
+			KEY slot_start (slot_start),
+			KEY slot_booking_id (slot_booking_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+	}},
+	{20, []string{
+		`ALTER TABLE notification_preference ADD COLUMN preference_agenda_hour tinyint NULL, ADD INDEX preference_agenda_hour (preference_agenda_hour)`,
+	}},
+	{21, []string{
+		`ALTER TABLE classroom_policy ADD COLUMN policy_capacity int NOT NULL DEFAULT 0`,
+		// Seat reservations share their slot, so the slot is only unique
+		// among bookings of the whole classroom.
+		`ALTER TABLE booking ADD COLUMN booking_seats int NOT NULL DEFAULT 0,
+			ADD COLUMN booking_seat_key char(26) AS (IF(booking_seats > 0, booking_public_id, '')) STORED,
+			DROP INDEX booking_UNIQUE,
+			ADD UNIQUE KEY booking_UNIQUE (booking_time, booking_classroom_id, booking_seat_key)`,
+		`ALTER TABLE booking_archive ADD COLUMN booking_seats int NOT NULL DEFAULT 0`,
+	}},
+	{22, []string{
+		`CREATE TABLE IF NOT EXISTS booker_group (
+			group_id varchar(64) NOT NULL,
+			group_name varchar(255) NOT NULL,
+			PRIMARY KEY (group_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+		`CREATE TABLE IF NOT EXISTS booker_group_member (
+			member_group_id varchar(64) NOT NULL,
+			member_booker_id varchar(20) NOT NULL,
+			member_role enum('member','manager') NOT NULL DEFAULT 'member',
+			PRIMARY KEY (member_group_id, member_booker_id),
+			KEY member_booker_id (member_booker_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+		`ALTER TABLE booking ADD COLUMN booking_group_id varchar(64) NULL, ADD INDEX booking_group_id (booking_group_id)`,
+		`ALTER TABLE booking_archive ADD COLUMN booking_group_id varchar(64) NULL`,
+	}},
+	{23, []string{
+		`ALTER TABLE booking ADD COLUMN booking_priority tinyint NOT NULL DEFAULT 1`,
+		`ALTER TABLE booking_archive ADD COLUMN booking_priority tinyint NOT NULL DEFAULT 1`,
+		`ALTER TABLE classroom_policy ADD COLUMN policy_default_priority tinyint NOT NULL DEFAULT 0,
+			ADD COLUMN policy_preemptible tinyint(1) NOT NULL DEFAULT 0,
+			ADD COLUMN policy_preempt_notice int NOT NULL DEFAULT 0`,
+		`CREATE TABLE IF NOT EXISTS booking_waitlist (
+			waitlist_id int NOT NULL AUTO_INCREMENT,
+			waitlist_booker_id varchar(20) NOT NULL,
+			waitlist_classroom_id varchar(20) NOT NULL,
+			waitlist_booking_time varchar(20) NOT NULL,
+			waitlist_duration int NOT NULL DEFAULT 0,
+			waitlist_title varchar(100) NOT NULL DEFAULT '',
+			waitlist_seats int NOT NULL DEFAULT 0,
+			waitlist_group_id varchar(64) NULL,
+			waitlist_priority tinyint NOT NULL DEFAULT 1,
+			waitlist_displaced_by char(26) NOT NULL,
+			waitlist_created_at datetime NOT NULL,
+			PRIMARY KEY (waitlist_id),
+			KEY waitlist_booker_id (waitlist_booker_id),
+			KEY waitlist_classroom_id (waitlist_classroom_id, waitlist_booking_time)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+	}},
+	{24, []string{
+		// Existing events are numbered in the order they were appended.
+		`ALTER TABLE booking_event ADD COLUMN event_seq bigint NULL AFTER event_id`,
+		`UPDATE booking_event e JOIN (SELECT event_id, ROW_NUMBER() OVER (ORDER BY event_id) AS seq FROM booking_event) n ON n.event_id = e.event_id
+			SET e.event_seq = n.seq`,
+		`ALTER TABLE booking_event MODIFY event_seq bigint NOT NULL, ADD UNIQUE KEY event_seq (event_seq)`,
+		`CREATE TABLE IF NOT EXISTS event_sequence (
+			sequence_name varchar(30) NOT NULL,
+			sequence_value bigint NOT NULL,
+			PRIMARY KEY (sequence_name)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+		`INSERT INTO event_sequence (sequence_name, sequence_value) SELECT 'booking_event', COALESCE(MAX(event_seq), 0) FROM booking_event`,
+	}},
+	{25, []string{
+		`CREATE TABLE IF NOT EXISTS request_journal (
+			journal_id bigint NOT NULL AUTO_INCREMENT,
+			journal_request_id char(26) NOT NULL,
+			journal_phase enum('start','finish') NOT NULL,
+			journal_at datetime(3) NOT NULL,
+			journal_method varchar(10) NOT NULL DEFAULT '',
+			journal_path varchar(2048) NOT NULL DEFAULT '',
+			journal_actor varchar(100) NOT NULL DEFAULT '',
+			journal_body json NULL,
+			journal_body_truncated tinyint(1) NOT NULL DEFAULT 0,
+			journal_status int NOT NULL DEFAULT 0,
+			journal_duration_ms bigint NOT NULL DEFAULT 0,
+			PRIMARY KEY (journal_id),
+			KEY journal_request_id (journal_request_id),
+			KEY journal_at (journal_at)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+	}},
+	{26, []string{
+		`ALTER TABLE classroom ADD COLUMN classroom_map_url varchar(2048) NOT NULL DEFAULT '',
+			ADD COLUMN classroom_access_instructions text NULL,
+			ADD COLUMN classroom_photo_updated_at datetime NULL`,
+	}},
+	{27, []string{
+		`CREATE TABLE IF NOT EXISTS bootstrap (
+			bootstrap_id tinyint NOT NULL,
+			bootstrapped_at datetime NOT NULL,
+			PRIMARY KEY (bootstrap_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+	}},
+	{28, []string{
+		`ALTER TABLE classroom_policy ADD COLUMN policy_min_duration int NOT NULL DEFAULT 0,
+			ADD COLUMN policy_granularity int NOT NULL DEFAULT 0,
+			ADD COLUMN policy_max_lead_days int NOT NULL DEFAULT 0,
+			ADD COLUMN policy_min_notice int NOT NULL DEFAULT 0`,
+	}},
+	{29, []string{
+		`CREATE TABLE IF NOT EXISTS booking_series (
+			series_id int NOT NULL AUTO_INCREMENT,
+			series_booker_id varchar(64) NOT NULL,
+			series_template_id int NOT NULL,
+			series_recurrence varchar(10) NOT NULL,
+			series_created_at datetime NOT NULL,
+			PRIMARY KEY (series_id),
+			KEY series_booker_id (series_booker_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+		`CREATE TABLE IF NOT EXISTS booking_occurrence (
+			occurrence_booking_id int NOT NULL,
+			occurrence_series_id int NOT NULL,
+			occurrence_index int NOT NULL,
+			occurrence_time varchar(20) NOT NULL,
+			occurrence_exception varchar(16) NOT NULL DEFAULT '',
+			occurrence_exception_at datetime NULL,
+			PRIMARY KEY (occurrence_booking_id),
+			UNIQUE KEY occurrence_series_index (occurrence_series_id, occurrence_index)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+	}},
+	{30, []string{
+		`ALTER TABLE booking_event ADD COLUMN event_request_id varchar(128) NOT NULL DEFAULT ''`,
+		`ALTER TABLE request_journal MODIFY journal_request_id varchar(128) NOT NULL`,
+	}},
+	{31, []string{
+		`ALTER TABLE audit_log ADD COLUMN audit_tenant varchar(50) NOT NULL DEFAULT 'default',
+			ADD COLUMN audit_route varchar(200) NOT NULL DEFAULT '',
+			ADD COLUMN audit_request_id varchar(128) NOT NULL DEFAULT '',
+			ADD INDEX audit_at_idx (audit_at)`,
+	}},
+	{32, []string{
+		`ALTER TABLE classroom ADD COLUMN classroom_door_id varchar(64) NOT NULL DEFAULT ''`,
+		`CREATE TABLE IF NOT EXISTS booking_access_grant (
+			access_booking_id int NOT NULL,
+			access_grant_id varchar(255) NOT NULL,
+			access_door_id varchar(64) NOT NULL,
+			access_valid_from datetime NOT NULL,
+			access_valid_until datetime NOT NULL,
+			PRIMARY KEY (access_booking_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+	}},
+	{33, []string{
+		`ALTER TABLE classroom ADD COLUMN classroom_capacity int NOT NULL DEFAULT 0`,
+		`CREATE TABLE IF NOT EXISTS classroom_equipment (
+			equipment_classroom_id varchar(20) NOT NULL,
+			equipment_name varchar(64) NOT NULL,
+			PRIMARY KEY (equipment_classroom_id, equipment_name)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+	}},
+	{34, []string{
+		`CREATE TABLE IF NOT EXISTS booking_receipt (
+			receipt_id int NOT NULL AUTO_INCREMENT,
+			receipt_booking_id int NOT NULL,
+			receipt_booking_public_id char(26) NOT NULL,
+			receipt_booker_id varchar(20) NOT NULL,
+			receipt_event varchar(32) NOT NULL,
+			receipt_jws text NOT NULL,
+			receipt_issued_at datetime NOT NULL,
+			PRIMARY KEY (receipt_id),
+			KEY receipt_booking_id (receipt_booking_id),
+			KEY receipt_booking_public_id (receipt_booking_public_id),
+			KEY receipt_booker_id (receipt_booker_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+	}},
+	{35, []string{
+		`CREATE TABLE IF NOT EXISTS classroom_subscription (
+			subscription_id char(26) NOT NULL,
+			subscription_classroom_id varchar(20) NOT NULL,
+			subscription_delivery varchar(16) NOT NULL,
+			subscription_webhook_url varchar(2048) NOT NULL DEFAULT '',
+			subscription_email varchar(255) NOT NULL DEFAULT '',
+			subscription_events varchar(255) NOT NULL DEFAULT '',
+			subscription_language varchar(8) NOT NULL DEFAULT '',
+			subscription_created_at datetime NOT NULL,
+			subscription_api_key_hash char(64) NOT NULL,
+			PRIMARY KEY (subscription_id),
+			KEY subscription_classroom_id (subscription_classroom_id),
+			KEY subscription_api_key_hash (subscription_api_key_hash)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3`,
+	}},
+	{36, []string{
+		`ALTER TABLE booking_event ADD COLUMN event_classroom_id varchar(20) AS (JSON_UNQUOTE(JSON_EXTRACT(event_booking, '$.classroom_id'))) STORED,
+			ADD INDEX event_classroom_id (event_classroom_id, event_created_at)`,
+	}},
+	{37, []string{
+		`ALTER TABLE classroom_subscription ADD COLUMN subscription_confirm_hash char(64) NOT NULL DEFAULT ''`,
+	}},
+	{38, []string{
+		`ALTER TABLE api_key ADD COLUMN api_key_tenant_id varchar(64) NULL`,
+	}},
+	{39, []string{
+		// Rows from before are taken as whole classroom bookings until the
+		// next rebuild.
+		`ALTER TABLE schedule_slot ADD COLUMN slot_booking_seats int NOT NULL DEFAULT 0`,
+	}},
+	{40, []string{
+		`ALTER TABLE booking ADD COLUMN booking_tenant varchar(64) NOT NULL DEFAULT 'default'`,
+		`ALTER TABLE booking_archive ADD COLUMN booking_tenant varchar(64) NOT NULL DEFAULT 'default'`,
+	}},
+}
+
+func migrateDb() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version int NOT NULL, applied_at datetime NOT NULL, PRIMARY KEY (version))`)
+	if err != nil {
+		return err
+	}
+	var current int
+	err = Db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		if err := applyStatements(ctx, m.Statements); err != nil {
+			return err
+		}
+		if _, err := Db.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES (?, UTC_TIMESTAMP())`, m.Version); err != nil {
+			return err
+		}
+		log.Printf("applied migration %d", m.Version)
+	}
+	return nil
+}
+
+// checkMigrated fails unless every migration has been applied, in place of
+// migrateDb on a read replica, whose database takes them from the primary.
+func checkMigrated() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var current int
+	if err := Db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	if latest := migrations[len(migrations)-1].Version; current < latest {
+		return fmt.Errorf("database is at migration %d of %d; migrate the primary first", current, latest)
+	}
+	return nil
+}
+
+// applyStatements runs schema changes in order, stopping at the first that
+// fails.
+func applyStatements(ctx context.Context, statements []string) error {
+	for _, stmt := range statements {
+		if _, err := Db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type notification struct {
+	Event   string           `json:"event"`
+	Subject string           `json:"subject"`
+	Text    string           `json:"text"`
+	Booking *bookingResponse `json:"booking,omitempty"`
+	// RequestId is the id of the API request that caused the notification,
+	// empty for scheduled ones such as reminders.
+	RequestId string `json:"request_id,omitempty"`
+	// booking is the booking notified about, for calendar invites.
+	booking *booking
+}
+
+type notifier interface {
+	Send(p notificationPreference, n notification) error
+}
+
+const (
+	channelNone     = "none"
+	channelEmail    = "email"
+	channelWebhook  = "webhook"
+	channelSlack    = "slack"
+	channelLine     = "line"
+	channelTelegram = "telegram"
+)
+
+const (
+	eventBookingCreated   = "booking.created"
+	eventBookingCancelled = "booking.cancelled"
+	eventBookingApproved  = "booking.approved"
+	eventBookingReminder  = "booking.reminder"
+	eventBookingDigest    = "booking.digest"
+	eventBookingAgenda    = "booking.agenda"
+
+	eventBookingRescheduled = "booking.rescheduled"
+	eventBookingPreempted   = "booking.preempted"
+	// Check-ins are kept in booking histories but not notified.
+	eventBookingCheckedIn = "booking.checked_in"
+)
+
+var notifiers = map[string]notifier{
+	channelEmail:    emailNotifier{},
+	channelWebhook:  webhookNotifier{},
+	channelSlack:    slackNotifier{},
+	channelLine:     lineNotifier{},
+	channelTelegram: telegramNotifier{},
+}
+
+var notifyClient = &http.Client{Timeout: 5 * time.Second}
+
+type emailNotifier struct{}
+
+func (emailNotifier) Send(p notificationPreference, n notification) error {
+	addr := envString("SMTP_ADDR", "")
+	if addr == "" {
+		log.Printf("SMTP_ADDR not set, dropping email to %s", p.Email)
+		return nil
+	}
+	from := envString("SMTP_FROM", "classroom@localhost")
+	var auth smtp.Auth
+	if user := envString("SMTP_USER", ""); user != "" {
+		auth = smtp.PlainAuth("", user, envString("SMTP_PASSWORD", ""), strings.Split(addr, ":")[0])
+	}
+	headers := ""
+	if n.RequestId != "" {
+		headers = fmt.Sprintf("%s: %s\r\n", requestIdHeader, n.RequestId)
+	}
+	var msg string
+	if method := inviteMethod(p, n); method != "" {
+		msg = fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n%s%s", from, p.Email, n.Subject, headers, inviteEmailBody(method, n, from, p.Email, time.Now()))
+	} else {
+		msg = fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n%sContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", from, p.Email, n.Subject, headers, n.Text)
+	}
+	return smtp.SendMail(addr, auth, from, []string{p.Email}, []byte(msg))
+}
+
+// Webhooks set in preferences are delivered as subscriptions' are, to
+// public addresses only.
+type webhookNotifier struct{}
+
+func (webhookNotifier) Send(p notificationPreference, n notification) error {
+	j, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	return postNotificationVia(subscriptionClient, p.WebhookUrl, "application/json", bytes.NewReader(j), "", n.RequestId)
+}
+
+type slackNotifier struct{}
+
+func (slackNotifier) Send(p notificationPreference, n notification) error {
+	j, err := json.Marshal(map[string]string{"text": n.Text})
+	if err != nil {
+		return err
+	}
+	return postNotificationVia(subscriptionClient, p.SlackWebhookUrl, "application/json", bytes.NewReader(j), "", n.RequestId)
+}
+
+type lineNotifier struct{}
+
+func (lineNotifier) Send(p notificationPreference, n notification) error {
+	form := url.Values{"message": {n.Text}}
+	return postNotification(envString("LINE_NOTIFY_URL", "https://notify-api.line.me/api/notify"), "application/x-www-form-urlencoded", strings.NewReader(form.Encode()), "Bearer "+p.LineToken, n.RequestId)
+}
+
+type telegramNotifier struct{}
+
+func (telegramNotifier) Send(p notificationPreference, n notification) error {
+	token := envString("TELEGRAM_BOT_TOKEN", "")
+	if token == "" {
+		log.Printf("TELEGRAM_BOT_TOKEN not set, dropping message to chat %s", p.TelegramChatId)
+		return nil
+	}
+	form := url.Values{"chat_id": {p.TelegramChatId}, "text": {n.Text}}
+	return postNotification("https://api.telegram.org/bot"+token+"/sendMessage", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()), "", n.RequestId)
+}
+
+func postNotification(target string, contentType string, body io.Reader, authorization string, requestId string) error {
+	return postNotificationVia(notifyClient, target, contentType, body, authorization, requestId)
+}
+
+// postNotificationVia posts a notification with client.
+func postNotificationVia(client *http.Client, target string, contentType string, body io.Reader, authorization string, requestId string) error {
+	req, err := http.NewRequest(http.MethodPost, target, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	setRequestIdHeaders(req, requestId)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("notify %s: %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+// preferenceLanguage is the language notifications to p are written in.
+func preferenceLanguage(p notificationPreference) string {
+	if lang, ok := supportedLanguage(p.Language); ok {
+		return lang
+	}
+	return defaultLanguage()
+}
+
+// notificationAction is the words for what event did to b, in lang.
+func notificationAction(event string, b booking, lang string) string {
+	var action string
+	switch event {
+	case eventBookingCreated:
+		action = translate(lang, "booking.confirmed")
+		if b.BookingStatus == bookingStatusPending {
+			action = translate(lang, "booking.pending")
+		}
+	case eventBookingCancelled:
+		action = translate(lang, "booking.cancelled")
+	case eventBookingApproved:
+		action = translate(lang, "booking.approved")
+	case eventBookingReminder:
+		action = translate(lang, "booking.reminder")
+	case eventBookingRescheduled:
+		action = translate(lang, "booking.rescheduled")
+	case eventBookingPreempted:
+		action = translate(lang, "booking.preempted")
+	}
+	return action
+}
+
+// bookingNotification renders the notification of event for b with the
+// templates of b's tenant, see notifytemplate.go.
+func bookingNotification(event string, b booking, lang string) notification {
+	data := bookingNotificationData(event, b, notificationAction(event, b, lang))
+	response := newBookingResponse(b)
+	return notification{Event: event, Subject: renderNotification(b.Tenant, lang, templateSubject, data), Text: renderNotification(b.Tenant, lang, templateText, data),
+		Booking: &response, RequestId: b.RequestId, booking: &b}
+}
+
+func sendNotification(p notificationPreference, n notification) {
+	notifier, ok := notifiers[p.Channel]
+	if !ok {
+		return
+	}
+	if err := notifier.Send(p, n); err != nil {
+		log.Printf("notify %s %s via %s: %v", p.Scope, p.OwnerId, p.Channel, err)
+	}
+}
+
+// notifyBookingEvent notifies the booker of b and the owner of its
+// classroom according to their preferences.
+func notifyBookingEvent(event string, b booking) {
+	if event == eventBookingCheckedIn {
+		return
+	}
+	for _, owner := range [][2]string{{scopeBooker, b.BookingBookerId}, {scopeClassroom, b.BookingClassroomId}} {
+		p, err := getPreference(owner[0], owner[1])
+		if err != nil || p.Channel == channelNone {
+			continue
+		}
+		n := bookingNotification(event, b, preferenceLanguage(p))
+		if p.Mode == modeDigest {
+			queueDigest(p.Scope, p.OwnerId, n.Text)
+			continue
+		}
+		sendNotification(p, n)
+	}
+}
+
+func queueDigest(scope string, ownerId string, text string) {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `INSERT INTO notification_digest (digest_scope, digest_owner_id, digest_text, digest_created_at) VALUES (?, ?, ?, UTC_TIMESTAMP())`, scope, ownerId, text)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// flushDigests sends every owner in digest mode one message with all the
+// notifications queued for them since the last flush.
+func flushDigests() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT digest_id, digest_scope, digest_owner_id, digest_text FROM notification_digest ORDER BY digest_id`)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	lastId := 0
+	texts := make(map[[2]string][]string)
+	for results.Next() {
+		var scope, ownerId, text string
+		if err := results.Scan(&lastId, &scope, &ownerId, &text); err != nil {
+			log.Println(err.Error())
+			results.Close()
+			return
+		}
+		texts[[2]string{scope, ownerId}] = append(texts[[2]string{scope, ownerId}], text)
+	}
+	results.Close()
+	if err := results.Err(); err != nil {
+		log.Println(err.Error())
+		return
+	}
+	if lastId == 0 {
+		return
+	}
+	for owner, lines := range texts {
+		p, err := digestPreference(owner[0], owner[1])
+		if err != nil || p.Channel == channelNone {
+			continue
+		}
+		sendNotification(p, notification{Event: eventBookingDigest, Subject: renderNotification(defaultTenant, preferenceLanguage(p), templateDigestSubject, notificationData{Event: eventBookingDigest}), Text: strings.Join(lines, "\n")})
+	}
+	_, err = Db.ExecContext(ctx, `DELETE FROM notification_digest WHERE digest_id <= ?`, lastId)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// reminderColumns is what sendReminders selects, a booking and its
+// booker's preference, in the order of their scanFields.
+var reminderColumns = qualifiedColumns("b", bookingColumns) + ", " + qualifiedColumns("p", preferenceColumns)
+
+// sendReminders notifies bookers whose reminder time, the booking start minus
+// their reminder lead, fell in (since, now].
+func sendReminders(since, now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT `+reminderColumns+`
+		FROM booking b JOIN notification_preference p ON p.preference_scope = ? AND p.preference_owner_id = b.booking_student_id
+		WHERE p.preference_channel <> ? AND p.preference_reminder_lead > 0 AND LEFT(TRIM(b.booking_time), 10) BETWEEN ? AND ?`,
+		scopeBooker, channelNone, now.In(bookingLocation).Format(bookingDateLayout), now.In(bookingLocation).AddDate(0, 0, 7).Format(bookingDateLayout))
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	defer results.Close()
+	for results.Next() {
+		var b booking
+		var p notificationPreference
+		fields := append(b.scanFields(), p.scanFields()...)
+		// A booking that doesn't scan loses its reminder, not everyone's.
+		if err := results.Scan(fields...); err != nil {
+			log.Printf("reminders: skipping a row: %v", err)
+			dbScanErrorsTotal.Inc("reminders")
+			continue
+		}
+		start, _, err := bookingWindow(b)
+		if err != nil {
+			continue
+		}
+		remindAt := start.Add(-time.Duration(p.ReminderLead) * time.Minute)
+		if remindAt.After(since) && !remindAt.After(now) {
+			go sendNotification(p, bookingNotification(eventBookingReminder, b, preferenceLanguage(p)))
+		}
+	}
+	if err := results.Err(); err != nil {
+		log.Println(err.Error())
+		dbScanErrorsTotal.Inc("reminders")
+	}
+}
+
+func startNotificationJobs() {
+	lastReminder := time.Now().UTC()
+	startJob("reminders", time.Minute, func() {
+		now := time.Now().UTC()
+		sendReminders(lastReminder, now)
+		lastReminder = now
+	})
+	startJob("digests", envDuration("DIGEST_INTERVAL", time.Hour), flushDigests)
+	lastAgenda := time.Now().In(bookingLocation)
+	startJob("agendas", time.Minute, func() {
+		now := time.Now().In(bookingLocation)
+		if now.Hour() != lastAgenda.Hour() {
+			sendAgendas(now)
+		}
+		lastAgenda = now
+	})
+}
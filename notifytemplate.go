@@ -0,0 +1,296 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// Notification subjects and texts are Go text templates, one per name and
+// language in notifications/<language>/<name>.tmpl, embedded in the binary.
+// A deployment overrides any of them with the same layout under
+// NOTIFICATION_TEMPLATES_DIR, and one tenant's with
+// <dir>/tenants/<tenant>/<language>/<name>.tmpl. A notification takes the
+// tenant's template, else the directory's, else the embedded one, in its
+// language and then in English. Notifications a request causes use its
+// tenant, scheduled ones such as reminders, digests and agendas the
+// default. The words for actions, "is confirmed" and the like, stay in the
+// catalogs, see i18n.go, and reach templates as .Action.
+//
+// Templates are checked when loaded, at first use and on reload, which
+// keeps the ones loaded before if a file doesn't parse. GET
+// /admin/notification-templates lists where each template comes from, and
+// .../preview renders them for a sample booking, or ?booking_id=, in
+// ?language= and ?tenant=.
+
+//go:embed notifications
+var notificationFS embed.FS
+
+const notificationTemplatesPath = "notification-templates"
+const previewPath = "preview"
+
+const (
+	templateSubject       = "subject"
+	templateText          = "text"
+	templateDigestSubject = "digest_subject"
+	templateAgendaSubject = "agenda_subject"
+	templateAgendaLine    = "agenda_line"
+)
+
+var notificationTemplateNames = []string{templateSubject, templateText, templateDigestSubject, templateAgendaSubject, templateAgendaLine}
+
+// notificationData is what templates are rendered with.
+type notificationData struct {
+	Event       string
+	Action      string
+	BookingId   string
+	ClassroomId string
+	BookerId    string
+	Time        string
+	Duration    int
+	Title       string
+	ActedBy     string
+	// Date is the day of an agenda.
+	Date string
+}
+
+// notificationTemplateSet holds the parsed templates by source, see
+// templateKey, with where each was read from.
+type notificationTemplateSet struct {
+	templates map[string]*template.Template
+	sources   map[string]string
+}
+
+// The layers templates are looked up in, a tenant's being its name.
+const (
+	layerEmbedded  = ""
+	layerDirectory = "/"
+)
+
+func templateKey(layer string, lang string, name string) string {
+	return layer + "|" + lang + "|" + name
+}
+
+var notificationTemplates atomic.Pointer[notificationTemplateSet]
+
+// loadLayer parses the templates under root of fsys, in
+// <language>/<name>.tmpl, into set as layer.
+func (set *notificationTemplateSet) loadLayer(fsys fs.FS, root string, layer string, origin string) error {
+	return fs.WalkDir(fsys, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel := p
+		if root != "." {
+			rel = strings.TrimPrefix(p, root+"/")
+		}
+		parts := strings.Split(rel, "/")
+		if len(parts) != 2 || path.Ext(parts[1]) != ".tmpl" {
+			return nil
+		}
+		name := strings.TrimSuffix(parts[1], ".tmpl")
+		data, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		t, err := template.New(name).Option("missingkey=error").Parse(strings.TrimRight(string(data), "\n"))
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", origin, rel, err)
+		}
+		key := templateKey(layer, parts[0], name)
+		set.templates[key], set.sources[key] = t, origin+":"+rel
+		return nil
+	})
+}
+
+// loadNotificationTemplates reads the embedded templates and those under
+// dir, if set.
+func loadNotificationTemplates(dir string) (*notificationTemplateSet, error) {
+	set := &notificationTemplateSet{templates: map[string]*template.Template{}, sources: map[string]string{}}
+	if err := set.loadLayer(notificationFS, "notifications", layerEmbedded, "embedded"); err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		return set, nil
+	}
+	fsys := os.DirFS(dir)
+	if err := set.loadLayer(fsys, ".", layerDirectory, dir); err != nil {
+		return nil, err
+	}
+	tenants, err := fs.ReadDir(fsys, "tenants")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, tenant := range tenants {
+		if tenant.IsDir() {
+			if err := set.loadLayer(fsys, "tenants/"+tenant.Name(), tenant.Name(), path.Join(dir, "tenants", tenant.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return set, nil
+}
+
+// reloadNotificationTemplates swaps in the templates as configured now,
+// keeping the loaded ones if they don't load.
+func reloadNotificationTemplates() error {
+	set, err := loadNotificationTemplates(envString("NOTIFICATION_TEMPLATES_DIR", ""))
+	if err != nil {
+		return err
+	}
+	notificationTemplates.Store(set)
+	return nil
+}
+
+func currentNotificationTemplates() *notificationTemplateSet {
+	if set := notificationTemplates.Load(); set != nil {
+		return set
+	}
+	if err := reloadNotificationTemplates(); err != nil {
+		log.Printf("notification templates: %v; using the embedded ones", err)
+		set, err := loadNotificationTemplates("")
+		if err != nil {
+			log.Fatal(err)
+		}
+		notificationTemplates.Store(set)
+	}
+	return notificationTemplates.Load()
+}
+
+// lookup returns the template name is rendered with for tenant in lang,
+// and its key.
+func (set *notificationTemplateSet) lookup(tenant string, lang string, name string) (*template.Template, string) {
+	layers := []string{layerDirectory, layerEmbedded}
+	if tenant != "" && tenant != defaultTenant {
+		layers = append([]string{tenant}, layers...)
+	}
+	for _, l := range []string{lang, fallbackLanguage} {
+		for _, layer := range layers {
+			key := templateKey(layer, l, name)
+			if t, ok := set.templates[key]; ok {
+				return t, key
+			}
+		}
+	}
+	return nil, ""
+}
+
+// renderNotification renders template name for tenant in lang. An
+// override that fails to render falls back to the embedded template.
+func renderNotification(tenant string, lang string, name string, data notificationData) string {
+	set := currentNotificationTemplates()
+	t, key := set.lookup(tenant, lang, name)
+	var text strings.Builder
+	if t != nil {
+		err := t.Execute(&text, data)
+		if err == nil {
+			return text.String()
+		}
+		log.Printf("notification template %s: %v", set.sources[key], err)
+		text.Reset()
+	}
+	for _, l := range []string{lang, fallbackLanguage} {
+		if embedded, ok := set.templates[templateKey(layerEmbedded, l, name)]; ok && embedded != t && embedded.Execute(&text, data) == nil {
+			return text.String()
+		}
+		text.Reset()
+	}
+	return name
+}
+
+// bookingNotificationData is what templates about b are rendered with.
+func bookingNotificationData(event string, b booking, action string) notificationData {
+	return notificationData{Event: event, Action: action, BookingId: b.publicId(), ClassroomId: b.BookingClassroomId, BookerId: b.BookingBookerId,
+		Time: strings.TrimSpace(b.BookingTime), Duration: b.BookingDuration, Title: b.BookingTitle, ActedBy: b.ActedBy}
+}
+
+type templatePreview struct {
+	Name     string `json:"name"`
+	Language string `json:"language"`
+	Tenant   string `json:"tenant"`
+	Source   string `json:"source"`
+	Rendered string `json:"rendered,omitempty"`
+}
+
+// sampleBooking is what previews render without a booking_id.
+func sampleBooking() booking {
+	tomorrow := time.Now().In(bookingLocation).AddDate(0, 0, 1)
+	return booking{BookingPublicId: "01HZSAMPLE0000000000000000", BookingClassroomId: "A-101", BookingBookerId: "s0001",
+		BookingTime:     time.Date(tomorrow.Year(), tomorrow.Month(), tomorrow.Day(), 10, 0, 0, 0, bookingLocation).Format(bookingTimeLayout),
+		BookingDuration: 90, BookingTitle: "Sample booking", BookingStatus: bookingStatusConfirmed, ActedBy: "admin"}
+}
+
+// handlerAdminNotificationTemplates serves /admin/notification-templates
+// and /admin/notification-templates/preview.
+func handlerAdminNotificationTemplates(w http.ResponseWriter, r *http.Request, segments []string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	preview := len(segments) == 1 && segments[0] == previewPath
+	if len(segments) > 1 || len(segments) == 1 && segments[0] != "" && !preview {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	lang, ok := supportedLanguage(query.Get("language"))
+	if !ok {
+		lang = defaultLanguage()
+	}
+	tenant := query.Get("tenant")
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	names := notificationTemplateNames
+	if name := query.Get("name"); name != "" {
+		names = []string{name}
+	}
+	event := query.Get("event")
+	if event == "" {
+		event = eventBookingCreated
+	}
+	b := sampleBooking()
+	if id := query.Get("booking_id"); preview && id != "" {
+		found, err := resolveBooking(bookingStore, id)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		if found == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		b = *found
+	}
+	action := notificationAction(event, b, lang)
+	set := currentNotificationTemplates()
+	previews := []templatePreview{}
+	for _, name := range names {
+		t, key := set.lookup(tenant, lang, name)
+		if t == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		p := templatePreview{Name: name, Language: strings.Split(key, "|")[1], Tenant: tenant, Source: set.sources[key]}
+		if preview {
+			data := bookingNotificationData(event, b, action)
+			data.Date = strings.Split(data.Time, " ")[0]
+			p.Rendered = renderNotification(tenant, lang, name, data)
+		}
+		previews = append(previews, p)
+	}
+	j, err := json.Marshal(previews)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}
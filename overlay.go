@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GET /api/calendar?date=&buildings= is the day of every classroom at once,
+// for the facilities big board: the classrooms of the buildings listed
+// (comma separated ids, all by default) grouped by building, floor order
+// within, each with its bookings of date (today by default) in time order.
+// Classrooms without a building come last, under a building of id 0. The day
+// takes two queries whatever the number of rooms: the classrooms, and the
+// bookings from the schedule read model, or from the booking table until
+// the model is built. Like the door displays it shows titles but not
+// bookers, and concurrent polls of one day share one read.
+
+type overlayBooking struct {
+	BookingId string    `json:"booking_id"`
+	Title     string    `json:"title,omitempty"`
+	Status    string    `json:"status"`
+	Seats     int       `json:"seats,omitempty"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+}
+
+type overlayClassroom struct {
+	ClassroomId   string           `json:"classroom_id"`
+	ClassroomName string           `json:"classroom_name"`
+	FloorLevel    *int             `json:"floor_level,omitempty"`
+	Bookings      []overlayBooking `json:"bookings"`
+}
+
+type overlayBuilding struct {
+	BuildingId   int                `json:"building_id"`
+	BuildingName string             `json:"building_name,omitempty"`
+	Classrooms   []overlayClassroom `json:"classrooms"`
+}
+
+type calendarOverlay struct {
+	Date      string            `json:"date"`
+	Buildings []overlayBuilding `json:"buildings"`
+}
+
+// overlayBookingsFromSchedule reads the bookings of the classrooms
+// overlapping [start, end) from the read model, joined with the booking
+// table for what the slots don't carry.
+func overlayBookingsFromSchedule(start, end time.Time) (map[string][]overlayBooking, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	from, to := start.In(bookingLocation).Format(scheduleTimeLayout), end.In(bookingLocation).Format(scheduleTimeLayout)
+	results, err := Db.QueryContext(ctx, `SELECT DISTINCT s.slot_classroom_id, s.slot_booking_public_id, s.slot_booking_start, s.slot_booking_end, b.booking_title, b.booking_status, b.booking_seats
+		FROM schedule_slot s JOIN booking b ON b.booking_id = s.slot_booking_id
+		WHERE s.slot_start >= ? AND s.slot_start < ? AND s.slot_booking_start < ? AND s.slot_booking_end > ?`,
+		slotStart(start.In(bookingLocation)).Format(scheduleTimeLayout), to, to, from)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	bookings := map[string][]overlayBooking{}
+	for results.Next() {
+		var classroomId, bookingStart, bookingEnd string
+		var b overlayBooking
+		if err := results.Scan(&classroomId, &b.BookingId, &bookingStart, &bookingEnd, &b.Title, &b.Status, &b.Seats); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		b.Start, _ = time.ParseInLocation(scheduleTimeLayout, bookingStart, bookingLocation)
+		b.End, _ = time.ParseInLocation(scheduleTimeLayout, bookingEnd, bookingLocation)
+		bookings[classroomId] = append(bookings[classroomId], b)
+	}
+	return bookings, results.Err()
+}
+
+// overlayBookings maps classroom ids to their bookings overlapping
+// [start, end).
+func overlayBookings(start, end time.Time) (map[string][]overlayBooking, error) {
+	if scheduleReady.Load() {
+		return overlayBookingsFromSchedule(start, end)
+	}
+	busy, err := getBookingsBetween(start, end, "")
+	if err != nil {
+		return nil, err
+	}
+	bookings := map[string][]overlayBooking{}
+	for classroomId, booked := range busyClassrooms(busy, start, end) {
+		for _, b := range booked {
+			bookingStart, bookingEnd, _ := bookingWindow(b)
+			bookings[classroomId] = append(bookings[classroomId], overlayBooking{b.publicId(), b.BookingTitle, b.BookingStatus, b.BookingSeats, bookingStart, bookingEnd})
+		}
+	}
+	return bookings, nil
+}
+
+// getCalendarOverlay builds the overlay of day for buildings, all if
+// empty.
+func getCalendarOverlay(day time.Time, buildings map[int]bool) (calendarOverlay, error) {
+	overlay := calendarOverlay{Date: day.Format(bookingDateLayout), Buildings: []overlayBuilding{}}
+	classrooms, err := getClassroomList(locationFilter{})
+	if err != nil {
+		return overlay, err
+	}
+	bookings, err := overlayBookings(day, day.AddDate(0, 0, 1))
+	if err != nil {
+		return overlay, err
+	}
+	sort.SliceStable(classrooms, func(i, j int) bool {
+		a, b := classrooms[i], classrooms[j]
+		if (a.BuildingId == nil) != (b.BuildingId == nil) {
+			return b.BuildingId == nil
+		}
+		if a.BuildingId != nil && *a.BuildingId != *b.BuildingId {
+			return *a.BuildingId < *b.BuildingId
+		}
+		if a.FloorLevel != nil && b.FloorLevel != nil && *a.FloorLevel != *b.FloorLevel {
+			return *a.FloorLevel < *b.FloorLevel
+		}
+		return a.ClassroomId < b.ClassroomId
+	})
+	for _, c := range classrooms {
+		buildingId := 0
+		if c.BuildingId != nil {
+			buildingId = *c.BuildingId
+		}
+		if len(buildings) > 0 && !buildings[buildingId] {
+			continue
+		}
+		if n := len(overlay.Buildings); n == 0 || overlay.Buildings[n-1].BuildingId != buildingId {
+			overlay.Buildings = append(overlay.Buildings, overlayBuilding{BuildingId: buildingId, BuildingName: c.BuildingName, Classrooms: []overlayClassroom{}})
+		}
+		room := overlayClassroom{c.ClassroomId, c.ClassroomName, c.FloorLevel, bookings[c.ClassroomId]}
+		if room.Bookings == nil {
+			room.Bookings = []overlayBooking{}
+		}
+		sort.Slice(room.Bookings, func(i, j int) bool { return room.Bookings[i].Start.Before(room.Bookings[j].Start) })
+		building := &overlay.Buildings[len(overlay.Buildings)-1]
+		building.Classrooms = append(building.Classrooms, room)
+	}
+	return overlay, nil
+}
+
+// handlerCalendarOverlay serves GET /api/calendar.
+func handlerCalendarOverlay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	now := time.Now().In(bookingLocation)
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, bookingLocation)
+	if v := query.Get("date"); v != "" {
+		var err error
+		if day, err = time.ParseInLocation(bookingDateLayout, v, bookingLocation); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_date", "date", v)
+			return
+		}
+	}
+	buildings := map[int]bool{}
+	if v := query.Get("buildings"); v != "" {
+		for _, id := range strings.Split(v, ",") {
+			buildingId, err := strconv.Atoi(strings.TrimSpace(id))
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, "invalid_buildings", "buildings", v)
+				return
+			}
+			buildings[buildingId] = true
+		}
+	}
+	v, err := sharedRead("calendar", day.Format(bookingDateLayout)+"/"+query.Get("buildings"), func() (interface{}, error) {
+		overlay, err := getCalendarOverlay(day, buildings)
+		if err != nil {
+			return nil, err
+		}
+		j, err := json.Marshal(overlay)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return j, nil
+	})
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	w.Write(v.([]byte))
+}
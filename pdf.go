@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// pdfPage draws a single page PDF with the standard Helvetica fonts, enough
+// for printable sheets without a PDF library. Coordinates are in points
+// from the top left corner. The standard fonts only cover Latin-1 text;
+// other characters print as "?" unless PDF_FONT names a font that has
+// them, see pdffont.go.
+type pdfPage struct {
+	width, height float64
+	content       bytes.Buffer
+	// used is the glyphs drawn in the regular and bold PDF_FONT faces.
+	used [2]map[uint16]rune
+}
+
+func newPdfPage(width, height float64) *pdfPage {
+	return &pdfPage{width: width, height: height, used: [2]map[uint16]rune{{}, {}}}
+}
+
+// pdfString escapes s for a PDF string literal in WinAnsiEncoding.
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// pdfTextWidth is the width of s in PDF_FONT, or an estimate of it in
+// Helvetica, which averages a little over half the font size per
+// character.
+func pdfTextWidth(s string, size float64) float64 {
+	if regular, _ := loadedPdfFonts(); regular != nil {
+		return regular.width(s, size)
+	}
+	return float64(len([]rune(s))) * size * 0.55
+}
+
+// fitText shortens s with "..." to fit width.
+func fitText(s string, size float64, width float64) string {
+	if pdfTextWidth(s, size) <= width {
+		return s
+	}
+	runes := []rune(s)
+	for len(runes) > 0 && pdfTextWidth(string(runes)+"...", size) > width {
+		runes = runes[:len(runes)-1]
+	}
+	if len(runes) == 0 {
+		return ""
+	}
+	return string(runes) + "..."
+}
+
+// text writes s with its baseline at y.
+func (p *pdfPage) text(x, y, size float64, bold bool, s string) {
+	font, face := "F1", 0
+	if bold {
+		font, face = "F2", 1
+	}
+	encoded := "(" + pdfString(s) + ")"
+	if faces := pdfFaces(); faces[face] != nil {
+		if faces[face] == faces[0] {
+			// Without a bold face bold text is regular, embedded once.
+			font, face = "F1", 0
+		}
+		encoded = faces[face].encode(s, p.used[face])
+	}
+	fmt.Fprintf(&p.content, "BT /%s %.1f Tf %.2f %.2f Td %s Tj ET\n", font, size, x, p.height-y, encoded)
+}
+
+// rect outlines a rectangle, filling it with gray (0 black, 1 white) unless
+// fill is negative.
+func (p *pdfPage) rect(x, y, width, height, fill float64) {
+	if fill >= 0 {
+		fmt.Fprintf(&p.content, "%.2f g %.2f %.2f %.2f %.2f re B 0 g\n", fill, x, p.height-y-height, width, height)
+		return
+	}
+	fmt.Fprintf(&p.content, "%.2f %.2f %.2f %.2f re S\n", x, p.height-y-height, width, height)
+}
+
+func (p *pdfPage) line(x1, y1, x2, y2, gray float64) {
+	fmt.Fprintf(&p.content, "%.2f G %.2f %.2f m %.2f %.2f l S 0 G\n", gray, x1, p.height-y1, x2, p.height-y2)
+}
+
+// pdfFaces is the regular and bold PDF_FONT faces, nil for Helvetica.
+func pdfFaces() [2]*ttfFont {
+	regular, bold := loadedPdfFonts()
+	return [2]*ttfFont{regular, bold}
+}
+
+// bytes renders the document.
+func (p *pdfPage) bytes() []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", p.content.Len(), p.content.String()),
+	}
+	standard := [2]string{"Helvetica", "Helvetica-Bold"}
+	var fonts [2]int
+	faces := pdfFaces()
+	for face, font := range faces {
+		if face == 1 && font != nil && font == faces[0] {
+			fonts[1] = fonts[0]
+			continue
+		}
+		fonts[face] = len(objects) + 1
+		if font == nil {
+			objects = append(objects, "<< /Type /Font /Subtype /Type1 /BaseFont /"+standard[face]+" /Encoding /WinAnsiEncoding >>")
+			continue
+		}
+		objects = append(objects, font.objects(fonts[face], p.used[face])...)
+	}
+	objects[2] = fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Contents 4 0 R /Resources << /Font << /F1 %d 0 R /F2 %d 0 R >> >> >>", p.width, p.height, fonts[0], fonts[1])
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes()
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The standard PDF fonts stop at Latin-1, so Thai titles and classroom
+// names print as "?" without a font of their own. PDF_FONT names a
+// TrueType file to print with instead, and PDF_FONT_BOLD its bold face
+// (the regular one if unset), such as Noto Sans Thai or Sarabun, both
+// under the OFL. The file is read once and embedded whole in every PDF;
+// it must be a .ttf, not an .otf or a collection, and its license must
+// allow embedding. Characters are drawn one glyph each as the font's cmap
+// maps them, with its own advances: Thai vowels and tone marks, which most
+// Thai fonts give no advance, sit on their consonant, but the font's
+// mark positioning isn't applied. A font that can't be read is logged and
+// the standard fonts are used.
+
+// ttfFont is what the PDFs need of a TrueType font.
+type ttfFont struct {
+	name       string
+	data       []byte
+	unitsPerEm int
+	ascent     int
+	descent    int
+	bbox       [4]int
+	glyphs     map[rune]uint16
+	advances   []uint16
+}
+
+var pdfFonts struct {
+	once          sync.Once
+	regular, bold *ttfFont
+}
+
+// loadedPdfFonts returns the configured regular and bold fonts, nil for
+// the standard ones.
+func loadedPdfFonts() (*ttfFont, *ttfFont) {
+	pdfFonts.once.Do(func() {
+		load := func(key string) *ttfFont {
+			path := envString(key, "")
+			if path == "" {
+				return nil
+			}
+			font, err := loadTtfFont(path)
+			if err != nil {
+				log.Printf("pdf: %s: %v", key, err)
+				return nil
+			}
+			return font
+		}
+		pdfFonts.regular = load("PDF_FONT")
+		if pdfFonts.regular != nil {
+			pdfFonts.bold = load("PDF_FONT_BOLD")
+			if pdfFonts.bold == nil {
+				pdfFonts.bold = pdfFonts.regular
+			}
+		}
+	})
+	return pdfFonts.regular, pdfFonts.bold
+}
+
+var errBadTtf = errors.New("not a TrueType font")
+
+func loadTtfFont(path string) (*ttfFont, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 12 || binary.BigEndian.Uint32(data) != 0x00010000 && string(data[:4]) != "true" {
+		return nil, errBadTtf
+	}
+	tables := map[string][]byte{}
+	for i, n := 0, int(binary.BigEndian.Uint16(data[4:])); i < n; i++ {
+		record := 12 + 16*i
+		if record+16 > len(data) {
+			return nil, errBadTtf
+		}
+		offset, length := binary.BigEndian.Uint32(data[record+8:]), binary.BigEndian.Uint32(data[record+12:])
+		if uint64(offset)+uint64(length) > uint64(len(data)) {
+			return nil, errBadTtf
+		}
+		tables[string(data[record:record+4])] = data[offset : offset+length]
+	}
+	head, hhea, hmtx, cmap := tables["head"], tables["hhea"], tables["hmtx"], tables["cmap"]
+	if len(head) < 54 || len(hhea) < 36 || cmap == nil || tables["glyf"] == nil {
+		return nil, errBadTtf
+	}
+	i16 := func(b []byte, at int) int { return int(int16(binary.BigEndian.Uint16(b[at:]))) }
+	font := &ttfFont{
+		name:       pdfFontName(path),
+		data:       data,
+		unitsPerEm: int(binary.BigEndian.Uint16(head[18:])),
+		ascent:     i16(hhea, 4),
+		descent:    i16(hhea, 6),
+		bbox:       [4]int{i16(head, 36), i16(head, 38), i16(head, 40), i16(head, 42)},
+	}
+	if font.unitsPerEm == 0 {
+		return nil, errBadTtf
+	}
+	metrics := int(binary.BigEndian.Uint16(hhea[34:]))
+	if metrics == 0 || len(hmtx) < 4*metrics {
+		return nil, errBadTtf
+	}
+	for i := 0; i < metrics; i++ {
+		font.advances = append(font.advances, binary.BigEndian.Uint16(hmtx[4*i:]))
+	}
+	if font.glyphs, err = parseCmap(cmap); err != nil {
+		return nil, err
+	}
+	return font, nil
+}
+
+// pdfFontName is a PDF name for the font in path, from its file name.
+func pdfFontName(path string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return -1
+	}, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+	if name == "" {
+		return "Embedded"
+	}
+	return name
+}
+
+// parseCmap maps characters to glyphs with the font's Unicode cmap,
+// format 12 (all of Unicode) if it has one, else format 4 (the BMP).
+func parseCmap(cmap []byte) (map[rune]uint16, error) {
+	if len(cmap) < 4 {
+		return nil, errBadTtf
+	}
+	var bmp, full []byte
+	for i, n := 0, int(binary.BigEndian.Uint16(cmap[2:])); i < n && 4+8*i+8 <= len(cmap); i++ {
+		record := cmap[4+8*i:]
+		platform, encoding, offset := binary.BigEndian.Uint16(record), binary.BigEndian.Uint16(record[2:]), binary.BigEndian.Uint32(record[4:])
+		if int(offset)+4 > len(cmap) {
+			continue
+		}
+		subtable := cmap[offset:]
+		switch format := binary.BigEndian.Uint16(subtable); {
+		case format == 12 && (platform == 3 && encoding == 10 || platform == 0):
+			full = subtable
+		case format == 4 && (platform == 3 && encoding == 1 || platform == 0):
+			bmp = subtable
+		}
+	}
+	glyphs := map[rune]uint16{}
+	switch {
+	case len(full) >= 16:
+		groups := int(binary.BigEndian.Uint32(full[12:]))
+		if len(full) < 16+12*groups {
+			return nil, errBadTtf
+		}
+		for i := 0; i < groups; i++ {
+			group := full[16+12*i:]
+			start, end, glyph := binary.BigEndian.Uint32(group), binary.BigEndian.Uint32(group[4:]), binary.BigEndian.Uint32(group[8:])
+			for c := start; c <= end && c <= 0x10ffff; c++ {
+				glyphs[rune(c)] = uint16(glyph + c - start)
+			}
+		}
+	case len(bmp) >= 14:
+		segments := int(binary.BigEndian.Uint16(bmp[6:])) / 2
+		if len(bmp) < 16+8*segments {
+			return nil, errBadTtf
+		}
+		ends, starts, deltas, rangeOffsets := bmp[14:], bmp[16+2*segments:], bmp[16+4*segments:], 16+6*segments
+		for s := 0; s < segments; s++ {
+			start, end := int(binary.BigEndian.Uint16(starts[2*s:])), int(binary.BigEndian.Uint16(ends[2*s:]))
+			delta, rangeOffset := binary.BigEndian.Uint16(deltas[2*s:]), int(binary.BigEndian.Uint16(bmp[rangeOffsets+2*s:]))
+			for c := start; c <= end && c < 0xffff; c++ {
+				glyph := uint16(c) + delta
+				if rangeOffset != 0 {
+					at := rangeOffsets + 2*s + rangeOffset + 2*(c-start)
+					if at+2 > len(bmp) {
+						continue
+					}
+					if glyph = binary.BigEndian.Uint16(bmp[at:]); glyph != 0 {
+						glyph += delta
+					}
+				}
+				if glyph != 0 {
+					glyphs[rune(c)] = glyph
+				}
+			}
+		}
+	default:
+		return nil, errors.New("no Unicode cmap")
+	}
+	return glyphs, nil
+}
+
+// advance is the width of glyph in thousandths of the font size.
+func (f *ttfFont) advance(glyph uint16) int {
+	advance := f.advances[len(f.advances)-1]
+	if int(glyph) < len(f.advances) {
+		advance = f.advances[glyph]
+	}
+	return f.scale(int(advance))
+}
+
+func (f *ttfFont) scale(units int) int {
+	return units * 1000 / f.unitsPerEm
+}
+
+// width is the width of s in f at size.
+func (f *ttfFont) width(s string, size float64) float64 {
+	total := 0
+	for _, r := range s {
+		total += f.advance(f.glyphs[r])
+	}
+	return float64(total) * size / 1000
+}
+
+// encode is s as the glyph ids of f, in a PDF hex string for Identity-H,
+// recording the characters they draw in used.
+func (f *ttfFont) encode(s string, used map[uint16]rune) string {
+	var b strings.Builder
+	b.WriteByte('<')
+	for _, r := range s {
+		glyph := f.glyphs[r]
+		if glyph != 0 {
+			used[glyph] = r
+		}
+		fmt.Fprintf(&b, "%04X", glyph)
+	}
+	b.WriteByte('>')
+	return b.String()
+}
+
+// objects returns the PDF objects embedding f, numbered from first, with
+// the widths and text of the glyphs used. The first is the font.
+func (f *ttfFont) objects(first int, used map[uint16]rune) []string {
+	glyphs := make([]int, 0, len(used))
+	for glyph := range used {
+		glyphs = append(glyphs, int(glyph))
+	}
+	sort.Ints(glyphs)
+	var widths, unicode strings.Builder
+	for _, glyph := range glyphs {
+		fmt.Fprintf(&widths, " %d [%d]", glyph, f.advance(uint16(glyph)))
+	}
+	// ToUnicode lets the text be searched and copied; bfchar takes at
+	// most 100 entries a block.
+	unicode.WriteString("/CIDInit /ProcSet findresource begin 12 dict begin begincmap\n/CIDSystemInfo << /Registry (Adobe) /Ordering (UCS) /Supplement 0 >> def\n/CMapName /Adobe-Identity-UCS def /CMapType 2 def\n1 begincodespacerange <0000> <FFFF> endcodespacerange\n")
+	for i := 0; i < len(glyphs); i += 100 {
+		block := glyphs[i:]
+		if len(block) > 100 {
+			block = block[:100]
+		}
+		fmt.Fprintf(&unicode, "%d beginbfchar\n", len(block))
+		for _, glyph := range block {
+			fmt.Fprintf(&unicode, "<%04X> <%s>\n", glyph, utf16Hex(used[uint16(glyph)]))
+		}
+		unicode.WriteString("endbfchar\n")
+	}
+	unicode.WriteString("endcmap CMapName currentdict /CMap defineresource pop end end")
+	var file bytes.Buffer
+	zw := zlib.NewWriter(&file)
+	zw.Write(f.data)
+	zw.Close()
+	return []string{
+		fmt.Sprintf("<< /Type /Font /Subtype /Type0 /BaseFont /%s /Encoding /Identity-H /DescendantFonts [%d 0 R] /ToUnicode %d 0 R >>", f.name, first+1, first+2),
+		fmt.Sprintf("<< /Type /Font /Subtype /CIDFontType2 /BaseFont /%s /CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >> /FontDescriptor %d 0 R /CIDToGIDMap /Identity /DW %d /W [%s] >>",
+			f.name, first+3, f.advance(0), widths.String()),
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", unicode.Len(), unicode.String()),
+		fmt.Sprintf("<< /Type /FontDescriptor /FontName /%s /Flags 32 /FontBBox [%d %d %d %d] /ItalicAngle 0 /Ascent %d /Descent %d /CapHeight %d /StemV 80 /FontFile2 %d 0 R >>",
+			f.name, f.scale(f.bbox[0]), f.scale(f.bbox[1]), f.scale(f.bbox[2]), f.scale(f.bbox[3]), f.scale(f.ascent), f.scale(f.descent), f.scale(f.ascent), first+4),
+		fmt.Sprintf("<< /Length %d /Length1 %d /Filter /FlateDecode >>\nstream\n%s\nendstream", file.Len(), len(f.data), file.String()),
+	}
+}
+
+// utf16Hex is r in UTF-16BE hex, as ToUnicode maps take it.
+func utf16Hex(r rune) string {
+	if r < 0x10000 {
+		return fmt.Sprintf("%04X", r)
+	}
+	r -= 0x10000
+	return fmt.Sprintf("%04X%04X", 0xd800+(r>>10), 0xdc00+(r&0x3ff))
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+const standingPath = "standing"
+const approvePath = "approve"
+
+const (
+	penaltyNoShow           = "no_show"
+	penaltyLateCancellation = "late_cancellation"
+)
+
+const (
+	standingOk               = "ok"
+	standingApprovalRequired = "approval_required"
+	standingBlocked          = "blocked"
+)
+
+type penaltyPolicy struct {
+	Window            time.Duration
+	ApprovalThreshold int
+	BlockThreshold    int
+	BlockFor          time.Duration
+	LateCancelWindow  time.Duration
+	NoShowGrace       time.Duration
+}
+
+type bookerStanding struct {
+	BookerId          string     `json:"booker_id"`
+	Score             int        `json:"score"`
+	NoShows           int        `json:"no_shows"`
+	LateCancellations int        `json:"late_cancellations"`
+	Status            string     `json:"status"`
+	BlockedUntil      *time.Time `json:"blocked_until,omitempty"`
+}
+
+func currentPenaltyPolicy() penaltyPolicy {
+	return penaltyPolicy{
+		Window:            envDuration("PENALTY_WINDOW", 30*24*time.Hour),
+		ApprovalThreshold: envInt("PENALTY_APPROVAL_THRESHOLD", 3),
+		BlockThreshold:    envInt("PENALTY_BLOCK_THRESHOLD", 5),
+		BlockFor:          envDuration("PENALTY_BLOCK_FOR", 7*24*time.Hour),
+		LateCancelWindow:  envDuration("LATE_CANCEL_WINDOW", 2*time.Hour),
+		NoShowGrace:       envDuration("NO_SHOW_GRACE", 15*time.Minute),
+	}
+}
+
+// bookingStatus is the status a new booking by this booker starts in.
+// Without the approval workflow nothing waits for approval.
+func (s bookerStanding) bookingStatus(tenant string) string {
+	if s.Status == standingApprovalRequired && flagEnabled(flagApprovalWorkflow, tenant, s.BookerId) {
+		return bookingStatusPending
+	}
+	return bookingStatusConfirmed
+}
+
+// getStanding scores a booker by their penalties inside the policy window.
+// Reaching the block threshold blocks them for BlockFor after their latest
+// penalty; reaching the approval threshold holds their bookings as pending.
+func getStanding(bookerId string) (bookerStanding, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	policy := currentPenaltyPolicy()
+	standing := bookerStanding{BookerId: bookerId, Status: standingOk}
+	var latest []byte
+	err := Db.QueryRowContext(ctx, `SELECT COALESCE(SUM(penalty_kind = ?), 0), COALESCE(SUM(penalty_kind = ?), 0), MAX(penalty_created_at)
+		FROM booker_penalty WHERE penalty_booker_id = ? AND penalty_created_at >= ?`,
+		penaltyNoShow, penaltyLateCancellation, bookerId, time.Now().UTC().Add(-policy.Window)).Scan(&standing.NoShows, &standing.LateCancellations, &latest)
+	if err != nil {
+		log.Println(err)
+		return standing, err
+	}
+	standing.Score = standing.NoShows + standing.LateCancellations
+	if standing.Score >= policy.BlockThreshold && latest != nil {
+		latestAt, err := time.Parse("2006-01-02 15:04:05", string(latest))
+		if err == nil {
+			until := latestAt.Add(policy.BlockFor)
+			if time.Now().Before(until) {
+				standing.Status, standing.BlockedUntil = standingBlocked, &until
+				return standing, nil
+			}
+		}
+	}
+	if standing.Score >= policy.ApprovalThreshold {
+		standing.Status = standingApprovalRequired
+	}
+	return standing, nil
+}
+
+func recordPenalty(bookerId string, bookingId int, kind string) {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `INSERT IGNORE INTO booker_penalty (penalty_booker_id, penalty_booking_id, penalty_kind, penalty_created_at) VALUES (?, ?, ?, UTC_TIMESTAMP())`, bookerId, bookingId, kind)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// recordCancellation penalizes cancelling a booking that is about to start
+// or already running. Deleting bookings that already ended is not a
+// cancellation.
+func recordCancellation(b booking) {
+	start, end, err := bookingWindow(b)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	if now.After(start.Add(-currentPenaltyPolicy().LateCancelWindow)) && now.Before(end) {
+		recordPenalty(b.BookingBookerId, b.BookingId, penaltyLateCancellation)
+	}
+}
+
+// detectNoShows penalizes confirmed bookings of the last two days that ended
+// without a check-in.
+func detectNoShows() {
+	now := time.Now()
+	grace := currentPenaltyPolicy().NoShowGrace
+	bookings, err := getBookingsBetween(now.AddDate(0, 0, -2), now, "")
+	if err != nil {
+		return
+	}
+	checkedIn, err := getCheckedInBookings(now.AddDate(0, 0, -3))
+	if err != nil {
+		return
+	}
+	for _, b := range bookings {
+		_, end, err := bookingWindow(b)
+		if err != nil || b.BookingStatus != bookingStatusConfirmed || checkedIn[b.BookingId] {
+			continue
+		}
+		if end.Add(grace).Before(now) && end.After(now.AddDate(0, 0, -2)) {
+			recordPenalty(b.BookingBookerId, b.BookingId, penaltyNoShow)
+		}
+	}
+}
+
+func getCheckedInBookings(since time.Time) (map[int]bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT booking_id FROM booking WHERE booking_checked_in_at >= ?`, since.UTC())
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	checkedIn := make(map[int]bool)
+	for results.Next() {
+		var bookingId int
+		if err := results.Scan(&bookingId); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		checkedIn[bookingId] = true
+	}
+	return checkedIn, results.Err()
+}
+
+func approveBooking(bookingId int) (bool, error) {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	result, err := Db.ExecContext(ctx, `UPDATE booking SET booking_status = ? WHERE booking_id = ? AND booking_status = ?`, bookingStatusConfirmed, bookingId, bookingStatusPending)
+	if err != nil {
+		log.Println(err.Error())
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		log.Println(err.Error())
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+func writeBlocked(w http.ResponseWriter, r *http.Request, standing bookerStanding) {
+	j, err := json.Marshal(map[string]interface{}{
+		"error":    "booker_blocked",
+		"message":  translate(requestLanguage(r), "error.booker_blocked", "booker", standing.BookerId),
+		"standing": standing,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(http.StatusForbidden)
+	w.Write(j)
+}
+
+func handlerBookerStanding(w http.ResponseWriter, r *http.Request, bookerId string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	standing, err := getStanding(bookerId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	j, err := json.Marshal(standing)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}
+
+// handlerBookingApprove serves POST /api/bookings/{id}/approve for admins
+// and the managers of the booking's classroom.
+func handlerBookingApprove(w http.ResponseWriter, r *http.Request, b booking) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	approved, err := approveBookingAs(callerOf(r), b)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	if !approved {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	booking, err := bookingStore.GetBooking(b.BookingId)
+	if err == nil && booking != nil {
+		booking.RequestId = requestIdOf(r)
+		booking.Tenant = tenantOf(r)
+		if err := dispatchBookingEvent(eventBookingApproved, *booking); err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		j, err := json.Marshal(map[string]string{"receipt": latestReceipt(*booking)})
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// GET /api/admin/perf reports latency percentiles and error rates per route
+// pattern from the process itself, for deployments without Prometheus to
+// scrape /metrics. Each route keeps a histogram per minute over the last
+// hour, with bounds growing by a quarter from 1ms to a minute, so a
+// percentile is accurate to within that quarter. The report covers the
+// last PERF_WINDOW (default 15m), or ?window=, up to the hour; it restarts
+// with the process and covers this instance only.
+
+const perfPath = "perf"
+const perfSlots = 60
+
+// perfBounds are the histogram bounds in milliseconds.
+var perfBounds = func() []float64 {
+	bounds := []float64{}
+	for bound := 1.0; bound < 60000; bound *= 1.25 {
+		bounds = append(bounds, bound)
+	}
+	return append(bounds, 60000)
+}()
+
+// perfSlot counts the requests of one minute; the last count is for
+// requests slower than every bound.
+type perfSlot struct {
+	minute       int64
+	requests     uint32
+	errors       uint32
+	clientErrors uint32
+	counts       []uint32
+}
+
+var perfStats = struct {
+	sync.Mutex
+	routes map[string]*[perfSlots]perfSlot
+}{routes: make(map[string]*[perfSlots]perfSlot)}
+
+type perfRoute struct {
+	Route             string  `json:"route"`
+	Requests          int     `json:"requests"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	// ErrorRate is the share failed with a 5xx, ClientErrorRate with a 4xx.
+	ErrorRate       float64 `json:"error_rate"`
+	ClientErrorRate float64 `json:"client_error_rate"`
+	P50             float64 `json:"p50_ms"`
+	P95             float64 `json:"p95_ms"`
+	P99             float64 `json:"p99_ms"`
+	counts          []uint32
+	errors          int
+	clientErrors    int
+}
+
+type perfReport struct {
+	Window string      `json:"window"`
+	Since  time.Time   `json:"since"`
+	Total  perfRoute   `json:"total"`
+	Routes []perfRoute `json:"routes"`
+}
+
+// observePerf counts a request to pattern answered with status in elapsed.
+func observePerf(pattern string, status int, elapsed time.Duration, now time.Time) {
+	minute := now.Unix() / 60
+	perfStats.Lock()
+	defer perfStats.Unlock()
+	slots, ok := perfStats.routes[pattern]
+	if !ok {
+		slots = new([perfSlots]perfSlot)
+		perfStats.routes[pattern] = slots
+	}
+	slot := &slots[minute%perfSlots]
+	if slot.minute != minute || slot.counts == nil {
+		*slot = perfSlot{minute: minute, counts: make([]uint32, len(perfBounds)+1)}
+	}
+	slot.observe(status, elapsed)
+}
+
+// observe counts a request answered with status in elapsed in slot.
+func (slot *perfSlot) observe(status int, elapsed time.Duration) {
+	if slot.counts == nil {
+		slot.counts = make([]uint32, len(perfBounds)+1)
+	}
+	ms := float64(elapsed) / float64(time.Millisecond)
+	slot.requests++
+	slot.counts[sort.SearchFloat64s(perfBounds, ms)]++
+	switch {
+	case status >= 500:
+		slot.errors++
+	case status >= 400:
+		slot.clientErrors++
+	}
+}
+
+// add merges slot into p.
+func (p *perfRoute) add(slot perfSlot) {
+	if p.counts == nil {
+		p.counts = make([]uint32, len(perfBounds)+1)
+	}
+	p.Requests += int(slot.requests)
+	p.errors += int(slot.errors)
+	p.clientErrors += int(slot.clientErrors)
+	for i, n := range slot.counts {
+		p.counts[i] += n
+	}
+}
+
+// percentile is the bound in milliseconds under which a share q of the
+// requests were answered; requests slower than every bound count as the
+// largest.
+func (p perfRoute) percentile(q float64) float64 {
+	rank := uint32(math.Ceil(q * float64(p.Requests)))
+	var seen uint32
+	for i, n := range p.counts {
+		seen += n
+		if seen >= rank && seen > 0 {
+			if i == len(perfBounds) {
+				i--
+			}
+			return math.Round(perfBounds[i]*10) / 10
+		}
+	}
+	return 0
+}
+
+// finish computes p's rates and percentiles over window.
+func (p *perfRoute) finish(window time.Duration) {
+	if p.Requests == 0 {
+		return
+	}
+	p.RequestsPerSecond = float64(p.Requests) / window.Seconds()
+	p.ErrorRate = float64(p.errors) / float64(p.Requests)
+	p.ClientErrorRate = float64(p.clientErrors) / float64(p.Requests)
+	p.P50, p.P95, p.P99 = p.percentile(0.5), p.percentile(0.95), p.percentile(0.99)
+}
+
+// perfSummary reports the requests of the last window, in whole minutes
+// including the current one.
+func perfSummary(window time.Duration, now time.Time) perfReport {
+	minutes := int64(math.Ceil(window.Minutes()))
+	current := now.Unix() / 60
+	report := perfReport{Window: window.String(), Since: now.Add(-window), Routes: make([]perfRoute, 0)}
+	perfStats.Lock()
+	for pattern, slots := range perfStats.routes {
+		route := perfRoute{Route: pattern}
+		for _, slot := range slots {
+			if slot.counts != nil && slot.minute > current-minutes && slot.minute <= current {
+				route.add(slot)
+				report.Total.add(slot)
+			}
+		}
+		if route.Requests > 0 {
+			route.finish(window)
+			report.Routes = append(report.Routes, route)
+		}
+	}
+	perfStats.Unlock()
+	report.Total.Route = "*"
+	report.Total.finish(window)
+	sort.Slice(report.Routes, func(i, j int) bool {
+		return report.Routes[i].Route < report.Routes[j].Route
+	})
+	return report
+}
+
+// handlerAdminPerf serves GET /api/admin/perf.
+func handlerAdminPerf(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	window := envDuration("PERF_WINDOW", 15*time.Minute)
+	if v := r.URL.Query().Get("window"); v != "" {
+		var err error
+		if window, err = time.ParseDuration(v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if window < time.Minute || window > perfSlots*time.Minute {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	j, err := json.Marshal(perfSummary(window, time.Now()))
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Admins upload a photo per classroom with PUT /api/classrooms/{id}/photo,
+// the image (JPEG, PNG or GIF, up to PHOTO_MAX_SIZE bytes) as the body, and
+// set its map link and access instructions with PUT
+// /api/classrooms/{id}/metadata. Photos go to the attachment store;
+// GET /api/classrooms/{id}/photo serves the original, and ?size=small,
+// medium or large a JPEG thumbnail fitting that many pixels, made on first
+// request and kept beside the original until the next upload.
+
+const (
+	photoPath    = "photo"
+	metadataPath = "metadata"
+
+	maxPhotoPixels       = 40 << 20
+	maxInstructionLength = 2000
+)
+
+var photoSizes = map[string]int{"small": 160, "medium": 480, "large": 1024}
+
+type classroomMetadata struct {
+	MapUrl             string `json:"map_url"`
+	AccessInstructions string `json:"access_instructions"`
+}
+
+func photoKey(classroomId string) string {
+	return classroomPath + "/" + url.PathEscape(classroomId) + "/" + photoPath
+}
+
+// isPhotoUpload reports whether r uploads a classroom photo, whose body is
+// an image rather than JSON.
+func isPhotoUpload(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/"+photoPath) && err == nil && strings.HasPrefix(mediaType, "image/")
+}
+
+func setClassroomPhotoUpdatedAt(classroomId string, updatedAt *time.Time) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `UPDATE classroom SET classroom_photo_updated_at = ? WHERE classroom_id = ?`, updatedAt, classroomId)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+func saveClassroomMetadata(classroomId string, metadata classroomMetadata) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `UPDATE classroom SET classroom_map_url = ?, classroom_access_instructions = ? WHERE classroom_id = ?`, metadata.MapUrl, metadata.AccessInstructions, classroomId)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+// resizeImage scales src down, keeping its aspect, to fit a size×size
+// square, averaging the source pixels under each thumbnail pixel. Images
+// that already fit are returned as they are.
+func resizeImage(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	sw, sh := bounds.Dx(), bounds.Dy()
+	if sw <= size && sh <= size {
+		return src
+	}
+	w, h := size, sh*size/sw
+	if sh > sw {
+		w, h = sw*size/sh, size
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewRGBA64(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := bounds.Min.Y+y*sh/h, bounds.Min.Y+(y+1)*sh/h
+		for x := 0; x < w; x++ {
+			x0, x1 := bounds.Min.X+x*sw/w, bounds.Min.X+(x+1)*sw/w
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// photoThumbnail returns the JPEG thumbnail of original fitting size
+// pixels, from the store if it was made before.
+func photoThumbnail(store attachmentStore, classroomId string, size string, original []byte) ([]byte, error) {
+	key := photoKey(classroomId) + "-" + size
+	thumbnail, err := store.Get(key)
+	if err == nil || !errors.Is(err, errNoAttachment) {
+		return thumbnail, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(original))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, resizeImage(img, photoSizes[size]), &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	if err := store.Put(key, buf.Bytes()); err != nil {
+		log.Printf("photo %s: %v", key, err)
+	}
+	return buf.Bytes(), nil
+}
+
+func deleteClassroomPhotos(store attachmentStore, classroomId string) error {
+	key := photoKey(classroomId)
+	for size := range photoSizes {
+		if err := store.Delete(key + "-" + size); err != nil {
+			return err
+		}
+	}
+	return store.Delete(key)
+}
+
+// handlerClassroomPhoto serves /api/classrooms/{id}/photo. Anyone can see
+// a photo; admins upload and delete them.
+func handlerClassroomPhoto(w http.ResponseWriter, r *http.Request, classroom classroom) {
+	store, err := attachments()
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		size := r.URL.Query().Get("size")
+		if _, ok := photoSizes[size]; size != "" && !ok {
+			writeError(w, r, http.StatusBadRequest, "invalid_size")
+			return
+		}
+		if classroom.PhotoUpdatedAt == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if checkLastModified(w, r, *classroom.PhotoUpdatedAt) {
+			return
+		}
+		photo, err := store.Get(photoKey(classroom.ClassroomId))
+		if errors.Is(err, errNoAttachment) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println(err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if size != "" {
+			if photo, err = photoThumbnail(store, classroom.ClassroomId, size, photo); err != nil {
+				writeServiceError(w, r, err)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", http.DetectContentType(photo))
+		w.Write(photo)
+	case http.MethodPut, http.MethodDelete:
+		requireApiKey(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodDelete {
+				if err := deleteClassroomPhotos(store, classroom.ClassroomId); err != nil {
+					writeServiceError(w, r, err)
+					return
+				}
+				if setClassroomPhotoUpdatedAt(classroom.ClassroomId, nil) != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				recordAudit(r, "classroom.photo_delete", "classroom", classroom.ClassroomId, nil)
+				return
+			}
+			maxSize := int64(envInt("PHOTO_MAX_SIZE", 5<<20))
+			photo, err := io.ReadAll(io.LimitReader(r.Body, maxSize+1))
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, "invalid_body")
+				return
+			}
+			if int64(len(photo)) > maxSize {
+				writeError(w, r, http.StatusRequestEntityTooLarge, "photo_too_large", "max", strconv.FormatInt(maxSize, 10))
+				return
+			}
+			config, _, err := image.DecodeConfig(bytes.NewReader(photo))
+			if err != nil || config.Width*config.Height > maxPhotoPixels {
+				writeError(w, r, http.StatusBadRequest, "invalid_photo")
+				return
+			}
+			if err := deleteClassroomPhotos(store, classroom.ClassroomId); err != nil {
+				writeServiceError(w, r, err)
+				return
+			}
+			if err := store.Put(photoKey(classroom.ClassroomId), photo); err != nil {
+				writeServiceError(w, r, err)
+				return
+			}
+			now := time.Now().UTC()
+			if setClassroomPhotoUpdatedAt(classroom.ClassroomId, &now) != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			recordAudit(r, "classroom.photo", "classroom", classroom.ClassroomId, map[string]interface{}{"bytes": len(photo), "width": config.Width, "height": config.Height})
+		}), roleAdmin).ServeHTTP(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handlerClassroomMetadata serves /api/classrooms/{id}/metadata.
+func handlerClassroomMetadata(w http.ResponseWriter, r *http.Request, classroom classroom) {
+	switch r.Method {
+	case http.MethodGet:
+		j, err := json.Marshal(classroomMetadata{classroom.MapUrl, classroom.AccessInstructions})
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+	case http.MethodPut:
+		requireApiKey(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var metadata classroomMetadata
+			if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+				writeError(w, r, http.StatusBadRequest, "invalid_body")
+				return
+			}
+			if metadata.MapUrl != "" {
+				if u, err := url.Parse(metadata.MapUrl); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+					writeError(w, r, http.StatusBadRequest, "invalid_map_url")
+					return
+				}
+			}
+			if len([]rune(metadata.AccessInstructions)) > maxInstructionLength {
+				writeError(w, r, http.StatusBadRequest, "instructions_too_long", "max", strconv.Itoa(maxInstructionLength))
+				return
+			}
+			if saveClassroomMetadata(classroom.ClassroomId, metadata) != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			recordAudit(r, "classroom.metadata", "classroom", classroom.ClassroomId, metadata)
+		}), roleAdmin).ServeHTTP(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// POLICY_WEBHOOK_URL names an external policy service, such as a faculty's
+// approval system, asked about every new booking before it is stored. It
+// answers {"decision": "allow" | "deny" | "needs_approval", "reason": ...}.
+// The call is given POLICY_WEBHOOK_TIMEOUT; when it fails the booking goes
+// through unless POLICY_WEBHOOK_FAIL is "closed". POLICY_WEBHOOK_TOKEN is
+// sent as a bearer token.
+
+const (
+	policyAllow         = "allow"
+	policyDeny          = "deny"
+	policyNeedsApproval = "needs_approval"
+)
+
+var policyWebhookTotal = newCounter("policy_webhook_total", "Policy webhook calls by outcome.", "outcome")
+
+type policyRequest struct {
+	Event     string          `json:"event"`
+	Actor     string          `json:"actor"`
+	Tenant    string          `json:"tenant,omitempty"`
+	RequestId string          `json:"request_id,omitempty"`
+	Booking   bookingResponse `json:"booking"`
+}
+
+type policyDecision struct {
+	Decision string `json:"decision"`
+	Reason   string `json:"reason"`
+}
+
+// askPolicyWebhook posts b to the policy service and returns its decision.
+func askPolicyWebhook(target string, r *http.Request, b booking) (policyDecision, error) {
+	var decision policyDecision
+	j, err := json.Marshal(policyRequest{"booking.requested", actorOf(callerOf(r)), tenantOf(r), requestIdOf(r), newBookingResponse(b)})
+	if err != nil {
+		return decision, err
+	}
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(j))
+	if err != nil {
+		return decision, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setRequestIdHeaders(req, requestIdOf(r))
+	if token := envString("POLICY_WEBHOOK_TOKEN", ""); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: envDuration("POLICY_WEBHOOK_TIMEOUT", 2*time.Second)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return decision, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return decision, fmt.Errorf("policy webhook %s: %s", req.URL.Host, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return decision, err
+	}
+	switch decision.Decision {
+	case policyAllow, policyDeny, policyNeedsApproval:
+		return decision, nil
+	}
+	return decision, fmt.Errorf("policy webhook %s: unknown decision %q", req.URL.Host, decision.Decision)
+}
+
+// applyPolicyWebhook asks the policy service about b, holding it for
+// approval if told so, and writes the error and returns true if the
+// booking is denied, or the service failed and POLICY_WEBHOOK_FAIL is
+// "closed".
+func applyPolicyWebhook(w http.ResponseWriter, r *http.Request, b *booking) bool {
+	target := envString("POLICY_WEBHOOK_URL", "")
+	if target == "" {
+		return false
+	}
+	decision, err := askPolicyWebhook(target, r, *b)
+	if err != nil {
+		log.Print(err)
+		if envString("POLICY_WEBHOOK_FAIL", "open") == "closed" {
+			policyWebhookTotal.Inc("failed_closed")
+			writeError(w, r, http.StatusServiceUnavailable, "policy_unavailable")
+			return true
+		}
+		policyWebhookTotal.Inc("failed_open")
+		return false
+	}
+	policyWebhookTotal.Inc(decision.Decision)
+	switch decision.Decision {
+	case policyDeny:
+		writeError(w, r, http.StatusForbidden, "policy_denied", "reason", decision.Reason)
+		return true
+	case policyNeedsApproval:
+		b.BookingStatus = bookingStatusPending
+	}
+	return false
+}
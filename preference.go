@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type notificationPreference struct {
+	Scope           string `json:"-"`
+	OwnerId         string `json:"owner_id"`
+	Channel         string `json:"channel"`
+	Email           string `json:"email,omitempty"`
+	WebhookUrl      string `json:"webhook_url,omitempty"`
+	SlackWebhookUrl string `json:"slack_webhook_url,omitempty"`
+	LineToken       string `json:"line_token,omitempty"`
+	TelegramChatId  string `json:"telegram_chat_id,omitempty"`
+	ReminderLead    int    `json:"reminder_lead"`
+	Mode            string `json:"mode"`
+	Language        string `json:"language,omitempty"`
+	// AgendaHour is the hour of the day, in the booking time zone, the
+	// booker is sent the day's agenda at. nil sends none.
+	AgendaHour *int `json:"agenda_hour"`
+}
+
+const preferencePath = "preferences"
+
+// Preferences belong either to a booker or to the owner of a classroom, who
+// is told about every booking made in it.
+const (
+	scopeBooker    = "booker"
+	scopeClassroom = "classroom"
+)
+
+const (
+	modeImmediate = "immediate"
+	modeDigest    = "digest"
+)
+
+// defaultPreference is used for owners that never saved preferences.
+func defaultPreference(scope string, ownerId string) notificationPreference {
+	return notificationPreference{Scope: scope, OwnerId: ownerId, Channel: channelNone, Mode: modeImmediate}
+}
+
+func (p notificationPreference) valid() bool {
+	if _, ok := notifiers[p.Channel]; !ok && p.Channel != channelNone {
+		return false
+	}
+	switch p.Channel {
+	case channelEmail:
+		if p.Email == "" {
+			return false
+		}
+	case channelWebhook:
+		if p.WebhookUrl == "" {
+			return false
+		}
+	case channelSlack:
+		if p.SlackWebhookUrl == "" {
+			return false
+		}
+	case channelLine:
+		if p.LineToken == "" {
+			return false
+		}
+	case channelTelegram:
+		if p.TelegramChatId == "" {
+			return false
+		}
+	}
+	if _, ok := supportedLanguage(p.Language); !ok && p.Language != "" {
+		return false
+	}
+	if p.AgendaHour != nil && (*p.AgendaHour < 0 || *p.AgendaHour > 23) {
+		return false
+	}
+	return p.ReminderLead >= 0 && (p.Mode == modeImmediate || p.Mode == modeDigest)
+}
+
+const preferenceColumns = `preference_scope, preference_owner_id, preference_channel, preference_email, preference_webhook_url, preference_slack_webhook_url, preference_line_token, preference_telegram_chat_id, preference_reminder_lead, preference_mode, preference_language, preference_agenda_hour`
+
+func (p *notificationPreference) scanFields() []interface{} {
+	return []interface{}{&p.Scope, &p.OwnerId, &p.Channel, &p.Email, &p.WebhookUrl, &p.SlackWebhookUrl, &p.LineToken, &p.TelegramChatId, &p.ReminderLead, &p.Mode, &p.Language, sqlInt{&p.AgendaHour}}
+}
+
+func getPreference(scope string, ownerId string) (notificationPreference, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	row := Db.QueryRowContext(ctx, `SELECT `+preferenceColumns+` FROM notification_preference WHERE preference_scope = ? AND preference_owner_id = ?`, scope, ownerId)
+	var p notificationPreference
+	err := row.Scan(p.scanFields()...)
+	if err == sql.ErrNoRows {
+		return defaultPreference(scope, ownerId), nil
+	} else if err != nil {
+		log.Println(err)
+		return p, err
+	}
+	return p, nil
+}
+
+func savePreference(p notificationPreference) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `INSERT INTO notification_preference (`+preferenceColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE preference_channel = VALUES(preference_channel), preference_email = VALUES(preference_email), preference_webhook_url = VALUES(preference_webhook_url),
+		preference_slack_webhook_url = VALUES(preference_slack_webhook_url), preference_line_token = VALUES(preference_line_token), preference_telegram_chat_id = VALUES(preference_telegram_chat_id),
+		preference_reminder_lead = VALUES(preference_reminder_lead), preference_mode = VALUES(preference_mode), preference_language = VALUES(preference_language),
+		preference_agenda_hour = VALUES(preference_agenda_hour)`,
+		p.Scope, p.OwnerId, p.Channel, p.Email, p.WebhookUrl, p.SlackWebhookUrl, p.LineToken, p.TelegramChatId, p.ReminderLead, p.Mode, p.Language, p.AgendaHour)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+// authorizePreferences lets the booker, or the classroom's managers, at
+// their preferences, which hold where notifications go, answering 401/403
+// for everyone else.
+func authorizePreferences(w http.ResponseWriter, r *http.Request, scope string, ownerId string) bool {
+	if scope == scopeClassroom {
+		return authorizeManager(w, r, ownerId, classroomOwner, classroomManager)
+	}
+	return authorizeBooker(w, r, ownerId)
+}
+
+// publicWebhooks checks that the webhooks of p are http(s) URLs of public
+// hosts, as subscriptions' are, writing the error and returning false if
+// one isn't.
+func publicWebhooks(w http.ResponseWriter, r *http.Request, p notificationPreference) bool {
+	for _, webhookUrl := range []string{p.WebhookUrl, p.SlackWebhookUrl} {
+		if webhookUrl == "" {
+			continue
+		}
+		u, err := url.Parse(webhookUrl)
+		if err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+			writeError(w, r, http.StatusBadRequest, "invalid_preference")
+			return false
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		public := publicHost(ctx, u.Hostname())
+		cancel()
+		if !public {
+			writeError(w, r, http.StatusBadRequest, "subscription_webhook_not_public", "host", u.Hostname())
+			return false
+		}
+	}
+	return true
+}
+
+// handlerPreferences serves /api/booker/{id}/preferences and
+// /api/classrooms/{id}/preferences.
+func handlerPreferences(w http.ResponseWriter, r *http.Request, scope string, ownerId string) {
+	if r.Method != http.MethodOptions && !authorizePreferences(w, r, scope, ownerId) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		preference, err := getPreference(scope, ownerId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		j, err := json.Marshal(preference)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = w.Write(j)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case http.MethodPut:
+		preference := defaultPreference(scope, ownerId)
+		err := json.NewDecoder(r.Body).Decode(&preference)
+		if err != nil {
+			log.Print(err)
+			writeError(w, r, http.StatusBadRequest, "invalid_body")
+			return
+		}
+		preference.Scope, preference.OwnerId = scope, ownerId
+		if !preference.valid() {
+			writeError(w, r, http.StatusBadRequest, "invalid_preference")
+			return
+		}
+		if !publicWebhooks(w, r, preference) {
+			return
+		}
+		if err := savePreference(preference); err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+	case http.MethodOptions:
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bookings come in priority tiers: exams above lectures above student
+// study. In a classroom whose policy makes it preemptible, a tentative
+// booking, one still pending approval, may be displaced by a booking that
+// outranks it up to the policy's PreemptNotice minutes before it starts;
+// confirmed bookings never are. The displaced bookings are waitlisted and
+// removed in the transaction that inserts the new one, and their bookers
+// notified once it commits; the waitlist books them again once their slot
+// frees up.
+
+const waitlistPath = "waitlist"
+
+type priority int
+
+const (
+	priorityStudy priority = iota + 1
+	priorityLecture
+	priorityExam
+)
+
+var priorityNames = map[string]priority{"study": priorityStudy, "lecture": priorityLecture, "exam": priorityExam}
+
+func (p priority) String() string {
+	for name, tier := range priorityNames {
+		if tier == p {
+			return name
+		}
+	}
+	return ""
+}
+
+func (p priority) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *priority) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*p = 0
+		return nil
+	}
+	tier, ok := priorityNames[string(text)]
+	if !ok {
+		return fmt.Errorf("unknown priority %q", text)
+	}
+	*p = tier
+	return nil
+}
+
+// priority is b's tier. Bookings made before tiers existed are study.
+func (b booking) priority() priority {
+	if b.BookingPriority < int(priorityStudy) {
+		return priorityStudy
+	}
+	return priority(b.BookingPriority)
+}
+
+var rolePriorities = map[string]priority{roleAdmin: priorityExam, roleManager: priorityExam}
+
+// callerPriority is the highest tier the caller may book at: exam for
+// admins and managers and study for everyone else, unless
+// PRIORITY_MAX_<ROLE> (e.g. PRIORITY_MAX_MANAGER=lecture) says otherwise.
+// Admins acting for a booker book at their own tier.
+func callerPriority(caller *apiKey) priority {
+	if caller == nil {
+		return priorityStudy
+	}
+	if caller.ActingAdmin != nil {
+		caller = caller.ActingAdmin
+	}
+	tier, ok := rolePriorities[caller.Role]
+	if !ok {
+		tier = priorityStudy
+	}
+	if name := envString("PRIORITY_MAX_"+strings.ToUpper(caller.Role), ""); name != "" {
+		if configured, ok := priorityNames[name]; ok {
+			tier = configured
+		} else {
+			log.Printf("PRIORITY_MAX_%s: unknown priority %q", strings.ToUpper(caller.Role), name)
+		}
+	}
+	return tier
+}
+
+// applyPriority gives b the default tier of its classroom, capped at the
+// caller's, unless it asks for one, and writes the error and returns true
+// if it asks for a tier above the caller's.
+func applyPriority(w http.ResponseWriter, r *http.Request, b *booking) bool {
+	limit := callerPriority(callerOf(r))
+	if b.BookingPriority != 0 {
+		if b.priority() > limit {
+			writeError(w, r, http.StatusForbidden, "priority_not_allowed", "priority", b.priority().String(), "max", limit.String())
+			return true
+		}
+		return false
+	}
+	policy, err := getRoomPolicy(b.BookingClassroomId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return true
+	}
+	tier := policy.DefaultPriority
+	if tier == 0 {
+		tier = priorityStudy
+	}
+	if tier > limit {
+		tier = limit
+	}
+	b.BookingPriority = int(tier)
+	return false
+}
+
+// preempts reports whether b may displace c under the classroom's policy.
+func (p roomPolicy) preempts(b, c booking, now time.Time) bool {
+	if !p.Preemptible || c.BookingStatus != bookingStatusPending || c.priority() >= b.priority() {
+		return false
+	}
+	start, _, err := bookingWindow(c)
+	return err == nil && now.Add(time.Duration(p.PreemptNotice)*time.Minute).Before(start)
+}
+
+// slotTakenPreempting is slotTaken for a booking that may displace the
+// bookings its tier outranks; it returns those.
+func slotTakenPreempting(w http.ResponseWriter, r *http.Request, b booking) ([]booking, bool) {
+	if b.priority() == priorityStudy {
+		return nil, slotTaken(w, r, b)
+	}
+	policy, err := getRoomPolicy(b.BookingClassroomId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return nil, true
+	}
+	now := time.Now()
+	return slotConflicts(w, r, b, func(c booking) bool { return policy.preempts(b, c, now) })
+}
+
+// insertPreempting inserts b in place of the bookings it displaces in one
+// transaction: the displaced are waitlisted and removed and b inserted, or
+// none of it happens. A displaced booking changed or gone since, or
+// another booking in the slot, fails it with errConflict.
+func insertPreempting(b booking, displaced []booking) (int, error) {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	tx, err := Db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for _, c := range displaced {
+		if err := insertWaitlistEntry(ctx, tx, c, b.BookingPublicId); err != nil {
+			return 0, err
+		}
+		result, err := tx.ExecContext(ctx, `DELETE FROM booking WHERE booking_id = ? AND booking_status = ?`, c.BookingId, bookingStatusPending)
+		if err != nil {
+			log.Println(err.Error())
+			return 0, err
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			return 0, errConflict
+		}
+	}
+	conflicts, err := lockedConflicts(ctx, tx, b)
+	if errors.Is(err, errNoSeats) || err == nil && len(conflicts) > 0 {
+		return 0, errConflict
+	} else if err != nil {
+		return 0, err
+	}
+	bookingId, err := insertBookingRow(ctx, tx, b)
+	if err != nil {
+		return 0, err
+	}
+	return bookingId, tx.Commit()
+}
+
+// notifyPreempted audits the bookings b displaced and notifies their
+// bookers, once b is stored. It returns the first error dispatching their
+// events.
+func notifyPreempted(r *http.Request, b booking, displaced []booking) error {
+	var first error
+	for _, c := range displaced {
+		recordAudit(r, "booking.preempt", "booking", c.publicId(), map[string]string{"preempted_by": b.BookingPublicId})
+		c.RequestId = requestIdOf(r)
+		c.Tenant = tenantOf(r)
+		if err := dispatchBookingEvent(eventBookingPreempted, c); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// A waitlistEntry is a displaced booking waiting for its slot.
+type waitlistEntry struct {
+	WaitlistId      int       `json:"waitlist_id"`
+	BookerId        string    `json:"booker_id"`
+	ClassroomId     string    `json:"classroom_id"`
+	BookingTime     string    `json:"booking_time"`
+	BookingDuration int       `json:"booking_duration"`
+	BookingTitle    string    `json:"booking_title"`
+	Seats           int       `json:"seats,omitempty"`
+	GroupId         string    `json:"group_id,omitempty"`
+	Priority        priority  `json:"priority"`
+	DisplacedBy     string    `json:"displaced_by"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+func (e waitlistEntry) booking() booking {
+	return booking{BookingTime: e.BookingTime, BookingClassroomId: e.ClassroomId, BookingBookerId: e.BookerId, BookingDuration: e.BookingDuration,
+		BookingTitle: e.BookingTitle, BookingSeats: e.Seats, BookingGroupId: e.GroupId, BookingPriority: int(e.Priority)}
+}
+
+const waitlistColumns = `waitlist_id, waitlist_booker_id, waitlist_classroom_id, waitlist_booking_time, waitlist_duration, waitlist_title, waitlist_seats, waitlist_group_id, waitlist_priority, waitlist_displaced_by, waitlist_created_at`
+
+func (e *waitlistEntry) scanFields() []interface{} {
+	return []interface{}{&e.WaitlistId, &e.BookerId, &e.ClassroomId, &e.BookingTime, &e.BookingDuration, &e.BookingTitle, &e.Seats, sqlString{&e.GroupId}, &e.Priority, &e.DisplacedBy, sqlTime{&e.CreatedAt}}
+}
+
+func insertWaitlistEntry(ctx context.Context, tx *sql.Tx, b booking, displacedBy string) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO booking_waitlist (waitlist_booker_id, waitlist_classroom_id, waitlist_booking_time, waitlist_duration, waitlist_title, waitlist_seats, waitlist_group_id, waitlist_priority, waitlist_displaced_by, waitlist_created_at)
+		VALUES (?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?, ?, UTC_TIMESTAMP())`,
+		b.BookingBookerId, b.BookingClassroomId, b.BookingTime, b.BookingDuration, b.BookingTitle, b.BookingSeats, b.BookingGroupId, b.priority(), displacedBy)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+func queryWaitlist(where string, args ...interface{}) ([]waitlistEntry, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT `+waitlistColumns+` FROM booking_waitlist WHERE `+where+` ORDER BY waitlist_priority DESC, waitlist_id`, args...)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	entries := make([]waitlistEntry, 0)
+	for results.Next() {
+		var e waitlistEntry
+		if err := results.Scan(e.scanFields()...); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, results.Err()
+}
+
+func getWaitlist(bookerId string) ([]waitlistEntry, error) {
+	return queryWaitlist(`waitlist_booker_id = ?`, bookerId)
+}
+
+// getClassroomWaitlist lists the entries for a classroom on date, highest
+// tier first.
+func getClassroomWaitlist(classroomId string, date string) ([]waitlistEntry, error) {
+	return queryWaitlist(`waitlist_classroom_id = ? AND LEFT(TRIM(waitlist_booking_time), 10) = ?`, classroomId, date)
+}
+
+var errNoWaitlistEntry = fmt.Errorf("waitlist entry %w", errNotFound)
+
+func removeWaitlistEntry(bookerId string, waitlistId int) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	result, err := Db.ExecContext(ctx, `DELETE FROM booking_waitlist WHERE waitlist_id = ? AND waitlist_booker_id = ?`, waitlistId, bookerId)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errNoWaitlistEntry
+	}
+	return nil
+}
+
+// waitlistMu keeps two freed slots from booking the same entry twice.
+var waitlistMu sync.Mutex
+
+// promoteWaitlist books the waitlisted entries of a classroom whose slot
+// is free again after a booking there was cancelled or moved away, the
+// slot of b.Previous. Entries whose slot has passed are dropped.
+func promoteWaitlist(event string, b booking) {
+	freed := b
+	switch {
+	case event == eventBookingRescheduled && b.Previous != nil:
+		freed = *b.Previous
+	case event != eventBookingCancelled:
+		return
+	}
+	start, _, err := bookingWindow(freed)
+	if err != nil {
+		return
+	}
+	waitlistMu.Lock()
+	defer waitlistMu.Unlock()
+	entries, err := getClassroomWaitlist(freed.BookingClassroomId, start.Format(bookingDateLayout))
+	if err != nil || len(entries) == 0 {
+		return
+	}
+	policy, err := getRoomPolicy(freed.BookingClassroomId)
+	if err != nil {
+		return
+	}
+	// The entries are booked in the tenant of the booking that freed the
+	// slot, as a create of that tenant would be.
+	tenant, store := defaultTenant, bookingStore
+	if b.Tenant != "" && b.Tenant != defaultTenant {
+		tenant, store = b.Tenant, bookingStoreForTenant(bookingStore, b.Tenant)
+	}
+	now := time.Now()
+	for _, e := range entries {
+		next := e.booking()
+		if start, _, err := bookingWindow(next); err != nil || !start.After(now) {
+			removeWaitlistEntry(e.BookerId, e.WaitlistId)
+			continue
+		}
+		if conflicts, err := findConflicts(next); err != nil || len(conflicts) > 0 {
+			continue
+		}
+		if holds, err := findHoldConflicts(next); err != nil || len(holds) > 0 {
+			continue
+		}
+		standing, err := getStanding(next.BookingBookerId)
+		if err != nil {
+			continue
+		}
+		if standing.Status == standingBlocked {
+			removeWaitlistEntry(e.BookerId, e.WaitlistId)
+			continue
+		}
+		next.BookingStatus = standing.bookingStatus(tenant)
+		if policy.RequiresApproval {
+			next.BookingStatus = bookingStatusPending
+		}
+		next.BookingPublicId = newPublicId()
+		next.Tenant = b.Tenant
+		bookingId, err := store.InsertBooking(next)
+		if err != nil {
+			continue
+		}
+		removeWaitlistEntry(e.BookerId, e.WaitlistId)
+		next.BookingId = bookingId
+		// The promotion is part of what the cancel or move set off.
+		next.RequestId = b.RequestId
+		if err := dispatchBookingEvent(eventBookingCreated, next); err != nil {
+			// No request is left to answer with it.
+			log.Printf("waitlist %d: %v", e.WaitlistId, err)
+		}
+	}
+}
+
+func init() {
+	bookingEventHandlers = append(bookingEventHandlers, promoteWaitlist)
+}
+
+// handlerBookerWaitlist serves /api/bookers/{id}/waitlist, where bookers
+// see the bookings they were displaced from and leave the waitlist.
+func handlerBookerWaitlist(w http.ResponseWriter, r *http.Request, bookerId string, urlPathSegments []string) {
+	if !authorizeBooker(w, r, bookerId) {
+		return
+	}
+	if len(urlPathSegments) > 0 && urlPathSegments[0] != "" {
+		waitlistId, err := strconv.Atoi(urlPathSegments[0])
+		if err != nil || len(urlPathSegments) > 1 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := removeWaitlistEntry(bookerId, waitlistId); err != nil {
+			writeServiceError(w, r, err)
+		}
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	entries, err := getWaitlist(bookerId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	j, err := json.Marshal(entries)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}
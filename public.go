@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GET /api/public/classrooms/{id}/schedule needs no API key, for hallway
+// displays and the like. It covers ?from= to ?to= (dates, today and a week
+// on by default, at most publicScheduleMaxDays) as busy and free blocks.
+// Overlapping bookings merge into one busy block, and who booked and why
+// stay out, unless PUBLIC_SCHEDULE_TITLES=true or
+// PUBLIC_SCHEDULE_BOOKERS=true show titles or booker ids, one block per
+// booking. Booker ids are shown as far as the caller may see them, see
+// redact.go.
+
+const publicPath = "public"
+const scheduleViewPath = "schedule"
+const publicScheduleMaxDays = 31
+
+const (
+	blockBusy = "busy"
+	blockFree = "free"
+)
+
+type scheduleBlock struct {
+	Status string    `json:"status"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Title  string    `json:"title,omitempty"`
+	Booker string    `json:"booker_id,omitempty"`
+}
+
+type publicSchedule struct {
+	ClassroomId   string          `json:"classroom_id"`
+	ClassroomName string          `json:"classroom_name"`
+	From          time.Time       `json:"from"`
+	To            time.Time       `json:"to"`
+	Blocks        []scheduleBlock `json:"blocks"`
+}
+
+// scheduleBlocks tiles [from, to) with the bookings' busy blocks and the
+// free time between them.
+func scheduleBlocks(bookings []booking, from, to time.Time, titles, bookers bool) []scheduleBlock {
+	busy := make([]scheduleBlock, 0, len(bookings))
+	for _, b := range bookings {
+		start, end, err := bookingWindow(b)
+		if err != nil || !overlaps(start, end, from, to) {
+			continue
+		}
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		block := scheduleBlock{Status: blockBusy, Start: start, End: end}
+		if titles {
+			block.Title = b.BookingTitle
+		}
+		if bookers {
+			block.Booker = b.BookingBookerId
+		}
+		busy = append(busy, block)
+	}
+	sort.SliceStable(busy, func(i, j int) bool { return busy[i].Start.Before(busy[j].Start) })
+	blocks := []scheduleBlock{}
+	cursor := from
+	for _, block := range busy {
+		if block.Start.After(cursor) {
+			blocks = append(blocks, scheduleBlock{Status: blockFree, Start: cursor, End: block.Start})
+		}
+		if last := len(blocks) - 1; !titles && !bookers && last >= 0 && blocks[last].Status == blockBusy && !block.Start.After(blocks[last].End) {
+			if block.End.After(blocks[last].End) {
+				blocks[last].End = block.End
+			}
+		} else {
+			blocks = append(blocks, block)
+		}
+		if block.End.After(cursor) {
+			cursor = block.End
+		}
+	}
+	if cursor.Before(to) {
+		blocks = append(blocks, scheduleBlock{Status: blockFree, Start: cursor, End: to})
+	}
+	return blocks
+}
+
+// handlerPublic serves /api/public/classrooms/{id}/schedule.
+func handlerPublic(w http.ResponseWriter, r *http.Request) {
+	urlPathSegments := strings.Split(r.URL.Path, fmt.Sprintf("%s/", publicPath))
+	urlPathSegments = strings.Split(urlPathSegments[len(urlPathSegments)-1], "/")
+	if len(urlPathSegments) != 3 || urlPathSegments[0] != classroomPath || urlPathSegments[2] != scheduleViewPath {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	now := time.Now().In(bookingLocation)
+	from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, bookingLocation)
+	to := from.AddDate(0, 0, 7)
+	query := r.URL.Query()
+	var err error
+	if v := query.Get("from"); v != "" {
+		if from, err = time.ParseInLocation(bookingDateLayout, v, bookingLocation); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_schedule_range", "max", strconv.Itoa(publicScheduleMaxDays))
+			return
+		}
+		to = from.AddDate(0, 0, 7)
+	}
+	if v := query.Get("to"); v != "" {
+		if to, err = time.ParseInLocation(bookingDateLayout, v, bookingLocation); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_schedule_range", "max", strconv.Itoa(publicScheduleMaxDays))
+			return
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+	if !to.After(from) || to.After(from.AddDate(0, 0, publicScheduleMaxDays)) {
+		writeError(w, r, http.StatusBadRequest, "invalid_schedule_range", "max", strconv.Itoa(publicScheduleMaxDays))
+		return
+	}
+	classroom, err := getClassroom(urlPathSegments[1])
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	if classroom == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	bookings, err := getBookingsBetween(from, to, classroom.ClassroomId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	titles := envString("PUBLIC_SCHEDULE_TITLES", "") == "true"
+	bookers := envString("PUBLIC_SCHEDULE_BOOKERS", "") == "true"
+	if bookers {
+		bookings = redactionFor(r).bookings(bookings)
+		if callerOf(r) != nil {
+			// What a key may see is not for a shared cache to hand on.
+			noStore(w)
+		}
+	}
+	j, err := json.Marshal(publicSchedule{classroom.ClassroomId, classroom.ClassroomName, from, to, scheduleBlocks(bookings, from, to, titles, bookers)})
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}
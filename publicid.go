@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bookings are addressed in the API by a ULID, so ids don't reveal how many
+// bookings exist or let clients walk through them. The integer id stays the
+// primary key. Paths still accept integer ids while BOOKING_INTEGER_IDS is
+// on, until clients have moved over.
+
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+const publicIdLength = 26
+
+// newPublicId returns a ULID: 48 bits of millisecond time followed by 80
+// random bits, in Crockford base32.
+func newPublicId() string {
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], uint64(time.Now().UnixMilli())<<16)
+	if _, err := io.ReadFull(rand.Reader, id[6:]); err != nil {
+		log.Fatal(err)
+	}
+	// 128 bits encode to 26 characters, the first carrying only 3 bits.
+	out := make([]byte, publicIdLength)
+	hi, lo := binary.BigEndian.Uint64(id[:8]), binary.BigEndian.Uint64(id[8:])
+	for i := publicIdLength - 1; i >= 0; i-- {
+		out[i] = crockfordAlphabet[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
+
+// publicIdTime is the time the ULID id was made, which for a booking is
+// when it was created.
+func publicIdTime(id string) (time.Time, bool) {
+	if !isPublicId(id) {
+		return time.Time{}, false
+	}
+	// The first 10 characters are the 48 bits of time, after the 2 bits
+	// padding 128 to 130.
+	var millis int64
+	for i := 0; i < 10; i++ {
+		millis = millis<<5 | int64(strings.IndexByte(crockfordAlphabet, id[i]))
+	}
+	return time.UnixMilli(millis), true
+}
+
+func isPublicId(s string) bool {
+	if len(s) != publicIdLength || s[0] > '7' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !containsByte(crockfordAlphabet, s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsByte(s string, c byte) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] == c {
+			return true
+		}
+	}
+	return false
+}
+
+// publicId is the id b is known by in the API, falling back to the integer
+// id for rows not backfilled yet.
+func (b booking) publicId() string {
+	if b.BookingPublicId != "" {
+		return b.BookingPublicId
+	}
+	return strconv.Itoa(b.BookingId)
+}
+
+// resolveBooking looks a booking up by a path segment holding its public or,
+// during the migration, its integer id.
+func resolveBooking(store BookingRepository, segment string) (*booking, error) {
+	if isPublicId(segment) {
+		return store.GetBookingByPublicId(segment)
+	}
+	if envString("BOOKING_INTEGER_IDS", "true") != "true" {
+		return nil, nil
+	}
+	bookingId, err := strconv.Atoi(segment)
+	if err != nil {
+		return nil, nil
+	}
+	return store.GetBooking(bookingId)
+}
+
+// backfillPublicIds gives every booking created before public ids, or
+// restored from an older backup, a public id.
+func backfillPublicIds() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	for {
+		results, err := Db.QueryContext(ctx, `SELECT booking_id FROM booking WHERE booking_public_id IS NULL LIMIT 500`)
+		if err != nil {
+			return err
+		}
+		ids := make([]int, 0, 500)
+		for results.Next() {
+			var id int
+			if err := results.Scan(&id); err != nil {
+				results.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		results.Close()
+		if err := results.Err(); err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		for _, id := range ids {
+			if _, err := Db.ExecContext(ctx, `UPDATE booking SET booking_public_id = ?, booking_updated_at = booking_updated_at WHERE booking_id = ? AND booking_public_id IS NULL`, newPublicId(), id); err != nil {
+				return err
+			}
+		}
+		log.Printf("backfilled public ids of %d bookings", len(ids))
+	}
+}
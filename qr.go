@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const qrPath = "qr"
+const checkinPath = "checkin"
+
+// checkinSecret signs check-in tokens. Without CHECKIN_SECRET a random secret
+// is used, so tokens issued before a restart stop validating.
+var checkinSecret = loadCheckinSecret()
+
+func loadCheckinSecret() []byte {
+	if secret := envString("CHECKIN_SECRET", ""); secret != "" {
+		return []byte(secret)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatal(err)
+	}
+	return secret
+}
+
+func checkinSignature(payload string) string {
+	mac := hmac.New(sha256.New, checkinSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkinToken binds a booking to its classroom and expires when the booking
+// ends, so a token can neither be replayed later nor used at another room.
+func checkinToken(b booking) (string, time.Time, error) {
+	_, end, err := bookingWindow(b)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	payload := fmt.Sprintf("%d.%s.%d", b.BookingId, b.BookingClassroomId, end.Unix())
+	return payload + "." + checkinSignature(payload), end, nil
+}
+
+func verifyCheckinToken(token string) (int, string, error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return 0, "", fmt.Errorf("malformed token")
+	}
+	payload, signature := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(checkinSignature(payload))) {
+		return 0, "", fmt.Errorf("bad signature")
+	}
+	parts := strings.Split(payload, ".")
+	if len(parts) != 3 {
+		return 0, "", fmt.Errorf("malformed token")
+	}
+	bookingId, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", err
+	}
+	expiry, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return 0, "", err
+	}
+	if time.Now().Unix() >= expiry {
+		return 0, "", fmt.Errorf("token expired")
+	}
+	return bookingId, parts[1], nil
+}
+
+// checkInBooking records the check-in time, through the check-in buffer,
+// unless the booking already has one. It reports whether this call
+// performed the check-in.
+func checkInBooking(bookingId int) (bool, error) {
+	done, err := enqueueCheckins([]int{bookingId})
+	if err != nil {
+		return false, err
+	}
+	result := <-done[0]
+	return result.checkedIn, result.err
+}
+
+// verifyCheckin returns the booking a check-in is for, or writes why it
+// can't be checked in.
+func verifyCheckin(w http.ResponseWriter, r *http.Request, request checkinRequest) (*booking, bool) {
+	bookingId, classroomId, err := verifyCheckinToken(request.Token)
+	if err != nil || classroomId != request.ClassroomId {
+		w.WriteHeader(http.StatusForbidden)
+		return nil, false
+	}
+	booking, err := bookingStore.GetBooking(bookingId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return nil, false
+	}
+	if booking == nil || booking.BookingClassroomId != classroomId {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, false
+	}
+	start, _, err := bookingWindow(*booking)
+	if err != nil || time.Now().Before(start.Add(-envDuration("CHECKIN_EARLY", 15*time.Minute))) {
+		w.WriteHeader(http.StatusForbidden)
+		return nil, false
+	}
+	return booking, true
+}
+
+// handlerBookingQr serves /api/bookings/{id}/qr as a PNG, or as the bare
+// token with ?format=token.
+func handlerBookingQr(w http.ResponseWriter, r *http.Request, bookingId int) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	booking, err := bookingStore.GetBooking(bookingId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	if booking == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	token, expiry, err := checkinToken(*booking)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	if !time.Now().Before(expiry) {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	if r.URL.Query().Get("format") == "token" {
+		j, err := json.Marshal(map[string]interface{}{"token": token, "expires_at": expiry.UTC().Format(time.RFC3339)})
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+		return
+	}
+	png, err := qrcode.Encode(token, qrcode.Medium, 256)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(png)
+}
+
+// handlerCheckin is called by the tablet of a classroom with a scanned token.
+// Check-in opens CHECKIN_EARLY (default 15m) before the booking starts.
+func handlerCheckin(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var request checkinRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		booking, ok := verifyCheckin(w, r, request)
+		if !ok {
+			return
+		}
+		checkedIn, err := checkInBooking(booking.BookingId)
+		if errors.Is(err, errCheckinsBacklogged) {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusServiceUnavailable, "overloaded")
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !checkedIn {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		booking.RequestId = requestIdOf(r)
+		booking.Tenant = tenantOf(r)
+		if err := dispatchBookingEvent(eventBookingCheckedIn, *booking); err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		j, err := json.Marshal(legacyBookingResponse(redactionFor(r).booking(*booking)))
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+	case http.MethodOptions:
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
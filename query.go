@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A sqlColumn is a column, or a column expression, that conditions compare
+// against. Filters build their conditions from columns so the SQL and its
+// arguments can't drift apart.
+type sqlColumn string
+
+const (
+	colBookingId          sqlColumn = "booking_id"
+	colBookingClassroomId sqlColumn = "booking_classroom_id"
+	colBookingBookerId    sqlColumn = "booking_student_id"
+	colBookingStatus      sqlColumn = "booking_status"
+	colBookingUpdatedAt   sqlColumn = "booking_updated_at"
+	colBookingPublicId    sqlColumn = "booking_public_id"
+	colBookingGroupId     sqlColumn = "booking_group_id"
+	colBookingTenant      sqlColumn = "booking_tenant"
+	// colBookingDate is the date part of booking_time, which is stored as
+	// text with or without a time.
+	colBookingDate sqlColumn = "LEFT(TRIM(booking_time), 10)"
+)
+
+// A condition is one term of a WHERE clause and the arguments for its
+// placeholders.
+type condition struct {
+	sql  string
+	args []interface{}
+}
+
+func (c sqlColumn) compare(op string, v interface{}) condition {
+	return condition{string(c) + " " + op + " ?", []interface{}{v}}
+}
+
+func (c sqlColumn) eq(v interface{}) condition  { return c.compare("=", v) }
+func (c sqlColumn) gt(v interface{}) condition  { return c.compare(">", v) }
+func (c sqlColumn) gte(v interface{}) condition { return c.compare(">=", v) }
+func (c sqlColumn) lte(v interface{}) condition { return c.compare("<=", v) }
+
+// in matches any of values. No values match nothing.
+func (c sqlColumn) in(values ...interface{}) condition {
+	if len(values) == 0 {
+		return condition{"FALSE", nil}
+	}
+	return condition{string(c) + " IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ") + ")", values}
+}
+
+// inSubquery matches the values a one column subquery returns.
+func (c sqlColumn) inSubquery(subquery string, args ...interface{}) condition {
+	return newCondition(string(c)+" IN ("+subquery+")", args...)
+}
+
+// newCondition is a hand written condition. It panics if the placeholders
+// and arguments don't match, which is always a programming error.
+func newCondition(sql string, args ...interface{}) condition {
+	if n := strings.Count(sql, "?"); n != len(args) {
+		panic(fmt.Sprintf("condition %q has %d placeholders for %d arguments", sql, n, len(args)))
+	}
+	return condition{sql, args}
+}
+
+// A selectQuery adds conditions, ordering, a limit and locking to a fixed
+// SELECT ... FROM text.
+type selectQuery struct {
+	base       string
+	conditions []condition
+	orderBy    string
+	limit      int
+	forUpdate  bool
+}
+
+func newQuery(base string) *selectQuery {
+	return &selectQuery{base: base}
+}
+
+func selectBookings(columns string) *selectQuery {
+	return newQuery(`SELECT ` + columns + ` FROM booking`)
+}
+
+// where ANDs conditions onto the query.
+func (q *selectQuery) where(conditions ...condition) *selectQuery {
+	q.conditions = append(q.conditions, conditions...)
+	return q
+}
+
+func (q *selectQuery) order(by string) *selectQuery {
+	q.orderBy = by
+	return q
+}
+
+func (q *selectQuery) limitTo(n int) *selectQuery {
+	q.limit = n
+	return q
+}
+
+func (q *selectQuery) lockForUpdate() *selectQuery {
+	q.forUpdate = true
+	return q
+}
+
+// whereClause is the " WHERE ..." of conditions, empty without any.
+func whereClause(conditions []condition) (string, []interface{}) {
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	terms := make([]string, len(conditions))
+	args := []interface{}{}
+	for i, c := range conditions {
+		terms[i] = c.sql
+		args = append(args, c.args...)
+	}
+	return " WHERE " + strings.Join(terms, " AND "), args
+}
+
+func (q *selectQuery) build() (string, []interface{}) {
+	where, args := whereClause(q.conditions)
+	query := q.base + where
+	if q.orderBy != "" {
+		query += " ORDER BY " + q.orderBy
+	}
+	if q.limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.limit)
+	}
+	if q.forUpdate {
+		query += " FOR UPDATE"
+	}
+	return query, args
+}
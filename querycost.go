@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Each caller has a query budget by the role of its key, "public" without
+// one, bounding what one request may make the database do: the bookings a
+// list returns, the groups expanded into them, and the days a report
+// covers. A request over budget answers 400 with query_too_many_rows,
+// query_too_many_expansions or query_range_too_long, naming what it asked
+// for and the most allowed, unless QUERY_COST_MODE=truncate, which cuts it
+// down to the budget instead and says what was cut in X-Query-Truncated,
+// such as rows=1000. Lists read one row past the budget, so a list over it
+// costs no more than one within it, in the order bookingFilter.order
+// gives, so a list cut down keeps the bookings nearest the dates it asks
+// for rather than the oldest.
+//
+// QUERY_BUDGET_<ROLE> sets a role's budget as [rows=N][,expansions=N]
+// [,report_days=N], keeping the defaults below for what it leaves out; 0 is
+// no limit. Only the REST API is limited: the service has no GraphQL
+// endpoint.
+
+const (
+	costRows       = "rows"
+	costExpansions = "expansions"
+	costReportDays = "report_days"
+)
+
+const queryCostReject = "reject"
+const queryCostTruncate = "truncate"
+
+type queryBudget struct {
+	Rows       int
+	Expansions int
+	ReportDays int
+}
+
+const rolePublic = "public"
+
+var queryBudgetRoles = []string{rolePublic, roleStudent, roleDisplay, roleManager, roleAdmin}
+
+var defaultQueryBudgets = map[string]queryBudget{
+	rolePublic:  {Rows: 200, Expansions: 50, ReportDays: 31},
+	roleStudent: {Rows: 1000, Expansions: 100, ReportDays: 31},
+	roleDisplay: {Rows: 1000, Expansions: 100, ReportDays: 31},
+	roleManager: {Rows: 10000, Expansions: 1000, ReportDays: 366},
+	roleAdmin:   {Rows: 50000, Expansions: 5000, ReportDays: 731},
+}
+
+// queryCostErrors are the error codes of the limits.
+var queryCostErrors = map[string]string{
+	costRows:       "query_too_many_rows",
+	costExpansions: "query_too_many_expansions",
+	costReportDays: "query_range_too_long",
+}
+
+var queryCostTotal = newCounter("query_cost_exceeded_total", "Requests over their query budget, by limit, role and whether they were rejected or truncated.", "limit", "role", "action")
+
+// parseQueryBudget reads a QUERY_BUDGET_<ROLE> value over base.
+func parseQueryBudget(v string, base queryBudget) (queryBudget, error) {
+	budget := base
+	for _, part := range strings.Split(v, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(part, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || n < 0 {
+			return base, fmt.Errorf("%q is not a limit of zero or more", part)
+		}
+		switch strings.TrimSpace(name) {
+		case costRows:
+			budget.Rows = n
+		case costExpansions:
+			budget.Expansions = n
+		case costReportDays:
+			budget.ReportDays = n
+		default:
+			return base, fmt.Errorf("%q is not rows, expansions or report_days", name)
+		}
+	}
+	return budget, nil
+}
+
+// callerRole is the role whose budget r is held to.
+func callerRole(r *http.Request) string {
+	if caller := callerOf(r); caller != nil {
+		return caller.Role
+	}
+	return rolePublic
+}
+
+// queryBudgetOf returns the budget of role as configured now,
+// falling back to the defaults if the setting doesn't parse.
+func queryBudgetOf(role string) queryBudget {
+	base, ok := defaultQueryBudgets[role]
+	if !ok {
+		base = defaultQueryBudgets[rolePublic]
+	}
+	budget, err := parseQueryBudget(envString("QUERY_BUDGET_"+strings.ToUpper(role), ""), base)
+	if err != nil {
+		return base
+	}
+	return budget
+}
+
+func (b queryBudget) of(limit string) int {
+	switch limit {
+	case costRows:
+		return b.Rows
+	case costExpansions:
+		return b.Expansions
+	default:
+		return b.ReportDays
+	}
+}
+
+// limitQueryCost holds requested of limit to the budget of r's caller. It
+// returns what may be served: requested within the budget, the budget in
+// truncate mode. Otherwise it answers the error and returns false.
+func limitQueryCost(w http.ResponseWriter, r *http.Request, limit string, requested int) (int, bool) {
+	role := callerRole(r)
+	allowed := queryBudgetOf(role).of(limit)
+	if allowed == 0 || requested <= allowed {
+		return requested, true
+	}
+	if envString("QUERY_COST_MODE", queryCostReject) == queryCostTruncate {
+		queryCostTotal.Inc(limit, role, queryCostTruncate)
+		w.Header().Add("X-Query-Truncated", limit+"="+strconv.Itoa(allowed))
+		return allowed, true
+	}
+	queryCostTotal.Inc(limit, role, queryCostReject)
+	writeError(w, r, http.StatusBadRequest, queryCostErrors[limit], "requested", strconv.Itoa(requested), "max", strconv.Itoa(allowed), "role", role)
+	return 0, false
+}
+
+// listLimit is the limit of the booking list r asks for with ?limit=, held
+// to its caller's budget, or without one the budget and a row past it, to
+// tell a list over budget.
+func listLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		if rows := queryBudgetOf(callerRole(r)).Rows; rows > 0 {
+			return rows + 1, true
+		}
+		return 0, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		writeError(w, r, http.StatusBadRequest, "invalid_list_limit")
+		return 0, false
+	}
+	return limitQueryCost(w, r, costRows, n)
+}
+
+// limitRows holds a list read with listLimit to the budget.
+func limitRows(w http.ResponseWriter, r *http.Request, bookings []booking) ([]booking, bool) {
+	n, ok := limitQueryCost(w, r, costRows, len(bookings))
+	if !ok {
+		return nil, false
+	}
+	return bookings[:n], true
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bookers may hold up to BOOKER_WEEKLY_BOOKINGS bookings, and
+// BOOKER_WEEKLY_MINUTES minutes of them, starting in one week (Monday to
+// Sunday in the booking time zone); zero, the default, is no limit, and
+// all-day bookings count their whole day. Admins book past the quota.
+// Creates that would exceed it answer 429 quota_exceeded; those that leave
+// QUOTA_WARN_PERCENT (default 20) of it or less answer with warnings, so
+// clients can tell the booker before they hit it. Creates answer with the
+// quota in X-Quota-Limit, X-Quota-Remaining and X-Quota-Reset, the start of
+// the next week. Each create is checked against what is booked, so the
+// creates of one batch don't count against each other, and a template
+// booking is checked by its first occurrence, as in the policy checks.
+//
+// GET /api/booker/{id}/usage-forecast?weeks= projects the quota over the
+// coming weeks, default 4 and at most 26, from what is booked, most of it
+// the occurrences of recurring series.
+
+const usageForecastPath = "usage-forecast"
+const maxForecastWeeks = 26
+
+const (
+	quotaOk       = "ok"
+	quotaWarning  = "warning"
+	quotaAtLimit  = "at_limit"
+	quotaExceeded = "exceeded"
+)
+
+type quotaLimits struct {
+	Bookings    int `json:"bookings,omitempty"`
+	Minutes     int `json:"minutes,omitempty"`
+	warnPercent int
+}
+
+func currentQuota() quotaLimits {
+	return quotaLimits{
+		Bookings:    envInt("BOOKER_WEEKLY_BOOKINGS", 0),
+		Minutes:     envInt("BOOKER_WEEKLY_MINUTES", 0),
+		warnPercent: envInt("QUOTA_WARN_PERCENT", 20),
+	}
+}
+
+// values has the limits set, by name.
+func (l quotaLimits) values() map[string]int {
+	values := map[string]int{}
+	if l.Bookings > 0 {
+		values["bookings"] = l.Bookings
+	}
+	if l.Minutes > 0 {
+		values["minutes"] = l.Minutes
+	}
+	return values
+}
+
+// quotaUsage is what a booker has booked in the week starting Week.
+type quotaUsage struct {
+	Week     string      `json:"week"`
+	Bookings int         `json:"bookings"`
+	Minutes  int         `json:"minutes"`
+	Limits   quotaLimits `json:"-"`
+	// RecurringBookings and RecurringMinutes are the part of the usage
+	// booked by series.
+	RecurringBookings int `json:"recurring_bookings"`
+	RecurringMinutes  int `json:"recurring_minutes"`
+	// Remaining has what is left of each limit set.
+	Remaining map[string]int `json:"remaining"`
+	Status    string         `json:"status"`
+	start     time.Time
+}
+
+type bookingWarning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// weekStart is the Monday midnight starting the week of t, in the booking
+// time zone.
+func weekStart(t time.Time) time.Time {
+	t = t.In(bookingLocation)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, bookingLocation)
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+func bookingMinutes(b booking) int {
+	if b.BookingDuration == 0 {
+		return 24 * 60
+	}
+	return b.BookingDuration
+}
+
+// add counts b in u.
+func (u *quotaUsage) add(b booking, recurring bool) {
+	u.Bookings++
+	u.Minutes += bookingMinutes(b)
+	if recurring {
+		u.RecurringBookings++
+		u.RecurringMinutes += bookingMinutes(b)
+	}
+}
+
+// finish computes what remains of the limits of u and how close it is.
+func (u *quotaUsage) finish() {
+	u.Week = u.start.Format(bookingDateLayout)
+	u.Status = quotaOk
+	u.Remaining = map[string]int{}
+	used := map[string]int{"bookings": u.Bookings, "minutes": u.Minutes}
+	for name, limit := range u.Limits.values() {
+		remaining := limit - used[name]
+		switch {
+		case remaining < 0:
+			u.Status = quotaExceeded
+			remaining = 0
+		case remaining == 0 && u.Status != quotaExceeded:
+			u.Status = quotaAtLimit
+		case remaining*100 <= limit*u.Limits.warnPercent && u.Status == quotaOk:
+			u.Status = quotaWarning
+		}
+		u.Remaining[name] = remaining
+	}
+}
+
+// weeklyUsage counts the bookings of bookerId in weeks weeks from start,
+// leaving out the booking numbered except, and those in recurring as
+// recurring.
+func weeklyUsage(store BookingRepository, bookerId string, start time.Time, weeks int, except int, recurring map[int]bool) ([]quotaUsage, error) {
+	bookings, err := store.GetBooker(bookerId)
+	if err != nil {
+		return nil, err
+	}
+	limits := currentQuota()
+	usage := make([]quotaUsage, weeks)
+	for i := range usage {
+		usage[i] = quotaUsage{start: start.AddDate(0, 0, 7*i), Limits: limits}
+	}
+	for _, b := range bookings {
+		begin, _, err := bookingWindow(b)
+		if err != nil || b.BookingId == except || begin.Before(start) {
+			continue
+		}
+		if week := int(weekStart(begin).Sub(start).Hours()+12) / (7 * 24); week < weeks {
+			usage[week].add(b, recurring[b.BookingId])
+		}
+	}
+	return usage, nil
+}
+
+// seriesBookingIds returns the bookings of bookerId booked by a series.
+func seriesBookingIds(bookerId string) (map[int]bool, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT o.occurrence_booking_id FROM booking_occurrence o JOIN booking_series s ON s.series_id = o.occurrence_series_id WHERE s.series_booker_id = ?`, bookerId)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	ids := make(map[int]bool)
+	for results.Next() {
+		var id int
+		if err := results.Scan(&id); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, results.Err()
+}
+
+// bookingQuota is the usage of the week of b with b booked, or nil when no
+// quota applies to it. added and removed are bookings not booked or
+// cancelled yet that count as if they were, those of a batch.
+func bookingQuota(r *http.Request, b booking, added []booking, removed []booking) (*quotaUsage, error) {
+	limits := currentQuota()
+	if limits.Bookings == 0 && limits.Minutes == 0 || b.BookingBookerId == "" {
+		return nil, nil
+	}
+	if caller := callerOf(r); caller != nil && caller.Role == roleAdmin {
+		return nil, nil
+	}
+	begin, _, err := bookingWindow(b)
+	if err != nil {
+		return nil, nil
+	}
+	usage, err := weeklyUsage(bookingStoreFor(r), b.BookingBookerId, weekStart(begin), 1, b.BookingId, nil)
+	if err != nil {
+		return nil, err
+	}
+	sameWeek := func(other booking) bool {
+		otherBegin, _, err := bookingWindow(other)
+		return err == nil && other.BookingBookerId == b.BookingBookerId && weekStart(otherBegin).Equal(usage[0].start)
+	}
+	for _, other := range removed {
+		if sameWeek(other) {
+			usage[0].Bookings--
+			usage[0].Minutes -= bookingMinutes(other)
+		}
+	}
+	for _, other := range added {
+		if sameWeek(other) {
+			usage[0].add(other, false)
+		}
+	}
+	usage[0].add(b, false)
+	usage[0].finish()
+	return &usage[0], nil
+}
+
+// quotaHeader lists the bookings and minutes of values that are set.
+func quotaHeader(values map[string]int) string {
+	parts := []string{}
+	for _, name := range []string{"bookings", "minutes"} {
+		if v, ok := values[name]; ok {
+			parts = append(parts, fmt.Sprintf("%s=%d", name, v))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// applyQuota answers 429 if creating b would exceed its booker's quota, and
+// otherwise sets the quota headers of the create, with what remains once b
+// is booked.
+func applyQuota(w http.ResponseWriter, r *http.Request, b booking) bool {
+	return applyBatchQuota(w, r, b, nil, nil)
+}
+
+// applyBatchQuota is applyQuota for a create of a batch, whose earlier
+// operations add and remove bookings.
+func applyBatchQuota(w http.ResponseWriter, r *http.Request, b booking, added []booking, removed []booking) bool {
+	usage, err := bookingQuota(r, b, added, removed)
+	if err == nil && usage != nil {
+		if usage.Status == quotaExceeded {
+			// Refused, b leaves the quota as it was.
+			usage.Bookings--
+			usage.Minutes -= bookingMinutes(b)
+			usage.finish()
+			err = fmt.Errorf("booker %s, week %s: %w", b.BookingBookerId, usage.Week, errQuotaExceeded)
+		}
+		w.Header().Set("X-Quota-Limit", quotaHeader(usage.Limits.values()))
+		w.Header().Set("X-Quota-Remaining", quotaHeader(usage.Remaining))
+		w.Header().Set("X-Quota-Reset", usage.start.AddDate(0, 0, 7).Format(time.RFC3339))
+	}
+	if err != nil {
+		writeServiceError(w, r, err)
+		return true
+	}
+	return false
+}
+
+// quotaWarnings warns of the quota of the week of b, booked, running low.
+func quotaWarnings(r *http.Request, b booking) []bookingWarning {
+	usage, err := bookingQuota(r, b, nil, nil)
+	if err != nil || usage == nil || usage.Status == quotaOk {
+		return nil
+	}
+	low := func(remaining, limit int) bool {
+		return limit > 0 && remaining*100 <= limit*usage.Limits.warnPercent
+	}
+	lang := requestLanguage(r)
+	warnings := []bookingWarning{}
+	if low(usage.Remaining["bookings"], usage.Limits.Bookings) {
+		warnings = append(warnings, bookingWarning{"quota_low", translate(lang, "warning.quota_bookings_low",
+			"remaining", strconv.Itoa(usage.Remaining["bookings"]), "limit", strconv.Itoa(usage.Limits.Bookings), "week", usage.Week)})
+	}
+	if low(usage.Remaining["minutes"], usage.Limits.Minutes) {
+		warnings = append(warnings, bookingWarning{"quota_low", translate(lang, "warning.quota_minutes_low",
+			"remaining", strconv.Itoa(usage.Remaining["minutes"]), "limit", strconv.Itoa(usage.Limits.Minutes), "week", usage.Week)})
+	}
+	return warnings
+}
+
+type usageForecast struct {
+	BookerId string       `json:"booker_id"`
+	Limits   quotaLimits  `json:"limits"`
+	Weeks    []quotaUsage `json:"weeks"`
+}
+
+// handlerBookerUsageForecast serves GET /api/booker/{id}/usage-forecast.
+func handlerBookerUsageForecast(w http.ResponseWriter, r *http.Request, bookerId string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeBooker(w, r, bookerId) {
+		return
+	}
+	weeks := 4
+	if v := r.URL.Query().Get("weeks"); v != "" {
+		var err error
+		if weeks, err = strconv.Atoi(v); err != nil || weeks < 1 || weeks > maxForecastWeeks {
+			writeError(w, r, http.StatusBadRequest, "invalid_forecast_weeks", "max", strconv.Itoa(maxForecastWeeks))
+			return
+		}
+	}
+	recurring, err := seriesBookingIds(bookerId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	usage, err := weeklyUsage(bookingStoreFor(r), bookerId, weekStart(time.Now()), weeks, 0, recurring)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	for i := range usage {
+		usage[i].finish()
+	}
+	j, err := json.Marshal(usageForecast{BookerId: bookerId, Limits: currentQuota(), Weeks: usage})
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}
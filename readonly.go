@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// A server started with --read-only (or READ_ONLY=true) is a read replica:
+// it serves reads from a database replica, for a region far from the
+// primary, and answers every other request 503 with the same request on
+// the primary, --primary-url (or PRIMARY_URL), in X-Primary-Url and the
+// body. Requests are told apart by method, as in maintenance. A replica
+// applies no migrations, refusing to start on a database behind them,
+// counts no usage, journals nothing to request_journal, and runs none of
+// the jobs that write or notify, which the primary runs already: the
+// schedule rebuild, reminders, digests and agendas, no-shows, retention,
+// cleanup, journal pruning and calendar sync.
+
+var readOnly bool
+var primaryUrl string
+
+// readOnlyMiddleware refuses writes on a read replica.
+func readOnlyMiddleware(handler http.Handler) http.Handler {
+	if !readOnly {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isReadMethod(r.Method) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		body := map[string]string{"error": "read_only", "message": translate(requestLanguage(r), "error.read_only")}
+		if primaryUrl != "" {
+			body["primary"] = strings.TrimSuffix(primaryUrl, "/") + r.URL.RequestURI()
+			w.Header().Set("X-Primary-Url", body["primary"])
+		}
+		j, err := json.Marshal(body)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Header().Set("Content-Type", jsonContentType)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write(j)
+	})
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Creating or approving a booking issues a receipt: a JWS, signed with
+// EdDSA, over the booking as it was then, which the booker can keep to
+// prove they held the booking whatever happens to it later. Receipts are
+// stored as issued and never changed; POST /api/bookings, /bookings/auto
+// and /approve answer with theirs, and GET /api/bookings/{id}/receipt
+// returns the latest, even for a booking since cancelled. Anyone can check
+// a receipt against the keys at GET /api/receipts/keys (a JWKS), or with
+// POST /api/receipts/verify, which also tells whether the booking changed
+// since.
+//
+// RECEIPT_SIGNING_KEY is the base64 Ed25519 seed receipts are signed with;
+// without it a random key is used, whose receipts stop verifying after a
+// restart. Once a key is rotated, list its base64 public key in
+// RECEIPT_PREVIOUS_KEYS, comma separated, to keep its receipts verifying.
+// Erasing a booker's data deletes their receipts, as a signed receipt
+// can't be anonymized; the booker's copies stay valid.
+
+const receiptPath = "receipt"
+const receiptsPath = "receipts"
+const receiptKeysPath = "keys"
+const receiptVerifyPath = "verify"
+
+const receiptAlgorithm = "EdDSA"
+const receiptType = "booking-receipt+jwt"
+
+var receiptEvents = map[string]bool{eventBookingCreated: true, eventBookingApproved: true}
+
+// receiptKey is set by serve, once the settings are loaded.
+var receiptKey ed25519.PrivateKey
+
+func loadReceiptKey() (ed25519.PrivateKey, error) {
+	if seed := envString("RECEIPT_SIGNING_KEY", ""); seed != "" {
+		raw, err := base64.StdEncoding.DecodeString(seed)
+		if err != nil || len(raw) != ed25519.SeedSize {
+			return nil, fmt.Errorf("RECEIPT_SIGNING_KEY must be a base64 Ed25519 seed of %d bytes", ed25519.SeedSize)
+		}
+		return ed25519.NewKeyFromSeed(raw), nil
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	return key, err
+}
+
+// receiptKeyId names a public key by its SHA-256.
+func receiptKeyId(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+// receiptPublicKeys are the keys receipts verify with, by key id: the
+// signing key's and the previous ones.
+func receiptPublicKeys() map[string]ed25519.PublicKey {
+	current := receiptKey.Public().(ed25519.PublicKey)
+	keys := map[string]ed25519.PublicKey{receiptKeyId(current): current}
+	for _, encoded := range strings.Split(envString("RECEIPT_PREVIOUS_KEYS", ""), ",") {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(raw) != ed25519.PublicKeySize {
+			continue
+		}
+		keys[receiptKeyId(raw)] = ed25519.PublicKey(raw)
+	}
+	return keys
+}
+
+type receiptHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyId     string `json:"kid"`
+}
+
+type receiptClaims struct {
+	Issuer   string          `json:"iss"`
+	Subject  string          `json:"sub"`
+	IssuedAt int64           `json:"iat"`
+	Event    string          `json:"event"`
+	Booking  bookingResponse `json:"booking"`
+}
+
+func signReceipt(claims receiptClaims) (string, error) {
+	header, err := json.Marshal(receiptHeader{receiptAlgorithm, receiptType, receiptKeyId(receiptKey.Public().(ed25519.PublicKey))})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(receiptKey, []byte(unsigned))), nil
+}
+
+// verifyReceipt checks the signature of receipt and returns its claims and
+// the id of the key that signed it.
+func verifyReceipt(receipt string) (receiptClaims, string, error) {
+	var claims receiptClaims
+	parts := strings.Split(receipt, ".")
+	if len(parts) != 3 {
+		return claims, "", errors.New("not a compact JWS")
+	}
+	var header receiptHeader
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(raw, &header) != nil || header.Algorithm != receiptAlgorithm {
+		return claims, "", errors.New("malformed header")
+	}
+	key, ok := receiptPublicKeys()[header.KeyId]
+	if !ok {
+		return claims, "", fmt.Errorf("unknown key %q", header.KeyId)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !ed25519.Verify(key, []byte(parts[0]+"."+parts[1]), signature) {
+		return claims, "", errors.New("bad signature")
+	}
+	raw, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(raw, &claims) != nil {
+		return claims, "", errors.New("malformed claims")
+	}
+	return claims, header.KeyId, nil
+}
+
+// issueReceipt signs and stores the receipt of event for b, if the event
+// issues one.
+func issueReceipt(event string, b booking) {
+	if !receiptEvents[event] {
+		return
+	}
+	now := time.Now().UTC()
+	receipt, err := signReceipt(receiptClaims{envString("RECEIPT_ISSUER", "classroom"), b.publicId(), now.Unix(), event, newBookingResponse(b)})
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err = Db.ExecContext(ctx, `INSERT INTO booking_receipt (receipt_booking_id, receipt_booking_public_id, receipt_booker_id, receipt_event, receipt_jws, receipt_issued_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, b.BookingId, b.publicId(), b.BookingBookerId, event, receipt, now)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+type bookingReceipt struct {
+	BookingId string    `json:"booking_id"`
+	Event     string    `json:"event"`
+	IssuedAt  time.Time `json:"issued_at"`
+	Receipt   string    `json:"receipt"`
+	bookerId  string
+}
+
+// getLatestReceipt returns the last receipt issued for the booking with
+// public or, during the migration, integer id segment, or nil.
+func getLatestReceipt(segment string) (*bookingReceipt, error) {
+	column, key := "receipt_booking_public_id", interface{}(segment)
+	if !isPublicId(segment) {
+		bookingId, err := strconv.Atoi(segment)
+		if err != nil || envString("BOOKING_INTEGER_IDS", "true") != "true" {
+			return nil, nil
+		}
+		column, key = "receipt_booking_id", bookingId
+	}
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	var receipt bookingReceipt
+	err := Db.QueryRowContext(ctx, `SELECT receipt_booking_public_id, receipt_event, receipt_issued_at, receipt_jws, receipt_booker_id FROM booking_receipt
+		WHERE `+column+` = ? ORDER BY receipt_id DESC LIMIT 1`, key).Scan(&receipt.BookingId, &receipt.Event, sqlTime{&receipt.IssuedAt}, &receipt.Receipt, &receipt.bookerId)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	return &receipt, nil
+}
+
+// latestReceipt is the receipt to answer a create or approval of b with,
+// empty if none was issued.
+func latestReceipt(b booking) string {
+	receipt, err := getLatestReceipt(b.publicId())
+	if err != nil || receipt == nil {
+		return ""
+	}
+	return receipt.Receipt
+}
+
+// handlerBookingReceipt serves GET /api/bookings/{id}/receipt.
+func handlerBookingReceipt(w http.ResponseWriter, r *http.Request, segment string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	receipt, err := getLatestReceipt(segment)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	if receipt == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if owned, ok := bookingStoreFor(r).(ownedBookingRepository); ok && (owned.bookerId == "" || receipt.bookerId != owned.bookerId) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	j, err := json.Marshal(receipt)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}
+
+type receiptJwk struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyId     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+type receiptVerification struct {
+	Valid  bool           `json:"valid"`
+	Error  string         `json:"error,omitempty"`
+	KeyId  string         `json:"kid,omitempty"`
+	Claims *receiptClaims `json:"claims,omitempty"`
+	// Current is the booking as it is now, nil once it is gone or if the
+	// caller may not see it, and Modified whether it changed since the
+	// receipt.
+	Current  *bookingResponse `json:"current,omitempty"`
+	Modified bool             `json:"modified"`
+}
+
+// receiptContent is what a receipt holds of a booking, without what isn't
+// stored or may be filled in after the receipt was signed.
+func receiptContent(b bookingResponse) bookingResponse {
+	b.UpdatedAt, b.Group, b.ActedBy = time.Time{}, nil, ""
+	return b
+}
+
+// handlerReceipts serves /api/receipts/keys and /api/receipts/verify.
+func handlerReceipts(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, basePath+"/"+receiptsPath+"/") {
+	case receiptKeysPath:
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		keys := []receiptJwk{}
+		for id, key := range receiptPublicKeys() {
+			keys = append(keys, receiptJwk{"OKP", "Ed25519", base64.RawURLEncoding.EncodeToString(key), id, receiptAlgorithm, "sig"})
+		}
+		j, err := json.Marshal(map[string][]receiptJwk{"keys": keys})
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+	case receiptVerifyPath:
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var request struct {
+			Receipt string `json:"receipt"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Receipt == "" {
+			writeError(w, r, http.StatusBadRequest, "invalid_body")
+			return
+		}
+		var verification receiptVerification
+		claims, keyId, err := verifyReceipt(request.Receipt)
+		if err != nil {
+			verification.Error = err.Error()
+		} else {
+			verification.Valid, verification.KeyId, verification.Claims = true, keyId, &claims
+			current, err := resolveBooking(bookingStoreFor(r), claims.Subject)
+			if err != nil {
+				writeServiceError(w, r, err)
+				return
+			}
+			if current != nil {
+				response := newBookingResponse(*current)
+				verification.Modified = receiptContent(response) != receiptContent(claims.Booking)
+				redactionFor(r).response(&response)
+				verification.Current = &response
+			}
+		}
+		j, err := json.Marshal(verification)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import "net/http"
+
+// What a booking payload shows depends on who asks, whichever endpoint
+// serves it: booking bodies and lists, field projections, histories, the
+// event replay, the changes feed, series and the public schedule all pass
+// through a redaction for the caller before they are written. Students see
+// booker ids only on their own bookings, including group bookings a fellow
+// member made; managers, display screens and, when ANONYMOUS_BOOKINGS is
+// on, anonymous callers see every booker, as they see every booking.
+// Audit fields, who acted for the booker and the request behind an event,
+// are for admins only. Notifications and webhooks are addressed to the
+// booker or the operator and stay whole.
+
+type redaction struct {
+	// audit keeps acted_by and request ids.
+	audit bool
+	// bookers keeps the booker ids of other bookers' bookings; self is the
+	// one booker id kept without it.
+	bookers bool
+	self    string
+}
+
+func redactionFor(r *http.Request) redaction {
+	return redactionOf(callerOf(r))
+}
+
+// redactionOf is the redaction for caller, nil for anonymous callers, also
+// applied where there is no request, such as subscription deliveries.
+func redactionOf(caller *apiKey) redaction {
+	switch {
+	case caller == nil:
+		return redaction{bookers: envString("ANONYMOUS_BOOKINGS", "false") == "true"}
+	case caller.Role == roleAdmin || caller.ActingAdmin != nil:
+		return redaction{audit: true, bookers: true}
+	case caller.Role == roleStudent:
+		return redaction{self: caller.BookerId}
+	}
+	return redaction{bookers: true}
+}
+
+func (red redaction) showsBooker(bookerId string) bool {
+	return red.bookers || bookerId != "" && bookerId == red.self
+}
+
+func (red redaction) booking(b booking) booking {
+	if !red.showsBooker(b.BookingBookerId) {
+		b.BookingBookerId = ""
+	}
+	if !red.audit {
+		b.ActedBy, b.RequestId = "", ""
+	}
+	return b
+}
+
+func (red redaction) bookings(bookings []booking) []booking {
+	redacted := make([]booking, len(bookings))
+	for i, b := range bookings {
+		redacted[i] = red.booking(b)
+	}
+	return redacted
+}
+
+func (red redaction) response(response *bookingResponse) {
+	if !red.showsBooker(response.BookerId) {
+		response.BookerId = ""
+	}
+	if !red.audit {
+		response.ActedBy = ""
+	}
+}
+
+func (red redaction) event(e *bookingEvent) {
+	red.response(&e.Booking)
+	if !red.audit {
+		e.ActedBy, e.RequestId = "", ""
+	}
+}
+
+func (red redaction) events(events []sequencedEvent) {
+	for i := range events {
+		red.event(&events[i].bookingEvent)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const reportPath = "reports"
+
+type heatmapCell struct {
+	ClassroomId string `json:"classroom_id"`
+	Weekday     int    `json:"weekday"`
+	Hour        *int   `json:"hour"`
+	Bookings    int    `json:"bookings"`
+	Minutes     int    `json:"minutes"`
+}
+
+// getHeatmap counts bookings per classroom, weekday (0 is Sunday) and start
+// hour between two dates, over the classrooms the caller manages. Whole-day
+// bookings have no hour.
+func getHeatmap(caller *apiKey, tenant string, from, to string) ([]heatmapCell, error) {
+	classroomIds, all, err := managedClassrooms(caller)
+	if err != nil {
+		return nil, err
+	}
+	cells := make([]heatmapCell, 0)
+	if !all && len(classroomIds) == 0 {
+		return cells, nil
+	}
+	scope, args := "", []interface{}{from, to}
+	if !all {
+		scope = " AND booking_classroom_id IN (?" + strings.Repeat(", ?", len(classroomIds)-1) + ")"
+		for _, classroomId := range classroomIds {
+			args = append(args, classroomId)
+		}
+	}
+	ctx, cancel := tenantQueryContext(tenant, queryReport)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT booking_classroom_id, weekday, hour, COUNT(*), SUM(booking_duration)
+		FROM (SELECT booking_classroom_id, booking_duration,
+			DAYOFWEEK(LEFT(TRIM(booking_time), 10)) - 1 AS weekday,
+			IF(CHAR_LENGTH(TRIM(booking_time)) > 10, HOUR(STR_TO_DATE(TRIM(booking_time), '%Y-%m-%d %H:%i')), NULL) AS hour
+			FROM booking WHERE LEFT(TRIM(booking_time), 10) BETWEEN ? AND ?`+scope+`) b
+		GROUP BY booking_classroom_id, weekday, hour
+		ORDER BY booking_classroom_id, weekday, hour`, args...)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	for results.Next() {
+		var cell heatmapCell
+		var hour sql.NullInt64
+		if err := results.Scan(&cell.ClassroomId, &cell.Weekday, &hour, &cell.Bookings, &cell.Minutes); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		if hour.Valid {
+			h := int(hour.Int64)
+			cell.Hour = &h
+		}
+		cells = append(cells, cell)
+	}
+	return cells, results.Err()
+}
+
+func handlerReports(w http.ResponseWriter, r *http.Request) {
+	urlPathSegments := strings.Split(r.URL.Path, fmt.Sprintf("%s/", reportPath))
+	report := urlPathSegments[len(urlPathSegments)-1]
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	switch report {
+	case "heatmap":
+		from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+		start, err := time.Parse(bookingDateLayout, from)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		end, err := time.Parse(bookingDateLayout, to)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// Both dates count, and the budget bounds the days covered.
+		days := int(end.Sub(start).Hours()/24) + 1
+		if allowed, ok := limitQueryCost(w, r, costReportDays, days); !ok {
+			return
+		} else if allowed < days {
+			to = start.AddDate(0, 0, allowed-1).Format(bookingDateLayout)
+		}
+		cells, err := getHeatmap(callerOf(r), tenantOf(r), from, to)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		j, err := json.Marshal(cells)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
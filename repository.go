@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bookingFilter narrows a booking list down by location or classroom, to
+// one booker or booker group, a status and dates between From and To
+// inclusive and, for delta sync, to bookings changed after UpdatedSince.
+type bookingFilter struct {
+	locationFilter
+	ClassroomId  string
+	BookerId     string
+	GroupId      string
+	Status       string
+	From         string
+	To           string
+	UpdatedSince time.Time
+	// Limit caps the bookings listed, in the order of order, 0 listing all;
+	// see querycost.go.
+	Limit int
+}
+
+// order is the order a limited list is read in, so that one cut short
+// keeps the bookings nearest the time it asks about: from its From date
+// on the soonest first, otherwise the latest first.
+func (filter bookingFilter) order() string {
+	if filter.From != "" {
+		return "booking_time, booking_id"
+	}
+	return "booking_time DESC, booking_id DESC"
+}
+
+// limit orders bookings, a list read whole, as order does and cuts it to
+// Limit, as a limited query would.
+func (filter bookingFilter) limit(bookings []booking) []booking {
+	if filter.Limit <= 0 {
+		return bookings
+	}
+	before := func(x, y booking) bool {
+		xt, yt := strings.TrimSpace(x.BookingTime), strings.TrimSpace(y.BookingTime)
+		if xt != yt {
+			return xt < yt
+		}
+		return x.BookingId < y.BookingId
+	}
+	sort.SliceStable(bookings, func(i, j int) bool {
+		if filter.From != "" {
+			return before(bookings[i], bookings[j])
+		}
+		return before(bookings[j], bookings[i])
+	})
+	if len(bookings) > filter.Limit {
+		bookings = bookings[:filter.Limit]
+	}
+	return bookings
+}
+
+func (filter bookingFilter) where() []condition {
+	conditions := filter.locationFilter.where(colBookingClassroomId)
+	if filter.ClassroomId != "" {
+		conditions = append(conditions, colBookingClassroomId.eq(filter.ClassroomId))
+	}
+	if filter.BookerId != "" {
+		conditions = append(conditions, colBookingBookerId.eq(filter.BookerId))
+	}
+	if filter.GroupId != "" {
+		conditions = append(conditions, colBookingGroupId.eq(filter.GroupId))
+	}
+	if filter.Status != "" {
+		conditions = append(conditions, colBookingStatus.eq(filter.Status))
+	}
+	if filter.From != "" {
+		conditions = append(conditions, colBookingDate.gte(filter.From))
+	}
+	if filter.To != "" {
+		conditions = append(conditions, colBookingDate.lte(filter.To))
+	}
+	if !filter.UpdatedSince.IsZero() {
+		conditions = append(conditions, colBookingUpdatedAt.gt(filter.UpdatedSince.UTC()))
+	}
+	return conditions
+}
+
+// BookingRepository is the storage of the core booking records.
+type BookingRepository interface {
+	GetBooking(bookingId int) (*booking, error)
+	GetBookingByPublicId(publicId string) (*booking, error)
+	GetBooker(bookerId string) ([]booking, error)
+	GetBookingList(filter bookingFilter, fields []bookingField) ([]booking, error)
+	InsertBooking(booking booking) (int, error)
+	RemoveBooking(bookingId int) error
+}
+
+// mysqlBookingRepository runs its queries through a prepared statement
+// cache; the query texts are fixed apart from the list filter, so the cache
+// stays small. tenant picks the timeouts and limits reads and writes to the
+// tenant's bookings; the store of the background jobs has none, and sees
+// every tenant's with the default tenant's timeouts.
+type mysqlBookingRepository struct {
+	stmts  *stmtCache
+	tenant string
+}
+
+var bookingStore BookingRepository = wrapBookingStore(mysqlBookingRepository{stmts: newStmtCache()})
+
+// bookingBackends are the BookingRepository implementations BOOKING_STORE
+// can pick. Optional ones register themselves from files behind build
+// tags, e.g. gorm.
+var bookingBackends = map[string]func(db *sql.DB) (BookingRepository, error){
+	"mysql": func(db *sql.DB) (BookingRepository, error) {
+		return mysqlBookingRepository{stmts: newStmtCache()}, nil
+	},
+}
+
+func (repo mysqlBookingRepository) forTenant(tenant string) BookingRepository {
+	repo.tenant = tenant
+	return repo
+}
+
+// scoped adds the condition on the repository's tenant to conditions.
+func (repo mysqlBookingRepository) scoped(conditions ...condition) []condition {
+	if repo.tenant == "" {
+		return conditions
+	}
+	return append(conditions, colBookingTenant.eq(repo.tenant))
+}
+
+func (repo mysqlBookingRepository) queryContext(op queryOp) (context.Context, context.CancelFunc) {
+	if repo.tenant == "" {
+		return queryContext(op)
+	}
+	return tenantQueryContext(repo.tenant, op)
+}
+
+// backendLayers wrap the backend beneath the retries. Files behind build
+// tags add them, e.g. chaos.
+var backendLayers []func(BookingRepository) BookingRepository
+
+// wrapBookingStore adds read deduplication, retries and the circuit breaker
+// in front of a backend.
+func wrapBookingStore(backend BookingRepository) BookingRepository {
+	for _, layer := range backendLayers {
+		backend = layer(backend)
+	}
+	return dedupBookingRepository{next: resilientBookingRepository{backend, dbBreaker}}
+}
+
+// setupBookingStore switches the booking store to the named backend, the
+// BOOKING_STORE one unless running in memory, once the database is open.
+func setupBookingStore(name string) error {
+	open, ok := bookingBackends[name]
+	if !ok {
+		return fmt.Errorf("unknown BOOKING_STORE %q; optional stores need their build tag", name)
+	}
+	backend, err := open(Db)
+	if err != nil {
+		return err
+	}
+	bookingStore = wrapBookingStore(backend)
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"regexp"
+)
+
+// Every request gets an id, answered in X-Request-Id: the caller's own
+// X-Request-Id if it sends a usable one, else the trace id of its W3C
+// traceparent header, else a new one. The id travels with the bookings the
+// request changes into their events, webhook and notification payloads,
+// the policy webhook and the request journal, and goes out as X-Request-Id
+// on outgoing webhook calls, with a traceparent continuing the caller's
+// trace when the id is one, so downstream systems can tie their work back
+// to the API call that caused it.
+
+const requestIdHeader = "X-Request-Id"
+
+type requestIdKey struct{}
+
+var (
+	validRequestId = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+	validTraceId   = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	traceparentRe  = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-[0-9a-f]{16}-[0-9a-f]{2}$`)
+)
+
+// incomingRequestId is the id r asks to be known by, if any.
+func incomingRequestId(r *http.Request) string {
+	if id := r.Header.Get(requestIdHeader); validRequestId.MatchString(id) {
+		return id
+	}
+	if m := traceparentRe.FindStringSubmatch(r.Header.Get("traceparent")); m != nil && m[1] != "00000000000000000000000000000000" {
+		return m[1]
+	}
+	return ""
+}
+
+func requestIdMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := incomingRequestId(r)
+		if id == "" {
+			id = newPublicId()
+		}
+		w.Header().Set(requestIdHeader, id)
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id)))
+	})
+}
+
+// requestIdOf returns the id of r, empty outside requestIdMiddleware.
+func requestIdOf(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdKey{}).(string)
+	return id
+}
+
+// setRequestIdHeaders marks an outgoing call as made for request id.
+func setRequestIdHeaders(req *http.Request, id string) {
+	if id == "" {
+		return
+	}
+	req.Header.Set(requestIdHeader, id)
+	if validTraceId.MatchString(id) {
+		span := make([]byte, 8)
+		if _, err := io.ReadFull(rand.Reader, span); err == nil {
+			req.Header.Set("traceparent", "00-"+id+"-"+hex.EncodeToString(span)+"-01")
+		}
+	}
+}
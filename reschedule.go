@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const reschedulePath = "reschedule"
+
+// rescheduleRequest moves a booking. Fields left out keep their current
+// value.
+type rescheduleRequest struct {
+	BookingTime     string `json:"booking_time"`
+	BookingDuration *int   `json:"booking_duration"`
+	ClassroomId     string `json:"classroom_id"`
+	Seats           *int   `json:"seats"`
+	// TimeZone is the zone of a booking time without an offset, as in
+	// booking creates.
+	TimeZone string `json:"time_zone"`
+	// Override lets an admin move a booking out of a slot inside
+	// CANCEL_MIN_NOTICE, as in cancels.
+	Override bool `json:"override"`
+}
+
+func (req rescheduleRequest) apply(b booking) booking {
+	if req.BookingTime != "" {
+		b.BookingTime = req.BookingTime
+	}
+	if req.BookingDuration != nil {
+		b.BookingDuration = *req.BookingDuration
+	}
+	if req.ClassroomId != "" && req.ClassroomId != b.BookingClassroomId {
+		// Seats are counted anew in the new classroom.
+		b.BookingClassroomId = req.ClassroomId
+		b.BookingSeats = 0
+	}
+	if req.Seats != nil {
+		b.BookingSeats = *req.Seats
+	}
+	return b
+}
+
+// rejectReschedule checks moving b to moved as a new booking is checked:
+// the booker mustn't be blocked, the week of moved must have quota left,
+// with added and removed as in applyBatchQuota, and moved must keep to
+// the room policy of its classroom. Leaving a slot inside
+// CANCEL_MIN_NOTICE is refused as cancelling it would be. It writes the
+// error and returns true if the move can't be made.
+func rejectReschedule(w http.ResponseWriter, r *http.Request, b booking, moved *booking, override bool, added []booking, removed []booking) bool {
+	if override && !canOverrideNotice(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return true
+	}
+	leaves := moved.BookingTime != b.BookingTime || moved.BookingDuration != b.BookingDuration || moved.BookingClassroomId != b.BookingClassroomId
+	if notice := insideCancelNotice(b, time.Now()); leaves && notice > 0 && !override {
+		writeError(w, r, http.StatusConflict, "cancel_notice", "minutes", strconv.Itoa(int(notice.Minutes())))
+		return true
+	}
+	standing, err := getStanding(moved.BookingBookerId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return true
+	}
+	if standing.Status == standingBlocked {
+		writeBlocked(w, r, standing)
+		return true
+	}
+	return applyBatchQuota(w, r, *moved, added, removed) || applyRoomPolicy(w, r, moved)
+}
+
+// errRescheduleConflict is returned by moveBooking with the bookings the
+// move collides with.
+var errRescheduleConflict = fmt.Errorf("%w: booking overlaps another booking", errConflict)
+
+// moveBooking updates the time, duration, classroom, seats and status of b
+// in one transaction. The bookings that could overlap it in its new
+// classroom are locked first, so a concurrent booking can't take the slot
+// between the check and the update.
+func moveBooking(b booking) ([]booking, error) {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	tx, err := Db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if conflicts, err := moveBookingTx(ctx, tx, b); err != nil {
+		return conflicts, err
+	}
+	return nil, tx.Commit()
+}
+
+// moveBookingTx is moveBooking within tx.
+func moveBookingTx(ctx context.Context, tx *sql.Tx, b booking) ([]booking, error) {
+	conflicts, err := lockedConflicts(ctx, tx, b)
+	if errors.Is(err, errNoSeats) {
+		return nil, errRescheduleConflict
+	} else if err != nil {
+		return nil, err
+	}
+	if len(conflicts) > 0 {
+		return conflicts, errRescheduleConflict
+	}
+	where, whereArgs := whereClause([]condition{colBookingId.eq(b.BookingId)})
+	_, err = tx.ExecContext(ctx, `UPDATE booking SET booking_time = ?, booking_duration = ?, booking_classroom_id = ?, booking_status = ?, booking_seats = ?`+where,
+		append([]interface{}{b.BookingTime, b.BookingDuration, b.BookingClassroomId, b.BookingStatus, b.BookingSeats}, whereArgs...)...)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return nil, err
+}
+
+// handlerBookingReschedule serves POST /api/bookings/{id}/reschedule. The
+// booking keeps its id, title and booker; the new slot is checked against
+// other bookings and holds, and by rejectReschedule, as a new booking
+// would be.
+func handlerBookingReschedule(w http.ResponseWriter, r *http.Request, store BookingRepository, b booking) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var request rescheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_body")
+		return
+	}
+	moved := request.apply(b)
+	if request.BookingTime != "" && applyBookingTime(w, r, &moved, request.TimeZone) {
+		return
+	}
+	if moved.BookingDuration < 0 {
+		writeError(w, r, http.StatusBadRequest, "invalid_booking_time")
+		return
+	}
+	if _, _, err := bookingWindow(moved); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_booking_time")
+		return
+	}
+	if rejectReschedule(w, r, b, &moved, request.Override, nil, nil) {
+		return
+	}
+	holds, err := findHoldConflicts(moved)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	if len(holds) > 0 {
+		writeConflict(w, r, moved, nil)
+		return
+	}
+	conflicts, err := moveBooking(moved)
+	if isConflict(err) {
+		writeConflict(w, r, moved, conflicts)
+		return
+	} else if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	if updated, err := store.GetBooking(b.BookingId); err == nil && updated != nil {
+		moved = *updated
+	}
+	recordAudit(r, "booking.reschedule", "booking", b.publicId(), map[string]interface{}{
+		"from": newBookingResponse(b),
+		"to":   newBookingResponse(moved),
+	})
+	moved.ActedBy = actedBy(r)
+	moved.RequestId = requestIdOf(r)
+	moved.Tenant = tenantOf(r)
+	moved.Previous = &b
+	if err := dispatchBookingEvent(eventBookingRescheduled, moved); err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	j, err := json.Marshal(bookingBody(w, r, moved))
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Bookings older than RETENTION_DAYS are moved out of the booking table by a
+// daily job, either into booking_archive (RETENTION_ARCHIVE=table, the
+// default) or into gzipped NDJSON files under RETENTION_ARCHIVE_DIR
+// (RETENTION_ARCHIVE=file). Retention is off unless RETENTION_DAYS is set;
+// any other archive mode stops serve from starting, rather than bookings
+// being deleted unarchived.
+
+const retentionBatchSize = 1000
+
+const (
+	archiveTable = "table"
+	archiveFile  = "file"
+)
+
+// checkArchiveMode fails unless mode is an archive mode.
+func checkArchiveMode(mode string) error {
+	if mode != archiveTable && mode != archiveFile {
+		return fmt.Errorf("RETENTION_ARCHIVE=%q is neither table nor file", mode)
+	}
+	return nil
+}
+
+func startRetentionJob() {
+	days := envInt("RETENTION_DAYS", 0)
+	if days <= 0 {
+		return
+	}
+	if err := checkArchiveMode(envString("RETENTION_ARCHIVE", archiveTable)); err != nil {
+		log.Fatal(err)
+	}
+	startJob("retention", envDuration("RETENTION_INTERVAL", 24*time.Hour), func() {
+		cutoff := time.Now().In(bookingLocation).AddDate(0, 0, -days).Format(bookingDateLayout)
+		archived, err := archiveBookings(cutoff, envString("RETENTION_ARCHIVE", archiveTable))
+		if err != nil {
+			log.Printf("retention: %v", err)
+		}
+		if archived > 0 {
+			log.Printf("retention: archived %d bookings before %s", archived, cutoff)
+		}
+	})
+}
+
+// archiveBookings moves every booking dated before cutoff in batches, so a
+// large backlog doesn't hold locks on the booking table for long.
+func archiveBookings(cutoff string, mode string) (int, error) {
+	if err := checkArchiveMode(mode); err != nil {
+		return 0, err
+	}
+	total := 0
+	for {
+		bookings, err := getBookingsBefore(cutoff, retentionBatchSize)
+		if err != nil || len(bookings) == 0 {
+			return total, err
+		}
+		if mode == archiveFile {
+			if err := writeArchiveFile(bookings); err != nil {
+				return total, err
+			}
+		}
+		if err := moveBookings(bookings, mode == archiveTable); err != nil {
+			return total, err
+		}
+		total += len(bookings)
+	}
+}
+
+func getBookingsBefore(cutoff string, limit int) ([]booking, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT `+bookingColumns+`, booking_tenant FROM booking WHERE LEFT(TRIM(booking_time), 10) < ? ORDER BY booking_id LIMIT ?`, cutoff, limit)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	bookings := make([]booking, 0, limit)
+	for results.Next() {
+		var b booking
+		if err := results.Scan(append(b.scanFields(), &b.Tenant)...); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		bookings = append(bookings, b)
+	}
+	return bookings, results.Err()
+}
+
+func moveBookings(bookings []booking, toTable bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	ids := make([]interface{}, len(bookings))
+	for i, b := range bookings {
+		ids[i] = b.BookingId
+	}
+	in := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	tx, err := Db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if toTable {
+		_, err := tx.ExecContext(ctx, `INSERT IGNORE INTO booking_archive (`+bookingColumns+`, booking_tenant, booking_checked_in_at, archived_at)
+			SELECT `+bookingColumns+`, booking_tenant, booking_checked_in_at, UTC_TIMESTAMP() FROM booking WHERE booking_id IN (`+in+`)`, ids...)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM booking WHERE booking_id IN (`+in+`)`, ids...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// archivedBooking is a line of an archive file: the booking as the API
+// answers it, with the tenant it was booked for.
+type archivedBooking struct {
+	bookingResponse
+	Tenant string `json:"tenant"`
+}
+
+func writeArchiveFile(bookings []booking) error {
+	dir := envString("RETENTION_ARCHIVE_DIR", "archive")
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	name := filepath.Join(dir, fmt.Sprintf("bookings-%s-%d.ndjson.gz", time.Now().UTC().Format("20060102T150405"), bookings[0].BookingId))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	encoder := json.NewEncoder(gz)
+	for _, b := range bookings {
+		if err := encoder.Encode(archivedBooking{newBookingResponse(b), b.tenant()}); err != nil {
+			return err
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A route is one resource path and the methods it serves. {name} matches a
+// single path segment. Scopes says who each method is for, in the order of
+// Methods, or one scope for all of them; the role scoped OpenAPI documents
+// are built from it.
+type route struct {
+	Pattern string
+	Methods []string
+	Scopes  []apiScope
+}
+
+// A routeInfo is a route as the index and the OpenAPI documents describe
+// it: Name identifies it, and with the method its OpenAPI operation; Roles
+// are the API key roles its mount requires.
+type routeInfo struct {
+	route
+	Name  string
+	Roles []string
+}
+
+// An apiScope is an audience of the API. Each includes the ones before it:
+// students can call public routes, admins, managers and displays all
+// routes.
+type apiScope string
+
+const (
+	scopePublic  apiScope = "public"
+	scopeStudent apiScope = "student"
+	scopeAdmin   apiScope = "admin"
+)
+
+var apiScopes = []apiScope{scopePublic, scopeStudent, scopeAdmin}
+
+// A mount is a handler registered on a ServeMux path together with the
+// routes it serves. Internal mounts go on the operational listener.
+// MaxInFlight caps the mount's concurrent requests, 0 leaving only the
+// global cap. SloLatency overrides SLO_LATENCY for the mount's routes, see
+// slo.go. Cache makes the mount's GET responses cacheable by a CDN, see
+// cache.go. LongPoll mounts hold requests open until there is something to
+// answer: they are left out of the global cap and the latency objective.
+// Roles, if any, are the API key roles every route of the mount requires;
+// handlers check finer grained access themselves.
+type mount struct {
+	Path        string
+	Handler     http.Handler
+	Internal    bool
+	MaxInFlight int
+	SloLatency  time.Duration
+	Cache       cachePolicy
+	LongPoll    bool
+	Roles       []string
+	Routes      []route
+}
+
+// routes returns the routes of m with their names and roles.
+func (m mount) routes(apiBasePath string) []routeInfo {
+	routes := make([]routeInfo, len(m.Routes))
+	for i, rt := range m.Routes {
+		routes[i] = routeInfo{rt, routeName(apiBasePath, rt.Pattern), m.Roles}
+	}
+	return routes
+}
+
+// routeName names a route after the segments of its pattern below the API
+// base path, a {booking_id} segment as booking: /api/bookings/{booking_id}/qr
+// is bookings.booking.qr. The base path itself is the index.
+func routeName(apiBasePath string, pattern string) string {
+	rest := strings.Trim(strings.TrimPrefix(pattern, apiBasePath), "/")
+	if rest == "" {
+		return "index"
+	}
+	segments := strings.Split(rest, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			segments[i] = strings.TrimSuffix(strings.Trim(segment, "{}"), "_id")
+		} else {
+			segments[i] = strings.TrimSuffix(segment, ".json")
+		}
+	}
+	return strings.Join(segments, ".")
+}
+
+// operationId names method on rt in OpenAPI documents.
+func (rt routeInfo) operationId(method string) string {
+	return strings.ToLower(method) + "." + rt.Name
+}
+
+func methods(m ...string) []string {
+	return m
+}
+
+func scopes(s ...apiScope) []apiScope {
+	return s
+}
+
+// includes reports whether callers of scope can use routes of other.
+func (scope apiScope) includes(other apiScope) bool {
+	for _, s := range apiScopes {
+		if s == other {
+			return true
+		}
+		if s == scope {
+			return false
+		}
+	}
+	return false
+}
+
+// scope returns the scope of method on rt.
+func (rt route) scope(method string) apiScope {
+	if len(rt.Scopes) == 1 {
+		return rt.Scopes[0]
+	}
+	for i, m := range rt.Methods {
+		if m == method && i < len(rt.Scopes) {
+			return rt.Scopes[i]
+		}
+	}
+	return scopeAdmin
+}
+
+// routeTable lists every mount the service serves under apiBasePath.
+func routeTable(apiBasePath string) []mount {
+	api := func(segments ...string) string {
+		return apiBasePath + "/" + strings.Join(segments, "/")
+	}
+	booking := api(bookingPath, "{booking_id}")
+	booker := api(bookerPath, "{booker_id}")
+	building := api(buildingPath, "{building_id}")
+	classroom := api(classroomPath, "{classroom_id}")
+	group := api(groupPath, "{group_id}")
+	admin := api(adminPath)
+	return []mount{
+		{Path: apiBasePath, Handler: handlerIndex(apiBasePath), Cache: cachePolicy{5 * time.Minute, "index"}, Routes: []route{
+			{apiBasePath, methods(http.MethodGet), scopes(scopePublic)},
+		}},
+		{Path: api(openApiPath), Handler: handlerOpenApi(apiBasePath), Cache: cachePolicy{5 * time.Minute, "index"}, Routes: []route{
+			{api(openApiPath), methods(http.MethodGet), scopes(scopePublic)},
+		}},
+		{Path: api(subscriptionPath) + "/", Handler: http.HandlerFunc(handlerSubscriptionSocket), MaxInFlight: 256, LongPoll: true, Routes: []route{
+			{api(subscriptionPath, "{subscription_id}", subscriptionSocketPath), methods(http.MethodGet), scopes(scopeStudent)},
+		}},
+		{Path: api(bookingPath, changesPath), Handler: http.HandlerFunc(handlerBookingChanges), MaxInFlight: 256, LongPoll: true, Routes: []route{
+			{api(bookingPath, changesPath), methods(http.MethodGet), scopes(scopeStudent)},
+		}},
+		{Path: api(bookingPath) + "/", Handler: http.HandlerFunc(handlerBooking), Routes: []route{
+			{api(bookingPath, validatePath), methods(http.MethodPost), scopes(scopeStudent)},
+			{api(bookingPath, autoPath), methods(http.MethodPost), scopes(scopeStudent)},
+			{api(bookingPath, importPath), methods(http.MethodPost), scopes(scopeStudent)},
+			{api(bookingPath, exportPath), methods(http.MethodGet), scopes(scopeStudent)},
+			{booking, methods(http.MethodGet, http.MethodDelete), scopes(scopeStudent)},
+			{booking + "/" + qrPath, methods(http.MethodGet), scopes(scopeStudent)},
+			{booking + "/" + approvePath, methods(http.MethodPost), scopes(scopeAdmin)},
+			{booking + "/" + historyPath, methods(http.MethodGet), scopes(scopeStudent)},
+			{booking + "/" + receiptPath, methods(http.MethodGet), scopes(scopeStudent)},
+			{booking + "/" + cancelPath, methods(http.MethodPost), scopes(scopeStudent)},
+			{booking + "/" + reschedulePath, methods(http.MethodPost), scopes(scopeStudent)},
+		}},
+		{Path: api(bookingPath), Handler: http.HandlerFunc(handlerBookings), MaxInFlight: 8, Routes: []route{
+			{api(bookingPath), methods(http.MethodGet, http.MethodPost, http.MethodDelete), scopes(scopeStudent, scopeStudent, scopeAdmin)},
+		}},
+		{Path: api(batchPath), Handler: http.HandlerFunc(handlerBatch), MaxInFlight: 8, Routes: []route{
+			{api(batchPath), methods(http.MethodPost), scopes(scopeStudent)},
+		}},
+		{Path: api(receiptsPath) + "/", Handler: http.HandlerFunc(handlerReceipts), Routes: []route{
+			{api(receiptsPath, receiptKeysPath), methods(http.MethodGet), scopes(scopePublic)},
+			{api(receiptsPath, receiptVerifyPath), methods(http.MethodPost), scopes(scopePublic)},
+		}},
+		{Path: api(bookerPath) + "/", Handler: http.HandlerFunc(handlerBooker), Routes: []route{
+			{booker, methods(http.MethodGet), scopes(scopeStudent)},
+			{booker + "/" + templatePath, methods(http.MethodGet, http.MethodPost), scopes(scopeStudent)},
+			{booker + "/" + templatePath + "/{template_id}", methods(http.MethodGet, http.MethodDelete), scopes(scopeStudent)},
+			{booker + "/" + templatePath + "/{template_id}/book", methods(http.MethodPost), scopes(scopeStudent)},
+			{booker + "/" + favoritePath, methods(http.MethodGet, http.MethodPost), scopes(scopeStudent)},
+			{booker + "/" + favoritePath + "/{classroom_id}", methods(http.MethodPut, http.MethodDelete), scopes(scopeStudent)},
+			{booker + "/" + preferencePath, methods(http.MethodGet, http.MethodPut), scopes(scopeStudent)},
+			{booker + "/" + standingPath, methods(http.MethodGet), scopes(scopeStudent)},
+			{booker + "/" + agendaPath, methods(http.MethodGet), scopes(scopeStudent)},
+			{booker + "/" + exportPath, methods(http.MethodGet), scopes(scopeStudent)},
+			{booker + "/" + dataPath, methods(http.MethodDelete), scopes(scopeStudent)},
+			{booker + "/" + waitlistPath, methods(http.MethodGet), scopes(scopeStudent)},
+			{booker + "/" + waitlistPath + "/{waitlist_id}", methods(http.MethodDelete), scopes(scopeStudent)},
+			{booker + "/" + seriesPath, methods(http.MethodGet), scopes(scopeStudent)},
+			{booker + "/" + seriesPath + "/{series_id}", methods(http.MethodGet), scopes(scopeStudent)},
+			{booker + "/" + usageForecastPath, methods(http.MethodGet), scopes(scopeStudent)},
+		}},
+		{Path: api(buildingPath) + "/", Handler: http.HandlerFunc(handlerBuilding), Cache: cachePolicy{5 * time.Minute, buildingPath}, Routes: []route{
+			{building, methods(http.MethodGet, http.MethodDelete), scopes(scopePublic, scopeAdmin)},
+			{building + "/" + floorPath, methods(http.MethodGet, http.MethodPost), scopes(scopePublic, scopeAdmin)},
+		}},
+		{Path: api(buildingPath), Handler: http.HandlerFunc(handlerBuildings), Cache: cachePolicy{5 * time.Minute, buildingPath}, Routes: []route{
+			{api(buildingPath), methods(http.MethodGet, http.MethodPost), scopes(scopePublic, scopeAdmin)},
+		}},
+		{Path: api(classroomPath) + "/", Handler: http.HandlerFunc(handlerClassroom), Cache: cachePolicy{time.Minute, classroomPath}, Routes: []route{
+			{classroom, methods(http.MethodGet, http.MethodPut), scopes(scopePublic, scopeAdmin)},
+			{classroom + "/" + preferencePath, methods(http.MethodGet, http.MethodPut), scopes(scopeAdmin)},
+			{classroom + "/" + calendarPath, methods(http.MethodGet, http.MethodPut), scopes(scopeAdmin)},
+			{classroom + "/" + doorPath, methods(http.MethodGet, http.MethodPut), scopes(scopeAdmin)},
+			{classroom + "/" + policyPath, methods(http.MethodGet, http.MethodPut), scopes(scopePublic, scopeAdmin)},
+			{classroom + "/" + occupancyPath, methods(http.MethodGet), scopes(scopePublic)},
+			{classroom + "/" + scheduleViewPath, methods(http.MethodGet), scopes(scopeStudent)},
+			{classroom + "/" + schedulePdfPath, methods(http.MethodGet), scopes(scopePublic)},
+			{classroom + "/" + photoPath, methods(http.MethodGet, http.MethodPut, http.MethodDelete), scopes(scopePublic, scopeAdmin, scopeAdmin)},
+			{classroom + "/" + metadataPath, methods(http.MethodGet, http.MethodPut), scopes(scopePublic, scopeAdmin)},
+			{classroom + "/" + featuresPath, methods(http.MethodGet, http.MethodPut), scopes(scopePublic, scopeAdmin)},
+			{classroom + "/" + subscriptionPath, methods(http.MethodGet, http.MethodPost), scopes(scopeStudent)},
+			{classroom + "/" + subscriptionPath + "/{subscription_id}", methods(http.MethodDelete), scopes(scopeStudent)},
+			{classroom + "/" + subscriptionPath + "/{subscription_id}/" + subscriptionConfirmPath, methods(http.MethodPost), scopes(scopeStudent)},
+			{classroom + "/" + managerPath, methods(http.MethodGet), scopes(scopeAdmin)},
+			{classroom + "/" + managerPath + "/{department_id}", methods(http.MethodPut, http.MethodDelete), scopes(scopeAdmin)},
+		}},
+		{Path: api(classroomPath), Handler: http.HandlerFunc(handlerClassrooms), Cache: cachePolicy{time.Minute, classroomPath}, Routes: []route{
+			{api(classroomPath), methods(http.MethodGet), scopes(scopePublic)},
+		}},
+		{Path: api(groupPath) + "/", Handler: http.HandlerFunc(handlerGroup), Routes: []route{
+			{group, methods(http.MethodGet, http.MethodDelete), scopes(scopeStudent)},
+			{group + "/" + memberPath, methods(http.MethodGet), scopes(scopeStudent)},
+			{group + "/" + memberPath + "/{booker_id}", methods(http.MethodPut, http.MethodDelete), scopes(scopeStudent)},
+		}},
+		{Path: api(groupPath), Handler: http.HandlerFunc(handlerGroups), Routes: []route{
+			{api(groupPath), methods(http.MethodGet, http.MethodPost), scopes(scopeStudent)},
+		}},
+		{Path: api(bootstrapPath), Handler: http.HandlerFunc(handlerBootstrap), Routes: []route{
+			{api(bootstrapPath), methods(http.MethodPost), scopes(scopeAdmin)},
+		}},
+		{Path: api(checkinPath), Handler: http.HandlerFunc(handlerCheckin), Routes: []route{
+			{api(checkinPath), methods(http.MethodPost), scopes(scopeStudent)},
+		}},
+		{Path: api(checkinsPath, batchPath), Handler: http.HandlerFunc(handlerCheckinBatch), MaxInFlight: 8, Routes: []route{
+			{api(checkinsPath, batchPath), methods(http.MethodPost), scopes(scopeStudent)},
+		}},
+		{Path: api(publicPath, classroomPath) + "/", Handler: http.HandlerFunc(handlerPublic), Cache: cachePolicy{30 * time.Second, classroomPath}, Routes: []route{
+			{api(publicPath, classroomPath, "{classroom_id}", scheduleViewPath), methods(http.MethodGet), scopes(scopePublic)},
+		}},
+		{Path: api(displayPath) + "/", Handler: http.HandlerFunc(handlerDisplay), Roles: []string{roleDisplay}, Routes: []route{
+			{api(displayPath, classroomPath, "{classroom_id}", "now"), methods(http.MethodGet), scopes(scopeAdmin)},
+		}},
+		{Path: api(calendarPath), Handler: http.HandlerFunc(handlerCalendarOverlay), Roles: []string{roleDisplay, roleAdmin, roleManager}, Routes: []route{
+			{api(calendarPath), methods(http.MethodGet), scopes(scopeAdmin)},
+		}},
+		{Path: api(reportPath) + "/", Handler: http.HandlerFunc(handlerReports), Roles: []string{roleAdmin, roleManager}, MaxInFlight: 2, SloLatency: 2500 * time.Millisecond, Routes: []route{
+			{api(reportPath, "heatmap"), methods(http.MethodGet), scopes(scopeAdmin)},
+		}},
+		{Path: api(eventsPath), Handler: http.HandlerFunc(handlerEvents), Roles: []string{roleAdmin}, Routes: []route{
+			{api(eventsPath), methods(http.MethodGet), scopes(scopeAdmin)},
+		}},
+		{Path: api(holdPath) + "/", Handler: http.HandlerFunc(handlerHold), Routes: []route{
+			{api(holdPath, "{hold_id}"), methods(http.MethodGet, http.MethodDelete), scopes(scopeStudent)},
+			{api(holdPath, "{hold_id}", "confirm"), methods(http.MethodPost), scopes(scopeStudent)},
+		}},
+		{Path: api(holdPath), Handler: http.HandlerFunc(handlerHolds), Routes: []route{
+			{api(holdPath), methods(http.MethodPost), scopes(scopeStudent)},
+		}},
+		{Path: api(availabilityPath), Handler: http.HandlerFunc(handlerAvailability), MaxInFlight: 8, Cache: cachePolicy{30 * time.Second, availabilityPath}, Routes: []route{
+			{api(availabilityPath), methods(http.MethodGet), scopes(scopePublic)},
+		}},
+		{Path: api(availabilityPath) + "/", Handler: http.HandlerFunc(handlerAvailabilityQuery), MaxInFlight: 4, SloLatency: time.Second, Routes: []route{
+			{api(availabilityPath, "query"), methods(http.MethodPost), scopes(scopePublic)},
+		}},
+		{Path: admin + "/", Handler: http.HandlerFunc(handlerAdmin), Roles: []string{roleAdmin}, Internal: true, Routes: []route{
+			{admin + "/backup", methods(http.MethodPost), scopes(scopeAdmin)},
+			{admin + "/maintenance", methods(http.MethodGet, http.MethodPut), scopes(scopeAdmin)},
+			{admin + "/" + flagPath, methods(http.MethodGet), scopes(scopeAdmin)},
+			{admin + "/" + flagPath + "/{flag_name}", methods(http.MethodPut), scopes(scopeAdmin)},
+			{admin + "/reload", methods(http.MethodPost), scopes(scopeAdmin)},
+			{admin + "/usage", methods(http.MethodGet), scopes(scopeAdmin)},
+			{admin + "/" + sloRulesPath, methods(http.MethodGet), scopes(scopeAdmin)},
+			{admin + "/" + perfPath, methods(http.MethodGet), scopes(scopeAdmin)},
+			{admin + "/" + schemaPath, methods(http.MethodGet, http.MethodPost), scopes(scopeAdmin)},
+			{admin + "/" + cachePath + "/purge", methods(http.MethodPost), scopes(scopeAdmin)},
+			{admin + "/" + auditPath + "/" + exportPath, methods(http.MethodGet), scopes(scopeAdmin)},
+			{admin + "/" + exportPath + "/" + exportBookingsPath, methods(http.MethodGet), scopes(scopeAdmin)},
+			{admin + "/" + exportPath + "/" + exportBookingsPath + "/{snapshot_id}", methods(http.MethodGet), scopes(scopeAdmin)},
+			{admin + "/" + exportPath + "/" + exportBookingsPath + "/{snapshot_id}/" + manifestPath, methods(http.MethodGet), scopes(scopeAdmin)},
+			{admin + "/" + notificationTemplatesPath, methods(http.MethodGet), scopes(scopeAdmin)},
+			{admin + "/" + notificationTemplatesPath + "/" + previewPath, methods(http.MethodGet), scopes(scopeAdmin)},
+		}},
+		{Path: adminUiPath, Handler: handlerAdminUi(apiBasePath), Internal: true, Routes: []route{
+			{adminUiPath, methods(http.MethodGet), scopes(scopeAdmin)},
+			{adminUiPath + "{asset}", methods(http.MethodGet), scopes(scopeAdmin)},
+		}},
+	}
+}
+
+// operationalRoutes are served without CORS: /healthz and /readyz on every
+// listener, /metrics on the internal one.
+func operationalRoutes() []mount {
+	return []mount{
+		{Path: "/healthz", Handler: http.HandlerFunc(handlerHealthz), Routes: []route{{"/healthz", methods(http.MethodGet), scopes(scopePublic)}}},
+		{Path: "/readyz", Handler: http.HandlerFunc(handlerReadyz), Routes: []route{{"/readyz", methods(http.MethodGet), scopes(scopePublic)}}},
+		{Path: "/metrics", Handler: http.HandlerFunc(handlerMetrics), Internal: true, Routes: []route{{"/metrics", methods(http.MethodGet), scopes(scopeAdmin)}}},
+	}
+}
+
+func (rt route) matches(path string) bool {
+	patternSegments := strings.Split(strings.Trim(rt.Pattern, "/"), "/")
+	pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(patternSegments) != len(pathSegments) {
+		return false
+	}
+	for i, segment := range patternSegments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if pathSegments[i] == "" {
+				return false
+			}
+		} else if segment != pathSegments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// allow lists the methods of rt as sent in Allow headers.
+func (rt route) allow() string {
+	allowed := append([]string{}, rt.Methods...)
+	for _, method := range rt.Methods {
+		if method == http.MethodGet {
+			allowed = append(allowed, http.MethodHead)
+		}
+	}
+	return strings.Join(append(allowed, http.MethodOptions), ", ")
+}
+
+func (rt route) allows(method string) bool {
+	for _, m := range rt.Methods {
+		if m == method || method == http.MethodHead && m == http.MethodGet {
+			return true
+		}
+	}
+	return false
+}
+
+type routeKey struct{}
+
+// withRoute records the route pattern serving r in its context, for the
+// audit log.
+func withRoute(r *http.Request, pattern string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), routeKey{}, pattern))
+}
+
+// routeMiddleware answers OPTIONS from the route table, rejects methods a
+// route doesn't serve with 405 and serves HEAD through the GET handler.
+// Paths no route matches are left to the handler. Requests are counted per
+// route pattern, or per mount when none matches.
+func routeMiddleware(m mount, cors bool, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var matched *route
+		for i := range m.Routes {
+			if m.Routes[i].matches(r.URL.Path) {
+				matched = &m.Routes[i]
+				break
+			}
+		}
+		pattern := m.Path
+		if matched != nil {
+			pattern = matched.Pattern
+		}
+		r = withRoute(r, pattern)
+		sw := &statusWriter{ResponseWriter: w}
+		defer observeRequest(pattern, r.Method, sw, time.Now())
+		w = sw
+		if matched == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Allow", matched.allow())
+		switch {
+		case r.Method == http.MethodOptions:
+			if cors {
+				addCorsHeaders(w, r)
+				w.Header().Set("Access-Control-Allow-Methods", matched.allow())
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case !matched.allows(r.Method):
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case r.Method == http.MethodHead:
+			serveHead(w, r, handler)
+		default:
+			handler.ServeHTTP(w, r)
+		}
+	})
+}
+
+// headWriter discards the body of a GET response, counting it so HEAD can
+// answer with the Content-Length the GET would have had.
+type headWriter struct {
+	header http.Header
+	status int
+	length int
+}
+
+func (hw *headWriter) Header() http.Header {
+	return hw.header
+}
+
+func (hw *headWriter) WriteHeader(status int) {
+	if hw.status == 0 {
+		hw.status = status
+	}
+}
+
+func (hw *headWriter) Write(p []byte) (int, error) {
+	if hw.status == 0 {
+		hw.status = http.StatusOK
+	}
+	hw.length += len(p)
+	return len(p), nil
+}
+
+func serveHead(w http.ResponseWriter, r *http.Request, handler http.Handler) {
+	hw := &headWriter{header: w.Header()}
+	get := r.Clone(r.Context())
+	get.Method = http.MethodGet
+	handler.ServeHTTP(hw, get)
+	if hw.status == 0 {
+		hw.status = http.StatusOK
+	}
+	if w.Header().Get("Content-Length") == "" {
+		w.Header().Set("Content-Length", strconv.Itoa(hw.length))
+	}
+	w.WriteHeader(hw.status)
+}
+
+// apiMiddleware wraps the handlers of API mounts. Files behind build tags
+// add to it, e.g. chaos.
+var apiMiddleware []func(m mount, handler http.Handler) http.Handler
+
+// middleware is the chain m's handler is served through, first outermost.
+// Every mount gets request ids, the route table's method handling and
+// metrics, and the journal. API mounts also get the CORS, content type and
+// caching headers and are shed under load; operational ones are always
+// answered. The mount's roles are checked last.
+func (m mount) middleware(cors bool) []func(http.Handler) http.Handler {
+	chain := []func(http.Handler) http.Handler{
+		requestIdMiddleware,
+		func(handler http.Handler) http.Handler { return routeMiddleware(m, cors, handler) },
+		journalMiddleware,
+	}
+	if cors {
+		chain = append(chain,
+			corsMiddleware,
+			contentTypeMiddleware,
+			func(handler http.Handler) http.Handler { return cacheMiddleware(m, handler) },
+			func(handler http.Handler) http.Handler { return shedMiddleware(m, handler) },
+		)
+		for i := len(apiMiddleware) - 1; i >= 0; i-- {
+			middleware := apiMiddleware[i]
+			chain = append(chain, func(handler http.Handler) http.Handler { return middleware(m, handler) })
+		}
+	}
+	if len(m.Roles) > 0 {
+		chain = append(chain, func(handler http.Handler) http.Handler { return requireApiKey(handler, m.Roles...) })
+	}
+	return chain
+}
+
+// register adds m to mux, served through its middleware.
+func (m mount) register(mux *http.ServeMux, cors bool) {
+	handler := m.Handler
+	chain := m.middleware(cors)
+	for i := len(chain) - 1; i >= 0; i-- {
+		handler = chain[i](handler)
+	}
+	mux.Handle(m.Path, handler)
+}
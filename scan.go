@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// bookingField maps a booking field to its column so list queries can
+// select and scan a subset of columns. name is the key in bookingResponse,
+// legacyName the one in legacyBookingResponse; the integer id is only
+// served in the legacy schema.
+type bookingField struct {
+	name       string
+	legacyName string
+	column     string
+	target     func(b *booking) interface{}
+}
+
+var bookingFields = []bookingField{
+	{"booking_id", "BookingPublicId", "booking_public_id", func(b *booking) interface{} { return sqlString{&b.BookingPublicId} }},
+	{"", "BookingId", "booking_id", func(b *booking) interface{} { return &b.BookingId }},
+	{"booking_time", "BookingTime", "booking_time", func(b *booking) interface{} { return &b.BookingTime }},
+	{"classroom_id", "BookingClassroomId", "booking_classroom_id", func(b *booking) interface{} { return &b.BookingClassroomId }},
+	{"booker_id", "BookingBookerId", "booking_student_id", func(b *booking) interface{} { return &b.BookingBookerId }},
+	{"booking_duration", "BookingDuration", "booking_duration", func(b *booking) interface{} { return &b.BookingDuration }},
+	{"booking_title", "BookingTitle", "booking_title", func(b *booking) interface{} { return &b.BookingTitle }},
+	{"booking_status", "BookingStatus", "booking_status", func(b *booking) interface{} { return &b.BookingStatus }},
+	{"updated_at", "BookingUpdatedAt", "booking_updated_at", func(b *booking) interface{} { return sqlTime{&b.BookingUpdatedAt} }},
+	{"seats", "BookingSeats", "booking_seats", func(b *booking) interface{} { return &b.BookingSeats }},
+	{"group_id", "BookingGroupId", "booking_group_id", func(b *booking) interface{} { return sqlString{&b.BookingGroupId} }},
+	{"priority", "BookingPriority", "booking_priority", func(b *booking) interface{} { return &b.BookingPriority }},
+}
+
+// projectBookingFields returns the fields named in names, under either
+// schema, or every field when names is empty.
+func projectBookingFields(names []string) ([]bookingField, error) {
+	if len(names) == 0 {
+		return bookingFields, nil
+	}
+	fields := make([]bookingField, 0, len(names))
+	for _, name := range names {
+		found := false
+		for _, field := range bookingFields {
+			if name != "" && (field.name == name || strings.EqualFold(field.legacyName, name)) {
+				fields = append(fields, field)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, validationError{Fields: []string{"fields"}}
+		}
+	}
+	return fields, nil
+}
+
+func bookingFieldColumns(fields []bookingField) string {
+	columns := make([]string, len(fields))
+	for i, field := range fields {
+		columns[i] = field.column
+	}
+	return strings.Join(columns, ", ")
+}
+
+// qualifiedColumns is columns, a comma separated list, each prefixed with
+// the table alias, for joins.
+func qualifiedColumns(alias string, columns string) string {
+	qualified := strings.Split(columns, ",")
+	for i, column := range qualified {
+		qualified[i] = alias + "." + strings.TrimSpace(column)
+	}
+	return strings.Join(qualified, ", ")
+}
+
+var dbScanErrorsTotal = newCounter("db_scan_errors_total", "Rows that failed to scan and result sets cut short by an iteration error, by query.", "query")
+
+// scanBookings reads every row into a slice sized from sizeHint, reusing
+// one set of scan targets across rows, and reports Scan and iteration
+// errors instead of returning a silently truncated list or zero-valued
+// bookings: a row that doesn't scan fails the whole list, naming the row
+// and the fields read, and counts in db_scan_errors_total.
+func scanBookings(rows *sql.Rows, fields []bookingField, sizeHint int) ([]booking, error) {
+	bookings := make([]booking, 0, sizeHint)
+	targets := make([]interface{}, len(fields))
+	for rows.Next() {
+		bookings = append(bookings, booking{})
+		b := &bookings[len(bookings)-1]
+		for i, field := range fields {
+			targets[i] = field.target(b)
+		}
+		if err := rows.Scan(targets...); err != nil {
+			dbScanErrorsTotal.Inc("bookings")
+			return nil, fmt.Errorf("booking row %d (%s): %w", len(bookings), bookingFieldColumns(fields), err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		dbScanErrorsTotal.Inc("bookings")
+		return nil, err
+	}
+	return bookings, nil
+}
+
+// projectBooking keeps only the selected fields of b for a JSON response.
+func projectBooking(b *booking, fields []bookingField, legacy bool) map[string]interface{} {
+	projected := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		if legacy {
+			projected[field.legacyName] = field.target(b)
+		} else {
+			projected[field.name] = field.target(b)
+		}
+	}
+	return projected
+}
+
+// bookingListSizeHint remembers the size of the last booking list so
+// the next one starts with a slice of about the right capacity instead of
+// growing through repeated appends.
+var bookingListSizeHint atomic.Int64
+
+// sqlTime scans a DATETIME into a UTC time.Time; the DSN leaves parseTime
+// off, so the driver hands datetimes over as text.
+type sqlTime struct {
+	t *time.Time
+}
+
+const sqlTimeLayout = "2006-01-02 15:04:05.999999"
+
+func (s sqlTime) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*s.t = time.Time{}
+	case time.Time:
+		*s.t = v.UTC()
+	case []byte:
+		return s.Scan(string(v))
+	case string:
+		t, err := time.ParseInLocation(sqlTimeLayout, v, time.UTC)
+		if err != nil {
+			return err
+		}
+		*s.t = t
+	default:
+		return fmt.Errorf("cannot scan %T into a time", value)
+	}
+	return nil
+}
+
+func (s sqlTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(*s.t)
+}
+
+// sqlString scans a nullable text column, NULL becoming "".
+type sqlString struct {
+	s *string
+}
+
+func (s sqlString) Scan(value interface{}) error {
+	var v sql.NullString
+	if err := v.Scan(value); err != nil {
+		return err
+	}
+	*s.s = v.String
+	return nil
+}
+
+func (s sqlString) MarshalJSON() ([]byte, error) {
+	return json.Marshal(*s.s)
+}
+
+// sqlInt scans a nullable integer column, NULL becoming nil.
+type sqlInt struct {
+	i **int
+}
+
+func (s sqlInt) Scan(value interface{}) error {
+	var v sql.NullInt64
+	if err := v.Scan(value); err != nil {
+		return err
+	}
+	*s.i = nil
+	if v.Valid {
+		i := int(v.Int64)
+		*s.i = &i
+	}
+	return nil
+}
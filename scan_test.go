@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// fieldsNamed returns the booking fields of the given columns.
+func fieldsNamed(t testing.TB, columns ...string) []bookingField {
+	fields := []bookingField{}
+	for _, column := range columns {
+		for _, field := range bookingFields {
+			if field.column == column {
+				fields = append(fields, field)
+			}
+		}
+	}
+	if len(fields) != len(columns) {
+		t.Fatalf("no booking fields for all of %v", columns)
+	}
+	return fields
+}
+
+func TestScanBookings(t *testing.T) {
+	withFakeDb(t, 3)
+	rows, err := Db.QueryContext(context.Background(), `SELECT `+bookingFieldColumns(bookingFields)+` FROM booking`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	bookings, err := scanBookings(rows, bookingFields, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bookings) != 3 {
+		t.Fatalf("scanned %d bookings, want 3", len(bookings))
+	}
+	for i, b := range bookings {
+		if b.BookingId != i+1 || b.BookingTitle == "" || b.BookingUpdatedAt.IsZero() {
+			t.Errorf("booking %d scanned as %+v", i, b)
+		}
+	}
+}
+
+func TestScanBookingsFailsOnBadRow(t *testing.T) {
+	withFakeDb(t, 3)
+	// The titles don't scan into the integer duration.
+	rows, err := Db.QueryContext(context.Background(), `SELECT booking_title FROM booking`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	bookings, err := scanBookings(rows, fieldsNamed(t, "booking_duration"), 0)
+	if err == nil {
+		t.Fatalf("scanned %d bookings, want an error", len(bookings))
+	}
+}
+
+func TestProjectBookingFields(t *testing.T) {
+	fields, err := projectBookingFields([]string{"booking_time", "BookingTitle"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bookingFieldColumns(fields); got != "booking_time, booking_title" {
+		t.Errorf("projected columns %q", got)
+	}
+	if _, err := projectBookingFields([]string{"booking_time", "nope"}); serviceStatus(err) != http.StatusBadRequest {
+		t.Errorf("unknown field answers %d, want 400", serviceStatus(err))
+	}
+}
+
+// BenchmarkScanBookings reads 100k rows as list queries do, with and
+// without a size hint and with a projection of two fields.
+func BenchmarkScanBookings(b *testing.B) {
+	const rows = 100000
+	withFakeDb(b, rows)
+	for _, bench := range []struct {
+		name     string
+		fields   []bookingField
+		sizeHint int
+	}{
+		{"all", bookingFields, 0},
+		{"all/hinted", bookingFields, rows},
+		{"projected", fieldsNamed(b, "booking_public_id", "booking_time"), 0},
+		{"projected/hinted", fieldsNamed(b, "booking_public_id", "booking_time"), rows},
+	} {
+		query := `SELECT ` + bookingFieldColumns(bench.fields) + ` FROM booking`
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				results, err := Db.QueryContext(context.Background(), query)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := scanBookings(results, bench.fields, bench.sizeHint); err != nil {
+					b.Fatal(err)
+				}
+				results.Close()
+			}
+		})
+	}
+}
+
+// TestScanFieldsMatchColumns checks that the column lists the stores
+// select have a scan destination each.
+func TestScanFieldsMatchColumns(t *testing.T) {
+	var b booking
+	var p notificationPreference
+	for _, test := range []struct {
+		name         string
+		columns      string
+		destinations int
+	}{
+		{"booking", bookingColumns, len(b.scanFields())},
+		{"preference", preferenceColumns, len(p.scanFields())},
+		{"reminder", reminderColumns, len(append(b.scanFields(), p.scanFields()...))},
+	} {
+		if n := len(strings.Split(test.columns, ",")); n != test.destinations {
+			t.Errorf("%s selects %d columns into %d destinations", test.name, n, test.destinations)
+		}
+	}
+}
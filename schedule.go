@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// schedule_slot is a read model of the booking table: one row per classroom,
+// 30 minute slot and booking overlapping it, carrying the booking's exact
+// window. Availability questions become index lookups on the slot instead
+// of range scans over booking times stored as text. It is kept up to date
+// on every booking event and rebuilt by a job to catch up with anything
+// that changed bookings behind its back.
+const scheduleSlotLength = 30 * time.Minute
+
+const scheduleTimeLayout = "2006-01-02 15:04:05"
+
+// scheduleReady is set once the read model has been built, so reads fall
+// back to the booking table until then.
+var scheduleReady atomic.Bool
+
+// scheduleMu orders event updates and the swap of a rebuild. While a
+// rebuild reads the bookings, without it, the events applied meanwhile are
+// kept in scheduleReplay, to apply again to the rebuilt read model.
+var scheduleMu sync.Mutex
+
+type scheduleEvent struct {
+	event string
+	b     booking
+}
+
+// scheduleReplay is nil unless a rebuild is reading.
+var scheduleReplay *[]scheduleEvent
+
+type scheduleRow struct {
+	ClassroomId string
+	SlotStart   time.Time
+	BookingId   int
+	PublicId    string
+	Start       time.Time
+	End         time.Time
+	// Seats are the seats the booking reserves, 0 for the whole classroom.
+	Seats int
+}
+
+// booking is the part of the booking in row that seatConflicts needs.
+func (row scheduleRow) booking() booking {
+	return booking{BookingClassroomId: row.ClassroomId, BookingPublicId: row.PublicId, BookingTime: row.Start.In(bookingLocation).Format(bookingTimeLayout),
+		BookingDuration: int(row.End.Sub(row.Start) / time.Minute), BookingSeats: row.Seats}
+}
+
+// scheduleRows splits a booking into the slots it touches.
+func scheduleRows(b booking) []scheduleRow {
+	start, end, err := bookingWindow(b)
+	if err != nil {
+		return nil
+	}
+	rows := make([]scheduleRow, 0, int(end.Sub(start)/scheduleSlotLength)+1)
+	for slot := slotStart(start); slot.Before(end); slot = slot.Add(scheduleSlotLength) {
+		rows = append(rows, scheduleRow{b.BookingClassroomId, slot, b.BookingId, b.publicId(), start, end, b.BookingSeats})
+	}
+	return rows
+}
+
+func slotStart(t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return day.Add(t.Sub(day) / scheduleSlotLength * scheduleSlotLength)
+}
+
+// insertScheduleRows writes rows in batches through exec.
+func insertScheduleRows(ctx context.Context, exec func(ctx context.Context, query string, args ...interface{}) error, rows []scheduleRow) error {
+	const batch = 500
+	for len(rows) > 0 {
+		n := len(rows)
+		if n > batch {
+			n = batch
+		}
+		args := make([]interface{}, 0, 7*n)
+		for _, row := range rows[:n] {
+			args = append(args, row.ClassroomId, row.SlotStart.Format(scheduleTimeLayout), row.BookingId, row.PublicId,
+				row.Start.Format(scheduleTimeLayout), row.End.Format(scheduleTimeLayout), row.Seats)
+		}
+		values := strings.TrimSuffix(strings.Repeat("(?, ?, ?, ?, ?, ?, ?), ", n), ", ")
+		if err := exec(ctx, `INSERT IGNORE INTO schedule_slot (slot_classroom_id, slot_start, slot_booking_id, slot_booking_public_id, slot_booking_start, slot_booking_end, slot_booking_seats) VALUES `+values, args...); err != nil {
+			return err
+		}
+		rows = rows[n:]
+	}
+	return nil
+}
+
+// applyToSchedule brings the read model in line with a booking event.
+func applyToSchedule(event string, b booking) {
+	scheduleMu.Lock()
+	defer scheduleMu.Unlock()
+	if scheduleReplay != nil {
+		*scheduleReplay = append(*scheduleReplay, scheduleEvent{event, b})
+	}
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	exec := func(ctx context.Context, query string, args ...interface{}) error {
+		_, err := Db.ExecContext(ctx, query, args...)
+		return err
+	}
+	if err := applyScheduleEvent(ctx, exec, event, b); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func applyScheduleEvent(ctx context.Context, exec func(ctx context.Context, query string, args ...interface{}) error, event string, b booking) error {
+	switch event {
+	case eventBookingCreated, eventBookingRescheduled:
+		if err := exec(ctx, `DELETE FROM schedule_slot WHERE slot_booking_id = ?`, b.BookingId); err != nil {
+			return err
+		}
+		return insertScheduleRows(ctx, exec, scheduleRows(b))
+	case eventBookingCancelled, eventBookingPreempted:
+		return exec(ctx, `DELETE FROM schedule_slot WHERE slot_booking_id = ?`, b.BookingId)
+	}
+	return nil
+}
+
+// rebuildSchedule replaces the read model with the bookings that haven't
+// ended yet, dropping past slots on the way. The bookings are read without
+// holding up event updates, which are replayed onto the rows read.
+func rebuildSchedule() error {
+	replay := []scheduleEvent{}
+	scheduleMu.Lock()
+	scheduleReplay = &replay
+	scheduleMu.Unlock()
+	defer func() {
+		scheduleMu.Lock()
+		scheduleReplay = nil
+		scheduleMu.Unlock()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	now := time.Now().In(bookingLocation)
+	results, err := Db.QueryContext(ctx, `SELECT `+bookingColumns+` FROM booking WHERE LEFT(TRIM(booking_time), 10) >= ?`, now.AddDate(0, 0, -1).Format(bookingDateLayout))
+	if err != nil {
+		return err
+	}
+	rows := make([]scheduleRow, 0)
+	for results.Next() {
+		var b booking
+		if err := results.Scan(b.scanFields()...); err != nil {
+			results.Close()
+			return err
+		}
+		for _, row := range scheduleRows(b) {
+			if row.End.After(now) {
+				rows = append(rows, row)
+			}
+		}
+	}
+	results.Close()
+	if err := results.Err(); err != nil {
+		return err
+	}
+	scheduleMu.Lock()
+	defer scheduleMu.Unlock()
+	tx, err := Db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	exec := func(ctx context.Context, query string, args ...interface{}) error {
+		_, err := tx.ExecContext(ctx, query, args...)
+		return err
+	}
+	if err := exec(ctx, `DELETE FROM schedule_slot`); err != nil {
+		return err
+	}
+	if err := insertScheduleRows(ctx, exec, rows); err != nil {
+		return err
+	}
+	for _, e := range replay {
+		if err := applyScheduleEvent(ctx, exec, e.event, e.b); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	scheduleReady.Store(true)
+	return nil
+}
+
+// startScheduleJob builds the read model and rebuilds it every
+// SCHEDULE_REBUILD_INTERVAL.
+func startScheduleJob() {
+	rebuild := func() {
+		if err := rebuildSchedule(); err != nil {
+			log.Printf("schedule rebuild: %v", err)
+		}
+	}
+	go rebuild()
+	startJob("schedule", envDuration("SCHEDULE_REBUILD_INTERVAL", time.Hour), rebuild)
+}
+
+// A scheduleWindow asks which bookings overlap [Start, End), in one
+// classroom or, with an empty ClassroomId, in all of them.
+type scheduleWindow struct {
+	ClassroomId string
+	Start       time.Time
+	End         time.Time
+}
+
+// scheduleConflicts answers every window from the read model in one query,
+// mapping classroom ids to the bookings overlapping it, as far as
+// seatConflicts needs them.
+func scheduleConflicts(windows []scheduleWindow) ([]map[string][]booking, error) {
+	clauses := make([]string, len(windows))
+	args := make([]interface{}, 0, 5*len(windows))
+	for i, window := range windows {
+		start, end := window.Start.In(bookingLocation), window.End.In(bookingLocation)
+		clauses[i] = `(slot_start >= ? AND slot_start < ? AND slot_booking_start < ? AND slot_booking_end > ?`
+		args = append(args, slotStart(start).Format(scheduleTimeLayout), end.Format(scheduleTimeLayout), end.Format(scheduleTimeLayout), start.Format(scheduleTimeLayout))
+		if window.ClassroomId != "" {
+			clauses[i] += ` AND slot_classroom_id = ?`
+			args = append(args, window.ClassroomId)
+		}
+		clauses[i] += `)`
+	}
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT DISTINCT slot_classroom_id, slot_booking_public_id, slot_booking_start, slot_booking_end, slot_booking_seats FROM schedule_slot
+		WHERE `+strings.Join(clauses, ` OR `), args...)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	conflicts := make([]map[string][]booking, len(windows))
+	for i := range conflicts {
+		conflicts[i] = make(map[string][]booking)
+	}
+	for results.Next() {
+		var row scheduleRow
+		var start, end string
+		if err := results.Scan(&row.ClassroomId, &row.PublicId, &start, &end, &row.Seats); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		row.Start, _ = time.ParseInLocation(scheduleTimeLayout, start, bookingLocation)
+		row.End, _ = time.ParseInLocation(scheduleTimeLayout, end, bookingLocation)
+		for i, window := range windows {
+			if (window.ClassroomId == "" || window.ClassroomId == row.ClassroomId) && overlaps(window.Start, window.End, row.Start, row.End) {
+				conflicts[i][row.ClassroomId] = append(conflicts[i][row.ClassroomId], row.booking())
+			}
+		}
+	}
+	return conflicts, results.Err()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const schedulePdfPath = "schedule.pdf"
+
+// The weekly sheet is an A4 landscape page covering the hours from
+// schedulePdfFirstHour to schedulePdfLastHour, with whole-day bookings in a
+// row of their own above them.
+const (
+	schedulePdfWidth     = 842
+	schedulePdfHeight    = 595
+	schedulePdfMargin    = 36
+	schedulePdfFirstHour = 7
+	schedulePdfLastHour  = 21
+)
+
+// parseWeek returns the Monday starting the week v names, either as an ISO
+// week ("2026-W42") or as any date in it. An empty v is the current week.
+func parseWeek(v string, now time.Time) (time.Time, error) {
+	var day time.Time
+	if v == "" {
+		day = now.In(bookingLocation)
+	} else if year, week, ok := strings.Cut(v, "-W"); ok {
+		y, err := strconv.Atoi(year)
+		if err != nil {
+			return time.Time{}, err
+		}
+		w, err := strconv.Atoi(week)
+		if err != nil || w < 1 || w > 53 {
+			return time.Time{}, fmt.Errorf("invalid week %q", v)
+		}
+		// Week 1 is the week with January 4th in it.
+		jan4 := time.Date(y, time.January, 4, 0, 0, 0, 0, bookingLocation)
+		day = jan4.AddDate(0, 0, (w-1)*7)
+	} else {
+		var err error
+		if day, err = time.ParseInLocation(bookingDateLayout, v, bookingLocation); err != nil {
+			return time.Time{}, err
+		}
+	}
+	monday := day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	return time.Date(monday.Year(), monday.Month(), monday.Day(), 0, 0, 0, 0, bookingLocation), nil
+}
+
+// scheduleSheet renders a classroom's bookings for the week starting on
+// monday. Overlapping bookings, such as seat reservations, share their day
+// column side by side.
+func scheduleSheet(c classroom, monday time.Time, bookings []booking) []byte {
+	page := newPdfPage(schedulePdfWidth, schedulePdfHeight)
+	title := "Classroom " + c.ClassroomId
+	if c.ClassroomName != "" && c.ClassroomName != c.ClassroomId {
+		title += " - " + c.ClassroomName
+	}
+	if c.BuildingName != "" {
+		title += ", " + c.BuildingName
+	}
+	page.text(schedulePdfMargin, schedulePdfMargin+14, 16, true, title)
+	page.text(schedulePdfMargin, schedulePdfMargin+30, 10, false,
+		fmt.Sprintf("Week of %s to %s", monday.Format("Mon 2 Jan 2006"), monday.AddDate(0, 0, 6).Format("Mon 2 Jan 2006")))
+
+	const timeWidth, headerHeight, allDayHeight = 40.0, 18.0, 18.0
+	left, top := float64(schedulePdfMargin)+timeWidth, float64(schedulePdfMargin)+44
+	dayWidth := (schedulePdfWidth - 2*schedulePdfMargin - timeWidth) / 7
+	hours := schedulePdfLastHour - schedulePdfFirstHour
+	gridTop := top + headerHeight + allDayHeight
+	hourHeight := (schedulePdfHeight - schedulePdfMargin - gridTop) / float64(hours)
+	gridBottom := gridTop + float64(hours)*hourHeight
+
+	page.rect(left-timeWidth, top, timeWidth+7*dayWidth, gridBottom-top, -1)
+	page.text(left-timeWidth+2, top+headerHeight+12, 7, false, "All day")
+	for h := 0; h <= hours; h++ {
+		y := gridTop + float64(h)*hourHeight
+		page.line(left-timeWidth, y, left+7*dayWidth, y, 0.7)
+		if h < hours {
+			page.text(left-timeWidth+2, y+9, 8, false, fmt.Sprintf("%02d:00", schedulePdfFirstHour+h))
+		}
+	}
+	page.line(left-timeWidth, top+headerHeight, left+7*dayWidth, top+headerHeight, 0)
+
+	for d := 0; d < 7; d++ {
+		day := monday.AddDate(0, 0, d)
+		x := left + float64(d)*dayWidth
+		page.line(x, top, x, gridBottom, 0)
+		page.text(x+3, top+12, 9, true, day.Format("Mon 2 Jan"))
+
+		allDay, timed := []booking{}, []booking{}
+		for _, b := range bookings {
+			start, _, err := bookingWindow(b)
+			if err != nil || start.Format(bookingDateLayout) != day.Format(bookingDateLayout) {
+				continue
+			}
+			if b.BookingDuration == 0 {
+				allDay = append(allDay, b)
+			} else {
+				timed = append(timed, b)
+			}
+		}
+		if len(allDay) > 0 {
+			labels := make([]string, len(allDay))
+			for i, b := range allDay {
+				labels[i] = scheduleLabel(b)
+			}
+			page.rect(x+1, top+headerHeight+1, dayWidth-2, allDayHeight-2, 0.85)
+			page.text(x+3, top+headerHeight+12, 7, false, fitText(strings.Join(labels, ", "), 7, dayWidth-6))
+		}
+
+		lanes := scheduleLanes(timed)
+		laneCount := 0
+		for _, lane := range lanes {
+			if lane+1 > laneCount {
+				laneCount = lane + 1
+			}
+		}
+		gridStart := day.Add(schedulePdfFirstHour * time.Hour)
+		gridEnd := day.Add(schedulePdfLastHour * time.Hour)
+		for i, b := range timed {
+			start, end, _ := bookingWindow(b)
+			if start.Before(gridStart) {
+				start = gridStart
+			}
+			if end.After(gridEnd) {
+				end = gridEnd
+			}
+			if !start.Before(end) {
+				continue
+			}
+			laneWidth := dayWidth / float64(laneCount)
+			bx := x + float64(lanes[i])*laneWidth + 1
+			by := gridTop + start.Sub(gridStart).Hours()*hourHeight
+			height := end.Sub(start).Hours() * hourHeight
+			page.rect(bx, by, laneWidth-2, height, 0.85)
+			if height >= 9 {
+				page.text(bx+2, by+8, 6, false, fitText(start.Format("15:04")+"-"+end.Format("15:04"), 6, laneWidth-6))
+			}
+			if height >= 18 {
+				page.text(bx+2, by+16, 7, true, fitText(scheduleLabel(b), 7, laneWidth-6))
+			}
+		}
+	}
+	page.text(schedulePdfMargin, schedulePdfHeight-schedulePdfMargin/2, 7, false, "Printed "+time.Now().In(bookingLocation).Format("2 Jan 2006 15:04"))
+	return page.bytes()
+}
+
+// scheduleLabel names a booking on the sheet. The sheet hangs in public,
+// so bookers aren't named.
+func scheduleLabel(b booking) string {
+	label := b.BookingTitle
+	if label == "" {
+		label = "Booked"
+	}
+	if b.BookingSeats > 1 {
+		label += fmt.Sprintf(" (%d seats)", b.BookingSeats)
+	}
+	if b.BookingStatus == bookingStatusPending {
+		label += " (pending)"
+	}
+	return label
+}
+
+// scheduleLanes sorts a day's bookings by start and assigns each the first
+// lane free at its start.
+func scheduleLanes(bookings []booking) []int {
+	sort.SliceStable(bookings, func(i, j int) bool {
+		si, _, _ := bookingWindow(bookings[i])
+		sj, _, _ := bookingWindow(bookings[j])
+		return si.Before(sj)
+	})
+	lanes := make([]int, len(bookings))
+	laneEnds := []time.Time{}
+	for i, b := range bookings {
+		start, end, _ := bookingWindow(b)
+		lane := 0
+		for lane < len(laneEnds) && laneEnds[lane].After(start) {
+			lane++
+		}
+		if lane == len(laneEnds) {
+			laneEnds = append(laneEnds, end)
+		} else {
+			laneEnds[lane] = end
+		}
+		lanes[i] = lane
+	}
+	return lanes
+}
+
+// handlerSchedulePdf serves GET /api/classrooms/{id}/schedule.pdf?week=, a
+// printable weekly timetable to pin to the classroom door.
+func handlerSchedulePdf(w http.ResponseWriter, r *http.Request, classroomId string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	monday, err := parseWeek(r.URL.Query().Get("week"), time.Now())
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_booking_time")
+		return
+	}
+	c, err := getClassroom(classroomId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	if c == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	bookings, err := getBookingsBetween(monday, monday.AddDate(0, 0, 7), classroomId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	pdf := scheduleSheet(*c, monday, bookings)
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s-%s.pdf"`, classroomId, monday.Format(bookingDateLayout)))
+	if _, err := w.Write(pdf); err != nil {
+		log.Print(err)
+	}
+}
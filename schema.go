@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The schema advisor checks on startup that the indexes the booking queries
+// lean on exist, since databases set up before the migrations, or by hand,
+// can lack them. Missing ones are logged with the statement that creates
+// them, and created when SCHEMA_CREATE_INDEXES=true. GET /admin/schema
+// reports the same; POST creates what is missing.
+
+const schemaPath = "schema"
+
+type indexAdvice struct {
+	Table     string   `json:"table"`
+	Index     string   `json:"index"`
+	Columns   []string `json:"columns"`
+	Reason    string   `json:"reason"`
+	Present   bool     `json:"present"`
+	Statement string   `json:"statement,omitempty"`
+}
+
+var advisedIndexes = []indexAdvice{
+	{Table: "booking", Index: "booking_student_id", Columns: []string{"booking_student_id"}, Reason: "a booker's bookings and the GDPR export and erasure"},
+	{Table: "booking", Index: "booking_classroom_time", Columns: []string{"booking_classroom_id", "booking_time"}, Reason: "a classroom's bookings over a time range"},
+	{Table: "booking_archive", Index: "archived_at", Columns: []string{"archived_at"}, Reason: "archived (deleted) bookings by when they were removed"},
+}
+
+func (a indexAdvice) create() string {
+	return "CREATE INDEX " + a.Index + " ON " + a.Table + " (" + strings.Join(a.Columns, ", ") + ")"
+}
+
+// indexColumns lists the columns of each index on table, in index order.
+func indexColumns(ctx context.Context, table string) (map[string][]string, error) {
+	results, err := Db.QueryContext(ctx, `SELECT INDEX_NAME, COLUMN_NAME FROM information_schema.STATISTICS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? ORDER BY INDEX_NAME, SEQ_IN_INDEX`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	indexes := map[string][]string{}
+	for results.Next() {
+		var index, column string
+		if err := results.Scan(&index, &column); err != nil {
+			return nil, err
+		}
+		indexes[index] = append(indexes[index], column)
+	}
+	return indexes, results.Err()
+}
+
+// covers reports whether an index starting with columns exists, whatever
+// its name.
+func covers(indexes map[string][]string, columns []string) bool {
+	for _, indexed := range indexes {
+		if len(indexed) < len(columns) {
+			continue
+		}
+		matched := true
+		for i, column := range columns {
+			if !strings.EqualFold(indexed[i], column) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// adviseSchema reports which advised indexes exist, with the statement
+// creating each missing one.
+func adviseSchema(ctx context.Context) ([]indexAdvice, error) {
+	tables := map[string]map[string][]string{}
+	advice := make([]indexAdvice, len(advisedIndexes))
+	for i, a := range advisedIndexes {
+		indexes, ok := tables[a.Table]
+		if !ok {
+			var err error
+			if indexes, err = indexColumns(ctx, a.Table); err != nil {
+				return nil, err
+			}
+			tables[a.Table] = indexes
+		}
+		a.Present = covers(indexes, a.Columns)
+		if !a.Present {
+			a.Statement = a.create()
+		}
+		advice[i] = a
+	}
+	return advice, nil
+}
+
+// createAdvisedIndexes creates the missing indexes in advice, marking them
+// present.
+func createAdvisedIndexes(ctx context.Context, advice []indexAdvice) error {
+	for i, a := range advice {
+		if a.Present {
+			continue
+		}
+		if err := applyStatements(ctx, []string{a.Statement}); err != nil {
+			return err
+		}
+		log.Printf("schema: created index %s on %s", a.Index, a.Table)
+		advice[i].Present, advice[i].Statement = true, ""
+	}
+	return nil
+}
+
+// checkSchema runs the advisor on startup. Failing to inspect the schema
+// doesn't stop the service; failing to create an index it was asked to
+// does.
+func checkSchema() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	advice, err := adviseSchema(ctx)
+	if err != nil {
+		log.Printf("schema: %v", err)
+		return nil
+	}
+	if envString("SCHEMA_CREATE_INDEXES", "") == "true" && !readOnly {
+		return createAdvisedIndexes(ctx, advice)
+	}
+	for _, a := range advice {
+		if !a.Present {
+			log.Printf("schema: missing index for %s, needed for %s: %s", a.Table, a.Reason, a.Statement)
+		}
+	}
+	return nil
+}
+
+// handlerAdminSchema serves GET /admin/schema, the advisor's report, and
+// POST, which creates the missing indexes.
+func handlerAdminSchema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Minute)
+	defer cancel()
+	advice, err := adviseSchema(ctx)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	if r.Method == http.MethodPost {
+		if err := createAdvisedIndexes(ctx, advice); err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		recordAudit(r, "admin.schema", "service", "", nil)
+	}
+	j, err := json.Marshal(advice)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// A classroom whose policy has a capacity is shared: its bookings reserve
+// seats, one unless asked for more, and overlap each other as long as no
+// more seats are reserved at once than the capacity. Bookings of the whole
+// classroom, such as templates and calendar imports, still take every seat.
+
+const occupancyPath = "occupancy"
+
+// errNoSeats is returned when a seat reservation no longer fits its slot.
+var errNoSeats = fmt.Errorf("%w: not enough seats left", errConflict)
+
+// seatsTaken is the most seats reserved at once during [start, end). A
+// booking of the whole classroom takes all of capacity.
+func seatsTaken(bookings []booking, start, end time.Time, capacity int) int {
+	type change struct {
+		at    time.Time
+		seats int
+	}
+	changes := make([]change, 0, 2*len(bookings))
+	for _, b := range bookings {
+		bookingStart, bookingEnd, err := bookingWindow(b)
+		if err != nil || !overlaps(start, end, bookingStart, bookingEnd) {
+			continue
+		}
+		seats := b.BookingSeats
+		if seats == 0 {
+			seats = capacity
+		}
+		changes = append(changes, change{bookingStart, seats}, change{bookingEnd, -seats})
+	}
+	// Seats freed at an instant are free for bookings starting then.
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].at.Equal(changes[j].at) {
+			return changes[i].seats < changes[j].seats
+		}
+		return changes[i].at.Before(changes[j].at)
+	})
+	taken, peak := 0, 0
+	for _, c := range changes {
+		taken += c.seats
+		if taken > peak {
+			peak = taken
+		}
+	}
+	return peak
+}
+
+// seatConflicts returns the bookings among others that keep b from its
+// slot in [start, end). A booking of the whole classroom conflicts with any
+// overlapping booking; a seat reservation only with whole classroom
+// bookings, or with the seat reservations that leave it no room.
+func seatConflicts(b booking, others []booking, start, end time.Time, capacity int) []booking {
+	overlapping := busyClassrooms(others, start, end)[b.BookingClassroomId]
+	if b.BookingSeats == 0 {
+		return overlapping
+	}
+	whole := make([]booking, 0)
+	for _, other := range overlapping {
+		if other.BookingSeats == 0 {
+			whole = append(whole, other)
+		}
+	}
+	if len(whole) > 0 {
+		return whole
+	}
+	if seatsTaken(overlapping, start, end, capacity)+b.BookingSeats > capacity {
+		return overlapping
+	}
+	return nil
+}
+
+// sqlQueryer is what lockedConflicts needs of a transaction; *sql.Tx and
+// GORM's connection inside a transaction both have it.
+type sqlQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// sqlExecer runs the booking insert: a transaction, GORM's connection
+// inside one or the statement cache.
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertBookingRow inserts b with exec, every store and write path's one
+// booking INSERT, returning its id.
+func insertBookingRow(ctx context.Context, exec sqlExecer, b booking) (int, error) {
+	result, err := exec.ExecContext(ctx, `INSERT INTO booking (booking_time, booking_classroom_id, booking_student_id, booking_duration, booking_title, booking_status, booking_public_id, booking_seats, booking_group_id, booking_priority, booking_tenant) VALUES (?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?, ?)`,
+		b.BookingTime, b.BookingClassroomId, b.BookingBookerId, b.BookingDuration, b.BookingTitle, b.BookingStatus, b.BookingPublicId, b.BookingSeats, b.BookingGroupId, b.priority(), b.tenant())
+	if err != nil {
+		log.Println(err.Error())
+		return 0, translateWriteError(err)
+	}
+	insertId, err := result.LastInsertId()
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+	return int(insertId), nil
+}
+
+// lockedConflicts is findConflicts inside a transaction, ignoring b itself.
+// It locks the bookings that could overlap b and, for a seat reservation,
+// the classroom's policy row, which serializes seat counting in the
+// classroom even while its slot is still empty.
+func lockedConflicts(ctx context.Context, tx sqlQueryer, b booking) ([]booking, error) {
+	start, end, err := bookingWindow(b)
+	if err != nil {
+		return nil, err
+	}
+	capacity := 0
+	if b.BookingSeats > 0 {
+		err := tx.QueryRowContext(ctx, `SELECT policy_capacity FROM classroom_policy WHERE policy_classroom_id = ? FOR UPDATE`, b.BookingClassroomId).Scan(&capacity)
+		if err != nil && err != sql.ErrNoRows {
+			log.Println(err.Error())
+			return nil, err
+		}
+		if b.BookingSeats > capacity {
+			return nil, errNoSeats
+		}
+	}
+	query, args := selectBookings(bookingColumns).where(
+		colBookingClassroomId.eq(b.BookingClassroomId),
+		colBookingDate.gte(start.AddDate(0, 0, -1).Format(bookingDateLayout)),
+		colBookingDate.lte(end.Format(bookingDateLayout)),
+	).lockForUpdate().build()
+	results, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	bookings, err := scanBookings(results, bookingFields, 0)
+	results.Close()
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	others := make([]booking, 0, len(bookings))
+	for _, other := range bookings {
+		if other.BookingId != b.BookingId {
+			others = append(others, other)
+		}
+	}
+	return seatConflicts(b, others, start, end, capacity), nil
+}
+
+// reserveSeats inserts a seat reservation, counting the seats taken in the
+// same transaction.
+func reserveSeats(ctx context.Context, b booking) (int, error) {
+	tx, err := Db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	conflicts, err := lockedConflicts(ctx, tx, b)
+	if err != nil {
+		return 0, err
+	}
+	if len(conflicts) > 0 {
+		return 0, errNoSeats
+	}
+	bookingId, err := insertBookingRow(ctx, tx, b)
+	if err != nil {
+		return 0, err
+	}
+	return bookingId, tx.Commit()
+}
+
+type occupancySlot struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Reserved  int       `json:"reserved"`
+	Available int       `json:"available"`
+}
+
+type occupancy struct {
+	ClassroomId string          `json:"classroom_id"`
+	Date        string          `json:"date"`
+	Capacity    int             `json:"capacity"`
+	Slots       []occupancySlot `json:"slots"`
+}
+
+// getOccupancy counts the seats reserved in each schedule slot of a day. A
+// classroom that isn't shared has a capacity of one.
+func getOccupancy(classroomId string, date time.Time) (occupancy, error) {
+	policy, err := getRoomPolicy(classroomId)
+	if err != nil {
+		return occupancy{}, err
+	}
+	capacity := policy.Capacity
+	if capacity == 0 {
+		capacity = 1
+	}
+	dayStart := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, bookingLocation)
+	dayEnd := dayStart.AddDate(0, 0, 1)
+	bookings, err := getBookingsBetween(dayStart, dayEnd, classroomId)
+	if err != nil {
+		return occupancy{}, err
+	}
+	result := occupancy{classroomId, dayStart.Format(bookingDateLayout), capacity, []occupancySlot{}}
+	for slot := dayStart; slot.Before(dayEnd); slot = slot.Add(scheduleSlotLength) {
+		reserved := seatsTaken(bookings, slot, slot.Add(scheduleSlotLength), capacity)
+		if reserved > capacity {
+			reserved = capacity
+		}
+		result.Slots = append(result.Slots, occupancySlot{slot, slot.Add(scheduleSlotLength), reserved, capacity - reserved})
+	}
+	return result, nil
+}
+
+// handlerOccupancy serves GET /api/classrooms/{id}/occupancy?date=, today
+// when no date is given.
+func handlerOccupancy(w http.ResponseWriter, r *http.Request, classroomId string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	date := time.Now().In(bookingLocation)
+	if v := r.URL.Query().Get("date"); v != "" {
+		var err error
+		if date, err = time.ParseInLocation(bookingDateLayout, v, bookingLocation); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_booking_time")
+			return
+		}
+	}
+	result, err := getOccupancy(classroomId, date)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	j, err := json.Marshal(result)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Booking a template with a recurrence makes a series: one booking per
+// occurrence, each an ordinary booking that availability, listings and the
+// calendar sync see as such. A single occurrence is cancelled or moved with
+// the booking endpoints like any other booking. The series keeps an
+// occurrence row per booking with the time it was first booked at, and
+// marks it as an exception when its booking is cancelled, preempted or
+// rescheduled, so GET /api/booker/{id}/series/{seriesId} can show the
+// series as planned and where it departs from the plan, while the rest of
+// the series carries on.
+
+const seriesPath = "series"
+
+const (
+	exceptionCancelled   = "cancelled"
+	exceptionRescheduled = "rescheduled"
+	exceptionPreempted   = "preempted"
+)
+
+var seriesExceptions = map[string]string{
+	eventBookingCancelled:   exceptionCancelled,
+	eventBookingRescheduled: exceptionRescheduled,
+	eventBookingPreempted:   exceptionPreempted,
+}
+
+type bookingSeries struct {
+	SeriesId    int                `json:"series_id"`
+	BookerId    string             `json:"booker_id"`
+	TemplateId  int                `json:"template_id"`
+	Recurrence  string             `json:"recurrence"`
+	CreatedAt   time.Time          `json:"created_at"`
+	Occurrences []seriesOccurrence `json:"occurrences,omitempty"`
+}
+
+type seriesOccurrence struct {
+	Occurrence   int    `json:"occurrence"`
+	OriginalTime string `json:"original_time"`
+	// Exception is how the occurrence departs from the series, empty while
+	// it is booked as planned.
+	Exception   string           `json:"exception,omitempty"`
+	ExceptionAt *time.Time       `json:"exception_at,omitempty"`
+	Booking     *bookingResponse `json:"booking,omitempty"`
+	bookingId   int
+}
+
+func init() {
+	bookingEventHandlers = append(bookingEventHandlers, recordSeriesException)
+}
+
+// insertSeries records bookings, in occurrence order, as one series of
+// template within tx.
+func insertSeries(ctx context.Context, tx *sql.Tx, template bookingTemplate, bookings []booking) (int, error) {
+	result, err := tx.ExecContext(ctx, `INSERT INTO booking_series (series_booker_id, series_template_id, series_recurrence, series_created_at) VALUES (?, ?, ?, UTC_TIMESTAMP())`,
+		template.TemplateBookerId, template.TemplateId, template.TemplateRecurrence)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+	seriesId, err := result.LastInsertId()
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+	for i, b := range bookings {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO booking_occurrence (occurrence_booking_id, occurrence_series_id, occurrence_index, occurrence_time) VALUES (?, ?, ?, ?)`,
+			b.BookingId, seriesId, i, b.BookingTime); err != nil {
+			log.Println(err.Error())
+			return 0, err
+		}
+	}
+	return int(seriesId), nil
+}
+
+// recordSeriesException marks the occurrence a cancelled, preempted or
+// rescheduled booking stands for. Bookings outside a series match nothing.
+func recordSeriesException(event string, b booking) {
+	exception, ok := seriesExceptions[event]
+	if !ok {
+		return
+	}
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `UPDATE booking_occurrence SET occurrence_exception = ?, occurrence_exception_at = UTC_TIMESTAMP() WHERE occurrence_booking_id = ?`, exception, b.BookingId)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func getSeries(bookerId string, seriesId int) (*bookingSeries, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	series := &bookingSeries{Occurrences: make([]seriesOccurrence, 0)}
+	err := Db.QueryRowContext(ctx, `SELECT series_id, series_booker_id, series_template_id, series_recurrence, series_created_at FROM booking_series WHERE series_booker_id = ? AND series_id = ?`, bookerId, seriesId).
+		Scan(&series.SeriesId, &series.BookerId, &series.TemplateId, &series.Recurrence, sqlTime{&series.CreatedAt})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	results, err := Db.QueryContext(ctx, `SELECT occurrence_index, occurrence_time, occurrence_exception, occurrence_exception_at, occurrence_booking_id FROM booking_occurrence WHERE occurrence_series_id = ? ORDER BY occurrence_index`, seriesId)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	for results.Next() {
+		var o seriesOccurrence
+		var exceptionAt sql.NullTime
+		if err := results.Scan(&o.Occurrence, &o.OriginalTime, &o.Exception, &exceptionAt, &o.bookingId); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		if exceptionAt.Valid {
+			o.ExceptionAt = &exceptionAt.Time
+		}
+		series.Occurrences = append(series.Occurrences, o)
+	}
+	return series, results.Err()
+}
+
+func getSeriesList(bookerId string) ([]bookingSeries, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT series_id, series_booker_id, series_template_id, series_recurrence, series_created_at FROM booking_series WHERE series_booker_id = ? ORDER BY series_id`, bookerId)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	list := make([]bookingSeries, 0)
+	for results.Next() {
+		var series bookingSeries
+		if err := results.Scan(&series.SeriesId, &series.BookerId, &series.TemplateId, &series.Recurrence, sqlTime{&series.CreatedAt}); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		list = append(list, series)
+	}
+	return list, results.Err()
+}
+
+// handlerBookerSeries serves /api/booker/{id}/series and
+// /api/booker/{id}/series/{seriesId}, the latter with each occurrence's
+// current booking unless it was cancelled or preempted.
+func handlerBookerSeries(w http.ResponseWriter, r *http.Request, bookerId string, urlPathSegments []string) {
+	if !authorizeBooker(w, r, bookerId) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if len(urlPathSegments) == 0 || urlPathSegments[0] == "" {
+		list, err := getSeriesList(bookerId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		j, err := json.Marshal(list)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+		return
+	}
+	seriesId, err := strconv.Atoi(urlPathSegments[0])
+	if err != nil || len(urlPathSegments) > 1 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	series, err := getSeries(bookerId, seriesId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	if series == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	store := bookingStoreFor(r)
+	red := redactionFor(r)
+	for i, o := range series.Occurrences {
+		if o.Exception == exceptionCancelled || o.Exception == exceptionPreempted {
+			continue
+		}
+		b, err := store.GetBooking(o.bookingId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		if b != nil {
+			response := newBookingResponse(*b)
+			red.response(&response)
+			series.Occurrences[i].Booking = &response
+		}
+	}
+	j, err := json.Marshal(series)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}
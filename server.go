@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newServer builds the public HTTP server. The timeouts guard against
+// clients that trickle headers or bodies to hold connections open; raise
+// SERVER_WRITE_TIMEOUT if admin backups take longer than a minute to stream.
+// SERVER_H2C serves cleartext HTTP/2, for deployments behind a proxy that
+// speaks HTTP/2 to its backends without TLS.
+func newServer(handler http.Handler) *http.Server {
+	if envString("SERVER_H2C", "") == "true" {
+		handler = h2c.NewHandler(handler, &http2.Server{
+			IdleTimeout: envDuration("SERVER_IDLE_TIMEOUT", 120*time.Second),
+		})
+	}
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: envDuration("SERVER_READ_HEADER_TIMEOUT", 5*time.Second),
+		ReadTimeout:       envDuration("SERVER_READ_TIMEOUT", 30*time.Second),
+		WriteTimeout:      envDuration("SERVER_WRITE_TIMEOUT", 60*time.Second),
+		IdleTimeout:       envDuration("SERVER_IDLE_TIMEOUT", 120*time.Second),
+		MaxHeaderBytes:    envInt("SERVER_MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes),
+	}
+}
+
+// serve runs server on every listener and returns the first error.
+func serve(server *http.Server, listeners []net.Listener) error {
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- server.Serve(l)
+		}(l)
+	}
+	return <-errs
+}
+
+// The admin API and metrics are served on ADMIN_ADDR, bound to localhost by
+// default, so they stay off the public load balancer. An empty ADMIN_ADDR
+// serves them on the main listeners as before.
+const defaultAdminAddr = "127.0.0.1:5001"
+
+var adminMux = http.NewServeMux()
+
+// internalMux returns the mux operational endpoints are registered on.
+func internalMux() *http.ServeMux {
+	if envString("ADMIN_ADDR", defaultAdminAddr) == "" {
+		return http.DefaultServeMux
+	}
+	return adminMux
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	requestsShedTotal = newCounter("http_requests_shed_total", "API requests rejected because too many were in flight.", "route", "reason")
+	requestsInFlight  = newGauge("http_requests_in_flight", "API requests being served.")
+)
+
+// A limiter caps the requests it lets through at once. Requests over the cap
+// wait in a short queue for up to timeout before they are shed.
+type limiter struct {
+	slots     chan struct{}
+	queued    int64
+	queueSize int64
+	timeout   time.Duration
+}
+
+func newLimiter(concurrency int) *limiter {
+	return &limiter{
+		slots:     make(chan struct{}, concurrency),
+		queueSize: int64(envInt("SHED_QUEUE", 16)),
+		timeout:   envDuration("SHED_QUEUE_TIMEOUT", 100*time.Millisecond),
+	}
+}
+
+// acquire takes a slot, returning why it couldn't if it sheds the request.
+func (l *limiter) acquire(r *http.Request) (bool, string) {
+	select {
+	case l.slots <- struct{}{}:
+		return true, ""
+	default:
+	}
+	if atomic.AddInt64(&l.queued, 1) > l.queueSize {
+		atomic.AddInt64(&l.queued, -1)
+		return false, "queue_full"
+	}
+	defer atomic.AddInt64(&l.queued, -1)
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true, ""
+	case <-timer.C:
+		return false, "timeout"
+	case <-r.Context().Done():
+		return false, "cancelled"
+	}
+}
+
+func (l *limiter) release() {
+	<-l.slots
+}
+
+var inFlight int64
+
+// globalLimiter caps all API requests together at MAX_IN_FLIGHT. It is
+// nil, letting everything through, when MAX_IN_FLIGHT is 0.
+var globalLimiter = struct {
+	sync.Once
+	l *limiter
+}{}
+
+func apiLimiter() *limiter {
+	globalLimiter.Do(func() {
+		if n := envInt("MAX_IN_FLIGHT", 64); n > 0 {
+			globalLimiter.l = newLimiter(n)
+		}
+	})
+	return globalLimiter.l
+}
+
+// routeLimits reads MAX_IN_FLIGHT_ROUTES, a comma separated list of
+// path=limit overriding the limits in the route table.
+func routeLimits() map[string]int {
+	limits := make(map[string]int)
+	for _, entry := range strings.Split(envString("MAX_IN_FLIGHT_ROUTES", ""), ",") {
+		path, limit, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(limit); err == nil {
+			limits[path] = n
+		}
+	}
+	return limits
+}
+
+// shedMiddleware sheds API requests with 503 once too many are in flight,
+// overall or on the mount, so a burst on one expensive route can't take
+// every database connection. Long polls, which mostly wait, only count
+// against their mount.
+func shedMiddleware(m mount, handler http.Handler) http.Handler {
+	limit := m.MaxInFlight
+	if n, ok := routeLimits()[m.Path]; ok {
+		limit = n
+	}
+	var route *limiter
+	if limit > 0 {
+		route = newLimiter(limit)
+	}
+	global := apiLimiter()
+	if m.LongPoll {
+		global = nil
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, l := range []*limiter{global, route} {
+			if l == nil {
+				continue
+			}
+			ok, reason := l.acquire(r)
+			if !ok {
+				requestsShedTotal.Inc(m.Path, reason)
+				w.Header().Set("Retry-After", "1")
+				writeError(w, r, http.StatusServiceUnavailable, "overloaded")
+				return
+			}
+			defer l.release()
+		}
+		requestsInFlight.Set(float64(atomic.AddInt64(&inFlight, 1)))
+		defer func() { requestsInFlight.Set(float64(atomic.AddInt64(&inFlight, -1))) }()
+		handler.ServeHTTP(w, r)
+	})
+}
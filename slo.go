@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Requests are counted per route pattern of the route table, and the SLO
+// rules below are generated from the same table so they cover every route.
+// SLO_AVAILABILITY is the share of requests that must not fail with a 5xx
+// (default 0.999), SLO_LATENCY_TARGET (default 0.99) the share that must be
+// answered within the latency objective: SLO_LATENCY (default 500ms), or the
+// mount's SloLatency.
+
+const sloRulesPath = "slo-rules"
+
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+var (
+	httpRequestsTotal   = newCounter("http_requests_total", "Requests served by route pattern, method and status code.", "route", "method", "code")
+	httpRequestDuration = newHistogram("http_request_duration_seconds", "Request latency by route pattern.", latencyBuckets, "route")
+)
+
+// statusWriter remembers the status a handler answered with.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// Flush passes flushes on to the connection, so that requests measured
+// for the SLO still stream, such as long polls. Flushing before a status
+// sends 200, which is what the request is counted as.
+func (sw *statusWriter) Flush() {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack passes subscription sockets their connection, answered with
+// Switching Protocols.
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := hijack(sw.ResponseWriter)
+	if err == nil && sw.status == 0 {
+		sw.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func observeRequest(pattern string, method string, sw *statusWriter, start time.Time) {
+	status := sw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	httpRequestsTotal.Inc(pattern, method, strconv.Itoa(status))
+	elapsed := time.Since(start)
+	httpRequestDuration.Observe(elapsed.Seconds(), pattern)
+	observePerf(pattern, status, elapsed, time.Now())
+}
+
+// A burnWindow alerts when the error budget burns at rate times the
+// sustainable pace over both a long and a short window.
+type burnWindow struct {
+	long, short string
+	rate        float64
+	severity    string
+}
+
+var burnWindows = []burnWindow{
+	{"1h", "5m", 14.4, "page"},
+	{"6h", "30m", 6, "page"},
+	{"3d", "6h", 1, "ticket"},
+}
+
+// latencyBucket rounds objective up to a histogram bucket bound, since
+// only those can be queried.
+func latencyBucket(objective time.Duration) float64 {
+	for _, bound := range latencyBuckets {
+		if objective.Seconds() <= bound {
+			return bound
+		}
+	}
+	return latencyBuckets[len(latencyBuckets)-1]
+}
+
+// sloRules writes Prometheus recording and alerting rules for the API
+// routes of the route table.
+func sloRules(apiBasePath string) string {
+	availability := envFloat("SLO_AVAILABILITY", 0.999)
+	latencyTarget := envFloat("SLO_LATENCY_TARGET", 0.99)
+	// Routes with their own objective are matched by name; the rest share
+	// the default one.
+	defaultBound := latencyBucket(envDuration("SLO_LATENCY", 500*time.Millisecond))
+	patterns := map[float64][]string{}
+	overridden := []string{}
+	for _, m := range routeTable(apiBasePath) {
+		if m.LongPoll {
+			for _, rt := range m.Routes {
+				overridden = append(overridden, regexp.QuoteMeta(rt.Pattern))
+			}
+			continue
+		}
+		bound := latencyBucket(m.SloLatency)
+		if m.SloLatency == 0 || bound == defaultBound {
+			continue
+		}
+		for _, rt := range m.Routes {
+			patterns[bound] = append(patterns[bound], regexp.QuoteMeta(rt.Pattern))
+			overridden = append(overridden, regexp.QuoteMeta(rt.Pattern))
+		}
+	}
+	bounds := make([]float64, 0, len(patterns))
+	for bound := range patterns {
+		bounds = append(bounds, bound)
+	}
+	sort.Float64s(bounds)
+	bounds = append([]float64{defaultBound}, bounds...)
+	matchers := map[float64]string{}
+	for _, bound := range bounds {
+		matchers[bound] = fmt.Sprintf(`route=~"%s",`, strings.Join(patterns[bound], "|"))
+	}
+	if len(overridden) > 0 {
+		matchers[defaultBound] = fmt.Sprintf(`route!~"%s",`, strings.Join(overridden, "|"))
+	} else {
+		matchers[defaultBound] = ""
+	}
+	windows := []string{}
+	for _, w := range burnWindows {
+		for _, window := range []string{w.short, w.long} {
+			found := false
+			for _, seen := range windows {
+				found = found || seen == window
+			}
+			if !found {
+				windows = append(windows, window)
+			}
+		}
+	}
+
+	var sb strings.Builder
+	rule := func(kind, name, expr string, extra ...string) {
+		fmt.Fprintf(&sb, "      - %s: %s\n        expr: %q\n", kind, name, expr)
+		for _, line := range extra {
+			fmt.Fprintf(&sb, "        %s\n", line)
+		}
+	}
+	sb.WriteString("groups:\n  - name: classroom-booking-slo-recording\n    rules:\n")
+	for _, window := range windows {
+		rule("record", "route:http_requests:error_ratio_rate"+window, fmt.Sprintf(
+			`sum by (route) (rate(http_requests_total{code=~"5.."}[%s])) / sum by (route) (rate(http_requests_total[%s]))`, window, window))
+		for _, bound := range bounds {
+			matcher := matchers[bound]
+			rule("record", "route:http_request_duration:slow_ratio_rate"+window, fmt.Sprintf(
+				`1 - sum by (route) (rate(http_request_duration_seconds_bucket{%sle="%s"}[%s])) / sum by (route) (rate(http_request_duration_seconds_count{%s}[%s]))`,
+				matcher, fmt.Sprint(bound), window, strings.TrimSuffix(matcher, ","), window), fmt.Sprintf("labels: {objective_seconds: %q}", fmt.Sprint(bound)))
+		}
+	}
+	sb.WriteString("  - name: classroom-booking-slo-alerts\n    rules:\n")
+	for _, w := range burnWindows {
+		for _, slo := range []struct {
+			alert, series string
+			budget        float64
+			summary       string
+		}{
+			{"RouteErrorBudgetBurn", "route:http_requests:error_ratio_rate", 1 - availability, "{{ $labels.route }} fails too many requests"},
+			{"RouteLatencyBudgetBurn", "route:http_request_duration:slow_ratio_rate", 1 - latencyTarget, "{{ $labels.route }} answers too many requests slowly"},
+		} {
+			threshold := strconv.FormatFloat(w.rate*slo.budget, 'g', 6, 64)
+			rule("alert", slo.alert, fmt.Sprintf("%s%s > %s and %s%s > %s", slo.series, w.long, threshold, slo.series, w.short, threshold),
+				fmt.Sprintf("labels: {severity: %s, window: %s}", w.severity, w.long),
+				fmt.Sprintf("annotations: {summary: %q}", slo.summary+fmt.Sprintf(", burning the %s budget %gx too fast", w.long, w.rate)))
+		}
+	}
+	return sb.String()
+}
+
+// handlerSloRules serves GET /admin/slo-rules, the rules file to load into
+// Prometheus.
+func handlerSloRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write([]byte(sloRules(basePath)))
+}
+
+// runSloRules prints the rules file, for the slo-rules command.
+func runSloRules(args []string) {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: slo-rules")
+		os.Exit(2)
+	}
+	if err := loadConfigFile(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Print(sloRules(basePath))
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GET /api/admin/export/bookings exports every booking of the caller's
+// tenant for the data warehouse as of one instant: the rows are read in a
+// single read-only REPEATABLE READ transaction, so a booking changed during
+// the export shows as it was when the export began, and none shows twice
+// or not at all. In memory mode they are read from the booking store at
+// once. The export is gzipped NDJSON, one booking per line as in booking
+// lists, in id order.
+//
+// Each export is a snapshot written under EXPORT_DIR (default "exports")
+// before it is served, so it can be downloaded again byte for byte for
+// EXPORT_SNAPSHOT_TTL (default 24h); a tenant's snapshots are its own. A
+// plain GET serves the tenant's latest snapshot while it is younger than
+// EXPORT_SNAPSHOT_REUSE (default 5m) rather than taking another, and
+// expired snapshots are deleted every EXPORT_CLEANUP_INTERVAL (default 1h).
+// A snapshot is at
+// /api/admin/export/bookings/{snapshot_id}, named by Content-Location and
+// the ETag, with Range requests to resume a download cut short. A Range
+// request to /api/admin/export/bookings with If-Range of the ETag resumes
+// too; without a snapshot to resume it takes a new one and sends it whole.
+// .../{snapshot_id}/manifest describes the snapshot: its rows, its size and
+// the SHA-256 of the file and of the NDJSON in it, which also goes out as
+// Repr-Digest.
+
+const exportBookingsPath = "bookings"
+const manifestPath = "manifest"
+
+// exportPageSize is the number of bookings read per query of the snapshot
+// transaction.
+const exportPageSize = 1000
+
+type exportManifest struct {
+	SnapshotId    string    `json:"snapshot_id"`
+	Tenant        string    `json:"tenant"`
+	Entity        string    `json:"entity"`
+	Isolation     string    `json:"isolation"`
+	CreatedAt     time.Time `json:"created_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	Format        string    `json:"format"`
+	Compression   string    `json:"compression"`
+	Rows          int       `json:"rows"`
+	Bytes         int64     `json:"bytes"`
+	Sha256        string    `json:"sha256"`
+	ContentSha256 string    `json:"content_sha256"`
+}
+
+func exportDir() string {
+	return envString("EXPORT_DIR", "exports")
+}
+
+func snapshotFile(id string) string {
+	return filepath.Join(exportDir(), "bookings-"+id+".ndjson.gz")
+}
+
+func manifestFile(id string) string {
+	return filepath.Join(exportDir(), "bookings-"+id+".manifest.json")
+}
+
+// writeBookingsSnapshot writes every booking of tenant, as one transaction
+// sees them, to w as NDJSON, returning the number written.
+func writeBookingsSnapshot(ctx context.Context, w io.Writer, tenant string) (int, error) {
+	if memoryStorage() {
+		return writeMemorySnapshot(w, tenant)
+	}
+	tx, err := Db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	encoder := json.NewEncoder(w)
+	rows := 0
+	var after int
+	for {
+		results, err := tx.QueryContext(ctx, `SELECT `+bookingFieldColumns(bookingFields)+` FROM booking WHERE booking_tenant = ? AND booking_id > ? ORDER BY booking_id LIMIT ?`, tenant, after, exportPageSize)
+		if err != nil {
+			return rows, err
+		}
+		bookings, err := scanBookings(results, bookingFields, exportPageSize)
+		results.Close()
+		if err != nil {
+			return rows, err
+		}
+		for _, b := range bookings {
+			if err := encoder.Encode(newBookingResponse(b)); err != nil {
+				return rows, err
+			}
+		}
+		rows += len(bookings)
+		if len(bookings) < exportPageSize {
+			return rows, nil
+		}
+		after = bookings[len(bookings)-1].BookingId
+	}
+}
+
+// memoryStorage reports whether the service runs in memory mode, where
+// the database has no rows.
+func memoryStorage() bool {
+	_, ok := Db.Driver().(emptyDriver)
+	return ok
+}
+
+// writeMemorySnapshot is writeBookingsSnapshot in memory mode: the store
+// lists every booking under one lock.
+func writeMemorySnapshot(w io.Writer, tenant string) (int, error) {
+	bookings, err := bookingStore.GetBookingList(bookingFilter{}, bookingFields)
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(bookings, func(i, j int) bool { return bookings[i].BookingId < bookings[j].BookingId })
+	encoder := json.NewEncoder(w)
+	rows := 0
+	for _, b := range bookings {
+		if b.tenant() != tenant {
+			continue
+		}
+		if err := encoder.Encode(newBookingResponse(b)); err != nil {
+			return rows, err
+		}
+		rows++
+	}
+	return rows, nil
+}
+
+// takeBookingsSnapshot writes a new snapshot of tenant and its manifest,
+// the manifest last so that a snapshot without one was never finished.
+func takeBookingsSnapshot(ctx context.Context, tenant string) (*exportManifest, error) {
+	if err := os.MkdirAll(exportDir(), 0o750); err != nil {
+		return nil, err
+	}
+	m := &exportManifest{SnapshotId: newPublicId(), Tenant: tenant, Entity: "booking", Isolation: "REPEATABLE READ", CreatedAt: time.Now().UTC(), Format: formatNdjson, Compression: "gzip"}
+	if memoryStorage() {
+		m.Isolation = "memory"
+	}
+	m.ExpiresAt = m.CreatedAt.Add(envDuration("EXPORT_SNAPSHOT_TTL", 24*time.Hour))
+	name := snapshotFile(m.SnapshotId)
+	f, err := os.OpenFile(name+".tmp", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	file, content := sha256.New(), sha256.New()
+	counted := &countingWriter{w: io.MultiWriter(f, file)}
+	gz := gzip.NewWriter(counted)
+	if m.Rows, err = writeBookingsSnapshot(ctx, io.MultiWriter(gz, content), tenant); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	m.Bytes, m.Sha256, m.ContentSha256 = counted.n, hexSum(file), hexSum(content)
+	if err := os.Rename(f.Name(), name); err != nil {
+		return nil, err
+	}
+	j, err := json.Marshal(m)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(manifestFile(m.SnapshotId), j, 0o640); err != nil {
+		os.Remove(name)
+		return nil, err
+	}
+	return m, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func hexSum(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// getSnapshotManifest returns the manifest of the unexpired snapshot id of
+// tenant, or nil.
+func getSnapshotManifest(id string, tenant string) (*exportManifest, error) {
+	if !isPublicId(id) {
+		return nil, nil
+	}
+	m, err := readSnapshotManifest(manifestFile(id))
+	if err != nil || m == nil || m.Tenant != tenant || time.Now().After(m.ExpiresAt) {
+		return nil, err
+	}
+	return m, nil
+}
+
+func readSnapshotManifest(name string) (*exportManifest, error) {
+	j, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m exportManifest
+	if err := json.Unmarshal(j, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// freshSnapshot returns the manifest of the latest snapshot of tenant
+// younger than EXPORT_SNAPSHOT_REUSE, or nil.
+func freshSnapshot(tenant string) (*exportManifest, error) {
+	names, err := filepath.Glob(manifestFile("*"))
+	if err != nil {
+		return nil, err
+	}
+	maxAge := envDuration("EXPORT_SNAPSHOT_REUSE", 5*time.Minute)
+	var fresh *exportManifest
+	for _, name := range names {
+		m, err := readSnapshotManifest(name)
+		if err != nil {
+			log.Printf("export: %v", err)
+			continue
+		}
+		if m != nil && m.Tenant == tenant && time.Since(m.CreatedAt) < maxAge && time.Now().Before(m.ExpiresAt) &&
+			(fresh == nil || m.CreatedAt.After(fresh.CreatedAt)) {
+			fresh = m
+		}
+	}
+	return fresh, nil
+}
+
+// startExportCleanupJob deletes expired snapshots on a timer.
+func startExportCleanupJob() {
+	startJob("export-cleanup", envDuration("EXPORT_CLEANUP_INTERVAL", time.Hour), removeExpiredSnapshots)
+}
+
+// removeExpiredSnapshots deletes the files of snapshots older than the
+// TTL, with the leftovers of any that failed.
+func removeExpiredSnapshots() {
+	names, err := filepath.Glob(filepath.Join(exportDir(), "bookings-*"))
+	if err != nil {
+		return
+	}
+	ttl := envDuration("EXPORT_SNAPSHOT_TTL", 24*time.Hour)
+	for _, name := range names {
+		if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > ttl {
+			if err := os.Remove(name); err != nil {
+				log.Printf("export: %v", err)
+			}
+		}
+	}
+}
+
+// snapshotLocation is the path of snapshot id under the API base r was
+// served from.
+func snapshotLocation(r *http.Request, id string) string {
+	prefix := "/" + adminPath + "/" + exportPath + "/" + exportBookingsPath
+	return r.URL.Path[:strings.Index(r.URL.Path, prefix)+len(prefix)] + "/" + id
+}
+
+// serveSnapshot sends the snapshot of m, honoring Range and If-Range.
+func serveSnapshot(w http.ResponseWriter, r *http.Request, m *exportManifest) {
+	f, err := os.Open(snapshotFile(m.SnapshotId))
+	if os.IsNotExist(err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("export: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	sum, _ := hex.DecodeString(m.Sha256)
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="bookings-%s.ndjson.gz"`, m.SnapshotId))
+	w.Header().Set("Content-Location", snapshotLocation(r, m.SnapshotId))
+	w.Header().Set("ETag", `"`+m.SnapshotId+`"`)
+	w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum)+":")
+	w.Header().Set("Link", "<"+snapshotLocation(r, m.SnapshotId)+"/"+manifestPath+`>; rel="describedby"`)
+	http.ServeContent(w, r, "", m.CreatedAt, f)
+}
+
+// handlerAdminExport serves /api/admin/export/bookings and the snapshots
+// under it.
+func handlerAdminExport(w http.ResponseWriter, r *http.Request, segments []string) {
+	if len(segments) == 0 || segments[0] != exportBookingsPath || len(segments) > 3 || len(segments) == 3 && segments[2] != manifestPath {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if len(segments) == 1 || segments[1] == "" {
+		tenant := tenantOf(r)
+		var m *exportManifest
+		var err error
+		if r.Header.Get("Range") != "" && strings.HasPrefix(r.Header.Get("If-Range"), `"`) {
+			m, err = getSnapshotManifest(strings.Trim(r.Header.Get("If-Range"), `"`), tenant)
+		}
+		if err == nil && m == nil {
+			r.Header.Del("Range")
+			m, err = freshSnapshot(tenant)
+		}
+		if err == nil && m == nil {
+			if m, err = takeBookingsSnapshot(r.Context(), tenant); err == nil {
+				log.Printf("export: snapshot %s, %d bookings, %d bytes", m.SnapshotId, m.Rows, m.Bytes)
+				recordAudit(r, "admin.export", "booking", m.SnapshotId, map[string]interface{}{"rows": m.Rows})
+			}
+		}
+		if err != nil {
+			log.Printf("export: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		serveSnapshot(w, r, m)
+		return
+	}
+	m, err := getSnapshotManifest(segments[1], tenantOf(r))
+	if err != nil {
+		log.Printf("export: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if m == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if len(segments) == 3 {
+		j, err := json.Marshal(m)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+		return
+	}
+	serveSnapshot(w, r, m)
+}
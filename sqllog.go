@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Db goes through a thin wrapper around the MySQL driver that times every
+// statement. Statements slower than DB_SLOW_QUERY (default 200ms, 0 turns
+// it off) are logged with their arguments redacted to their types and the
+// function that ran them, and counted per statement in
+// db_slow_queries_total. Database calls get their context from
+// queryContext, not from the request, so the log can't name a route or
+// request id; the caller is what tells them apart.
+
+const instrumentedDriverName = "mysql-instrumented"
+
+var dbSlowQueriesTotal = newCounter("db_slow_queries_total", "Statements slower than DB_SLOW_QUERY, by statement.", "statement")
+
+func init() {
+	sql.Register(instrumentedDriverName, instrumentedDriver{})
+}
+
+type instrumentedDriver struct{}
+
+func (instrumentedDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := mysql.MySQLDriver{}.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return instrumentedConn{conn}, nil
+}
+
+func (instrumentedDriver) OpenConnector(dsn string) (driver.Connector, error) {
+	connector, err := mysql.MySQLDriver{}.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return instrumentedConnector{connector}, nil
+}
+
+type instrumentedConnector struct {
+	next driver.Connector
+}
+
+func (c instrumentedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.next.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return instrumentedConn{conn}, nil
+}
+
+func (c instrumentedConnector) Driver() driver.Driver {
+	return instrumentedDriver{}
+}
+
+// instrumentedConn passes everything on to the driver's connection,
+// timing the statements it runs directly and wrapping the ones it
+// prepares.
+type instrumentedConn struct {
+	driver.Conn
+}
+
+func (c instrumentedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return instrumentedStmt{stmt, query}, nil
+}
+
+func (c instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := q.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		observeStatement(ctx, query, args, start)
+	}
+	return rows, err
+}
+
+func (c instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	result, err := e.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		observeStatement(ctx, query, args, start)
+	}
+	return result, err
+}
+
+func (c instrumentedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c instrumentedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c instrumentedConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c instrumentedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+type instrumentedStmt struct {
+	driver.Stmt
+	query string
+}
+
+func (s instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := s.Stmt.(driver.StmtExecContext)
+	if !ok {
+		return nil, fmt.Errorf("sql driver statement %T has no ExecContext", s.Stmt)
+	}
+	start := time.Now()
+	defer observeStatement(ctx, s.query, args, start)
+	return e.ExecContext(ctx, args)
+}
+
+func (s instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := s.Stmt.(driver.StmtQueryContext)
+	if !ok {
+		return nil, fmt.Errorf("sql driver statement %T has no QueryContext", s.Stmt)
+	}
+	start := time.Now()
+	defer observeStatement(ctx, s.query, args, start)
+	return q.QueryContext(ctx, args)
+}
+
+func (s instrumentedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (s instrumentedStmt) ColumnConverter(idx int) driver.ValueConverter {
+	if converter, ok := s.Stmt.(driver.ColumnConverter); ok {
+		return converter.ColumnConverter(idx)
+	}
+	return driver.DefaultParameterConverter
+}
+
+var (
+	statementSpace = regexp.MustCompile(`\s+`)
+	// Placeholder lists of any length count as one statement.
+	statementList = regexp.MustCompile(`\?(?:\s*,\s*\?)+`)
+)
+
+// statementOf is the metric label for query: its text on one line with
+// placeholder lists collapsed, cut at 200 bytes.
+func statementOf(query string) string {
+	statement := statementList.ReplaceAllString(statementSpace.ReplaceAllString(strings.TrimSpace(query), " "), "?, ...")
+	if len(statement) > 200 {
+		statement = statement[:200]
+	}
+	return statement
+}
+
+// redactArgs describes args by type, keeping numbers, booleans and times,
+// which say something about the plan without leaking personal data.
+func redactArgs(args []driver.NamedValue) string {
+	described := make([]string, len(args))
+	for i, arg := range args {
+		switch v := arg.Value.(type) {
+		case nil:
+			described[i] = "NULL"
+		case int64, float64, bool:
+			described[i] = fmt.Sprint(v)
+		case time.Time:
+			described[i] = v.Format(time.RFC3339)
+		case string:
+			described[i] = fmt.Sprintf("string(%d)", len(v))
+		case []byte:
+			described[i] = fmt.Sprintf("bytes(%d)", len(v))
+		default:
+			described[i] = fmt.Sprintf("%T", v)
+		}
+	}
+	return strings.Join(described, ", ")
+}
+
+// statementCaller is the first function outside database/sql and this file
+// on the stack.
+func statementCaller() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		name := frame.Function
+		if !strings.HasPrefix(name, "database/sql") && !strings.Contains(name, "instrumented") && !strings.HasSuffix(name, ".observeStatement") {
+			return name
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
+
+func observeStatement(ctx context.Context, query string, args []driver.NamedValue, start time.Time) {
+	elapsed := time.Since(start)
+	threshold := envDuration("DB_SLOW_QUERY", 200*time.Millisecond)
+	if threshold <= 0 || elapsed < threshold {
+		return
+	}
+	statement := statementOf(query)
+	dbSlowQueriesTotal.Inc(statement)
+	log.Printf("slow query %s caller=%s: %s [%s]", elapsed.Round(time.Millisecond), statementCaller(), statement, redactArgs(args))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+var (
+	stmtCacheHits   = newCounter("db_stmt_cache_hits_total", "Prepared statement cache hits.")
+	stmtCacheMisses = newCounter("db_stmt_cache_misses_total", "Prepared statement cache misses.")
+	stmtCacheSize   = newGauge("db_stmt_cache_size", "Statements held in the prepared statement cache.")
+)
+
+// stmtCache keeps one prepared statement per query text. database/sql
+// re-prepares a statement transparently on each pool connection it lands
+// on, so the cache only has to key by query. Queries beyond maxStmts run
+// unprepared rather than growing the cache without bound.
+type stmtCache struct {
+	mu    sync.Mutex
+	db    *sql.DB
+	stmts map[string]*sql.Stmt
+}
+
+const maxStmts = 64
+
+func newStmtCache() *stmtCache {
+	return &stmtCache{stmts: make(map[string]*sql.Stmt)}
+}
+
+// prepared returns the cached statement for query, or nil when it is not
+// worth caching.
+func (c *stmtCache) prepared(ctx context.Context, query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.db != Db {
+		c.reset()
+		c.db = Db
+	}
+	if stmt, ok := c.stmts[query]; ok {
+		stmtCacheHits.Inc()
+		return stmt, nil
+	}
+	stmtCacheMisses.Inc()
+	if len(c.stmts) >= maxStmts {
+		return nil, nil
+	}
+	stmt, err := Db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts[query] = stmt
+	stmtCacheSize.Set(float64(len(c.stmts)))
+	return stmt, nil
+}
+
+func (c *stmtCache) reset() {
+	for query, stmt := range c.stmts {
+		stmt.Close()
+		delete(c.stmts, query)
+	}
+	stmtCacheSize.Set(0)
+}
+
+func (c *stmtCache) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	stmt, err := c.prepared(ctx, query)
+	if err != nil || stmt == nil {
+		return Db.QueryRowContext(ctx, query, args...)
+	}
+	return stmt.QueryRowContext(ctx, args...)
+}
+
+func (c *stmtCache) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := c.prepared(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if stmt == nil {
+		return Db.QueryContext(ctx, query, args...)
+	}
+	return stmt.QueryContext(ctx, args...)
+}
+
+func (c *stmtCache) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := c.prepared(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if stmt == nil {
+		return Db.ExecContext(ctx, query, args...)
+	}
+	return stmt.ExecContext(ctx, args...)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeConnector is a database of rows bookings, each column made up from
+// its name, that counts the statements it prepares. It supports only the
+// SELECT ... FROM queries of the booking store.
+type fakeConnector struct {
+	rows     int
+	prepares atomic.Int64
+}
+
+func (c *fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	return fakeConn{c}, nil
+}
+
+func (c *fakeConnector) Driver() driver.Driver {
+	return fakeDriver{c}
+}
+
+type fakeDriver struct {
+	c *fakeConnector
+}
+
+func (d fakeDriver) Open(string) (driver.Conn, error) {
+	return fakeConn{d.c}, nil
+}
+
+type fakeConn struct {
+	c *fakeConnector
+}
+
+func (conn fakeConn) Prepare(query string) (driver.Stmt, error) {
+	conn.c.prepares.Add(1)
+	return fakeStmt{conn.c, query}, nil
+}
+
+func (fakeConn) Close() error {
+	return nil
+}
+
+func (fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("fake: no transactions")
+}
+
+type fakeStmt struct {
+	c     *fakeConnector
+	query string
+}
+
+func (fakeStmt) Close() error {
+	return nil
+}
+
+func (fakeStmt) NumInput() int {
+	return -1
+}
+
+func (fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(0), nil
+}
+
+func (s fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	selected, _, ok := strings.Cut(strings.TrimPrefix(s.query, "SELECT "), " FROM ")
+	if !ok {
+		return nil, fmt.Errorf("fake: cannot query %q", s.query)
+	}
+	columns := strings.Split(selected, ", ")
+	for i := range columns {
+		columns[i] = strings.TrimSpace(columns[i])
+	}
+	return &fakeRows{columns: columns, left: s.c.rows}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	left    int
+	n       int
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.left == 0 {
+		return io.EOF
+	}
+	r.left--
+	r.n++
+	for i, column := range r.columns {
+		switch column {
+		case "booking_id", "booking_duration", "booking_seats", "booking_priority":
+			dest[i] = int64(r.n)
+		case "booking_updated_at":
+			dest[i] = []byte("2026-01-05 08:00:00")
+		case "booking_time":
+			dest[i] = []byte("2026-01-05 08:00")
+		default:
+			dest[i] = []byte(fmt.Sprintf("%s-%d", column, r.n))
+		}
+	}
+	return nil
+}
+
+// withFakeDb serves Db from a fake database of rows bookings for the rest
+// of t.
+func withFakeDb(t testing.TB, rows int) *fakeConnector {
+	c := &fakeConnector{rows: rows}
+	previous := Db
+	Db = sql.OpenDB(c)
+	Db.SetMaxOpenConns(1)
+	t.Cleanup(func() {
+		Db.Close()
+		Db = previous
+	})
+	return c
+}
+
+func TestStmtCachePreparesOnce(t *testing.T) {
+	c := withFakeDb(t, 1)
+	cache := newStmtCache()
+	query := `SELECT booking_id FROM booking WHERE booking_id = ?`
+	for i := 0; i < 10; i++ {
+		var id int
+		if err := cache.QueryRowContext(context.Background(), query, i).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := c.prepares.Load(); n != 1 {
+		t.Errorf("cached query prepared %d times, want 1", n)
+	}
+	c.prepares.Store(0)
+	for i := 0; i < 10; i++ {
+		var id int
+		if err := Db.QueryRowContext(context.Background(), query, i).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := c.prepares.Load(); n != 10 {
+		t.Errorf("uncached query prepared %d times, want 10", n)
+	}
+}
+
+func TestStmtCacheBound(t *testing.T) {
+	withFakeDb(t, 1)
+	cache := newStmtCache()
+	for i := 0; i < maxStmts+8; i++ {
+		var id int
+		query := fmt.Sprintf(`SELECT booking_id FROM booking WHERE booking_id = %d`, i)
+		if err := cache.QueryRowContext(context.Background(), query).Scan(&id); err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+	}
+	if len(cache.stmts) != maxStmts {
+		t.Errorf("cache holds %d statements, want %d", len(cache.stmts), maxStmts)
+	}
+}
+
+func TestStmtCacheResetsOnNewDb(t *testing.T) {
+	withFakeDb(t, 1)
+	cache := newStmtCache()
+	query := `SELECT booking_id FROM booking WHERE booking_id = ?`
+	var id int
+	if err := cache.QueryRowContext(context.Background(), query, 1).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	c := withFakeDb(t, 1)
+	if err := cache.QueryRowContext(context.Background(), query, 1).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.prepares.Load(); n != 1 {
+		t.Errorf("query prepared %d times on the new database, want 1", n)
+	}
+}
+
+// BenchmarkStmtCache measures the round trips the cache saves, which only
+// MySQL has: it needs BENCH_STORAGE=mysql, see bench_test.go.
+func BenchmarkStmtCache(b *testing.B) {
+	if envString("BENCH_STORAGE", storageMemory) != storageMysql {
+		b.Skip("needs BENCH_STORAGE=mysql")
+	}
+	f := fixture(b)
+	query, _ := selectBookings(bookingColumns).where(colBookingId.eq(0)).build()
+	cache := newStmtCache()
+	for _, bench := range []struct {
+		name  string
+		query func(ctx context.Context, query string, args ...interface{}) *sql.Row
+	}{
+		{"prepared", cache.QueryRowContext},
+		{"unprepared", Db.QueryRowContext},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var got booking
+				if err := bench.query(context.Background(), query, f.ids[i%len(f.ids)]).Scan(got.scanFields()...); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Anyone with an API key can follow the bookings of one classroom through
+// /api/classrooms/{id}/subscriptions: POST subscribes to the room's booking
+// events, all or those listed, delivered by webhook, in the email digest,
+// or on a websocket; GET lists the caller's subscriptions to the room, all
+// of them for admins; DELETE .../subscriptions/{subscription_id} ends one.
+//
+// Webhooks and digests are fed by the booking event handlers like every
+// notification, and websockets by the event sequence like the changes
+// feed: GET /api/subscriptions/{id}/socket, the subscription's topic,
+// streams the room's events from the time of connecting, or after ?since=,
+// one JSON sequenced event per message. Subscriptions belong to the key
+// that made them and see bookings as it does, see redact.go; once the key
+// is gone they deliver nothing.
+//
+// Webhooks must point at a public address: a host resolving to a loopback,
+// private, link-local or otherwise internal one is refused when
+// subscribing, and again when delivering, should its name have changed
+// since. Digests go out only once the address confirms: subscribing mails
+// it a token, which the key POSTs to .../subscriptions/{subscription_id}/confirm
+// as {"token": "..."}.
+
+const subscriptionPath = "subscriptions"
+const subscriptionSocketPath = "socket"
+const subscriptionConfirmPath = "confirm"
+
+const (
+	deliveryWebhook     = "webhook"
+	deliveryEmailDigest = "email_digest"
+	deliveryWebsocket   = "websocket"
+)
+
+// scopeSubscription queues the digests of email subscriptions, owned by
+// the subscription id.
+const scopeSubscription = "subscription"
+
+type classroomSubscription struct {
+	SubscriptionId string    `json:"subscription_id"`
+	ClassroomId    string    `json:"classroom_id"`
+	Delivery       string    `json:"delivery"`
+	WebhookUrl     string    `json:"webhook_url,omitempty"`
+	Email          string    `json:"email,omitempty"`
+	Events         []string  `json:"events"`
+	Language       string    `json:"language,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	// Topic is the socket websocket subscriptions stream on.
+	Topic string `json:"topic,omitempty"`
+	// Confirmed is false for a digest whose address hasn't confirmed yet.
+	Confirmed bool `json:"confirmed"`
+	keyHash   string
+	// confirmHash is the hash of the token that confirms the address, empty
+	// once it has.
+	confirmHash string
+}
+
+func init() {
+	bookingEventHandlers = append(bookingEventHandlers, deliverSubscriptions)
+}
+
+func (s classroomSubscription) valid() bool {
+	switch s.Delivery {
+	case deliveryWebhook:
+		u, err := url.Parse(s.WebhookUrl)
+		if err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+			return false
+		}
+	case deliveryEmailDigest:
+		if !strings.Contains(s.Email, "@") {
+			return false
+		}
+	case deliveryWebsocket:
+	default:
+		return false
+	}
+	for _, event := range s.Events {
+		if !historyEvents[event] {
+			return false
+		}
+	}
+	_, ok := supportedLanguage(s.Language)
+	return ok || s.Language == ""
+}
+
+// nonPublicNets are the ranges, besides loopback, link-local and
+// private ones, that webhooks may not reach.
+var nonPublicNets = parseCidrs("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4", "64:ff9b::/96")
+
+func parseCidrs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// publicIp reports whether ip is an address on the internet.
+func publicIp(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicHost reports whether every address host resolves to is public.
+func publicHost(ctx context.Context, host string) bool {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return false
+	}
+	for _, addr := range addrs {
+		if !publicIp(addr.IP) {
+			return false
+		}
+	}
+	return true
+}
+
+// subscriptionClient delivers webhooks, connecting to public addresses
+// only, whatever a host resolves to by then.
+var subscriptionClient = &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{
+	DialContext: (&net.Dialer{Timeout: 5 * time.Second, Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || !publicIp(ip) {
+			return fmt.Errorf("webhook address %s is not public", host)
+		}
+		return nil
+	}}).DialContext,
+	TLSHandshakeTimeout: 5 * time.Second,
+}}
+
+// wants reports whether event is delivered to s.
+func (s classroomSubscription) wants(event string) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// preference is how s is notified, as the notifiers take it.
+func (s classroomSubscription) preference() notificationPreference {
+	p := notificationPreference{Scope: scopeSubscription, OwnerId: s.SubscriptionId, Channel: channelWebhook, WebhookUrl: s.WebhookUrl, Mode: modeImmediate, Language: s.Language}
+	if s.Delivery == deliveryEmailDigest {
+		p.Channel, p.Email, p.Mode = channelEmail, s.Email, modeDigest
+	}
+	return p
+}
+
+const subscriptionColumns = `subscription_id, subscription_classroom_id, subscription_delivery, subscription_webhook_url, subscription_email, subscription_events, subscription_language, subscription_created_at, subscription_api_key_hash, subscription_confirm_hash`
+
+func scanSubscription(scanner interface{ Scan(...interface{}) error }) (classroomSubscription, error) {
+	var s classroomSubscription
+	var events string
+	err := scanner.Scan(&s.SubscriptionId, &s.ClassroomId, &s.Delivery, &s.WebhookUrl, &s.Email, &events, &s.Language, sqlTime{&s.CreatedAt}, &s.keyHash, &s.confirmHash)
+	s.Confirmed = s.confirmHash == ""
+	s.Events = []string{}
+	if events != "" {
+		s.Events = strings.Split(events, ",")
+	}
+	if s.Delivery == deliveryWebsocket {
+		s.Topic = basePath + "/" + subscriptionPath + "/" + s.SubscriptionId + "/" + subscriptionSocketPath
+	}
+	return s, err
+}
+
+// getSubscriptions returns the subscriptions to classroomId, of the key
+// with keyHash unless it is empty, and of one delivery unless that is.
+func getSubscriptions(classroomId string, keyHash string, delivery string) ([]classroomSubscription, error) {
+	query, args := `SELECT `+subscriptionColumns+` FROM classroom_subscription WHERE subscription_classroom_id = ?`, []interface{}{classroomId}
+	if keyHash != "" {
+		query, args = query+` AND subscription_api_key_hash = ?`, append(args, keyHash)
+	}
+	if delivery != "" {
+		query, args = query+` AND subscription_delivery = ?`, append(args, delivery)
+	}
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, query+` ORDER BY subscription_created_at`, args...)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	subscriptions := []classroomSubscription{}
+	for results.Next() {
+		s, err := scanSubscription(results)
+		if err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+	return subscriptions, results.Err()
+}
+
+// getSubscription returns the subscription with id, or nil.
+func getSubscription(id string) (*classroomSubscription, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	s, err := scanSubscription(Db.QueryRowContext(ctx, `SELECT `+subscriptionColumns+` FROM classroom_subscription WHERE subscription_id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	return &s, nil
+}
+
+func insertSubscription(s classroomSubscription) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `INSERT INTO classroom_subscription (`+subscriptionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.SubscriptionId, s.ClassroomId, s.Delivery, s.WebhookUrl, s.Email, strings.Join(s.Events, ","), s.Language, s.CreatedAt, s.keyHash, s.confirmHash)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+func confirmSubscription(id string) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `UPDATE classroom_subscription SET subscription_confirm_hash = '' WHERE subscription_id = ?`, id)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+func deleteSubscription(id string) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `DELETE FROM classroom_subscription WHERE subscription_id = ?`, id)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+// subscriber returns the key s belongs to, nil once it is gone.
+func subscriber(s classroomSubscription) *apiKey {
+	key, err := getApiKey(s.keyHash)
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// deliverSubscriptions sends event to the webhook and digest subscribers
+// of b's classroom.
+func deliverSubscriptions(event string, b booking) {
+	if !historyEvents[event] {
+		return
+	}
+	subscriptions, err := getSubscriptions(b.BookingClassroomId, "", "")
+	if err != nil {
+		return
+	}
+	for _, s := range subscriptions {
+		if s.Delivery == deliveryWebsocket || !s.Confirmed || !s.wants(event) {
+			continue
+		}
+		key := subscriber(s)
+		if key == nil {
+			continue
+		}
+		p := s.preference()
+		n := bookingNotification(event, redactionOf(key).booking(b), preferenceLanguage(p))
+		if p.Mode == modeDigest {
+			queueDigest(p.Scope, p.OwnerId, n.Text)
+			continue
+		}
+		j, err := json.Marshal(n)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := postNotificationVia(subscriptionClient, p.WebhookUrl, "application/json", bytes.NewReader(j), "", n.RequestId); err != nil {
+			log.Printf("notify %s %s via %s: %v", p.Scope, p.OwnerId, p.Channel, err)
+		}
+	}
+}
+
+// sendConfirmation mails the digest subscription s the token that
+// confirms its address.
+func sendConfirmation(s classroomSubscription, token string) {
+	lang := preferenceLanguage(s.preference())
+	path := basePath + "/" + classroomPath + "/" + s.ClassroomId + "/" + subscriptionPath + "/" + s.SubscriptionId + "/" + subscriptionConfirmPath
+	p := notificationPreference{Scope: scopeSubscription, OwnerId: s.SubscriptionId, Channel: channelEmail, Email: s.Email}
+	sendNotification(p, notification{
+		Subject: translate(lang, "subscription.confirm_subject", "classroom", s.ClassroomId),
+		Text:    translate(lang, "subscription.confirm_text", "classroom", s.ClassroomId, "token", token, "path", path),
+	})
+}
+
+// digestPreference is how the digest queued for owner in scope is sent.
+func digestPreference(scope string, ownerId string) (notificationPreference, error) {
+	if scope != scopeSubscription {
+		return getPreference(scope, ownerId)
+	}
+	s, err := getSubscription(ownerId)
+	if err != nil {
+		return notificationPreference{}, err
+	}
+	if s == nil || !s.Confirmed || subscriber(*s) == nil {
+		return defaultPreference(scope, ownerId), nil
+	}
+	return s.preference(), nil
+}
+
+// handlerClassroomSubscriptions serves /api/classrooms/{id}/subscriptions
+// and /api/classrooms/{id}/subscriptions/{subscription_id}.
+func handlerClassroomSubscriptions(w http.ResponseWriter, r *http.Request, classroomId string, rest []string) {
+	caller := callerOf(r)
+	if caller == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	keyHash := caller.Hash
+	if caller.Role == roleAdmin {
+		keyHash = ""
+	}
+	if len(rest) == 2 && rest[1] == subscriptionConfirmPath {
+		handlerConfirmSubscription(w, r, classroomId, rest[0], caller)
+		return
+	}
+	if len(rest) == 1 && rest[0] != "" {
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s, err := getSubscription(rest[0])
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		if s == nil || s.ClassroomId != classroomId || keyHash != "" && s.keyHash != keyHash {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if deleteSubscription(s.SubscriptionId) != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		recordAudit(r, "classroom.unsubscribe", "classroom", classroomId, s.SubscriptionId)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if len(rest) > 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		subscriptions, err := getSubscriptions(classroomId, keyHash, "")
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		j, err := json.Marshal(subscriptions)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(j)
+	case http.MethodPost:
+		var s classroomSubscription
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_body")
+			return
+		}
+		if !s.valid() {
+			writeError(w, r, http.StatusBadRequest, "invalid_subscription")
+			return
+		}
+		if s.Delivery == deliveryWebhook {
+			ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+			u, _ := url.Parse(s.WebhookUrl)
+			public := publicHost(ctx, u.Hostname())
+			cancel()
+			if !public {
+				writeError(w, r, http.StatusBadRequest, "subscription_webhook_not_public", "host", u.Hostname())
+				return
+			}
+		}
+		classroom, err := getClassroom(classroomId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		if classroom == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if s.Events == nil {
+			s.Events = []string{}
+		}
+		s.SubscriptionId, s.ClassroomId, s.CreatedAt, s.keyHash = newPublicId(), classroomId, time.Now().UTC().Truncate(time.Second), caller.Hash
+		if s.Delivery == deliveryWebsocket {
+			s.Topic = basePath + "/" + subscriptionPath + "/" + s.SubscriptionId + "/" + subscriptionSocketPath
+		}
+		var token string
+		if s.Delivery == deliveryEmailDigest {
+			raw := make([]byte, 16)
+			if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+				writeServiceError(w, r, err)
+				return
+			}
+			token = hex.EncodeToString(raw)
+			s.confirmHash = hashApiKey(token)
+		}
+		s.Confirmed = s.confirmHash == ""
+		if insertSubscription(s) != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if token != "" {
+			go sendConfirmation(s, token)
+		}
+		recordAudit(r, "classroom.subscribe", "classroom", classroomId, s)
+		j, err := json.Marshal(s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write(j)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handlerConfirmSubscription serves POST
+// /api/classrooms/{id}/subscriptions/{subscription_id}/confirm to the key
+// that made the subscription.
+func handlerConfirmSubscription(w http.ResponseWriter, r *http.Request, classroomId string, id string, caller *apiKey) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	s, err := getSubscription(id)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	if s == nil || s.ClassroomId != classroomId || s.keyHash != caller.Hash {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var request struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_body")
+		return
+	}
+	if !s.Confirmed {
+		if subtle.ConstantTimeCompare([]byte(hashApiKey(request.Token)), []byte(s.confirmHash)) != 1 {
+			writeError(w, r, http.StatusBadRequest, "invalid_confirmation_token")
+			return
+		}
+		if confirmSubscription(s.SubscriptionId) != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		s.Confirmed, s.confirmHash = true, ""
+		recordAudit(r, "classroom.subscription_confirm", "classroom", classroomId, s.SubscriptionId)
+	}
+	j, err := json.Marshal(s)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}
+
+// handlerSubscriptionSocket serves GET /api/subscriptions/{id}/socket to
+// the key that made the subscription.
+func handlerSubscriptionSocket(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.TrimPrefix(r.URL.Path, basePath+"/"+subscriptionPath+"/"), "/")
+	if len(segments) != 2 || segments[1] != subscriptionSocketPath {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	caller := callerOf(r)
+	if caller == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s, err := getSubscription(segments[0])
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	if s == nil || s.Delivery != deliveryWebsocket || s.keyHash != caller.Hash {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// Sockets need the HTTP/1.1 upgrade.
+	if r.ProtoMajor != 1 {
+		w.WriteHeader(http.StatusHTTPVersionNotSupported)
+		return
+	}
+	since, err := latestSeq()
+	if v := r.URL.Query().Get("since"); v != "" {
+		if since, err = strconv.ParseInt(v, 10, 64); err != nil || since < 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid_cursor")
+			return
+		}
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	red := redactionOf(caller)
+	// Keys authenticate sockets, not cookies, so any origin may connect.
+	server := websocket.Server{Handshake: func(*websocket.Config, *http.Request) error { return nil }, Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+		// The server's timeouts are for requests, not for sockets.
+		ws.SetDeadline(time.Time{})
+		closed := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, ws)
+			close(closed)
+		}()
+		ticker := time.NewTicker(envDuration("LONGPOLL_INTERVAL", 2*time.Second))
+		defer ticker.Stop()
+		limit := envInt("LONGPOLL_LIMIT", 100)
+		for {
+			// Armed before the read, so that what is appended during it ends
+			// the wait below at once.
+			wake := nextChange()
+			events, err := getSequencedEvents(since, "", true, limit)
+			if err != nil {
+				return
+			}
+			for _, e := range events {
+				since = e.Seq
+				if e.Booking.ClassroomId != s.ClassroomId || !s.wants(e.Event) {
+					continue
+				}
+				red.event(&e.bookingEvent)
+				if err := websocket.JSON.Send(ws, e); err != nil {
+					return
+				}
+			}
+			if len(events) == limit {
+				continue
+			}
+			select {
+			case <-wake:
+			case <-ticker.C:
+			case <-closed:
+				return
+			}
+		}
+	}}
+	server.ServeHTTP(w, r)
+}
+
+// hijack hands the connection under w, through the writers of the
+// middleware, to a subscription socket.
+func hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+	return hijacker.Hijack()
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type bookingTemplate struct {
+	TemplateId          int    `json:"template_id"`
+	TemplateBookerId    string `json:"template_booker_id"`
+	TemplateClassroomId string `json:"template_classroom_id"`
+	TemplateDuration    int    `json:"template_duration"`
+	TemplateRecurrence  string `json:"template_recurrence"`
+	TemplateTitle       string `json:"template_title"`
+}
+
+const templatePath = "templates"
+const favoritePath = "favorites"
+const maxTemplateOccurrences = 52
+
+var recurrenceSteps = map[string]func(time.Time, int) time.Time{
+	"":       func(t time.Time, n int) time.Time { return t },
+	"daily":  func(t time.Time, n int) time.Time { return t.AddDate(0, 0, n) },
+	"weekly": func(t time.Time, n int) time.Time { return t.AddDate(0, 0, 7*n) },
+}
+
+func getTemplate(bookerId string, templateId int) (*bookingTemplate, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	row := Db.QueryRowContext(ctx, `SELECT template_id, template_booker_id, template_classroom_id, template_duration, template_recurrence, template_title FROM booking_template WHERE template_booker_id = ? AND template_id = ?`, bookerId, templateId)
+	template := &bookingTemplate{}
+	err := row.Scan(&template.TemplateId, &template.TemplateBookerId, &template.TemplateClassroomId, &template.TemplateDuration, &template.TemplateRecurrence, &template.TemplateTitle)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return template, nil
+}
+
+func getTemplateList(bookerId string) ([]bookingTemplate, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT template_id, template_booker_id, template_classroom_id, template_duration, template_recurrence, template_title FROM booking_template WHERE template_booker_id = ?`, bookerId)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	templates := make([]bookingTemplate, 0)
+	for results.Next() {
+		var template bookingTemplate
+		if err := results.Scan(&template.TemplateId, &template.TemplateBookerId, &template.TemplateClassroomId, &template.TemplateDuration, &template.TemplateRecurrence, &template.TemplateTitle); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		templates = append(templates, template)
+	}
+	return templates, results.Err()
+}
+
+func insertTemplate(template bookingTemplate) (int, error) {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	result, err := Db.ExecContext(ctx, `INSERT INTO booking_template (template_booker_id, template_classroom_id, template_duration, template_recurrence, template_title) VALUES (?, ?, ?, ?, ?)`, template.TemplateBookerId, template.TemplateClassroomId, template.TemplateDuration, template.TemplateRecurrence, template.TemplateTitle)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+	insertId, err := result.LastInsertId()
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+	return int(insertId), nil
+}
+
+func removeTemplate(bookerId string, templateId int) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `DELETE FROM booking_template WHERE template_booker_id = ? AND template_id = ?`, bookerId, templateId)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+// templateBookings is the bookings of occurrences of the template's
+// recurrence starting at start.
+func templateBookings(template bookingTemplate, start time.Time, occurrences int, status string, tenant string) []booking {
+	step := recurrenceSteps[template.TemplateRecurrence]
+	bookings := make([]booking, 0, occurrences)
+	for i := 0; i < occurrences; i++ {
+		bookings = append(bookings, booking{BookingTime: step(start, i).Format(bookingTimeLayout), BookingClassroomId: template.TemplateClassroomId, BookingBookerId: template.TemplateBookerId,
+			BookingDuration: template.TemplateDuration, BookingTitle: template.TemplateTitle, BookingStatus: status, BookingPublicId: newPublicId(), Tenant: tenant})
+	}
+	return bookings
+}
+
+// bookFromTemplate creates the bookings of templateBookings, as a series
+// when the template recurs, see series.go. Either every occurrence is
+// booked or none is: one a booking made meanwhile collides with fails the
+// lot with errConflict.
+func bookFromTemplate(template bookingTemplate, occurrences []booking) (int, []booking, error) {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	tx, err := Db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+	bookings := make([]booking, 0, len(occurrences))
+	for _, b := range occurrences {
+		conflicts, err := lockedConflicts(ctx, tx, b)
+		if errors.Is(err, errNoSeats) || err == nil && len(conflicts) > 0 {
+			return 0, nil, errConflict
+		} else if err != nil {
+			return 0, nil, err
+		}
+		if b.BookingId, err = insertBookingRow(ctx, tx, b); err != nil {
+			return 0, nil, err
+		}
+		bookings = append(bookings, b)
+	}
+	seriesId := 0
+	if template.TemplateRecurrence != "" && len(bookings) > 1 {
+		if seriesId, err = insertSeries(ctx, tx, template, bookings); err != nil {
+			return 0, nil, err
+		}
+	}
+	return seriesId, bookings, tx.Commit()
+}
+
+func getFavoriteList(bookerId string) ([]classroom, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, classroomSelect+` JOIN favorite_classroom fc ON fc.favorite_classroom_id = c.classroom_id WHERE fc.favorite_booker_id = ? ORDER BY c.classroom_id`, bookerId)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	classrooms := make([]classroom, 0)
+	for results.Next() {
+		classroom, err := scanClassroom(results)
+		if err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		classrooms = append(classrooms, classroom)
+	}
+	return classrooms, results.Err()
+}
+
+func insertFavorite(bookerId string, classroomId string) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `INSERT IGNORE INTO favorite_classroom (favorite_booker_id, favorite_classroom_id) VALUES (?, ?)`, bookerId, classroomId)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+func removeFavorite(bookerId string, classroomId string) error {
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	_, err := Db.ExecContext(ctx, `DELETE FROM favorite_classroom WHERE favorite_booker_id = ? AND favorite_classroom_id = ?`, bookerId, classroomId)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+// handlerBookerTemplates serves /api/booker/{id}/templates,
+// /api/booker/{id}/templates/{templateId} and
+// /api/booker/{id}/templates/{templateId}/book.
+func handlerBookerTemplates(w http.ResponseWriter, r *http.Request, bookerId string, urlPathSegments []string) {
+	if !authorizeBooker(w, r, bookerId) {
+		return
+	}
+	if len(urlPathSegments) == 0 || urlPathSegments[0] == "" {
+		switch r.Method {
+		case http.MethodGet:
+			templates, err := getTemplateList(bookerId)
+			if err != nil {
+				writeServiceError(w, r, err)
+				return
+			}
+			j, err := json.Marshal(templates)
+			if err != nil {
+				log.Fatal(err)
+			}
+			_, err = w.Write(j)
+			if err != nil {
+				log.Fatal(err)
+			}
+		case http.MethodPost:
+			var template bookingTemplate
+			err := json.NewDecoder(r.Body).Decode(&template)
+			if err != nil {
+				log.Print(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if _, ok := recurrenceSteps[template.TemplateRecurrence]; !ok || template.TemplateDuration < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			template.TemplateBookerId = bookerId
+			templateId, err := insertTemplate(template)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(fmt.Sprintf(`{"template_id":%d}`, templateId)))
+		case http.MethodOptions:
+			return
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	templateId, err := strconv.Atoi(urlPathSegments[0])
+	if err != nil || len(urlPathSegments) > 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if len(urlPathSegments) == 2 {
+		if urlPathSegments[1] != "book" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var request struct {
+			Start       string `json:"start"`
+			Occurrences int    `json:"occurrences"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		start, err := parseBookingTime(request.Start)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if request.Occurrences == 0 {
+			request.Occurrences = 1
+		}
+		if request.Occurrences < 0 || request.Occurrences > maxTemplateOccurrences {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		template, err := getTemplate(bookerId, templateId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		if template == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		standing, err := getStanding(bookerId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		if standing.Status == standingBlocked {
+			writeBlocked(w, r, standing)
+			return
+		}
+		// Every occurrence is checked as a create would check it: the
+		// quota counting the occurrences before it, the room policy, the
+		// policy webhook and conflicts with the bookings, holds and other
+		// occurrences there.
+		occurrences := templateBookings(*template, start, request.Occurrences, standing.bookingStatus(tenantOf(r)), tenantOf(r))
+		for i := range occurrences {
+			b := &occurrences[i]
+			if applyBatchQuota(w, r, *b, occurrences[:i], nil) || applyRoomPolicy(w, r, b) || applyPolicyWebhook(w, r, b) || slotTaken(w, r, *b) {
+				return
+			}
+			bookingStart, bookingEnd, _ := bookingWindow(*b)
+			if len(busyClassrooms(occurrences[:i], bookingStart, bookingEnd)[b.BookingClassroomId]) > 0 {
+				writeConflict(w, r, *b, nil)
+				return
+			}
+		}
+		seriesId, bookings, err := bookFromTemplate(*template, occurrences)
+		if isConflict(err) {
+			writeConflict(w, r, occurrences[0], nil)
+			return
+		} else if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		bookingIds := make([]int, len(bookings))
+		publicIds := make([]string, len(bookings))
+		var historyErr error
+		for i, b := range bookings {
+			bookingIds[i], publicIds[i] = b.BookingId, b.BookingPublicId
+			b.ActedBy = actedBy(r)
+			b.RequestId = requestIdOf(r)
+			recordUsage(r, usageBooking)
+			if err := dispatchBookingEvent(eventBookingCreated, b); err != nil && historyErr == nil {
+				historyErr = err
+			}
+		}
+		if historyErr != nil {
+			writeServiceError(w, r, historyErr)
+			return
+		}
+		var j []byte
+		if legacySchema(w, r) {
+			j, err = json.Marshal(map[string][]int{"bookingids": bookingIds})
+		} else {
+			j, err = json.Marshal(struct {
+				BookingIds []string `json:"booking_ids"`
+				SeriesId   int      `json:"series_id,omitempty"`
+			}{publicIds, seriesId})
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write(j)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		template, err := getTemplate(bookerId, templateId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		if template == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		j, err := json.Marshal(template)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = w.Write(j)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case http.MethodDelete:
+		err := removeTemplate(bookerId, templateId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+	case http.MethodOptions:
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handlerBookerFavorites serves /api/booker/{id}/favorites and
+// /api/booker/{id}/favorites/{classroomId}.
+func handlerBookerFavorites(w http.ResponseWriter, r *http.Request, bookerId string, urlPathSegments []string) {
+	if !authorizeBooker(w, r, bookerId) {
+		return
+	}
+	if len(urlPathSegments) > 0 && urlPathSegments[0] != "" {
+		if len(urlPathSegments) > 1 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			err := insertFavorite(bookerId, urlPathSegments[0])
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		case http.MethodDelete:
+			err := removeFavorite(bookerId, urlPathSegments[0])
+			if err != nil {
+				writeServiceError(w, r, err)
+				return
+			}
+		case http.MethodOptions:
+			return
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		favorites, err := getFavoriteList(bookerId)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		j, err := json.Marshal(favorites)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = w.Write(j)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case http.MethodPost:
+		var favorite struct {
+			ClassroomId string `json:"classroom_id"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&favorite)
+		if err != nil || favorite.ClassroomId == "" {
+			log.Print(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		err = insertFavorite(bookerId, favorite.ClassroomId)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodOptions:
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
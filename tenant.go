@@ -0,0 +1,34 @@
+package main
+
+import "net/http"
+
+const defaultTenant = "default"
+
+// tenantOf returns the tenant a request is made for: that of its API key,
+// see api_key_tenant_id, or for an admin key bound to none, the one named
+// by X-Tenant-ID. Other callers can't choose a tenant, and deployments
+// serving a single organization all share defaultTenant.
+func tenantOf(r *http.Request) string {
+	caller := callerOf(r)
+	if caller == nil {
+		return defaultTenant
+	}
+	if caller.ActingAdmin != nil {
+		caller = caller.ActingAdmin
+	}
+	if caller.TenantId != "" {
+		return caller.TenantId
+	}
+	if tenant := r.Header.Get("X-Tenant-ID"); tenant != "" && caller.Role == roleAdmin {
+		return tenant
+	}
+	return defaultTenant
+}
+
+// tenant is the tenant b is booked for, see booking_tenant.
+func (b booking) tenant() string {
+	if b.Tenant == "" {
+		return defaultTenant
+	}
+	return b.Tenant
+}
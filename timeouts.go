@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Database calls get a timeout by the kind of operation they are:
+// QUERY_TIMEOUT_READ and QUERY_TIMEOUT_WRITE (default 3s) and
+// QUERY_TIMEOUT_REPORT (default 10s). A tenant gets its own with the same
+// key suffixed by "." and the tenant, e.g. "QUERY_TIMEOUT_REPORT.acme" in
+// CONFIG_FILE. Requests reach the booking store and reports with their
+// tenant; other lookups use the defaults. Every missed deadline is counted
+// in query_deadline_exceeded_total, labelled with the tenant if it is the
+// default or listed in METRICS_TENANTS (comma separated) and with "other"
+// if not, so that tenants named by X-Tenant-ID can't grow the series
+// without bound.
+
+type queryOp string
+
+const (
+	queryRead   queryOp = "read"
+	queryWrite  queryOp = "write"
+	queryReport queryOp = "report"
+)
+
+var queryDeadlineExceeded = newCounter("query_deadline_exceeded_total", "Database calls that ran out of time, by operation and tenant.", "op", "tenant")
+
+// timeoutPolicy is the timeouts in effect for one tenant.
+type timeoutPolicy struct {
+	Read, Write, Report time.Duration
+}
+
+var defaultTimeouts = timeoutPolicy{Read: 3 * time.Second, Write: 3 * time.Second, Report: 10 * time.Second}
+
+func timeoutsFor(tenant string) timeoutPolicy {
+	lookup := func(key string, fallback time.Duration) time.Duration {
+		d := envDuration(key, fallback)
+		if tenant != defaultTenant {
+			d = envDuration(key+"."+tenant, d)
+		}
+		return d
+	}
+	return timeoutPolicy{
+		Read:   lookup("QUERY_TIMEOUT_READ", defaultTimeouts.Read),
+		Write:  lookup("QUERY_TIMEOUT_WRITE", defaultTimeouts.Write),
+		Report: lookup("QUERY_TIMEOUT_REPORT", defaultTimeouts.Report),
+	}
+}
+
+func (p timeoutPolicy) timeout(op queryOp) time.Duration {
+	switch op {
+	case queryWrite:
+		return p.Write
+	case queryReport:
+		return p.Report
+	}
+	return p.Read
+}
+
+// queryContext returns the context for a database call of the default
+// tenant.
+func queryContext(op queryOp) (context.Context, context.CancelFunc) {
+	return tenantQueryContext(defaultTenant, op)
+}
+
+// tenantQueryContext returns the context for a database call made for
+// tenant. Its cancel func counts the call if it ran out of time.
+func tenantQueryContext(tenant string, op queryOp) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutsFor(tenant).timeout(op))
+	return ctx, func() {
+		if ctx.Err() == context.DeadlineExceeded {
+			queryDeadlineExceeded.Inc(string(op), tenantLabel(tenant))
+		}
+		cancel()
+	}
+}
+
+// tenantLabel is the metric label of tenant.
+func tenantLabel(tenant string) string {
+	if tenant == defaultTenant {
+		return tenant
+	}
+	for _, known := range strings.Split(envString("METRICS_TENANTS", ""), ",") {
+		if strings.TrimSpace(known) == tenant {
+			return tenant
+		}
+	}
+	return "other"
+}
+
+// tenantScoped is implemented by booking stores that run their queries
+// with a tenant's timeouts, on the tenant's bookings only.
+type tenantScoped interface {
+	forTenant(tenant string) BookingRepository
+}
+
+// bookingStoreForTenant returns store with its backend scoped to tenant.
+func bookingStoreForTenant(store BookingRepository, tenant string) BookingRepository {
+	switch s := store.(type) {
+	case dedupBookingRepository:
+		s.next = bookingStoreForTenant(s.next, tenant)
+		s.tenant = tenant
+		return s
+	case resilientBookingRepository:
+		s.next = bookingStoreForTenant(s.next, tenant)
+		return s
+	case tenantScoped:
+		return s.forTenant(tenant)
+	}
+	return store
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// GET /api/classrooms/{id}/schedule?as_of= answers what the classroom's
+// schedule was at a past instant, for settling disputes such as "the room
+// was booked to me when I arrived". It replays the booking histories up to
+// as_of, so a booking cancelled or moved away since shows as it was then,
+// and one made since doesn't show. The schedule covers the day of as_of
+// unless ?from= and ?to= (dates, at most publicScheduleMaxDays apart) say
+// otherwise. Bookings older than their histories, see history.go, aren't
+// known to it.
+//
+// Students see who booked only their own bookings, and other bookings as
+// busy time without titles; the rest see bookings as in booking lists,
+// see redact.go.
+
+type pastBooking struct {
+	bookingResponse
+	CheckedIn bool `json:"checked_in"`
+	// LastEvent is the last event of the booking by as_of, which left it
+	// as shown.
+	LastEvent   string    `json:"last_event"`
+	LastEventAt time.Time `json:"last_event_at"`
+}
+
+type pastSchedule struct {
+	ClassroomId string        `json:"classroom_id"`
+	AsOf        time.Time     `json:"as_of"`
+	From        time.Time     `json:"from"`
+	To          time.Time     `json:"to"`
+	Bookings    []pastBooking `json:"bookings"`
+}
+
+// parseAsOf accepts RFC 3339 instants, with or without seconds, and the
+// zoned booking times, as being in the booking time zone.
+func parseAsOf(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02T15:04Z07:00", v); err == nil {
+		return t, nil
+	}
+	var t time.Time
+	var err error
+	for _, layout := range zonedTimeLayouts {
+		if t, err = time.ParseInLocation(layout, v, bookingLocation); err == nil {
+			break
+		}
+	}
+	return t, err
+}
+
+// getClassroomEventsAsOf returns, by booking, the events up to asOf of the
+// bookings that were in classroomId at some point by then, oldest first.
+func getClassroomEventsAsOf(classroomId string, asOf time.Time) (map[string][]bookingEvent, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT event_booking_public_id, event_type, event_created_at, event_acted_by, event_request_id, event_booking FROM booking_event
+		WHERE event_created_at <= ? AND event_booking_public_id IN (SELECT event_booking_public_id FROM booking_event WHERE event_classroom_id = ? AND event_created_at <= ?)
+		ORDER BY event_id`, asOf.UTC(), classroomId, asOf.UTC())
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	events := map[string][]bookingEvent{}
+	for results.Next() {
+		var bookingId string
+		var e bookingEvent
+		var snapshot []byte
+		if err := results.Scan(&bookingId, &e.Event, sqlTime{&e.At}, &e.ActedBy, &e.RequestId, &snapshot); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		if err := json.Unmarshal(snapshot, &e.Booking); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		events[bookingId] = append(events[bookingId], e)
+	}
+	return events, results.Err()
+}
+
+// scheduleAsOf replays the histories of classroomId up to asOf into the
+// bookings it then held over [from, to), in time order.
+func scheduleAsOf(classroomId string, asOf, from, to time.Time) ([]pastBooking, error) {
+	histories, err := getClassroomEventsAsOf(classroomId, asOf)
+	if err != nil {
+		return nil, err
+	}
+	bookings := []pastBooking{}
+	for _, events := range histories {
+		history := replayBookingEvents(events)
+		state := history.State
+		if state.ClassroomId != classroomId || state.BookingStatus == bookingCancelled {
+			continue
+		}
+		start, end, err := bookingWindow(booking{BookingTime: state.BookingTime, BookingDuration: state.BookingDuration})
+		if err != nil || !overlaps(start, end, from, to) {
+			continue
+		}
+		last := events[len(events)-1]
+		bookings = append(bookings, pastBooking{state, history.CheckedIn, last.Event, last.At})
+	}
+	sort.Slice(bookings, func(i, j int) bool {
+		a, _ := parseBookingTime(bookings[i].BookingTime)
+		b, _ := parseBookingTime(bookings[j].BookingTime)
+		return a.Before(b)
+	})
+	return bookings, nil
+}
+
+// handlerClassroomSchedule serves GET /api/classrooms/{id}/schedule.
+func handlerClassroomSchedule(w http.ResponseWriter, r *http.Request, classroomId string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if callerOf(r) == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	query := r.URL.Query()
+	asOf, err := parseAsOf(query.Get("as_of"))
+	if err != nil || asOf.After(time.Now()) {
+		writeError(w, r, http.StatusBadRequest, "invalid_as_of")
+		return
+	}
+	day := asOf.In(bookingLocation)
+	from := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, bookingLocation)
+	to := from.AddDate(0, 0, 1)
+	if v := query.Get("from"); v != "" {
+		if from, err = time.ParseInLocation(bookingDateLayout, v, bookingLocation); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_schedule_range", "max", strconv.Itoa(publicScheduleMaxDays))
+			return
+		}
+		to = from.AddDate(0, 0, 1)
+	}
+	if v := query.Get("to"); v != "" {
+		if to, err = time.ParseInLocation(bookingDateLayout, v, bookingLocation); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_schedule_range", "max", strconv.Itoa(publicScheduleMaxDays))
+			return
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+	if !to.After(from) || to.After(from.AddDate(0, 0, publicScheduleMaxDays)) {
+		writeError(w, r, http.StatusBadRequest, "invalid_schedule_range", "max", strconv.Itoa(publicScheduleMaxDays))
+		return
+	}
+	classroom, err := getClassroom(classroomId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	if classroom == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	bookings, err := scheduleAsOf(classroom.ClassroomId, asOf, from, to)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	owned, isOwned := bookingStoreFor(r).(ownedBookingRepository)
+	red := redactionFor(r)
+	for i := range bookings {
+		if isOwned && bookings[i].BookerId != owned.bookerId {
+			bookings[i].BookingTitle = ""
+		}
+		red.response(&bookings[i].bookingResponse)
+	}
+	j, err := json.Marshal(pastSchedule{classroom.ClassroomId, asOf.UTC(), from, to, bookings})
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}
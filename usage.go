@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Usage is counted in memory per caller and hour, and flushed to api_usage
+// every USAGE_FLUSH_INTERVAL so counting doesn't cost a write per request.
+
+const (
+	usageRequest      = "request"
+	usageBooking      = "booking"
+	usageCancellation = "cancellation"
+)
+
+type usageBucket struct {
+	Hour  time.Time
+	Actor string
+}
+
+type usageCounts struct {
+	Requests      int `json:"requests"`
+	Bookings      int `json:"bookings"`
+	Cancellations int `json:"cancellations"`
+}
+
+var pendingUsage = struct {
+	sync.Mutex
+	counts map[usageBucket]*usageCounts
+}{counts: make(map[usageBucket]*usageCounts)}
+
+func recordUsage(r *http.Request, kind string) {
+	bucket := usageBucket{time.Now().UTC().Truncate(time.Hour), actorOf(callerOf(r))}
+	pendingUsage.Lock()
+	defer pendingUsage.Unlock()
+	counts, ok := pendingUsage.counts[bucket]
+	if !ok {
+		counts = &usageCounts{}
+		pendingUsage.counts[bucket] = counts
+	}
+	switch kind {
+	case usageRequest:
+		counts.Requests++
+	case usageBooking:
+		counts.Bookings++
+	case usageCancellation:
+		counts.Cancellations++
+	}
+}
+
+// usageMiddleware counts every API request against its caller. A read
+// replica counts none, having nowhere to write them.
+func usageMiddleware(handler http.Handler) http.Handler {
+	if readOnly {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, basePath+"/") && r.Method != http.MethodOptions {
+			recordUsage(r, usageRequest)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// flushUsage adds the pending counts to api_usage. Counts that fail to
+// write are put back for the next flush.
+func flushUsage() {
+	pendingUsage.Lock()
+	counts := pendingUsage.counts
+	pendingUsage.counts = make(map[usageBucket]*usageCounts)
+	pendingUsage.Unlock()
+	ctx, cancel := queryContext(queryWrite)
+	defer cancel()
+	for bucket, c := range counts {
+		_, err := Db.ExecContext(ctx, `INSERT INTO api_usage (usage_hour, usage_actor, usage_requests, usage_bookings, usage_cancellations) VALUES (?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE usage_requests = usage_requests + VALUES(usage_requests), usage_bookings = usage_bookings + VALUES(usage_bookings), usage_cancellations = usage_cancellations + VALUES(usage_cancellations)`,
+			bucket.Hour, bucket.Actor, c.Requests, c.Bookings, c.Cancellations)
+		if err != nil {
+			log.Println(err.Error())
+			pendingUsage.Lock()
+			if current, ok := pendingUsage.counts[bucket]; ok {
+				current.Requests += c.Requests
+				current.Bookings += c.Bookings
+				current.Cancellations += c.Cancellations
+			} else {
+				pendingUsage.counts[bucket] = c
+			}
+			pendingUsage.Unlock()
+		}
+	}
+}
+
+func startUsageJob() {
+	startJob("usage", envDuration("USAGE_FLUSH_INTERVAL", time.Minute), flushUsage)
+}
+
+type actorUsage struct {
+	Actor string `json:"actor"`
+	usageCounts
+}
+
+func getUsage(since time.Time) ([]actorUsage, error) {
+	ctx, cancel := queryContext(queryRead)
+	defer cancel()
+	results, err := Db.QueryContext(ctx, `SELECT usage_actor, SUM(usage_requests), SUM(usage_bookings), SUM(usage_cancellations)
+		FROM api_usage WHERE usage_hour >= ? GROUP BY usage_actor ORDER BY SUM(usage_requests) DESC`, since.UTC().Truncate(time.Hour))
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer results.Close()
+	usage := make([]actorUsage, 0)
+	for results.Next() {
+		var u actorUsage
+		if err := results.Scan(&u.Actor, &u.Requests, &u.Bookings, &u.Cancellations); err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, results.Err()
+}
+
+// handlerAdminUsage answers GET /api/admin/usage?since=, with since a date
+// or RFC 3339 time defaulting to 24 hours ago.
+func handlerAdminUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	since := time.Now().Add(-24 * time.Hour)
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			if since, err = time.ParseInLocation(bookingDateLayout, v, bookingLocation); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	flushUsage()
+	usage, err := getUsage(since)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	j, err := json.Marshal(usage)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = w.Write(j)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+const validatePath = "validate"
+
+// bookingValidation is what POST /api/bookings/validate answers for a
+// booking that would be created: the booking as it would be stored and
+// the bookings it would displace.
+type bookingValidation struct {
+	Booking   bookingResponse  `json:"booking"`
+	Displaces []string         `json:"displaces,omitempty"`
+	Warnings  []bookingWarning `json:"warnings,omitempty"`
+}
+
+// rejectBooking runs the checks a booking create makes before writing
+// anything: ownership, the booker's standing, the group, the classroom's
+// policy, the priority tier, conflicts and the policy webhook. It
+// completes b with the status and tier it would be booked at and returns
+// the bookings it would displace, or writes the error and returns true.
+func rejectBooking(w http.ResponseWriter, r *http.Request, b *booking) ([]booking, bool) {
+	if owned, ok := bookingStoreFor(r).(ownedBookingRepository); ok && !owned.owns(b) {
+		w.WriteHeader(http.StatusForbidden)
+		return nil, true
+	}
+	standing, err := getStanding(b.BookingBookerId)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return nil, true
+	}
+	if standing.Status == standingBlocked {
+		writeBlocked(w, r, standing)
+		return nil, true
+	}
+	if applyQuota(w, r, *b) {
+		return nil, true
+	}
+	b.BookingStatus = standing.bookingStatus(tenantOf(r))
+	if applyGroupBooking(w, r, *b) || applyRoomPolicy(w, r, b) || applyPriority(w, r, b) {
+		return nil, true
+	}
+	displaced, taken := slotTakenPreempting(w, r, *b)
+	if taken || applyPolicyWebhook(w, r, b) {
+		return nil, true
+	}
+	return displaced, false
+}
+
+// applyBookingTime normalizes the booking time of b, sent in the formats
+// normalizeBookingTime accepts, or writes the error and returns true.
+func applyBookingTime(w http.ResponseWriter, r *http.Request, b *booking, timeZone string) bool {
+	var zone *time.Location
+	if timeZone != "" {
+		var err error
+		if zone, err = time.LoadLocation(timeZone); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_time_zone", "zone", timeZone)
+			return true
+		}
+	}
+	normalized, err := normalizeBookingTime(b.BookingTime, zone)
+	switch {
+	case errors.Is(err, errBookingTimeAmbiguous):
+		writeError(w, r, http.StatusBadRequest, "ambiguous_booking_time", "time", b.BookingTime, "zone", zoneName(zone))
+		return true
+	case errors.Is(err, errBookingTimeSkipped):
+		writeError(w, r, http.StatusBadRequest, "skipped_booking_time", "time", b.BookingTime, "zone", zoneName(zone))
+		return true
+	case err != nil:
+		writeError(w, r, http.StatusBadRequest, "invalid_booking_time")
+		return true
+	}
+	b.BookingTime = normalized
+	return false
+}
+
+// zoneName is the name of zone, the booking time zone if nil.
+func zoneName(zone *time.Location) string {
+	if zone == nil {
+		zone = bookingLocation
+	}
+	return zone.String()
+}
+
+// handlerBookingValidate serves POST /api/bookings/validate, a dry run of
+// POST /api/bookings: it answers with the errors a create would, or 200
+// and the validation, and stores nothing.
+func handlerBookingValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var request bookingRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_body")
+		return
+	}
+	b := request.booking()
+	if applyBookingTime(w, r, &b, request.TimeZone) {
+		return
+	}
+	displaced, rejected := rejectBooking(w, r, &b)
+	if rejected {
+		return
+	}
+	responses := []bookingResponse{newBookingResponse(b)}
+	expandGroups(responses)
+	validation := bookingValidation{Booking: responses[0], Warnings: quotaWarnings(r, b)}
+	validation.Booking.BookingId = ""
+	for _, c := range displaced {
+		validation.Displaces = append(validation.Displaces, c.publicId())
+	}
+	j, err := json.Marshal(validation)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Write(j)
+}